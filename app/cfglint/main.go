@@ -0,0 +1,119 @@
+//  ---------------------------------------------------------------------------
+//
+//  main.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+// cfglint is a command line utility which checks config files against the
+// config schema exported by a goapp application's --schema=<file> flag. Every
+// unknown key, invalid value, and missing required key is printed, and the
+// exit code is 1 if there were any. Files which can't be parsed, including
+// ini files with malformed lines, also exit with code 1. Files given
+// together are checked as the application would see them, with earlier
+// files taking priority, so required keys only need to be set in one of
+// them. Files may be in any format supported by the config module.
+//  Usage: cfglint -s <schema file> <config file> [config file ...]
+//
+//  // check gograph's ini file before deploying it
+//  gograph --schema=gograph.schema
+//  cfglint -s gograph.schema config/gograph.ini
+package main
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/config"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+)
+
+// Application name.
+const APP_NAME = "CfgLint"
+
+// Command line options.
+var (
+    schemaPath = flag.String("s", "", "schema file exported by the app's --schema flag")
+)
+
+
+// main is the application's entry point.
+func main() {
+    flag.Usage = usage
+    flag.Parse()
+
+    if *schemaPath == "" || flag.NArg() < 1 {
+        usage()
+        os.Exit(1)
+    }
+
+    err := loadSchema(*schemaPath)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    // paths are relative to the working directory, files are only read
+    // once, and malformed ini lines fail the check
+    config.IniDir    = ""
+    config.IniPollMs = 0
+    config.IniStrict = true
+
+    for i, path := range flag.Args() {
+        provider := config.InitFileProvider(path, i)
+        if provider == nil {
+            fmt.Fprintf(os.Stderr, "%s: unable to load config file\n", path)
+            os.Exit(1)
+        }
+    }
+
+    err = config.Validate()
+    if err == nil {
+        fmt.Println("OK")
+        return
+    }
+
+    schemaErr := err.(config.SchemaError)
+    for _, keyErr := range schemaErr {
+        fmt.Println(keyErr)
+    }
+
+    fmt.Printf("%d problems found\n", len(schemaErr))
+    os.Exit(1)
+}
+
+// loadSchema registers the schema held in the given file.
+func loadSchema(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    err = config.ImportSchema(file)
+    if err != nil {
+        return errors.New(fmt.Sprintf("%s: %v", path, err))
+    }
+
+    return nil
+}
+
+// usage prints the command line syntax and options.
+func usage() {
+    fmt.Fprintf(
+        os.Stderr,
+        "Usage: %s -s <schema file> <config file> [config file ...]\n",
+        os.Args[0],
+    )
+    flag.PrintDefaults()
+}
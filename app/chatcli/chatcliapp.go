@@ -15,10 +15,13 @@ package main
 // External imports.
 import (
     "github.com/xaevman/goat/mod/goapp"
+    "github.com/xaevman/goat/mod/log"
+    "github.com/xaevman/goat/mod/net"
 )
 
 // Stdlib imports.
 import (
+    "crypto/tls"
     "flag"
 )
 
@@ -32,6 +35,8 @@ func (this *ConsoleCliStart) PreInit() {
     flag.StringVar(&srvAddr, "s", srvAddr, "remote server address")
     flag.StringVar(&chatCli.username, "u", userName, "chat username")
     flag.BoolVar(&useUdp, "udp", false, "enable UDP transport")
+    flag.BoolVar(&useTls, "tls", false, "enable TLS transport")
+    flag.StringVar(&tlsCA, "ca", tlsCA, "CA certificate file for TLS")
     flag.Parse()
 }
 
@@ -48,8 +53,19 @@ func (this *ConsoleCliStart) PostInit() {
         }
 
         err = chatproto.DialUdp(srvAddr, sock)
+    } else if useTls {
+        var tlsConfig *tls.Config
+
+        tlsConfig, err = net.NewTLSConfig("", "", tlsCA)
+        if err != nil {
+            log.Error("Unable to load TLS config (%v)", err)
+            goapp.Stop()
+            return
+        }
+
+        err = chatproto.DialTcpReconnect(srvAddr, tlsConfig, nil)
     } else {
-        err = chatproto.DialTcp(srvAddr)
+        err = chatproto.DialTcpReconnect(srvAddr, nil, nil)
     }
 
     if err != nil {
@@ -80,15 +80,25 @@ func (this *ChatCli) Close() {
 // initializes the chat message handler and disables network security
 // for the chat protocol. Finally, it starts the console input handler
 // in a separate go routine.
-func (this *ChatCli) Init(proto *net.Protocol) {
+func (this *ChatCli) Init(chatProto *net.Protocol) {
     this.chanIdMap   = make(map[uint32]string, 0)
     this.chanNameMap = make(map[string]uint32, 0)
     this.currentChan = 0
     this.inputSync   = lifecycle.New()
-    this.proto       = proto
+    this.proto       = chatProto
 
     this.proto.AddSignature(new(chat.MsgHandler))
     this.proto.SetAccessProvider(new(net.NoSecurity))
+    this.proto.SetCompressionProvider(
+        net.NewCompressor(net.DEFAULT_COMPRESS_THRESHOLD_B),
+    )
+    this.proto.SetKeepalive(net.DEFAULT_KEEPALIVE_MS, net.DEFAULT_IDLE_TIMEOUT_MS)
+    this.proto.SetHelloOnConnect(true) // servers are upgraded first
+    this.proto.SetVersion(
+        proto.CHAT_PROTO_NAME,
+        proto.CHAT_PROTO_VER,
+        proto.CHAT_PROTO_MIN_VER,
+    )
 
     go this.startInput()
 }
@@ -123,6 +133,38 @@ func (this *ChatCli) OnDisconnect(con net.Connection) {
     go goapp.Stop()
 }
 
+// OnReconnected re-registers the client with the server after its connection
+// is restored, and rejoins any channels the client was a member of.
+func (this *ChatCli) OnReconnected(con net.Connection) {
+    this.printChatText("Reconnected to server", sysStyle)
+
+    channels := make([]string, 0, len(this.chanNameMap))
+    for name, _ := range this.chanNameMap {
+        if name != chat.PUB_CHANNEL {
+            channels = append(channels, name)
+        }
+    }
+
+    this.chanIdMap   = make(map[uint32]string, 0)
+    this.chanNameMap = make(map[string]uint32, 0)
+    this.currentChan = 0
+
+    this.sendConnect()
+
+    for i := range channels {
+        this.sendJoinChannel(channels[i])
+    }
+}
+
+// OnReconnecting notifies the user that the connection to the server was
+// lost and is being re-established.
+func (this *ChatCli) OnReconnecting(con net.Connection, attempt int) {
+    this.printChatText(
+        fmt.Sprintf("Connection lost. Reconnecting (attempt %d)", attempt),
+        errStyle,
+    )
+}
+
 // OnError forwards errors received from the network layer on to the
 // log system.
 func (this *ChatCli) OnError(err error) {
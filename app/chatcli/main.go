@@ -24,6 +24,8 @@ const APP_NAME = "ChatCli"
 // Config options.
 var (
     srvAddr  = "127.0.0.1:8900"
+    tlsCA    = ""
+    useTls   = false
     userName = "Anon"
     useUdp   = false
 )
@@ -16,6 +16,7 @@ package main
 import(
     "github.com/xaevman/goat/mod/config"
     "github.com/xaevman/goat/mod/diag"
+    "github.com/xaevman/goat/mod/goapp"
     "github.com/xaevman/goat/mod/log"
     "github.com/xaevman/goat/mod/net"
     "github.com/xaevman/goat/lib/perf"
@@ -27,36 +28,175 @@ import(
 )
 
 
+// Dispatch models, by config name.
+var dispatchModels = map[string]int {
+    "ordered"  : net.DISPATCH_ORDERED,
+    "parallel" : net.DISPATCH_PARALLEL,
+    "single"   : net.DISPATCH_SINGLE,
+}
+
+// Send queue overflow policies, by config name.
+var sendQueuePolicies = map[string]int {
+    "block"       : net.SEND_QUEUE_BLOCK,
+    "disconnect"  : net.SEND_QUEUE_DISCONNECT,
+    "drop-newest" : net.SEND_QUEUE_DROP_NEWEST,
+    "drop-oldest" : net.SEND_QUEUE_DROP_OLDEST,
+}
+
+
 // ChatSrvStart is a goapp.AppStarter implementation for a ChatSrv
 // instance.
 type ChatSrvStart struct {}
 
 // PreInit registers an ini config provider and queries the config
 // system to determine if debug logs should be enabled during this
-// run.
+// run. Config changes are applied as the ini file is reloaded.
 func (this *ChatSrvStart) PreInit() {
     config.InitIniProvider("config/chat.ini", 1)
     debugLogs, _ := config.GetBoolVal("System.DebugLogs", 0, false)
     log.DebugLogs = debugLogs
+
+    config.Subscribe(onConfigChange)
 }
 
-// PostInit queries the config system to determine which bind address
-// the server should listen on.
+// PostInit queries the config system to determine how client send queues
+// are bounded, how received messages are dispatched, how long clients are
+// given to drain at shutdown, whether traffic is captured, which bind
+// address the server should listen on, whether WebSocket clients are
+// accepted, which servers channels are federated with, and whether debug
+// clients must log in.
 func (this *ChatSrvStart) PostInit() {
+    loadSendQueueLimits()
+
+    model, _   := config.GetVal("Net.Dispatch", 0, "single")
+    workers, _ := config.GetIntVal(
+        "Net.DispatchWorkers",
+        0,
+        net.DEFAULT_DISPATCH_WORKERS,
+    )
+
+    modelId, ok := dispatchModels[model]
+    if !ok {
+        log.Error("Unknown dispatch model %q, using single", model)
+    }
+    chatproto.SetDispatch(modelId, workers)
+
+    chatproto.WatchRateLimits("Net")
+
+    drainSec, _ := config.GetIntVal(
+        "Net.DrainTimeoutSec",
+        0,
+        net.DEFAULT_DRAIN_TIMEOUT_SEC,
+    )
+    goapp.SetDrainTimeout(drainSec)
+
+    capPath, _ := config.GetVal("Net.CaptureFile", 0, "")
+    if capPath != "" {
+        capture, err := net.CreateCapture(capPath)
+        if err != nil {
+            log.Error("Unable to create capture file %s (%v)", capPath, err)
+        } else {
+            net.SetCapture(capture)
+        }
+    }
+
     addr, _ := config.GetVal("Net.SrvAddrTcp", 0, DEFAULT_TCP_ADDR)
     chatproto.ListenTcp(addr)
 
     addr, _ = config.GetVal("Net.SrvAddrUdp", 0, DEFAULT_UDP_ADDR)
     chatproto.ListenUdp(addr)
 
+    addr, _ = config.GetVal("Net.SrvAddrTls", 0, "")
+    if addr != "" {
+        tlsConfig, err := net.LoadTLSConfig("Net")
+        if err != nil {
+            log.Error("Unable to load TLS config (%v)", err)
+        } else {
+            chatproto.ListenTcpTLS(addr, tlsConfig)
+        }
+    }
+
+    peers, _    := config.GetAllVals("Net.FederatePeers", "")
+    channels, _ := config.GetAllVals("Net.FederateChannels", DEFAULT_FED_CHAN)
+    for _, peer := range peers {
+        if peer == "" {
+            continue
+        }
+
+        _, err := chatproto.FederateTcp(peer, nil, nil, channels...)
+        if err != nil {
+            log.Error("Unable to federate with %s (%v)", peer, err)
+        }
+    }
+
+    requireLogin, _ := config.GetBoolVal("Debug.RequireLogin", 0, false)
+    if requireLogin {
+        dbgProto.SetAccessProvider(net.NewCredentialAccess(
+            net.NewCredentialStore("Debug.Users"),
+        ))
+    }
+
     addr, _ = config.GetVal("Debug.SrvAddr", 0, DEFAULT_DBG_ADDR)
     dbgProto.ListenTcp(addr)
 
+    addr, _ = config.GetVal("Debug.SrvAddrUnix", 0, "")
+    if addr != "" {
+        dbgProto.Listen(net.TRANSPORT_UNIX, addr)
+    }
+
     addr, _ = config.GetVal("Net.SrvAddrHttp", 0, DEFAULT_DIAG_URI)
     if addr != "" {
         net.InitHttpSrv(addr)
         diag.InitWebDiag()
+
+        wsPath, _ := config.GetVal("Net.WebSocketPath", 0, "")
+        if wsPath != "" {
+            origins  := make([]string, 0)
+            vals, _ := config.GetAllVals("Net.WebSocketOrigins", "")
+            for _, origin := range vals {
+                if origin != "" {
+                    origins = append(origins, origin)
+                }
+            }
+
+            chatproto.SetWebSocketOrigins(origins...)
+            chatproto.Listen(net.TRANSPORT_WS, wsPath)
+        }
+    }
+}
+
+// loadSendQueueLimits queries the config system for the limits and overflow
+// policy of client send queues, and applies them to new connections.
+func loadSendQueueLimits() {
+    limits := net.NewSendQueueLimits()
+    limits.MaxBytes, _ = config.GetIntVal("Net.SendQueueBytes", 0, limits.MaxBytes)
+    limits.MaxMsgs, _  = config.GetIntVal("Net.SendQueueMsgs", 0, limits.MaxMsgs)
+
+    policy, _    := config.GetVal("Net.SendQueuePolicy", 0, "block")
+    policyId, ok := sendQueuePolicies[policy]
+    if ok {
+        limits.Policy = policyId
+    } else {
+        log.Error("Unknown send queue policy %q, using block", policy)
     }
+
+    chatproto.SetSendQueueLimits(limits)
+}
+
+// onConfigChange is called when chat.ini is reloaded, and applies the
+// settings which can change while the server is running: debug logging, and
+// the send queue limits of newly connected clients. Everything else only
+// changes on restart.
+func onConfigChange(
+    provider config.ConfigProvider,
+    changes  []*config.ConfigChange,
+) {
+    debugLogs, _ := config.GetBoolVal("System.DebugLogs", 0, false)
+    log.DebugLogs = debugLogs
+
+    loadSendQueueLimits()
+
+    log.Info("Config reloaded (%d keys changed)", len(changes))
 }
 
 
@@ -24,14 +24,17 @@ import(
 import(
     "fmt"
     "strings"
+    "sync"
 )
 
 
 // ChatSrv is a net.EventHandler implementation which implements the
-// behaviors of a basic chat server.
+// behaviors of a basic chat server. Messages may be received concurrently,
+// so the channel and user maps are guarded by mutex.
 type ChatSrv struct {
     chanMap     map[uint32]*net.BroadcastGroup
     chanNameMap map[string]*net.BroadcastGroup
+    mutex       sync.RWMutex
     proto       *net.Protocol
     userMap     map[uint32]string
 }
@@ -40,15 +43,25 @@ type ChatSrv struct {
 func (this *ChatSrv) Close() {}
 
 // Init creates the internal maps which track chat channels and user, and
-// also sets up chat message handler and server security handler.
-func (this *ChatSrv) Init(proto *net.Protocol) {
+// also sets up chat message handler, server security handler,
+// compression provider and keepalives.
+func (this *ChatSrv) Init(chatProto *net.Protocol) {
     this.chanMap     = make(map[uint32]*net.BroadcastGroup, 0)
     this.chanNameMap = make(map[string]*net.BroadcastGroup, 0)
-    this.proto       = proto
+    this.proto       = chatProto
     this.userMap     = make(map[uint32]string)
 
-    proto.AddSignature(new(chat.MsgHandler))
-    proto.SetAccessProvider(new(net.NoSecurity))
+    this.proto.AddSignature(new(chat.MsgHandler))
+    this.proto.SetAccessProvider(new(net.NoSecurity))
+    this.proto.SetCompressionProvider(
+        net.NewCompressor(net.DEFAULT_COMPRESS_THRESHOLD_B),
+    )
+    this.proto.SetKeepalive(net.DEFAULT_KEEPALIVE_MS, net.DEFAULT_IDLE_TIMEOUT_MS)
+    this.proto.SetVersion(
+        proto.CHAT_PROTO_NAME,
+        proto.CHAT_PROTO_VER,
+        proto.CHAT_PROTO_MIN_VER,
+    )
 }
 
 // OnConnect logs debugging information about a newly connected client.
@@ -60,7 +73,10 @@ func (this *ChatSrv) OnConnect(con net.Connection) {
 // and also removes the client from relevant channels and maps.
 func (this *ChatSrv) OnDisconnect(con net.Connection) {
     log.Debug("OnDisconnect event: %s", con.RemoteAddr())
+
+    this.mutex.Lock()
     this.handleDisco(con)
+    this.mutex.Unlock()
 }
 
 // OnError passes any errors from the network layer on to the logging system.
@@ -86,6 +102,50 @@ func (this *ChatSrv) OnReceive(msg interface{}, fromId uint32, access byte) {
     this.handleMsg(chatMsg)
 }
 
+// OnPublish delivers chat messages forwarded by federated servers to the
+// local members of the matching channel. Messages published by anything but
+// a federated server are dropped, and the sender is tagged with the address
+// of the server it came from, so that remote users can't pose as local ones.
+func (this *ChatSrv) OnPublish(
+    topic  string,
+    msg    interface{},
+    fromId uint32,
+    access byte,
+) {
+    log.Debug("%s: %v", topic, msg)
+
+    chatMsg, ok := msg.(*chat.Msg)
+    if !ok {
+        log.Error("Invalid type published: %T", msg)
+        return
+    }
+
+    peers := this.proto.TopicPeers(topic)
+    if peers == nil || peers.GetConnection(fromId) == nil {
+        log.Error("Publish to %s from non-federated con %v", topic, fromId)
+        return
+    }
+
+    chatMsg.From   = fmt.Sprintf(
+        "%s@%s",
+        chatMsg.From,
+        peers.GetConnection(fromId).RemoteAddr(),
+    )
+    chatMsg.FromId = fromId
+
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    ch := this.chanNameMap[topic]
+    if ch == nil || chatMsg.Subtype != chat.MSG_SUB_CHAT {
+        return
+    }
+
+    chatMsg.ChannelId = ch.Id()
+
+    this.send(ch.Id(), chatMsg)
+}
+
 // OnShutdown logs the shutdown event.
 func (this *ChatSrv) OnShutdown() {
     log.Info("Shutdown signal received")
@@ -150,7 +210,7 @@ func (this *ChatSrv) createChannel(name string) *net.BroadcastGroup {
 }
 
 // distChatMsg distributes an incoming chat message to all clients in the given
-// channel.
+// channel, and publishes it to any servers the channel is federated with.
 func (this *ChatSrv) distChatMsg(msg *chat.Msg) {
     ch := this.chanMap[msg.ChannelId]
     if ch == nil {
@@ -166,6 +226,7 @@ func (this *ChatSrv) distChatMsg(msg *chat.Msg) {
     msg.From = this.userMap[msg.FromId]
 
     this.send(msg.ChannelId, msg)
+    this.proto.Publish(ch.Name(), proto.CHAT_MSG, msg)
 }
 
 // handleConnect sends a message back to the conneting client to confirm
@@ -229,8 +290,17 @@ func (this *ChatSrv) handleLeaveChan(msg *chat.Msg) {
 }
 
 // handleMsg reads new messages and redistributes them to their appropriate
-// handlers based on subtype.
+// handlers based on subtype. Chat messages only read the channel and user
+// maps, and so may be distributed in parallel.
 func (this *ChatSrv) handleMsg(msg *chat.Msg) {
+    if msg.Subtype == chat.MSG_SUB_CHAT {
+        this.mutex.RLock()
+        defer this.mutex.RUnlock()
+    } else {
+        this.mutex.Lock()
+        defer this.mutex.Unlock()
+    }
+
     switch msg.Subtype {
     case chat.MSG_SUB_CHAT:
         perfs.Increment(PERF_CHATSRV_DIST_MSG)
@@ -27,6 +27,7 @@ const APP_NAME = "ChatSrv"
 const (
     DEFAULT_DBG_ADDR = "127.0.0.1:8910"
     DEFAULT_DIAG_URI = "127.0.0.1:8911"
+    DEFAULT_FED_CHAN = "public"
     DEFAULT_TCP_ADDR = "127.0.0.1:8900"
     DEFAULT_UDP_ADDR = "127.0.0.1:8901"
 )
@@ -70,6 +71,7 @@ var(
 func main() {
     goapp.SetAppStarter(new(ChatSrvStart))
     goapp.SetLoopHandler(new(ChatSrvLoop))
+    goapp.SetFlagPriority(0) // command line overrides ini
 
     goapp.SetHeartbeat(1000) // 1000ms / 1sec
 
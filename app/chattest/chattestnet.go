@@ -57,13 +57,19 @@ func (this *ChatTest) Close() {}
 // Init seeds rand with this instances instance number and sets up the
 // chat message handler. It also disables network level security on the
 // chat protocol.
-func (this *ChatTest) Init(proto *net.Protocol) {
+func (this *ChatTest) Init(chatProto *net.Protocol) {
     this.testMap = make(map[uint32]bool, 0)
-    this.proto   = proto
+    this.proto   = chatProto
     rand.Seed(int64(myIndex))
 
     this.proto.AddSignature(new(chat.MsgHandler))
     this.proto.SetAccessProvider(new(net.NoSecurity))
+    this.proto.SetHelloOnConnect(true) // servers are upgraded first
+    this.proto.SetVersion(
+        proto.CHAT_PROTO_NAME,
+        proto.CHAT_PROTO_VER,
+        proto.CHAT_PROTO_MIN_VER,
+    )
 }
 
 // GetResults returns the success and error counts, as well as the total
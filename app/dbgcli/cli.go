@@ -28,6 +28,7 @@ import (
     "errors"
     "fmt"
     "strings"
+    "time"
 )
 
 // Console text constants.
@@ -35,6 +36,9 @@ const (
     EXIT_MSG = "exit\n"
 )
 
+// Time to wait for the server to answer a command.
+const CMD_TIMEOUT = 30 * time.Second
+
 // Text styles.
 var (
     errStyle = console.Style{
@@ -97,13 +101,19 @@ func (this *DbgCli) Close() {
 
 // Init saves a reference to the parent protocol, registers the CmdMsgHandler
 // signature on the protocol, and starts the console input goroutine.
-func (this *DbgCli) Init(proto *net.Protocol) {
+func (this *DbgCli) Init(dbgProto *net.Protocol) {
     this.inputSync  = lifecycle.New()
     this.msgHandler = new(dbg.CmdMsgHandler)
-    this.proto      = proto
+    this.proto      = dbgProto
 
     this.proto.AddSignature(this.msgHandler)
     this.proto.SetAccessProvider(new(net.NoSecurity))
+    this.proto.SetHelloOnConnect(true) // servers are upgraded first
+    this.proto.SetVersion(
+        proto.DBG_PROTO_NAME,
+        proto.DBG_PROTO_VER,
+        proto.DBG_PROTO_MIN_VER,
+    )
 
     go this.startInput()
 }
@@ -132,6 +142,18 @@ func (this *DbgCli) OnDisconnect(con net.Connection) {
     go goapp.Stop()
 }
 
+// OnReconnected notifies the user that the connection to the server has
+// been restored.
+func (this *DbgCli) OnReconnected(con net.Connection) {
+    log.Info("Reconnected to server")
+}
+
+// OnReconnecting notifies the user that the connection to the server was
+// lost and is being re-established.
+func (this *DbgCli) OnReconnecting(con net.Connection, attempt int) {
+    log.Error("Connection lost. Reconnecting (attempt %d)", attempt)
+}
+
 // OnError passes network error messages along to the logging service.
 func (this *DbgCli) OnError(err error) {
     log.Error(err.Error())
@@ -183,6 +205,30 @@ func (this *DbgCli) OnTimeout(timeout *net.TimeoutEvent) {
 
 
 
+// callCmd sends a command to the server as an rpc request and prints the
+// response to the console.
+func (this *DbgCli) callCmd(cmdMsg *dbg.CmdMsg) {
+    resp, err := this.proto.Call(this.srvId, proto.DBG_MSG, cmdMsg, CMD_TIMEOUT)
+    if err != nil {
+        this.printChatText(
+            fmt.Sprintf("Command %d failed (%v)", cmdMsg.Cmd, err),
+            errStyle,
+        )
+        return
+    }
+
+    respMsg, ok := resp.(*dbg.CmdMsg)
+    if !ok {
+        this.printChatText(
+            fmt.Sprintf("Cannot handle response type %T", resp),
+            errStyle,
+        )
+        return
+    }
+
+    this.printResponse(respMsg)
+}
+
 // handleInput is called when a new line of input text is received from
 // the console. If the supplied text matches EXIT_MSG, the shutdown
 // sequence is started. Otherwise, the text is parsed as either a help
@@ -278,7 +324,7 @@ func (this *DbgCli) sendCmd(cmd string) {
         txtStyle,
     )
 
-    this.proto.SendMsg(this.srvId, proto.DBG_MSG, cmdMsg)
+    go this.callCmd(cmdMsg)
 }
 
 // startInput starts the console input loop, reading text from
@@ -18,14 +18,36 @@ import (
     "github.com/xaevman/goat/mod/net"
 )
 
+// Stdlib imports.
+import (
+    "flag"
+)
+
 // Application name.
 const APP_NAME = "DbgCli"
 
 // Application entry point.
 func main() {
+    srvAddr   := flag.String("s", "127.0.0.1:8910", "remote server address")
+    transport := flag.String("t", net.TRANSPORT_TCP, "transport (tcp, unix)")
+    user      := flag.String("u", "", "login user name")
+    secret    := flag.String("p", "", "login secret")
+    flag.Parse()
+
     evtHandler := new(DbgCli)
     proto      := net.NewProtocol(APP_NAME, evtHandler)
-    proto.DialTcp("127.0.0.1:8910")
+
+    if *user != "" {
+        access := net.NewCredentialAccess(nil)
+        access.SetCredentials(*user, *secret)
+        proto.SetAccessProvider(access)
+    }
+
+    if *transport == net.TRANSPORT_TCP {
+        proto.DialTcpReconnect(*srvAddr, nil, nil)
+    } else {
+        proto.Dial(*transport, *srvAddr)
+    }
 
     stopChan := goapp.Start(APP_NAME)
     <-stopChan
@@ -37,8 +37,13 @@ type GoGraphLoop struct {}
 func (this *GoGraphLoop) OnHeartbeat() {
     timestamp := time.Now()
 
-    for i := range sysCtlStats {
-        sendStat(sysCtlStats[i], timestamp)
+    cfgMutex.RLock()
+    prefix := appConfig.Graphite.StatPrefix
+    stats  := appConfig.Stats.SysctlStat
+    cfgMutex.RUnlock()
+
+    for i := range stats {
+        sendStat(prefix, stats[i], timestamp)
     }
 }
 
@@ -48,9 +53,10 @@ func (this *GoGraphLoop) PreLoop() {}
 // PostLoop is unused in GoGraph.
 func (this *GoGraphLoop) PostLoop() {}
 
-// sendStat queries for a given stat, formats it in the correct format,
-// and attempts to send it over the open socket to Graphite.
-func sendStat (stat string, timestamp time.Time) {
+// sendStat queries for a given stat, formats it in the correct format
+// under the given prefix, and attempts to send it over the open socket to
+// Graphite.
+func sendStat (prefix, stat string, timestamp time.Time) {
     val, err := getStat(stat)
     if err != nil {
         log.Error(err.Error())
@@ -67,7 +73,7 @@ func sendStat (stat string, timestamp time.Time) {
 
     graphTxt := fmt.Sprintf(
         GRAPH_MSG_FORMAT,
-        statPrefix,
+        prefix,
         host,
         stat,
         val,
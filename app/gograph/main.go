@@ -24,6 +24,7 @@ import (
 // Stdlib imports.
 import (
     "net"
+    "sync"
 )
 
 // Application name.
@@ -32,22 +33,37 @@ const APP_NAME  = "GoGraph"
 // Graphite message format.
 const GRAPH_MSG_FORMAT = "%s.%s.%s %s %d\n"
 
-// Application config variables.
+// Application config, bound from gograph.ini.
 var (
-    heartbeatMs = 60000
-    srvAddr     = "127.0.0.1:2003"
-    statPrefix  = "srv"
-    sysCtlStats = make([]string, 0)
+    appConfig GoGraphConfig
+    cfgMutex  sync.RWMutex
 )
 
 // Graphite server connection.
 var srvCon net.Conn
 
+// GoGraphConfig holds the settings read from gograph.ini, one nested struct
+// per ini section. It also serves as the application's config schema.
+type GoGraphConfig struct {
+    Graphite struct {
+        SendIntervalMs int    `default:"60000" min:"1" desc:"Stat send interval"`
+        SrvAddr        string `default:"127.0.0.1:2003" desc:"Graphite host:port"`
+        StatPrefix     string `default:"srv" desc:"Prefix of sent stat names"`
+    }
+    Stats struct {
+        SysctlStat []string `desc:"Sysctl stats to send"`
+    }
+    System struct {
+        DebugLogs bool `desc:"Enable debug logging"`
+    }
+}
+
 // main is the application entry point.
 func main() {
     goapp.SetAppStarter(new(GoGraphStart))
     goapp.SetLoopHandler(new(GoGraphLoop))
     goapp.SetCrashHandler(new(GoGraphCrash))
+    goapp.SetFlagPriority(0) // command line overrides ini
 
     stopChan := goapp.Start(APP_NAME)
     <-stopChan
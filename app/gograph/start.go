@@ -22,60 +22,49 @@ import (
 // Stdlib imports.
 import (
     "net"
-    "strings"
 )
 
 // GoGraphStart is a goapp.AppStarter implementation for a GoGraph
 // instance.
 type GoGraphStart struct {}
 
-// PreInit registers the application's ini config and queries to
-// determine if debug logs should be enabled or not.
+// PreInit registers the application's config schema and ini config, and
+// queries to determine if debug logs should be enabled or not. Config changes
+// are applied as the ini file is reloaded.
 func (this *GoGraphStart) PreInit() {
+    schema, err := config.SchemaOf("", &GoGraphConfig{})
+    if err == nil {
+        err = config.RegisterSchema(schema...)
+    }
+    if err != nil {
+        log.Error("Unable to register config schema (%v)", err)
+    }
+
     config.InitIniProvider("config/gograph.ini", 1)
     debugLogs, _ := config.GetBoolVal("System.DebugLogs", 0, false)
     log.DebugLogs = debugLogs
+
+    config.Subscribe(onConfigChange)
 }
 
-// PostInit queries the registered config to determine what prefix
+// PostInit binds the registered config to determine what prefix
 // to append to stat names, the address and port of the Graphite 
 // server, the interval at which to collect statistics, and which
 // statistics to look for.
 func (this *GoGraphStart) PostInit() {
-    // Stat prefix
-    prefix, _ := config.GetVal(
-        "Graphite.StatPrefix",
-        0,
-        "srv",
-    )
-    statPrefix = prefix
-
-    // Server address
-    srvAddr, _ := config.GetVal(
-        "Graphite.SrvAddr", 
-        0, 
-        "127.0.0.1:2003",
-    )
-    
-    // Send interval (in ms)
-    heartbeatMs, _ := config.GetIntVal(
-        "Graphite.SendIntervalMs",
-        0,
-        60000,
-    )
-
-    // Sysctl stats to gather
-    sStatEntries := config.GetEntries("Stats.SysctlStat")
-
-    for _, entry := range sStatEntries {
-        cleanVal := strings.TrimSpace(entry.GetVal(0))
-        if cleanVal == "" {
-            continue
-        }
-
-        sysCtlStats = append(sysCtlStats, cleanVal)
+    err := loadConfig()
+    if err != nil {
+        log.Error("%v", err)
+        goapp.SetExitCode(1)
+        goapp.Stop()
+        return
     }
 
+    cfgMutex.RLock()
+    srvAddr     := appConfig.Graphite.SrvAddr
+    heartbeatMs := appConfig.Graphite.SendIntervalMs
+    cfgMutex.RUnlock()
+
     // Apply config
     con, err := net.Dial("tcp", srvAddr)
     if err != nil {
@@ -95,3 +84,40 @@ func (this *GoGraphStart) PostInit() {
     )
 }
 
+// loadConfig binds the registered config to a new GoGraphConfig and, if
+// every key is valid, swaps it in and applies the debug log setting.
+func loadConfig() error {
+    var newConfig GoGraphConfig
+
+    err := config.Bind("", &newConfig)
+    if err != nil {
+        return err
+    }
+
+    log.DebugLogs = newConfig.System.DebugLogs
+
+    cfgMutex.Lock()
+    defer cfgMutex.Unlock()
+
+    appConfig = newConfig
+
+    return nil
+}
+
+// onConfigChange is called when gograph.ini is reloaded, and applies the
+// settings which can change while GoGraph is running: debug logging, the
+// stat prefix, and the statistics to look for. The Graphite server and send
+// interval only change on restart. An invalid config is logged, and the
+// current one kept.
+func onConfigChange(
+    provider config.ConfigProvider,
+    changes  []*config.ConfigChange,
+) {
+    err := loadConfig()
+    if err != nil {
+        log.Error("Config reload rejected (%v)", err)
+        return
+    }
+
+    log.Info("Config reloaded (%d keys changed)", len(changes))
+}
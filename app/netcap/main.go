@@ -0,0 +1,272 @@
+//  ---------------------------------------------------------------------------
+//
+//  main.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+// netcap is a command line utility for working with the capture files
+// recorded by net.Capture. It can print the messages in a capture, decoded
+// by goat's built-in MsgProcessors, or replay the traffic from a capture
+// against a live server.
+//  Usage: netcap [options] decode <capture file>
+//         netcap [options] replay <capture file>
+//
+//  // print every message a chat server received from connection 51
+//  netcap -c 51 decode chatsrv.cap
+//
+//  // resend everything the chat server's clients sent, in real time
+//  netcap -s 127.0.0.1:8900 -speed 1 replay chatsrv.cap
+package main
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/net"
+    "github.com/xaevman/goat/proto/chat"
+    "github.com/xaevman/goat/proto/dbg"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "time"
+)
+
+// Application name.
+const APP_NAME = "NetCap"
+
+// Time to wait for a replay connection to be established, and for replayed
+// messages to be flushed before disconnecting.
+const (
+    CONNECT_TIMEOUT = 10 * time.Second
+    FLUSH_TIMEOUT   = 2 * time.Second
+)
+
+// Direction names.
+var dirNames = map[byte]string {
+    net.CAPTURE_IN  : "in",
+    net.CAPTURE_OUT : "out",
+}
+
+// Command line options.
+var (
+    conId     = flag.Uint("c", 0, "only messages of this connection id")
+    ctrl      = flag.Bool("ctrl", false, "replay control messages")
+    direction = flag.String("d", "in", "direction to replay (in, out)")
+    protoName = flag.String("p", "", "only messages of this protocol")
+    speed     = flag.Float64("speed", 0, "replay speed (1 = real time, 0 = no delay)")
+    srvAddr   = flag.String("s", "127.0.0.1:8900", "replay server address")
+    transport = flag.String("t", net.TRANSPORT_TCP, "replay transport (tcp, unix)")
+)
+
+
+// main is the application's entry point.
+func main() {
+    flag.Usage = usage
+    flag.Parse()
+
+    if flag.NArg() != 2 {
+        usage()
+        os.Exit(1)
+    }
+
+    reader, err := net.OpenCapture(flag.Arg(1))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+    defer reader.Close()
+
+    switch flag.Arg(0) {
+    case "decode":
+        err = decode(reader)
+    case "replay":
+        err = replay(reader)
+    default:
+        usage()
+        os.Exit(1)
+    }
+
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
+
+// decode prints each message in the capture, along with its deserialized
+// object, if it was sent with a registered signature.
+func decode(reader *net.CaptureReader) error {
+    proto := newProto(new(ReplayHandler))
+    defer proto.Shutdown()
+
+    decoder := net.NewCaptureDecoder(proto)
+
+    for {
+        rec, err := reader.Next()
+        if err == io.EOF {
+            return nil
+        }
+
+        if err != nil {
+            return err
+        }
+
+        if *conId != 0 && rec.ConId != uint32(*conId) {
+            continue
+        }
+
+        if *protoName != "" && rec.Proto != *protoName {
+            continue
+        }
+
+        prefix := fmt.Sprintf(
+            "%s [%s] con %v %-3s",
+            rec.Time.Format("15:04:05.000000"),
+            rec.Proto,
+            rec.ConId,
+            dirNames[rec.Direction],
+        )
+
+        msg, obj, err := decoder.Decode(rec)
+        switch {
+        case err != nil:
+            fmt.Printf("%s %d bytes: %v\n", prefix, len(rec.Frame), err)
+        case msg == nil:
+            fmt.Printf("%s %d bytes: fragment\n", prefix, len(rec.Frame))
+        case obj == nil:
+            fmt.Printf(
+                "%s %s (%d bytes)\n",
+                prefix,
+                net.SigName(msg.MsgType()),
+                len(msg.GetPayload()),
+            )
+        default:
+            fmt.Printf(
+                "%s %s (%d bytes): %+v\n",
+                prefix,
+                net.SigName(msg.MsgType()),
+                len(msg.GetPayload()),
+                obj,
+            )
+        }
+    }
+}
+
+// newProto creates a protocol with goat's built-in MsgProcessors and
+// compression registered, for decoding and replaying captures.
+func newProto(handler net.EventHandler) *net.Protocol {
+    proto := net.NewProtocol(APP_NAME, handler)
+    proto.AddSignature(new(chat.MsgHandler))
+    proto.AddSignature(new(dbg.CmdMsgHandler))
+    proto.SetAccessProvider(new(net.NoSecurity))
+    proto.SetCompressionProvider(net.NewCompressor(net.DEFAULT_COMPRESS_THRESHOLD_B))
+
+    return proto
+}
+
+// replay connects to the server and sends it the frames in the capture
+// which match the command line options.
+func replay(reader *net.CaptureReader) error {
+    opts         := net.NewReplayOptions()
+    opts.ConId    = uint32(*conId)
+    opts.Proto    = *protoName
+    opts.SkipCtrl = !*ctrl
+    opts.Speed    = *speed
+
+    switch *direction {
+    case "in":
+        opts.Direction = net.CAPTURE_IN
+    case "out":
+        opts.Direction = net.CAPTURE_OUT
+    default:
+        return errors.New(fmt.Sprintf("Unknown direction %q", *direction))
+    }
+
+    handler := new(ReplayHandler)
+    proto   := newProto(handler)
+    defer proto.Shutdown()
+
+    err := proto.Dial(*transport, *srvAddr)
+    if err != nil {
+        return err
+    }
+
+    var con net.Connection
+
+    select {
+    case con = <-handler.conChan:
+    case <-time.After(CONNECT_TIMEOUT):
+        return errors.New(fmt.Sprintf("Timed out connecting to %s", *srvAddr))
+    }
+
+    sent, err := net.Replay(reader, con, opts)
+
+    fmt.Printf("Replayed %d messages to %s\n", sent, *srvAddr)
+
+    <-time.After(FLUSH_TIMEOUT)
+
+    return err
+}
+
+// usage prints the command line help.
+func usage() {
+    fmt.Fprintf(
+        os.Stderr,
+        "Usage: %s [options] decode|replay <capture file>\n",
+        os.Args[0],
+    )
+    flag.PrintDefaults()
+}
+
+
+// ReplayHandler is the net.EventHandler of the replaying protocol. Errors
+// and messages sent back by the server are printed.
+type ReplayHandler struct {
+    conChan chan net.Connection
+}
+
+// Close is unused in ReplayHandler.
+func (this *ReplayHandler) Close() {}
+
+// Init creates the connection channel.
+func (this *ReplayHandler) Init(proto *net.Protocol) {
+    this.conChan = make(chan net.Connection, 1)
+}
+
+// OnConnect hands the replay connection to replay.
+func (this *ReplayHandler) OnConnect(con net.Connection) {
+    select {
+    case this.conChan<- con:
+    default:
+    }
+}
+
+// OnDisconnect is unused in ReplayHandler.
+func (this *ReplayHandler) OnDisconnect(con net.Connection) {}
+
+// OnError prints the error.
+func (this *ReplayHandler) OnError(err error) {
+    fmt.Fprintln(os.Stderr, err)
+}
+
+// OnReceive prints messages sent back by the server.
+func (this *ReplayHandler) OnReceive(msg interface{}, fromId uint32, access byte) {
+    fmt.Printf("Received from con %v: %+v\n", fromId, msg)
+}
+
+// OnShutdown is unused in ReplayHandler.
+func (this *ReplayHandler) OnShutdown() {}
+
+// OnTimeout prints the timeout.
+func (this *ReplayHandler) OnTimeout(timeout *net.TimeoutEvent) {
+    fmt.Fprintf(os.Stderr, "Timeout: %+v\n", timeout)
+}
@@ -0,0 +1,89 @@
+//  ---------------------------------------------------------------------------
+//
+//  all_test.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package lz
+
+// Stdlib imports.
+import (
+    "bytes"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+// TestRoundTrip compresses and decompresses a variety of inputs, validating
+// that the output matches the original data.
+func TestRoundTrip(t *testing.T) {
+    random := make([]byte, 64 * 1024)
+    for i := range random {
+        random[i] = byte(rand.Intn(256))
+    }
+
+    inputs := [][]byte {
+        []byte {},
+        []byte("a"),
+        []byte("abc"),
+        []byte("abcdabcdabcdabcdabcdabcdabcd"),
+        []byte(strings.Repeat("x", 100000)),
+        []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 500)),
+        random,
+    }
+
+    for i := range inputs {
+        block := Compress(inputs[i])
+
+        out, err := Decompress(block, len(inputs[i]))
+        if err != nil {
+            t.Fatalf("Input %d: %v", i, err)
+        }
+
+        if !bytes.Equal(out, inputs[i]) {
+            t.Fatalf("Input %d: round trip mismatch", i)
+        }
+
+        t.Logf("Input %d: %d -> %d bytes", i, len(inputs[i]), len(block))
+    }
+
+    repeat := []byte(strings.Repeat("x", 100000))
+    if len(Compress(repeat)) > len(repeat) / 100 {
+        t.Fatal("Repetitive input was not compressed")
+    }
+}
+
+// TestCorrupt validates that truncated, oversized, and malformed blocks
+// are rejected rather than decoded.
+func TestCorrupt(t *testing.T) {
+    data  := []byte(strings.Repeat("corrupt me please ", 100))
+    block := Compress(data)
+
+    _, err := Decompress(block, len(data) - 1)
+    if err != ErrTooLarge {
+        t.Fatalf("Expected ErrTooLarge, got %v", err)
+    }
+
+    for i := 0; i < len(block); i++ {
+        _, err = Decompress(block[:i], len(data))
+        if err == nil {
+            t.Fatalf("Truncated block (%d / %d) decoded without error", i, len(block))
+        }
+    }
+
+    for i := 0; i < 1000; i++ {
+        garbage := make([]byte, rand.Intn(64))
+        for j := range garbage {
+            garbage[j] = byte(rand.Intn(256))
+        }
+
+        // must not panic
+        Decompress(garbage, 1024)
+    }
+}
@@ -0,0 +1,237 @@
+//  ---------------------------------------------------------------------------
+//
+//  lz.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+// Package lz implements a small, fast LZ77 style block compressor which
+// favors speed over compression ratio.
+//
+// Block format
+// [0-3] uncompressed length (uint32)
+// [4-]  sequences
+//
+// Sequence
+//      token          (byte, literal length in the high 4 bits,
+//                      match length - MIN_MATCH in the low 4 bits)
+//      literal length (optional, 255 continuation bytes when nibble == 15)
+//      literals
+//      match offset   (uint16, little endian, omitted in the final sequence)
+//      match length   (optional, 255 continuation bytes when nibble == 15)
+package lz
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+)
+
+// Codec constants.
+const (
+    HASH_BITS  = 14
+    MAX_OFFSET = 65535
+    MIN_MATCH  = 4
+)
+
+// Common errors.
+var (
+    ErrCorrupt  = errors.New("Corrupt lz block")
+    ErrTooLarge = errors.New("Uncompressed lz block exceeds max length")
+)
+
+
+// Compress encodes the supplied data into a new lz block.
+func Compress(src []byte) []byte {
+    var table [1 << HASH_BITS]int
+
+    cursor := 0
+    dst    := make([]byte, buffer.LenUint32(), len(src) + len(src) / 255 + 16)
+    buffer.WriteUint32(uint32(len(src)), dst, &cursor)
+
+    anchor := 0
+    limit  := len(src) - MIN_MATCH
+
+    for i := 0; i <= limit; {
+        seq := load32(src, i)
+        h   := hash(seq)
+        ref := table[h] - 1
+
+        table[h] = i + 1
+
+        if ref < 0 || i - ref > MAX_OFFSET || load32(src, ref) != seq {
+            i++
+            continue
+        }
+
+        matchLen := MIN_MATCH
+        for i + matchLen < len(src) && src[ref + matchLen] == src[i + matchLen] {
+            matchLen++
+        }
+
+        dst     = appendSequence(dst, src[anchor:i], i - ref, matchLen)
+        i      += matchLen
+        anchor  = i
+    }
+
+    if anchor < len(src) {
+        dst = appendSequence(dst, src[anchor:], 0, 0)
+    }
+
+    return dst
+}
+
+// Decompress decodes the supplied lz block, refusing to produce more than
+// maxLen bytes of output.
+func Decompress(src []byte, maxLen int) ([]byte, error) {
+    cursor    := 0
+    size, err := buffer.ReadUint32(src, &cursor)
+    if err != nil {
+        return nil, ErrCorrupt
+    }
+
+    if int(size) > maxLen {
+        return nil, ErrTooLarge
+    }
+
+    dst := make([]byte, 0, size)
+
+    for cursor < len(src) {
+        token := src[cursor]
+        cursor++
+
+        litLen, ok := readLen(src, &cursor, int(token >> 4))
+        if !ok || cursor + litLen > len(src) || len(dst) + litLen > int(size) {
+            return nil, ErrCorrupt
+        }
+
+        dst     = append(dst, src[cursor:cursor + litLen]...)
+        cursor += litLen
+
+        if cursor == len(src) {
+            break
+        }
+
+        if cursor + 2 > len(src) {
+            return nil, ErrCorrupt
+        }
+
+        offset := int(src[cursor]) | int(src[cursor + 1]) << 8
+        cursor += 2
+
+        matchLen, ok := readLen(src, &cursor, int(token & 0x0F))
+        if !ok {
+            return nil, ErrCorrupt
+        }
+
+        matchLen += MIN_MATCH
+
+        if offset < 1 || offset > len(dst) || len(dst) + matchLen > int(size) {
+            return nil, ErrCorrupt
+        }
+
+        // byte-wise copy, matches may overlap the output
+        start := len(dst) - offset
+        for i := 0; i < matchLen; i++ {
+            dst = append(dst, dst[start + i])
+        }
+    }
+
+    if len(dst) != int(size) {
+        return nil, ErrCorrupt
+    }
+
+    return dst, nil
+}
+
+// appendLen writes the continuation bytes for a length which didn't fit
+// in its token nibble.
+func appendLen(dst []byte, length int) []byte {
+    for length -= 15; length >= 255; length -= 255 {
+        dst = append(dst, 255)
+    }
+
+    return append(dst, byte(length))
+}
+
+// appendSequence writes one sequence (literals, followed by an optional
+// match) to the output block.
+func appendSequence(dst, literals []byte, offset, matchLen int) []byte {
+    litNibble   := len(literals)
+    matchNibble := matchLen - MIN_MATCH
+
+    if litNibble > 15 {
+        litNibble = 15
+    }
+
+    if matchLen == 0 {
+        matchNibble = 0
+    } else if matchNibble > 15 {
+        matchNibble = 15
+    }
+
+    dst = append(dst, byte(litNibble << 4 | matchNibble))
+
+    if litNibble == 15 {
+        dst = appendLen(dst, len(literals))
+    }
+
+    dst = append(dst, literals...)
+
+    if matchLen == 0 {
+        return dst
+    }
+
+    dst = append(dst, byte(offset), byte(offset >> 8))
+
+    if matchNibble == 15 {
+        dst = appendLen(dst, matchLen - MIN_MATCH)
+    }
+
+    return dst
+}
+
+// hash returns the match table slot for the given 4 byte sequence.
+func hash(seq uint32) uint32 {
+    return (seq * 2654435761) >> (32 - HASH_BITS)
+}
+
+// load32 reads 4 bytes from the given offset as a uint32 value.
+func load32(data []byte, offset int) uint32 {
+    return uint32(data[offset]) |
+        uint32(data[offset + 1]) << 8 |
+        uint32(data[offset + 2]) << 16 |
+        uint32(data[offset + 3]) << 24
+}
+
+// readLen reads the continuation bytes of a length value whose token nibble
+// was 15. The boolean return value is false if the block is truncated.
+func readLen(src []byte, cursor *int, nibble int) (int, bool) {
+    length := nibble
+    if nibble < 15 {
+        return length, true
+    }
+
+    for {
+        if *cursor >= len(src) {
+            return 0, false
+        }
+
+        next := int(src[*cursor])
+        *cursor++
+
+        length += next
+        if next < 255 {
+            return length, true
+        }
+    }
+}
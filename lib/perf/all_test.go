@@ -117,6 +117,37 @@ func TestPerfStore(t *testing.T) {
     log.Println("TestPerfStore: passed")
 }
 
+// TestCounterSetGroup makes sure group members are registered with the perf
+// system on demand, and unregistered when removed.
+func TestCounterSetGroup(t *testing.T) {
+    group := NewCounterSetGroup("testGroup", PERF_TEST_COUNT, perfNames)
+
+    perfs := group.Get("a")
+    perfs.Increment(PERF_TEST_COUNTER1)
+    group.Get("b")
+
+    if group.Get("a") != perfs || perfs.Value(PERF_TEST_COUNTER1) != 1 {
+        t.Fatal("Group returned a different object for the same key")
+    }
+
+    if GetCounterSet("testGroup.a") != perfs {
+        t.Fatal("Group member not registered")
+    }
+
+    keys := group.Keys()
+    if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+        t.Fatalf("Wrong keys %v", keys)
+    }
+
+    group.Remove("a")
+
+    if GetCounterSet("testGroup.a") != nil || len(group.Keys()) != 1 {
+        t.Fatal("Group member not unregistered")
+    }
+
+    log.Println("TestCounterSetGroup: passed")
+}
+
 // TestPerfCounts randomly increments test counters and then checks that the end results match
 // the number of iterations that were performed during the test.
 func TestPerfCounts(t *testing.T) {
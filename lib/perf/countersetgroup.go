@@ -0,0 +1,102 @@
+//  ---------------------------------------------------------------------------
+//
+//  countersetgroup.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package perf
+
+// Stdlib imports.
+import (
+    "fmt"
+    "sort"
+    "sync"
+)
+
+
+// CounterSetGroup represents a family of identically shaped CounterSets,
+// keyed by name, for tracking dynamic objects such as topics or users. Each
+// member CounterSet is registered with the perf service as <group>.<key>.
+type CounterSetGroup struct {
+    mutex sync.Mutex
+    name  string
+    names []string
+    sets  map[string]*CounterSet
+    size  int
+}
+
+// NewCounterSetGroup creates a new, empty CounterSetGroup whose members will
+// contain the counters described by size and names, as in NewCounterSet.
+func NewCounterSetGroup(name string, size int, names []string) *CounterSetGroup {
+    if len(names) != size {
+        panic("Perf enum length must == name map length")
+    }
+
+    newGroup := CounterSetGroup {
+        name  : name,
+        names : names,
+        sets  : make(map[string]*CounterSet),
+        size  : size,
+    }
+
+    return &newGroup
+}
+
+// Get returns the CounterSet for the given key, creating and registering it
+// if it doesn't exist yet.
+func (this *CounterSetGroup) Get(key string) *CounterSet {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    set := this.sets[key]
+    if set == nil {
+        set = NewCounterSet(
+            fmt.Sprintf("%s.%s", this.name, key),
+            this.size,
+            this.names,
+        )
+        this.sets[key] = set
+    }
+
+    return set
+}
+
+// Keys returns the sorted keys of all CounterSets in the group.
+func (this *CounterSetGroup) Keys() []string {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    keys := make([]string, 0, len(this.sets))
+    for k, _ := range this.sets {
+        keys = append(keys, k)
+    }
+
+    sort.Strings(keys)
+
+    return keys
+}
+
+// Name returns the friendly name of this CounterSetGroup.
+func (this *CounterSetGroup) Name() string {
+    return this.name
+}
+
+// Remove unregisters and discards the CounterSet for the given key.
+func (this *CounterSetGroup) Remove(key string) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    set := this.sets[key]
+    if set == nil {
+        return
+    }
+
+    unregisterCounterSet(set.Name())
+    delete(this.sets, key)
+}
@@ -14,19 +14,175 @@ package config
 
 // Stdlib imports.
 import(
+    "bytes"
+    "io/ioutil"
     "log"
+    "os"
+    "path/filepath"
+    "strings"
     "testing"
+    "time"
 )
 
-// TestConfig initializes a couple of ini providers and
-// attempts to pull values back out of them.
+// File extensions of the formats covered by the shared file provider tests.
+var testFormats = []string { ".ini", ".json", ".toml", ".yaml" }
+
+// Documents written by the shared file provider tests, in each format.
+var testFixtures = map[string]*fileFixtures {
+    ".ini" : &fileFixtures {
+        bind : `[Bind]
+Debug = true
+Skipped = set
+
+[Bind.Graphite]
+SrvAddr = 127.0.0.1:2003
+SendInterval = 30s
+Stat = a, b
+Stat = c
+
+[Bind.Limits]
+Float32 = 0.25
+Float64 = 1.5
+Int8 = -10
+Int = 1 2, 3
+Uint64 = 18446744073709551615
+`,
+        bindInvalid : `[Bind.Graphite]
+SendInterval = 10ms
+Stat = a
+
+[Bind.Limits]
+Float64 = 2
+Int8 = 128
+Int = 1 x
+`,
+        reloadBefore : "[Reload]\nsame = 1\nchanged = a, b\nremoved = x\n",
+        reloadAfter  : "[Reload]\nsame = 1\nchanged = a, c\nadded = y\nskipped\n",
+        reloadBad    : "",
+    },
+    ".json" : &fileFixtures {
+        bind : `{
+    "Bind" : {
+        "Debug"    : true,
+        "Skipped"  : "set",
+        "Graphite" : {
+            "SrvAddr"      : "127.0.0.1:2003",
+            "SendInterval" : "30s",
+            "Stat"         : [ "a", "b", "c" ]
+        },
+        "Limits" : {
+            "Float32" : 0.25,
+            "Float64" : 1.5,
+            "Int8"    : -10,
+            "Int"     : [ "1 2", 3 ],
+            "Uint64"  : 18446744073709551615
+        }
+    }
+}
+`,
+        bindInvalid : `{
+    "Bind" : {
+        "Graphite" : { "SendInterval" : "10ms", "Stat" : "a" },
+        "Limits"   : { "Float64" : 2, "Int8" : 128, "Int" : "1 x" }
+    }
+}
+`,
+        reloadBefore : `{ "Reload" : { "same" : 1, "changed" : [ "a", "b" ], "removed" : "x" } }`,
+        reloadAfter  : `{ "Reload" : { "same" : 1, "changed" : [ "a", "c" ], "added" : "y" } }`,
+        reloadBad    : `{ "Reload" : { "changed" } }`,
+    },
+    ".toml" : &fileFixtures {
+        bind : `# bind test
+[Bind]
+Debug = true
+Skipped = "set"
+
+[Bind.Graphite]
+SrvAddr = "127.0.0.1:2003"
+SendInterval = '30s'
+Stat = [
+    "a", # comment
+    "b",
+    "c",
+]
+
+[Bind.Limits]
+Float32 = 0.25
+Float64 = 1.5
+Int8 = -10
+Int = ["1 2", 3]
+Uint64 = 18_446_744_073_709_551_615
+`,
+        bindInvalid : `[Bind]
+Graphite = { SendInterval = "10ms", Stat = "a" }
+Limits.Float64 = 2
+Limits.Int8 = 128
+Limits.Int = "1 x"
+`,
+        reloadBefore : "[Reload]\nsame = 1\nchanged = [\"a\", \"b\"]\nremoved = \"x\"\n",
+        reloadAfter  : "[Reload]\nsame = 1\nchanged = [\"a\", \"c\"]\nadded = \"y\"\n",
+        reloadBad    : "[Reload]\nchanged\n",
+    },
+    ".yaml" : &fileFixtures {
+        bind : `---
+# bind test
+Bind:
+  Debug: true
+  Skipped: set
+  Graphite:
+    SrvAddr: "127.0.0.1:2003"
+    SendInterval: 30s   # comment
+    Stat:
+      - a
+      - 'b'
+      - c
+  Limits: { Float32: 0.25, Float64: 1.5, Int8: -10, Int: ["1 2", 3], Uint64: 18446744073709551615 }
+`,
+        bindInvalid : `Bind:
+  Graphite:
+    SendInterval: 10ms
+    Stat: a
+  Limits:
+    Float64: 2
+    Int8: 128
+    Int: 1 x
+`,
+        reloadBefore : "Reload:\n  same: 1\n  changed: [a, b]\n  removed: x\n",
+        reloadAfter  : "Reload:\n  same: 1\n  changed:\n    - a\n    - c\n  added: y\n",
+        reloadBad    : "Reload:\n  changed\n",
+    },
+}
+
+// fileFixtures holds the documents written by the shared file provider tests
+// for a single format.
+type fileFixtures struct {
+    bind         string
+    bindInvalid  string
+    reloadAfter  string
+    reloadBad    string
+    reloadBefore string
+}
+
+// TestConfig initializes the environment provider and a file provider of
+// each format, and attempts to pull values back out of them.
 func TestConfig(t *testing.T) {
+    for _, ext := range testFormats {
+        t.Run(ext, func(t *testing.T) { testConfig(t, ext) })
+    }
+}
+
+// testConfig runs the config tests against a file provider of the given
+// format.
+func testConfig(t *testing.T, ext string) {
     IniDir = "./"
 
     InitEnvProvider(1)
-    if InitIniProvider("test.ini", 2) == nil {
-        t.Fatal("Ini file not found")
+    provider := InitFileProvider("test" + ext, 2)
+    if provider == nil {
+        t.Fatalf("test%s not found", ext)
     }
+    defer provider.Shutdown()
+    defer UnregisterConfigProvider(provider)
 
     key         := "PATH"
     data, entry := GetAllVals(key, "/bin:/sbin")
@@ -36,11 +192,612 @@ func TestConfig(t *testing.T) {
     data, entry = GetAllVals(key, "default1")
     printConfig(key, data, entry.Parser())
 
+    if entry.Parser() != provider {
+        t.Fatalf("%s not served from test%s", key, ext)
+    }
+
     key         = "This.Key.Shouldnt.exist"
     data, entry = GetAllVals(key, "default3")
     printConfig(key, data, entry.Parser())
 }
 
+// TestFileProviders validates that the test.ini, test.json, test.toml and
+// test.yaml files, which hold the same config in each format, flatten into
+// the same entries.
+func TestFileProviders(t *testing.T) {
+    IniDir = "./"
+
+    expected := map[string][][]string {
+        "Ini.Section.key1" : {
+            { "val0", "val1", "val2", "val3" },
+            { "2val0", "2val1" },
+        },
+        "Ini.Section.key2" : {
+            { "val0", "val1", "val2" },
+        },
+        "Ini.New.Section.newKey1" : {
+            { "1.1", "1", "\"rawr\"", "true" },
+            { "1.0", "20220", "\"test123\"", "false" },
+        },
+        "Ini.New.Section.newKey2" : {
+            { "-10000" },
+        },
+    }
+
+    for _, ext := range testFormats {
+        provider := InitFileProvider("test" + ext, 0)
+        if provider == nil {
+            t.Fatalf("test%s not loaded", ext)
+        }
+
+        keys := provider.Keys()
+        if len(keys) != len(expected) {
+            t.Fatalf("Unexpected keys in test%s (%v)", ext, keys)
+        }
+
+        for key, vals := range expected {
+            entries := GetEntries(key)
+            if len(entries) != len(vals) || entries[0].Parser() != provider {
+                t.Fatalf("Unexpected %s entries in test%s (%v)", key, ext, entries)
+            }
+
+            for i := range vals {
+                if strings.Join(entries[i].GetAllVals(), "|") !=
+                    strings.Join(vals[i], "|") {
+                    t.Fatalf(
+                        "Unexpected %s values in test%s (%q)",
+                        key,
+                        ext,
+                        entries[i].GetAllVals(),
+                    )
+                }
+            }
+        }
+
+        UnregisterConfigProvider(provider)
+        provider.Shutdown()
+    }
+
+    if InitFileProvider("test.txt", 0) != nil {
+        t.Fatal("Unknown file format accepted")
+    }
+
+    // test.ini's malformed line fails a strict load
+    IniStrict = true
+    defer func() { IniStrict = false }()
+
+    if InitIniProvider("test.ini", 2) != nil {
+        t.Fatal("Malformed line accepted by strict load")
+    }
+}
+
+// TestBind validates that Bind populates nested structs and slices of each
+// supported type, applies defaults, and reports every invalid key at once,
+// from each file format.
+func TestBind(t *testing.T) {
+    for _, ext := range testFormats {
+        t.Run(ext, func(t *testing.T) { testBind(t, ext) })
+    }
+}
+
+// testBind runs the Bind tests against a file provider of the given format.
+func testBind(t *testing.T, ext string) {
+    type graphite struct {
+        Addr     string        `key:"SrvAddr" required:"true"`
+        Interval time.Duration `key:"SendInterval" default:"1m" min:"1s"`
+        Stats    []string      `key:"Stat"`
+    }
+
+    type bindTarget struct {
+        Graphite graphite
+        Limits   *struct {
+            Float32 float32
+            Float64 float64 `max:"1.5"`
+            Int8    int8    `min:"-10"`
+            Ints    []int   `key:"Int" delimiter:" "`
+            Uint16  uint16  `default:"7"`
+            Uint64  uint64
+        }
+        Debug    bool
+        Ports    []uint32 `default:"80, 443"`
+        Skipped  string   `key:"-"`
+        internal string
+    }
+
+    dir, err := ioutil.TempDir("", "bind")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    IniDir = dir
+    defer func() { IniDir = "./" }()
+
+    writeIni(t, filepath.Join(dir, "bind" + ext), testFixtures[ext].bind, 0)
+
+    provider := InitFileProvider("bind" + ext, 3)
+    if provider == nil {
+        t.Fatal("Ini file not loaded")
+    }
+
+    var target bindTarget
+    err = Bind("Bind", &target)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if target.Graphite.Addr != "127.0.0.1:2003" ||
+        target.Graphite.Interval != 30 * time.Second ||
+        len(target.Graphite.Stats) != 3 || target.Graphite.Stats[2] != "c" ||
+        !target.Debug ||
+        len(target.Ports) != 2 || target.Ports[1] != 443 ||
+        target.Skipped != "" {
+        t.Fatalf("Unexpected binding %+v", target)
+    }
+
+    limits := target.Limits
+    if limits.Float32 != 0.25 ||
+        limits.Float64 != 1.5 ||
+        limits.Int8 != -10 ||
+        len(limits.Ints) != 3 || limits.Ints[1] != 2 ||
+        limits.Uint16 != 7 ||
+        limits.Uint64 != 18446744073709551615 {
+        t.Fatalf("Unexpected binding %+v", *limits)
+    }
+
+    UnregisterConfigProvider(provider)
+    provider.Shutdown()
+
+    // every bad key is reported
+    writeIni(t, filepath.Join(dir, "invalid" + ext), testFixtures[ext].bindInvalid, 0)
+
+    invalid := InitFileProvider("invalid" + ext, 2)
+    if invalid == nil {
+        t.Fatal("Ini file not loaded")
+    }
+    defer invalid.Shutdown()
+    defer UnregisterConfigProvider(invalid)
+
+    err = Bind("Bind", &target)
+
+    bindErr, ok := err.(BindError)
+    if !ok {
+        t.Fatalf("Expected a BindError (%v)", err)
+    }
+
+    keys := []string {
+        "Bind.Graphite.SrvAddr",
+        "Bind.Graphite.SendInterval",
+        "Bind.Limits.Float64",
+        "Bind.Limits.Int8",
+        "Bind.Limits.Int",
+    }
+    if len(bindErr) != len(keys) {
+        t.Fatalf("Unexpected errors (%v)", bindErr)
+    }
+
+    for i := range keys {
+        if bindErr[i].Key != keys[i] {
+            t.Fatalf("Unexpected errors (%v)", bindErr)
+        }
+    }
+
+    t.Log(bindErr)
+
+    // self-referential sections aren't bound recursively
+    type bindList struct {
+        Next  *bindList
+        Stats []string `key:"Stat"`
+    }
+
+    var list bindList
+    err = Bind("Bind.Graphite", &list)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(list.Stats) != 1 || list.Next != nil {
+        t.Fatalf("Unexpected binding %+v", list)
+    }
+
+    // values outside their limits aren't stored
+    if target.Graphite.Interval != 30 * time.Second ||
+        target.Limits.Float64 != 1.5 {
+        t.Fatalf("Out of range values bound %+v %+v", target, *target.Limits)
+    }
+
+    if Bind("Bind", target) != ErrBindTarget {
+        t.Fatal("Non-pointer target accepted")
+    }
+}
+
+// TestFlagProvider validates that a FlagProvider parses config flags,
+// overrides other providers by priority, and lists known keys in its help.
+func TestFlagProvider(t *testing.T) {
+    dir, err := ioutil.TempDir("", "flags")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    IniDir = dir
+    defer func() { IniDir = "./" }()
+
+    writeIni(t, filepath.Join(dir, "flags.ini"), `[Flags]
+Addr = 127.0.0.1:2003
+Debug = false
+Unset = x
+`, 0)
+
+    ini := InitIniProvider("flags.ini", 3)
+    if ini == nil {
+        t.Fatal("Ini file not loaded")
+    }
+    defer ini.Shutdown()
+    defer UnregisterConfigProvider(ini)
+
+    flags := newFlagProvider([]string {
+        "--Flags.Debug",
+        "-v",
+        "--Flags.Addr=10.0.0.1:2003",
+        "--Flags.Stat=a,b",
+        "input.txt",
+        "--Flags.Stat=c",
+        "--NoSection=1",
+        "--help",
+        "--schema=app.schema",
+        "--",
+        "--Flags.After=1",
+    }, 4)
+
+    if !flags.HelpRequested() {
+        t.Fatal("Help flag not parsed")
+    }
+
+    if flags.SchemaPath() != "app.schema" {
+        t.Fatalf("Schema flag not parsed (%q)", flags.SchemaPath())
+    }
+
+    args := flags.Args()
+    if len(args) != 4 ||
+        args[0] != "-v" ||
+        args[1] != "input.txt" ||
+        args[2] != "--NoSection=1" ||
+        args[3] != "--Flags.After=1" {
+        t.Fatalf("Unexpected leftover args %v", args)
+    }
+
+    // lower priority than the ini file
+    RegisterConfigProvider(flags)
+
+    val, _ := GetVal("Flags.Addr", 0, "")
+    if val != "127.0.0.1:2003" {
+        t.Fatalf("Flag overrode a higher priority provider (%q)", val)
+    }
+
+    // higher priority, registered after the ini file
+    UnregisterConfigProvider(flags)
+    flags.priority = 0
+    RegisterConfigProvider(flags)
+    defer UnregisterConfigProvider(flags)
+
+    val, _ = GetVal("Flags.Addr", 0, "")
+    if val != "10.0.0.1:2003" {
+        t.Fatalf("Flag didn't override ini (%q)", val)
+    }
+
+    debug, _ := GetBoolVal("Flags.Debug", 0, false)
+    if !debug {
+        t.Fatal("Bare flag not set to true")
+    }
+
+    stats, _ := GetAllVals("Flags.Stat", "")
+    if len(stats) != 2 || stats[0] != "a,b" || stats[1] != "c" {
+        t.Fatalf("Repeated flags not merged (%v)", stats)
+    }
+
+    var help bytes.Buffer
+    flags.PrintHelp(&help)
+    t.Log(help.String())
+
+    expected := map[string][]string {
+        "--Flags.Addr"  : { "10.0.0.1:2003", "(FlagProvider)" },
+        "--Flags.Stat"  : { "a,b, c", "(FlagProvider)" },
+        "--Flags.Unset" : { "x", "(IniProvider.flags.ini)" },
+    }
+
+    for _, line := range strings.Split(help.String(), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 1 || expected[fields[0]] == nil {
+            continue
+        }
+
+        for _, text := range expected[fields[0]] {
+            if !strings.Contains(line, text) {
+                t.Fatalf("Help line %q missing %q", line, text)
+            }
+        }
+
+        delete(expected, fields[0])
+    }
+
+    if len(expected) > 0 {
+        t.Fatalf("Help missing keys %v", expected)
+    }
+}
+
+// TestReload validates that a file provider of each format reloads its file
+// when it changes, notifies subscribers of the changed keys, and keeps its
+// last good config when the file can't be parsed.
+func TestReload(t *testing.T) {
+    for _, ext := range testFormats {
+        t.Run(ext, func(t *testing.T) { testReload(t, ext) })
+    }
+}
+
+// testReload runs the reload tests against a file provider of the given
+// format.
+func testReload(t *testing.T, ext string) {
+    fixtures := testFixtures[ext]
+
+    dir, err := ioutil.TempDir("", "reload")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    IniDir    = dir
+    IniPollMs = 10
+    defer func() {
+        IniDir    = "./"
+        IniPollMs = DEFAULT_INI_POLL_MS
+    }()
+
+    path := filepath.Join(dir, "reload" + ext)
+    writeIni(t, path, fixtures.reloadBefore, 0)
+
+    provider := InitFileProvider("reload" + ext, 3)
+    if provider == nil {
+        t.Fatal("Ini file not loaded")
+    }
+    defer provider.Shutdown()
+    defer UnregisterConfigProvider(provider)
+
+    changeChan := make(chan []*ConfigChange, 1)
+    id         := Subscribe(func(p ConfigProvider, changes []*ConfigChange) {
+        if p == provider {
+            changeChan<- changes
+        }
+    })
+    defer Unsubscribe(id)
+
+    // edit the file
+    writeIni(t, path, fixtures.reloadAfter, 1)
+
+    var changes []*ConfigChange
+    select {
+    case changes = <-changeChan:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for reload")
+    }
+
+    if len(changes) != 3 ||
+        changes[0].Key != "Reload.added" || changes[0].Old != nil ||
+        changes[1].Key != "Reload.changed" ||
+        changes[1].Old[0].GetVal(1) != "b" ||
+        changes[1].New[0].GetVal(1) != "c" ||
+        changes[2].Key != "Reload.removed" || changes[2].New != nil {
+        t.Fatalf("Unexpected changes %+v", changes)
+    }
+
+    val, _ := GetVal("Reload.changed", 1, "")
+    if val != "c" {
+        t.Fatalf("Reloaded value not served (%q)", val)
+    }
+
+    // a malformed file keeps the last good config. Malformed ini lines are
+    // skipped rather than failing the parse, so ini files have no fixture
+    if fixtures.reloadBad == "" {
+        return
+    }
+
+    errs := provider.perfs.Value(PERF_CFG_FILE_RELOAD_ERRORS)
+    writeIni(t, path, fixtures.reloadBad, 2)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for provider.perfs.Value(PERF_CFG_FILE_RELOAD_ERRORS) == errs {
+        if time.Now().After(deadline) {
+            t.Fatal("Timed out waiting for reload error")
+        }
+
+        <-time.After(10 * time.Millisecond)
+    }
+
+    val, _ = GetVal("Reload.added", 0, "")
+    if val != "y" {
+        t.Fatalf("Last good config not kept (%q)", val)
+    }
+
+    select {
+    case changes = <-changeChan:
+        t.Fatalf("Subscribers notified of a failed reload (%+v)", changes)
+    default:
+    }
+}
+
+// TestSchema validates that a schema can be built from a tagged struct,
+// exported and imported, and that Validate reports unknown keys, invalid
+// values and missing required keys.
+func TestSchema(t *testing.T) {
+    defer clearSchema()
+
+    var target struct {
+        Schema struct {
+            Addr    string        `required:"true" desc:"Server address"`
+            Level   string        `enum:"debug, info"`
+            Port    uint16        `default:"2003" min:"1"`
+            Missing int           `required:"true"`
+            Timeout time.Duration `max:"1m"`
+            Tags    []string      `delimiter:" "`
+        }
+    }
+
+    schema, err := SchemaOf("", &target)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(schema) != 6 {
+        t.Fatalf("Expected 6 schema keys, got %d", len(schema))
+    }
+
+    expected := map[string]string {
+        "Schema.Addr"    : KEY_TYPE_STRING,
+        "Schema.Level"   : KEY_TYPE_STRING,
+        "Schema.Missing" : KEY_TYPE_INT,
+        "Schema.Port"    : KEY_TYPE_UINT,
+        "Schema.Tags"    : KEY_TYPE_STRING,
+        "Schema.Timeout" : KEY_TYPE_DURATION,
+    }
+
+    for _, key := range schema {
+        if expected[key.Key] != key.Type {
+            t.Fatalf("Key %v has type %q", key.Key, key.Type)
+        }
+    }
+
+    if !schema[0].Required || schema[0].Description != "Server address" {
+        t.Fatalf("Tags not read (%+v)", schema[0])
+    }
+
+    if !schema[5].Multi || schema[5].Delimiter != " " {
+        t.Fatalf("Slice not multi (%+v)", schema[5])
+    }
+
+    err = RegisterSchema(schema...)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // duplicates and invalid keys are rejected as a whole
+    err = RegisterSchema(
+        &KeySchema { Key : "Schema.Addr", Type : KEY_TYPE_STRING },
+        &KeySchema { Key : "Schema.Bad", Type : "complex" },
+        &KeySchema { Key : "Schema.Def", Type : KEY_TYPE_INT, Default : "x" },
+        &KeySchema { Key : "Schema.Ok", Type : KEY_TYPE_BOOL },
+    )
+    if err == nil || len(err.(SchemaError)) != 3 {
+        t.Fatalf("Expected 3 schema errors (%v)", err)
+    }
+
+    if getSchema("Schema.Ok") != nil {
+        t.Fatal("Failed registration added keys")
+    }
+
+    // round trip
+    var exported bytes.Buffer
+    err = ExportSchema(&exported)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    clearSchema()
+
+    err = ImportSchema(&exported)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(Schema()) != 6 || getSchema("Schema.Port").Min != "1" {
+        t.Fatalf("Schema not imported (%v)", Schema())
+    }
+
+    dir, err := ioutil.TempDir("", "schema")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    IniDir = dir
+    defer func() { IniDir = "./" }()
+
+    writeIni(t, filepath.Join(dir, "schema.ini"), `[Schema]
+Addr = 127.0.0.1
+Addr = 10.0.0.1
+Level = trace
+Port = 0
+Timeout = 2m
+Tags = a b c
+Unknown = 1
+`, 0)
+
+    ini := InitIniProvider("schema.ini", 5)
+    if ini == nil {
+        t.Fatal("Ini file not loaded")
+    }
+    defer ini.Shutdown()
+    defer UnregisterConfigProvider(ini)
+
+    err = ValidateProvider(ini)
+    if err == nil {
+        t.Fatal("Expected schema errors")
+    }
+
+    reasons := map[string]string {
+        "Schema.Addr"    : "Single value key has 2 values",
+        "Schema.Level"   : `Value "trace" not one of debug, info`,
+        "Schema.Port"    : `Value "0" below min 1`,
+        "Schema.Timeout" : `Value "2m" above max 1m`,
+        "Schema.Unknown" : "Unknown key",
+    }
+
+    for _, keyErr := range err.(SchemaError) {
+        t.Log(keyErr)
+
+        if keyErr.Provider != ini.Name() || reasons[keyErr.Key] != keyErr.Reason {
+            t.Fatalf("Unexpected schema error %v", keyErr)
+        }
+
+        delete(reasons, keyErr.Key)
+    }
+
+    if len(reasons) > 0 {
+        t.Fatalf("Missing schema errors %v", reasons)
+    }
+
+    err = Validate()
+    if err == nil {
+        t.Fatal("Expected schema errors")
+    }
+
+    missing := false
+    for _, keyErr := range err.(SchemaError) {
+        if keyErr.Key == "Schema.Missing" && keyErr.Provider == "" {
+            missing = true
+        }
+    }
+
+    if !missing {
+        t.Fatalf("Missing required key not reported (%v)", err)
+    }
+}
+
+// writeIni writes an ini file, and moves its modification time the given
+// number of seconds into the future, so that each write is seen as a change.
+func writeIni(t *testing.T, path, data string, offsetSec int) {
+    err := ioutil.WriteFile(path, []byte(data), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    modTime := time.Now().Add(time.Duration(offsetSec) * time.Second)
+
+    err = os.Chtimes(path, modTime, modTime)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
 //printConfig prints the value data retreived from the config system.
 func printConfig(key string, vals []string, parser ConfigProvider) {
     if vals == nil {
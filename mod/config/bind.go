@@ -0,0 +1,520 @@
+//  ---------------------------------------------------------------------------
+//
+//  bind.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/str"
+)
+
+// Stdlib imports.
+import(
+    "errors"
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Struct tags read by Bind.
+//  key       - key name, relative to the enclosing section ("-" to skip)
+//  default   - value used when the key isn't found
+//  required  - "true" if the key must be found
+//  min, max  - inclusive bounds for numbers and durations
+//  enum      - comma separated list of the allowed values
+//  delimiter - further splits each value of a slice field
+//  desc      - description of the key, used by SchemaOf
+const (
+    TAG_DEFAULT   = "default"
+    TAG_DELIMITER = "delimiter"
+    TAG_DESC      = "desc"
+    TAG_ENUM      = "enum"
+    TAG_KEY       = "key"
+    TAG_MAX       = "max"
+    TAG_MIN       = "min"
+    TAG_REQUIRED  = "required"
+)
+
+// Delimiter used to split the default values of slice fields which don't
+// specify one.
+const DEFAULT_BIND_DELIMITER = ","
+
+// Common error messages.
+var (
+    ErrBindTarget = errors.New("Bind target must be a non-nil struct pointer")
+    errMissingKey = errors.New("Required key not found")
+)
+
+// Type of time.Duration fields.
+var durationType = reflect.TypeOf(time.Duration(0))
+
+
+// Bind populates the exported fields of the struct pointed to by target from
+// the registered config providers. Each field is read from the key
+// <prefix>.<key>, where key is the field's key tag, or its name. Struct
+// fields are bound as nested sections, under <prefix>.<key>. Pointers to a
+// struct type which is already being bound, as in a linked list, are left
+// unchanged rather than bound recursively. Slice fields
+// take every value of every matching entry, while other fields take the
+// first value. Fields whose key isn't found, and which have no default,
+// are left unchanged.
+//
+// Bool, string, int, uint and float fields of any width are supported, as
+// are time.Duration fields, which are parsed with time.ParseDuration, and
+// slices of any of these. If any key is missing or invalid, a BindError
+// listing all of them is returned, and the valid keys are still bound.
+//  type GraphiteConfig struct {
+//      SrvAddr  string        `required:"true"`
+//      Interval time.Duration `key:"SendInterval" default:"60s" min:"1s"`
+//      Stats    []string      `delimiter:" "`
+//  }
+//
+//  err := config.Bind("Graphite", &graphiteCfg)
+func Bind(prefix string, target interface{}) error {
+    val := reflect.ValueOf(target)
+    if val.Kind() != reflect.Ptr ||
+        val.IsNil() ||
+        val.Elem().Kind() != reflect.Struct {
+        return ErrBindTarget
+    }
+
+    errs := make(BindError, 0)
+    bindStruct(prefix, val.Elem(), &errs, make(map[reflect.Type]bool))
+
+    if len(errs) > 0 {
+        return errs
+    }
+
+    return nil
+}
+
+// bindField populates a single, non-section field from the given key.
+func bindField(key string, field reflect.StructField, val reflect.Value) error {
+    vals := getBindVals(key, field.Tag.Get(TAG_DELIMITER))
+
+    // slices may be bound empty, but scalars need a value
+    missing := vals == nil || (len(vals) < 1 && val.Kind() != reflect.Slice)
+    if missing {
+        required, _ := strconv.ParseBool(field.Tag.Get(TAG_REQUIRED))
+        if required {
+            return errMissingKey
+        }
+
+        defaultVal, ok := field.Tag.Lookup(TAG_DEFAULT)
+        if !ok {
+            return nil
+        }
+
+        vals = []string { defaultVal }
+        if val.Kind() == reflect.Slice {
+            delim := field.Tag.Get(TAG_DELIMITER)
+            if delim == "" {
+                delim = DEFAULT_BIND_DELIMITER
+            }
+
+            vals = str.DelimToStrArray(defaultVal, delim)
+        }
+    }
+
+    if val.Kind() != reflect.Slice {
+        return setBindVal(val, vals[0], field)
+    }
+
+    slice := reflect.MakeSlice(val.Type(), 0, len(vals))
+    for i := range vals {
+        elem := reflect.New(val.Type().Elem()).Elem()
+
+        err := setBindVal(elem, vals[i], field)
+        if err != nil {
+            return errors.New(fmt.Sprintf("[%d] %v", i, err))
+        }
+
+        slice = reflect.Append(slice, elem)
+    }
+
+    val.Set(slice)
+
+    return nil
+}
+
+// bindStruct binds each exported field of a struct value under the given
+// section prefix, adding any failures to errs. Bound holds the struct types
+// being bound by the callers, so that self-referential types aren't
+// descended into forever.
+func bindStruct(
+    prefix string,
+    val    reflect.Value,
+    errs   *BindError,
+    bound  map[reflect.Type]bool,
+) {
+    typ := val.Type()
+
+    bound[typ] = true
+    defer delete(bound, typ)
+
+    for i := 0; i < typ.NumField(); i++ {
+        field := typ.Field(i)
+        if field.PkgPath != "" {
+            continue    // unexported
+        }
+
+        name := field.Tag.Get(TAG_KEY)
+        if name == "-" {
+            continue
+        }
+
+        if name == "" {
+            name = field.Name
+        }
+
+        key      := joinKey(prefix, name)
+        fieldVal := val.Field(i)
+
+        if isSection(field.Type) {
+            if fieldVal.Kind() == reflect.Ptr {
+                if bound[field.Type.Elem()] {
+                    continue
+                }
+
+                if fieldVal.IsNil() {
+                    fieldVal.Set(reflect.New(field.Type.Elem()))
+                }
+
+                fieldVal = fieldVal.Elem()
+            }
+
+            bindStruct(key, fieldVal, errs, bound)
+            continue
+        }
+
+        err := bindField(key, field, fieldVal)
+        if err != nil {
+            *errs = append(*errs, &KeyError {
+                Key    : key,
+                Reason : err.Error(),
+            })
+        }
+    }
+}
+
+// checkLimits validates a parsed value against inclusive min and max
+// bounds, and a list of allowed values. Empty bounds and lists aren't
+// checked.
+func checkLimits(
+    val  reflect.Value,
+    raw  string,
+    min  string,
+    max  string,
+    enum []string,
+) error {
+    if min != "" {
+        cmp, err := compareBindLimit(val, min)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Invalid min %q (%v)", min, err))
+        }
+
+        if cmp < 0 {
+            return errors.New(fmt.Sprintf("Value %q below min %v", raw, min))
+        }
+    }
+
+    if max != "" {
+        cmp, err := compareBindLimit(val, max)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Invalid max %q (%v)", max, err))
+        }
+
+        if cmp > 0 {
+            return errors.New(fmt.Sprintf("Value %q above max %v", raw, max))
+        }
+    }
+
+    if len(enum) < 1 {
+        return nil
+    }
+
+    for i := range enum {
+        if raw == enum[i] {
+            return nil
+        }
+    }
+
+    return errors.New(fmt.Sprintf(
+        "Value %q not one of %s",
+        raw,
+        strings.Join(enum, ", "),
+    ))
+}
+
+// compareBindLimit returns -1, 0 or 1 as a bound value is less than, equal
+// to, or greater than the given limit, which is parsed as the value's type.
+func compareBindLimit(val reflect.Value, limit string) (int, error) {
+    var a, b float64
+
+    switch {
+    case val.Type() == durationType:
+        d, err := time.ParseDuration(limit)
+        if err != nil {
+            return 0, err
+        }
+        a, b = float64(val.Int()), float64(d)
+    case isIntKind(val.Kind()):
+        l, err := strconv.ParseInt(limit, 10, 64)
+        if err != nil {
+            return 0, err
+        }
+        return compareInt64(val.Int(), l), nil
+    case isUintKind(val.Kind()):
+        l, err := strconv.ParseUint(limit, 10, 64)
+        if err != nil {
+            return 0, err
+        }
+        return compareUint64(val.Uint(), l), nil
+    case val.Kind() == reflect.Float32 || val.Kind() == reflect.Float64:
+        l, err := strconv.ParseFloat(limit, 64)
+        if err != nil {
+            return 0, err
+        }
+        a, b = val.Float(), l
+    default:
+        return 0, errors.New("Not supported for " + val.Type().String())
+    }
+
+    switch {
+    case a < b:
+        return -1, nil
+    case a > b:
+        return 1, nil
+    }
+
+    return 0, nil
+}
+
+// compareInt64 returns -1, 0 or 1 as a is less than, equal to, or greater
+// than b.
+func compareInt64(a, b int64) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+
+    return 0
+}
+
+// compareUint64 returns -1, 0 or 1 as a is less than, equal to, or greater
+// than b.
+func compareUint64(a, b uint64) int {
+    switch {
+    case a < b:
+        return -1
+    case a > b:
+        return 1
+    }
+
+    return 0
+}
+
+// getBindVals returns every value of every entry matching the given key,
+// splitting each by delim if one is given, or nil if no entries match.
+func getBindVals(key, delim string) []string {
+    entries := GetEntries(key)
+    if entries == nil {
+        return nil
+    }
+
+    vals := make([]string, 0)
+    for _, entry := range entries {
+        for _, val := range entry.GetAllVals() {
+            if delim == "" {
+                vals = append(vals, val)
+                continue
+            }
+
+            vals = append(vals, str.DelimToStrArray(val, delim)...)
+        }
+    }
+
+    return vals
+}
+
+// isIntKind returns true for the signed integer kinds.
+func isIntKind(kind reflect.Kind) bool {
+    switch kind {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return true
+    }
+
+    return false
+}
+
+// isSection returns true if fields of the given type are bound as nested
+// sections.
+func isSection(typ reflect.Type) bool {
+    if typ.Kind() == reflect.Ptr {
+        typ = typ.Elem()
+    }
+
+    return typ.Kind() == reflect.Struct
+}
+
+// isUintKind returns true for the unsigned integer kinds.
+func isUintKind(kind reflect.Kind) bool {
+    switch kind {
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return true
+    }
+
+    return false
+}
+
+// joinKey appends a key name to a section prefix.
+func joinKey(prefix, name string) string {
+    if prefix == "" {
+        return name
+    }
+
+    return prefix + "." + name
+}
+
+// parseBindVal parses a raw config value as the type of val, and stores
+// it.
+func parseBindVal(val reflect.Value, raw string) error {
+    var err error
+
+    kind := val.Kind()
+
+    switch {
+    case val.Type() == durationType:
+        var d time.Duration
+        d, err = time.ParseDuration(raw)
+        if err == nil {
+            val.SetInt(int64(d))
+        }
+    case kind == reflect.Bool:
+        var b bool
+        b, err = strconv.ParseBool(raw)
+        if err == nil {
+            val.SetBool(b)
+        }
+    case isIntKind(kind):
+        var i int64
+        i, err = strconv.ParseInt(raw, 10, val.Type().Bits())
+        if err == nil {
+            val.SetInt(i)
+        }
+    case isUintKind(kind):
+        var u uint64
+        u, err = strconv.ParseUint(raw, 10, val.Type().Bits())
+        if err == nil {
+            val.SetUint(u)
+        }
+    case kind == reflect.Float32 || kind == reflect.Float64:
+        var f float64
+        f, err = strconv.ParseFloat(raw, val.Type().Bits())
+        if err == nil {
+            val.SetFloat(f)
+        }
+    case kind == reflect.String:
+        val.SetString(raw)
+    default:
+        return errors.New("Unsupported field type " + val.Type().String())
+    }
+
+    if err != nil {
+        return errors.New(fmt.Sprintf(
+            "Invalid %v value %q",
+            val.Type(),
+            raw,
+        ))
+    }
+
+    return nil
+}
+
+// setBindVal parses a raw config value as the type of val, checks it
+// against the field's min, max and enum tags, and stores it. Values which
+// fail either step leave val unchanged.
+func setBindVal(val reflect.Value, raw string, field reflect.StructField) error {
+    parsed := reflect.New(val.Type()).Elem()
+
+    err := parseBindVal(parsed, raw)
+    if err != nil {
+        return err
+    }
+
+    err = checkLimits(
+        parsed,
+        raw,
+        field.Tag.Get(TAG_MIN),
+        field.Tag.Get(TAG_MAX),
+        tagList(field.Tag.Get(TAG_ENUM)),
+    )
+    if err != nil {
+        return err
+    }
+
+    val.Set(parsed)
+
+    return nil
+}
+
+// tagList splits a comma separated tag value into a list, or returns nil
+// for an empty tag.
+func tagList(tag string) []string {
+    if tag == "" {
+        return nil
+    }
+
+    return str.DelimToStrArray(tag, ",")
+}
+
+
+// BindError is returned by Bind, and lists every key which couldn't be
+// bound.
+type BindError []*KeyError
+
+// Error returns every failed key and its reason on one line.
+func (this BindError) Error() string {
+    reasons := make([]string, len(this))
+    for i := range this {
+        reasons[i] = this[i].Error()
+    }
+
+    return fmt.Sprintf(
+        "Unable to bind %d config keys: %s",
+        len(this),
+        strings.Join(reasons, "; "),
+    )
+}
+
+// KeyError describes a single key which couldn't be bound, or which failed
+// schema validation. Provider names the config provider holding the key,
+// when the problem is specific to one.
+type KeyError struct {
+    Key      string
+    Provider string
+    Reason   string
+}
+
+// Error returns the provider, if any, the key, and the reason it couldn't
+// be bound or validated.
+func (this *KeyError) Error() string {
+    if this.Provider != "" {
+        return fmt.Sprintf("%v: %v: %v", this.Provider, this.Key, this.Reason)
+    }
+
+    return fmt.Sprintf("%v: %v", this.Key, this.Reason)
+}
@@ -12,8 +12,13 @@
 
 // Package config presents a unified, hierarchical interface for retreiving
 // configuration options from any registered providers. The package includes
-// builtin providers for retrieving config settings from the environment and
-// ini formatted config files.
+// builtin providers for retrieving config settings from the environment, the
+// command line, and ini, json, toml or yaml formatted config files. Every
+// file format is flattened into the same <Section>.<Key> names. Files are
+// reloaded as they change, and callbacks registered with Subscribe are told
+// which keys changed. Bind populates a tagged struct from the registered
+// providers in one call. Apps can register a schema of their known keys,
+// against which Validate checks every registered provider.
 package config
 
 // External imports.
@@ -322,26 +327,22 @@ func RegisterConfigProvider(provider ConfigProvider) {
     mutex.Lock()
     defer mutex.Unlock()
 
-    if priList.Len() < 1 {
-        e := priList.PushFront(provider)
-        providerMap[provider.Name()] = e
-    } else {
-        for i := priList.Front(); i != nil; i = i.Next() {
-            if i.Next() == nil  {
-                e := priList.InsertAfter(provider, i)
-                providerMap[provider.Name()] = e
-                break
-            }
-
-            next := i.Next().Value.(ConfigProvider)
-            if next.Priority() >= provider.Priority() {
-                e := priList.InsertAfter(provider, i)
-                providerMap[provider.Name()] = e
-                break
-            }
+    var e *list.Element
+
+    for i := priList.Front(); i != nil; i = i.Next() {
+        cur := i.Value.(ConfigProvider)
+        if cur.Priority() >= provider.Priority() {
+            e = priList.InsertBefore(provider, i)
+            break
         }
     }
 
+    if e == nil {
+        e = priList.PushBack(provider)
+    }
+
+    providerMap[provider.Name()] = e
+
     cfgPerfs.Increment(PERF_CFG_PROVIDER_REGISTERED)
 
     log.Info("ConfigProvider %v registered", provider.Name())
@@ -0,0 +1,465 @@
+//  ---------------------------------------------------------------------------
+//
+//  fileprovider.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/fs"
+    "github.com/xaevman/goat/lib/lifecycle"
+    "github.com/xaevman/goat/lib/perf"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import(
+    "bufio"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Perf counters.
+const (
+    PERF_CFG_FILE_PRIORITY = iota
+    PERF_CFG_FILE_QUERIES
+    PERF_CFG_FILE_RELOAD_ERRORS
+    PERF_CFG_FILE_RELOADS
+    PERF_CFG_FILE_COUNT
+)
+
+// Perf counter friendly names.
+var cfgFilePerfNames = []string {
+    "Priority",
+    "Queries",
+    "ReloadErrors",
+    "Reloads",
+}
+
+// The base directory from which the file paths of all file providers will
+// be built. Defaults to the directory of the primary executable.
+var IniDir = filepath.Dir(fs.ExeFile())
+
+// The interval, in milliseconds, at which file providers check their files
+// for changes. Providers created while IniPollMs is zero never reload.
+var IniPollMs = DEFAULT_INI_POLL_MS
+
+// When IniStrict is set, a malformed ini line fails the load of the file,
+// rather than being logged and skipped. It applies to providers created
+// while it is set, for both their first load and later reloads.
+var IniStrict = false
+
+// Default file change polling interval.
+const DEFAULT_INI_POLL_MS = 1000
+
+// Supported config file formats, by file extension.
+var fileFormats = map[string]*fileFormat {
+    ".ini"  : &iniFormat,
+    ".json" : &jsonFormat,
+    ".toml" : &tomlFormat,
+    ".yaml" : &yamlFormat,
+    ".yml"  : &yamlFormat,
+}
+
+// InitFileProvider initializes a new file provider for the given path,
+// choosing its format by the file's extension: .ini, .json, .toml, .yaml
+// or .yml. See InitIniProvider, InitJsonProvider, InitTomlProvider and
+// InitYamlProvider. nil is returned for files of any other extension.
+func InitFileProvider(path string, pri int) *FileProvider {
+    format, ok := fileFormats[strings.ToLower(filepath.Ext(path))]
+    if !ok {
+        log.Error("Unknown config file format %v", path)
+        return nil
+    }
+
+    return initFileProvider(path, pri, format)
+}
+
+// initFileProvider initializes a new file provider for the given path and
+// format, registers it with the config service, and returns a pointer to
+// the object for direct use, if required. The file is polled for changes
+// every IniPollMs milliseconds, and reloaded when it changes.
+func initFileProvider(path string, pri int, format *fileFormat) *FileProvider {
+    fullPath     := filepath.Join(IniDir, path)
+    exists, info := fs.FileExists(fullPath)
+
+    if !exists{
+        log.Error("Config file doesn't exist %v", fullPath)
+        return nil
+    }
+
+    if info.IsDir() {
+        log.Error("Config path points to a directory (%v)", fullPath)
+        return nil
+    }
+
+    fileName     := filepath.Base(fullPath)
+    name         := fmt.Sprintf("%v.%v", format.modName, fileName)
+    fileProvider := FileProvider {
+        entries    : make(map[string][]*ConfigEntry, 0),
+        filePath   : fullPath,
+        format     : format,
+        moduleName : name,
+        perfs      : perf.NewCounterSet(
+            "Module.Config." + name,
+            PERF_CFG_FILE_COUNT,
+            cfgFilePerfNames,
+        ),
+        priority   : pri,
+        strict     : IniStrict,
+    }
+
+    entries, err := fileProvider.parseConfig()
+    if err != nil {
+        log.Error("Unable to open config file %v (%v)", fullPath, err)
+        return nil
+    }
+
+    fileProvider.entries = entries
+    fileProvider.modTime = info.ModTime()
+    fileProvider.size    = info.Size()
+
+    fileProvider.perfs.Set(PERF_CFG_FILE_PRIORITY, int64(pri))
+
+    RegisterConfigProvider(&fileProvider)
+
+    if IniPollMs > 0 {
+        fileProvider.syncObj = lifecycle.New()
+        go fileProvider.watch(IniPollMs)
+    }
+
+    return &fileProvider
+}
+
+
+// FileProvider represents a ConfigProvider implementation which can query
+// a config file for config entries. Whatever the file's format, ConfigEntry
+// names follow the format <Section>.<Key>, with nested sections separated
+// by dots.
+type FileProvider struct {
+    entries    map[string][]*ConfigEntry
+    filePath   string
+    format     *fileFormat
+    modTime    time.Time
+    moduleName string
+    mutex      sync.RWMutex
+    perfs      *perf.CounterSet
+    priority   int
+    size       int64
+    strict     bool
+    syncObj    *lifecycle.Lifecycle
+}
+
+// GetEntriesByKey returns all entries within the config file which match
+// the queried key name. ConfigEntry names follow the format
+// <Section>.<Key> .
+func (this *FileProvider) GetEntriesByKey(name string) []*ConfigEntry {
+    this.mutex.RLock()
+    list := this.entries[name]
+    this.mutex.RUnlock()
+
+    if list == nil {
+        return nil
+    }
+
+    results := make([]*ConfigEntry, 0)
+
+    for _, v := range list {
+        results = append(results, v)
+    }
+
+    this.perfs.Increment(PERF_CFG_FILE_QUERIES)
+
+    return results
+}
+
+// GetFirstEntryByKey returns the first entry within the config file which
+// matches the queried key name. ConfigEntry names follow the format
+// <Section>.<Key> .
+func (this *FileProvider) GetFirstEntryByKey(name string) *ConfigEntry {
+    entries := this.GetEntriesByKey(name)
+    if entries == nil || len(entries) < 1 {
+        return nil
+    }
+
+    this.perfs.Increment(PERF_CFG_FILE_QUERIES)
+
+    return entries[0]
+}
+
+// Keys returns the names of every key in the config file, sorted.
+func (this *FileProvider) Keys() []string {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    keys := make([]string, 0, len(this.entries))
+    for key := range this.entries {
+        keys = append(keys, key)
+    }
+
+    sort.Strings(keys)
+
+    return keys
+}
+
+// Name returns the name of this config module, which is the name of its
+// format's provider, followed by the file name. For example,
+// "IniProvider.gograph.ini".
+func (this *FileProvider) Name() string {
+    return this.moduleName
+}
+
+// Priority returns the assigned priority for this FileProvider object.
+func (this *FileProvider) Priority() int {
+    return this.priority
+}
+
+// Reload re-parses the config file and, if it parses cleanly, swaps in its
+// entries and notifies subscribers of any keys which changed. On error, the
+// previous entries are kept. Keys which fail the registered schema are
+// logged, but don't prevent the reload.
+func (this *FileProvider) Reload() error {
+    entries, err := this.parseConfig()
+    if err != nil {
+        this.perfs.Increment(PERF_CFG_FILE_RELOAD_ERRORS)
+        log.Error(
+            "Unable to reload config file %v, keeping last good config (%v)",
+            this.filePath,
+            err,
+        )
+        return err
+    }
+
+    this.mutex.Lock()
+    old         := this.entries
+    this.entries = entries
+    this.mutex.Unlock()
+
+    this.perfs.Increment(PERF_CFG_FILE_RELOADS)
+
+    changes := diffEntries(old, entries)
+    log.Info("%v reloaded (%d keys changed)", this.moduleName, len(changes))
+
+    err = ValidateProvider(this)
+    if err != nil {
+        log.Error("Reloaded config file %v fails schema (%v)", this.filePath, err)
+    }
+
+    if len(changes) > 0 {
+        notifyChanges(this, changes)
+    }
+
+    return nil
+}
+
+// Shutdown stops watching the config file for changes.
+func (this *FileProvider) Shutdown() {
+    if this.syncObj != nil {
+        this.syncObj.Shutdown()
+    }
+}
+
+// addEntry adds a new ConfigEntry holding the given values to a map of
+// entries, after any entries already held for the same key.
+func (this *FileProvider) addEntry(
+    entries map[string][]*ConfigEntry,
+    key     string,
+    vals    []string,
+) {
+    cfgEntry := ConfigEntry {
+        key    : key,
+        parser : this,
+        vals   : vals,
+    }
+
+    entries[key] = append(entries[key], &cfgEntry)
+    log.Debug(
+        "%v:%v:%v",
+        len(entries),
+        len(entries[key]),
+        &cfgEntry,
+    )
+}
+
+// addTree flattens a tree of decoded config data into entries. Nested maps
+// become dotted key names, lists of values become the values of a single
+// entry, and maps within lists are each flattened under the list's key, so
+// that their keys can repeat, as keys can in ini files. Scalars are kept as
+// strings, and nulls become entries without values.
+func (this *FileProvider) addTree(
+    entries map[string][]*ConfigEntry,
+    key     string,
+    node    interface{},
+) error {
+    switch val := node.(type) {
+    case map[string]interface{}:
+        for name, child := range val {
+            if name == "" {
+                return errors.New(fmt.Sprintf("Empty key name in %q", key))
+            }
+
+            err := this.addTree(entries, joinKey(key, name), child)
+            if err != nil {
+                return err
+            }
+        }
+    case []interface{}:
+        if key == "" {
+            return errors.New("Top level must be a map of keys")
+        }
+
+        vals := make([]string, 0, len(val))
+        for i := range val {
+            _, isMap := val[i].(map[string]interface{})
+            if !isMap {
+                vals = appendTreeVals(vals, val[i])
+                continue
+            }
+
+            err := this.addTree(entries, key, val[i])
+            if err != nil {
+                return err
+            }
+        }
+
+        if len(vals) > 0 || len(val) < 1 {
+            this.addEntry(entries, key, vals)
+        }
+    default:
+        if key == "" {
+            return errors.New("Top level must be a map of keys")
+        }
+
+        this.addEntry(entries, key, appendTreeVals(make([]string, 0, 1), val))
+    }
+
+    return nil
+}
+
+// parseConfig opens the provider's config file and parses it with the
+// provider's format into a new map of ConfigEntries, which is returned. An
+// error is returned if the file can't be read or parsed.
+func (this *FileProvider) parseConfig() (map[string][]*ConfigEntry, error) {
+    file, err := fs.OpenFile(this.filePath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    entries := make(map[string][]*ConfigEntry, 0)
+
+    err = this.format.parse(this, bufio.NewReader(file), entries)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("%v:%v", this.filePath, err))
+    }
+
+    return entries, nil
+}
+
+// watch runs in its own goroutine, polling the config file's modification
+// time and size every pollMs milliseconds, until the provider is shut down.
+// The file is reloaded once either has changed, and then held steady for a
+// full poll, so that files caught part way through being written aren't
+// loaded. Empty files are ignored for the same reason.
+func (this *FileProvider) watch(pollMs int) {
+    var pendingSize int64
+    var pendingTime time.Time
+
+    missing := false
+    pending := false
+
+    for this.syncObj.QueryRun() {
+        select {
+        case <-time.After(time.Duration(pollMs) * time.Millisecond):
+            info, err := os.Stat(this.filePath)
+            if err != nil {
+                if !missing {
+                    log.Error(
+                        "Unable to stat config file %v, keeping last good config (%v)",
+                        this.filePath,
+                        err,
+                    )
+                }
+                missing = true
+                continue
+            }
+
+            missing = false
+
+            // empty files are most likely being rewritten in place
+            if info.Size() < 1 ||
+                info.ModTime().Equal(this.modTime) && info.Size() == this.size {
+                pending = false
+                continue
+            }
+
+            steady := pending &&
+                info.ModTime().Equal(pendingTime) &&
+                info.Size() == pendingSize
+
+            if !steady {
+                pending     = true
+                pendingSize = info.Size()
+                pendingTime = info.ModTime()
+                continue
+            }
+
+            pending      = false
+            this.modTime = info.ModTime()
+            this.size    = info.Size()
+
+            this.Reload()
+        case <-this.syncObj.QueryShutdown():
+        }
+    }
+
+    this.syncObj.ShutdownComplete()
+}
+
+
+// fileFormat describes a config file format: the name of its providers,
+// and a function which parses a file into a map of entries. Parse errors
+// should be prefixed with the line number they occurred on.
+type fileFormat struct {
+    modName string
+    parse   func(
+        provider *FileProvider,
+        reader   *bufio.Reader,
+        entries  map[string][]*ConfigEntry,
+    ) error
+}
+
+// appendTreeVals appends the string form of a decoded scalar, or of every
+// scalar in a decoded list, to vals.
+func appendTreeVals(vals []string, node interface{}) []string {
+    switch val := node.(type) {
+    case nil:
+    case []interface{}:
+        for i := range val {
+            vals = appendTreeVals(vals, val[i])
+        }
+    default:
+        vals = append(vals, fmt.Sprintf("%v", val))
+    }
+
+    return vals
+}
+
+// lineError prefixes an error message with the line it occurred on.
+func lineError(lineNum int, format string, args ...interface{}) error {
+    return errors.New(fmt.Sprintf("%d: ", lineNum) + fmt.Sprintf(format, args...))
+}
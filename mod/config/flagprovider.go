@@ -0,0 +1,351 @@
+//  ---------------------------------------------------------------------------
+//
+//  flagprovider.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/perf"
+)
+
+// Stdlib imports.
+import(
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "text/tabwriter"
+)
+
+// Perf counters.
+const (
+    PERF_CFG_FLAG_PRIORITY = iota
+    PERF_CFG_FLAG_QUERIES
+    PERF_CFG_FLAG_COUNT
+)
+
+// Perf counter friendly names.
+var cfgFlagPerfNames = []string {
+    "Priority",
+    "Queries",
+}
+
+// Flag provider module name.
+const FLAG_MOD_NAME = "FlagProvider"
+
+// Prefix of the flag which requests the app's config schema.
+const SCHEMA_FLAG = "--schema="
+
+// Static instance and synchronization.
+var flagMutex    sync.Mutex
+var flagProvider *FlagProvider
+
+// InitFlagProvider initializes a FlagProvider config provider from the
+// command line arguments in os.Args, registers it with the config services
+// at the given priority, and returns a pointer to the object for direct use,
+// if required. The arguments are only parsed once; later calls move the
+// provider to the new priority.
+func InitFlagProvider(pri int) *FlagProvider {
+    flagMutex.Lock()
+    defer flagMutex.Unlock()
+
+    if flagProvider == nil {
+        flagProvider = newFlagProvider(os.Args[1:], pri)
+        RegisterConfigProvider(flagProvider)
+        return flagProvider
+    }
+
+    if pri == flagProvider.Priority() {
+        return flagProvider
+    }
+
+    UnregisterConfigProvider(flagProvider)
+    flagProvider.priority = pri
+
+    flagProvider.perfs.Set(PERF_CFG_FLAG_PRIORITY, int64(pri))
+
+    RegisterConfigProvider(flagProvider)
+
+    return flagProvider
+}
+
+// newFlagProvider returns a new, unregistered FlagProvider holding the
+// config flags parsed from the given arguments.
+func newFlagProvider(args []string, pri int) *FlagProvider {
+    newProvider := FlagProvider {
+        args       : make([]string, 0),
+        entries    : make(map[string]*ConfigEntry),
+        moduleName : FLAG_MOD_NAME,
+        perfs      : perf.NewCounterSet(
+            "Module.Config." + FLAG_MOD_NAME,
+            PERF_CFG_FLAG_COUNT,
+            cfgFlagPerfNames,
+        ),
+        priority   : pri,
+    }
+
+    newProvider.perfs.Set(PERF_CFG_FLAG_PRIORITY, int64(pri))
+    newProvider.parseArgs(args)
+
+    return &newProvider
+}
+
+// FlagProvider represents a ConfigProvider implementation which reads
+// config entries from command line flags of the form --<Section>.<Key>=value.
+// A flag without a value is set to "true". Repeating a flag gives its key
+// multiple values, in the order they were given. Values are taken as-is,
+// and aren't split on commas. A --schema=<file> flag requests that the
+// app's config schema be written to the given file. Arguments which aren't
+// config flags, and everything after a "--" argument, are left for the
+// application, and returned by Args.
+//  myapp --System.DebugLogs --Stats.SysctlStat=kern.maxfiles --Stats.SysctlStat=kern.openfiles
+type FlagProvider struct {
+    args       []string
+    entries    map[string]*ConfigEntry
+    help       bool
+    moduleName string
+    perfs      *perf.CounterSet
+    priority   int
+    schemaPath string
+}
+
+// Args returns the command line arguments which weren't config flags, in
+// their original order.
+func (this *FlagProvider) Args() []string {
+    return this.args
+}
+
+// GetEntriesByKey returns the entry set by the flags matching the queried
+// key name, if any. Only one entry will ever be returned from this call,
+// since repeated flags add values to a single entry.
+func (this *FlagProvider) GetEntriesByKey(name string) []*ConfigEntry {
+    entry := this.GetFirstEntryByKey(name)
+    if entry == nil {
+        return nil
+    }
+
+    return []*ConfigEntry { entry }
+}
+
+// GetFirstEntryByKey returns the entry set by the flags matching the queried
+// key name, or nil if no such flag was given.
+func (this *FlagProvider) GetFirstEntryByKey(name string) *ConfigEntry {
+    entry, ok := this.entries[name]
+    if !ok {
+        return nil
+    }
+
+    this.perfs.Increment(PERF_CFG_FLAG_QUERIES)
+
+    return entry
+}
+
+// HelpRequested returns true if a -h, -help or --help flag was given.
+func (this *FlagProvider) HelpRequested() bool {
+    return this.help
+}
+
+// Keys returns the names of every key set by the command line, sorted.
+func (this *FlagProvider) Keys() []string {
+    keys := make([]string, 0, len(this.entries))
+    for key := range this.entries {
+        keys = append(keys, key)
+    }
+
+    sort.Strings(keys)
+
+    return keys
+}
+
+// Name returns "FlagProvider", the name of this config module.
+func (this *FlagProvider) Name() string {
+    return this.moduleName
+}
+
+// PrintHelp writes usage information for the command line config flags to
+// w, listing every key known to the registered config providers or schema,
+// along with its current values and the provider they came from, or its
+// schema default, and its schema description.
+func (this *FlagProvider) PrintHelp(w io.Writer) {
+    fmt.Fprintf(
+        w,
+        "Usage: %s [--Section.Key[=value] ...] [args]\n\n" +
+        "Config keys given on the command line override their values from\n" +
+        "other config providers. Repeat a flag to set multiple values.\n" +
+        "Use --schema=<file> to write the app's config schema as json.\n\n",
+        filepath.Base(os.Args[0]),
+    )
+
+    keys := knownKeys()
+    if len(keys) < 1 {
+        fmt.Fprintln(w, "No config keys known.")
+        return
+    }
+
+    fmt.Fprintln(w, "Known keys:")
+
+    tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+    for _, key := range keys {
+        vals   := make([]string, 0)
+        source := "default"
+        desc   := ""
+
+        keySchema := getSchema(key)
+        if keySchema != nil {
+            vals = append(vals, keySchema.Default)
+            desc = keySchema.Description
+        }
+
+        entries := GetEntries(key)
+        if entries != nil {
+            vals   = make([]string, 0)
+            source = entries[0].Parser().Name()
+
+            for _, entry := range entries {
+                vals = append(vals, entry.GetAllVals()...)
+            }
+        } else if keySchema == nil {
+            continue
+        }
+
+        fmt.Fprintf(
+            tw,
+            "  --%s\t%s\t(%s)\t%s\n",
+            key,
+            strings.Join(vals, ", "),
+            source,
+            desc,
+        )
+    }
+
+    tw.Flush()
+}
+
+// Priority returns the assigned priority for this FlagProvider object.
+func (this *FlagProvider) Priority() int {
+    return this.priority
+}
+
+// SchemaPath returns the file given by a --schema=<file> flag, or an empty
+// string if the schema wasn't requested.
+func (this *FlagProvider) SchemaPath() string {
+    return this.schemaPath
+}
+
+// Unused in this module.
+func (this *FlagProvider) Shutdown() {}
+
+// parseArgs sorts the given command line arguments into config entries, a
+// help or schema request, and arguments left for the application.
+func (this *FlagProvider) parseArgs(args []string) {
+    for i, arg := range args {
+        if arg == "--" {
+            this.args = append(this.args, args[i+1:]...)
+            return
+        }
+
+        switch arg {
+        case "-h", "-help", "--help":
+            this.help = true
+            continue
+        }
+
+        if strings.HasPrefix(arg, SCHEMA_FLAG) && len(arg) > len(SCHEMA_FLAG) {
+            this.schemaPath = arg[len(SCHEMA_FLAG):]
+            continue
+        }
+
+        key, val, ok := parseFlag(arg)
+        if !ok {
+            this.args = append(this.args, arg)
+            continue
+        }
+
+        entry, exists := this.entries[key]
+        if !exists {
+            entry = &ConfigEntry {
+                key    : key,
+                parser : this,
+                vals   : make([]string, 0, 1),
+            }
+            this.entries[key] = entry
+        }
+
+        entry.vals = append(entry.vals, val)
+    }
+}
+
+
+// keyLister is implemented by config providers which can list the keys
+// they hold.
+type keyLister interface {
+    Keys() []string
+}
+
+// knownKeys returns the sorted, distinct names of every key in the
+// registered schema, or held by the registered config providers which can
+// list them.
+func knownKeys() []string {
+    keyMap := make(map[string]bool)
+    for _, keySchema := range Schema() {
+        keyMap[keySchema.Key] = true
+    }
+
+    mutex.Lock()
+
+    for i := priList.Front(); i != nil; i = i.Next() {
+        lister, ok := i.Value.(keyLister)
+        if !ok {
+            continue
+        }
+
+        for _, key := range lister.Keys() {
+            keyMap[key] = true
+        }
+    }
+
+    mutex.Unlock()
+
+    keys := make([]string, 0, len(keyMap))
+    for key := range keyMap {
+        keys = append(keys, key)
+    }
+
+    sort.Strings(keys)
+
+    return keys
+}
+
+// parseFlag splits a --<Section>.<Key>[=value] argument into its key and
+// value. ok is false for arguments which aren't config flags.
+func parseFlag(arg string) (key, val string, ok bool) {
+    if !strings.HasPrefix(arg, "--") {
+        return "", "", false
+    }
+
+    pair := strings.SplitN(arg[2:], "=", 2)
+    key   = pair[0]
+
+    dot := strings.Index(key, ".")
+    if dot < 1 || strings.HasSuffix(key, ".") {
+        return "", "", false
+    }
+
+    if len(pair) < 2 {
+        return key, "true", true
+    }
+
+    return key, pair[1], true
+}
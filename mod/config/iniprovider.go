@@ -14,8 +14,6 @@ package config
 
 // External imports.
 import (
-    "github.com/xaevman/goat/lib/fs"
-    "github.com/xaevman/goat/lib/perf"
     "github.com/xaevman/goat/lib/str"
     "github.com/xaevman/goat/mod/log"
 )
@@ -23,132 +21,106 @@ import (
 // Stdlib imports.
 import(
     "bufio"
+    "errors"
     "fmt"
-    "path/filepath"
+    "io"
     "regexp"
     "strings"
 )
 
-// Perf counters.
-const (
-    PERF_CFG_INI_PRIORITY = iota
-    PERF_CFG_INI_QUERIES
-    PERF_CFG_INI_COUNT
-)
-
-// Perf counter friendly names.
-var cfgIniPerfNames = []string {
-    "Priority",
-    "Queries",
-}
-
-// The base directory from which all supplied file paths will be built.
-// Defaults to the directory of the primary executable.
-var IniDir = filepath.Dir(fs.ExeFile())
-
 // Ini provider module name
 const INI_MOD_NAME = "IniProvider"
 
-// InitIniProvider initializes a new IniProvider config provider for the
-// give path, registers it with the conig service, and returns a 
-// pointer to the object for direct use, if required.
-func InitIniProvider(path string, pri int) *IniProvider {
-    fullPath     := filepath.Join(IniDir, path)
-    exists, info := fs.FileExists(fullPath)
+// IniProvider is the FileProvider used for ini files, and is kept as an
+// alias of FileProvider for existing code.
+type IniProvider = FileProvider
 
-    if !exists{
-        log.Error("Config file doesn't exist %v", fullPath)
-        return nil
-    }
+// Ini file format.
+var iniFormat = fileFormat {
+    modName : INI_MOD_NAME,
+    parse   : parseIni,
+}
 
-    if info.IsDir() {
-        log.Error("Config path points to a directory (%v)", fullPath)
-        return nil
-    }
+// InitIniProvider initializes a new ini file provider for the given path,
+// registers it with the config service, and returns a pointer to the object
+// for direct use, if required. The file is polled for changes every
+// IniPollMs milliseconds, and reloaded when it changes.
+func InitIniProvider(path string, pri int) *IniProvider {
+    return initFileProvider(path, pri, &iniFormat)
+}
 
-    fileName    := filepath.Base(fullPath)
-    name        := fmt.Sprintf("%v.%v", INI_MOD_NAME, fileName)
-    iniProvider := IniProvider {
-        entries    : make(map[string][]*ConfigEntry, 0),
-        filePath   : fullPath,
-        moduleName : name,
-        perfs      : perf.NewCounterSet(
-            "Module.Config." + name,
-            PERF_CFG_INI_COUNT,
-            cfgIniPerfNames,
-        ),
-        priority   : pri,
-    }
+// newIniEntry takes a section name and an ini-style config line, formats
+// it as a ConfigEntry object, and adds it to the given map of ConfigEntries.
+// Values may contain '=', but lines without one, or without a key name, are
+// rejected.
+func newIniEntry(
+    provider *FileProvider,
+    entries  map[string][]*ConfigEntry,
+    section  string,
+    line     string,
+) error {
+    line = trimCommentText(line)
 
-    err := iniProvider.parseConfig()
-    if err != nil {
-        log.Error("Unable to open ini file %v (%v)", fullPath, err)
-        return nil
+    pair := strings.SplitN(line, "=", 2)
+    if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+        return errors.New(fmt.Sprintf("Malformed line %q", line))
     }
 
-    iniProvider.perfs.Set(PERF_CFG_INI_PRIORITY, int64(pri))
-
-    RegisterConfigProvider(&iniProvider)
+    keyName := fmt.Sprintf("%v.%v", section, strings.TrimSpace(pair[0]))
+    valList := str.DelimToStrArray(pair[1], ",")
 
-    return &iniProvider
-}
+    provider.addEntry(entries, keyName, valList)
 
-// IniProvider represents a ConfigProvider implementation which can query
-// a given ini-formatted config file for config entries.
-type IniProvider struct {
-    entries    map[string][]*ConfigEntry
-    filePath   string
-    moduleName string
-    perfs      *perf.CounterSet
-    priority   int
+    return nil
 }
 
-// GetEntriesByKey returns all entries within the ini file which match
-// the queried key name. ConfigEntry names follow the format
-// <Section>.<Key> .
-func (this *IniProvider) GetEntriesByKey(name string) []*ConfigEntry {
-    list    := this.entries[name]
-    if list == nil {
-        return nil
-    }
-
-    results := make([]*ConfigEntry, 0)
+// parseIni parses an ini-formatted config file into the given map of
+// ConfigEntries. Each key = value line becomes an entry named
+// <Section>.<Key>, whose values are split on commas. Keys may repeat.
+// Malformed lines are logged and skipped, both when a file is first loaded
+// and when it is reloaded, unless the provider was created with IniStrict
+// set, in which case they fail the parse.
+func parseIni(
+    provider *FileProvider,
+    reader   *bufio.Reader,
+    entries  map[string][]*ConfigEntry,
+) error {
+    var section string
 
-    for _, v := range list {
-        results = append(results, v)
-    }
+    for lineNum := 1; ; lineNum++ {
+        line, readErr := reader.ReadString('\n')
+        if readErr != nil && readErr != io.EOF {
+            return readErr
+        }
 
-    this.perfs.Increment(PERF_CFG_INI_QUERIES)
+        line = strings.TrimSpace(line)
 
-    return results
-}
+        isSection, name := isSectionLine(line)
+        if isSection {
+            section = name
+        } else if !isCommentLine(line) {
+            err := newIniEntry(provider, entries, section, line)
+            if err != nil && provider.strict {
+                return lineError(lineNum, "%v", err)
+            }
+
+            if err != nil {
+                log.Error(
+                    "%v:%v. Skipping line",
+                    provider.filePath,
+                    lineError(lineNum, "%v", err),
+                )
+            }
+        }
 
-// GetFirstEntryByKey returns the first entry within the ini file which matches
-// the queried key name. ConfigEntry names follow the format <Section>.<Key> .
-func (this *IniProvider) GetFirstEntryByKey(name string) *ConfigEntry {
-    entries := this.GetEntriesByKey(name)
-    if entries == nil || len(entries) < 1 {
-        return nil
+        if readErr == io.EOF {
+            break
+        }
     }
 
-    this.perfs.Increment(PERF_CFG_INI_QUERIES)
-
-    return entries[0]
-}
-
-// Name returns "IniProvider", the name of this config module.
-func (this *IniProvider) Name() string {
-    return this.moduleName
-}
-
-// Priority returns the assigned priority for this EnvParser object.
-func (this *IniProvider) Priority() int {
-    return this.priority
+    return nil
 }
 
-// Unused.
-func (this *IniProvider) Shutdown() {}
-
 // IsIniCommentLine tests whether or not a given string is an ini-style
 // comment line.
 func isCommentLine(line string) bool {
@@ -177,72 +149,6 @@ func isSectionLine(line string) (bool, string) {
     return true, strings.TrimSpace(result[1])
 }
 
-// newEntry takes a section name and an ini-style config line, formats
-// it as a ConfigEntry object, and adds it to the list of ConfigEntries
-// associated with this parser.
-func (this *IniProvider) newEntry(section, line string) {
-    line = trimCommentText(line)
-
-    pair := strings.Split(line, "=")
-    if len(pair) != 2 {
-        return
-    }
-
-    keyName := fmt.Sprintf("%v.%v", section, strings.TrimSpace(pair[0]))
-    valList := str.DelimToStrArray(pair[1], ",")
-
-    cfgEntry := ConfigEntry {
-        key: keyName,
-        parser: this,
-        vals: valList,
-    }
-
-    this.entries[cfgEntry.key] = append(this.entries[cfgEntry.key], &cfgEntry)
-    log.Debug(
-        "%v:%v:%v", 
-        len(this.entries),
-        len(this.entries[cfgEntry.key]), 
-        &cfgEntry,
-    )
-}
-
-// parseConfig opens a given ini config file and Marshals it into an IniProvider
-// object representation.
-func (this *IniProvider) parseConfig() error {
-    file, err := fs.OpenFile(this.filePath)
-    if err != nil {
-        return err
-    }
-    defer file.Close()
-
-    var section string
-
-    reader := bufio.NewReader(file)
-
-    for {
-        line, err := reader.ReadString('\n')
-        if err != nil {
-            break   // eof
-        }
-
-        line = strings.TrimSpace(line)
-
-        if isCommentLine(line) {
-            continue
-        }
-
-        isSection, line := isSectionLine(line)
-        if isSection {
-            section = line
-            continue
-        }
-
-        this.newEntry(section, line)
-    }
-
-    return nil
-}
-
 // TrimIniCommentText trims any comment text out of a given string.
 //  key1 = val1 ;this text will be trimmed in resulting string
 func trimCommentText(line string) string {
@@ -0,0 +1,99 @@
+//  ---------------------------------------------------------------------------
+//
+//  jsonprovider.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// Stdlib imports.
+import(
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+)
+
+// Json provider module name.
+const JSON_MOD_NAME = "JsonProvider"
+
+// Json file format.
+var jsonFormat = fileFormat {
+    modName : JSON_MOD_NAME,
+    parse   : parseJson,
+}
+
+// InitJsonProvider initializes a new json file provider for the given path,
+// registers it with the config service, and returns a pointer to the object
+// for direct use, if required. The file must hold a single object, whose
+// nested objects are flattened into dotted key names, so that
+//  { "Graphite" : { "SrvAddr" : "127.0.0.1:2003", "Stats" : [ "a", "b" ] } }
+// holds the keys Graphite.SrvAddr, with one value, and Graphite.Stats, with
+// two. Objects within arrays are each flattened under the array's key, so
+// that keys can repeat, as they can in ini files.
+func InitJsonProvider(path string, pri int) *FileProvider {
+    return initFileProvider(path, pri, &jsonFormat)
+}
+
+// parseJson parses a json-formatted config file into the given map of
+// ConfigEntries.
+func parseJson(
+    provider *FileProvider,
+    reader   *bufio.Reader,
+    entries  map[string][]*ConfigEntry,
+) error {
+    data, err := ioutil.ReadAll(reader)
+    if err != nil {
+        return err
+    }
+
+    var tree interface{}
+
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+
+    err = decoder.Decode(&tree)
+    if err != nil {
+        return lineError(jsonErrorLine(data, err), "%v", err)
+    }
+
+    if decoder.More() {
+        offset := int(decoder.InputOffset())
+        return lineError(jsonLine(data, offset), "Unexpected data after object")
+    }
+
+    _, ok := tree.(map[string]interface{})
+    if !ok {
+        return lineError(1, "Top level must be an object")
+    }
+
+    return provider.addTree(entries, "", tree)
+}
+
+// jsonErrorLine returns the line of a json decoding error, or 1 if the
+// error doesn't give an offset.
+func jsonErrorLine(data []byte, err error) int {
+    switch jsonErr := err.(type) {
+    case *json.SyntaxError:
+        return jsonLine(data, int(jsonErr.Offset))
+    case *json.UnmarshalTypeError:
+        return jsonLine(data, int(jsonErr.Offset))
+    }
+
+    return 1
+}
+
+// jsonLine returns the line number of the given byte offset into data.
+func jsonLine(data []byte, offset int) int {
+    if offset > len(data) {
+        offset = len(data)
+    }
+
+    return bytes.Count(data[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,173 @@
+//  ---------------------------------------------------------------------------
+//
+//  notify.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import(
+    "sort"
+    "sync"
+)
+
+// Subscription map and synchronization.
+var (
+    subId    uint32
+    subMap   = make(map[uint32]ChangeHandler)
+    subMutex sync.Mutex
+)
+
+
+// ChangeHandler is the signature of the callbacks registered with Subscribe.
+// The provider which reloaded is passed along with the keys which changed,
+// sorted by name.
+type ChangeHandler func(provider ConfigProvider, changes []*ConfigChange)
+
+// ConfigChange describes a key whose entries changed when a provider
+// reloaded. Old is nil for keys which were added, and New is nil for keys
+// which were removed.
+type ConfigChange struct {
+    Key string
+    New []*ConfigEntry
+    Old []*ConfigEntry
+}
+
+// Subscribe registers a callback to be notified whenever a provider reloads
+// and some of its keys have changed. Callbacks are called from the
+// reloading provider's watcher goroutine, after its new entries are in
+// place. The returned id can be passed to Unsubscribe.
+func Subscribe(handler ChangeHandler) uint32 {
+    subMutex.Lock()
+    defer subMutex.Unlock()
+
+    subId++
+    subMap[subId] = handler
+
+    return subId
+}
+
+// Unsubscribe removes the callback registered with the given subscription
+// id.
+func Unsubscribe(id uint32) {
+    subMutex.Lock()
+    defer subMutex.Unlock()
+
+    delete(subMap, id)
+}
+
+// diffEntries compares two versions of a provider's entries, returning the
+// keys which were added, removed, or whose values changed, sorted by name.
+func diffEntries(old, new map[string][]*ConfigEntry) []*ConfigChange {
+    changes := make([]*ConfigChange, 0)
+
+    for key, oldList := range old {
+        newList := new[key]
+        if !entriesEqual(oldList, newList) {
+            changes = append(changes, &ConfigChange {
+                Key : key,
+                New : newList,
+                Old : oldList,
+            })
+        }
+    }
+
+    for key, newList := range new {
+        _, ok := old[key]
+        if !ok {
+            changes = append(changes, &ConfigChange {
+                Key : key,
+                New : newList,
+            })
+        }
+    }
+
+    sort.Sort(changeList(changes))
+
+    return changes
+}
+
+// entriesEqual returns true if two lists of entries hold the same values, in
+// the same order.
+func entriesEqual(a, b []*ConfigEntry) bool {
+    if len(a) != len(b) {
+        return false
+    }
+
+    for i := range a {
+        if len(a[i].vals) != len(b[i].vals) {
+            return false
+        }
+
+        for j := range a[i].vals {
+            if a[i].vals[j] != b[i].vals[j] {
+                return false
+            }
+        }
+    }
+
+    return true
+}
+
+// notifyChanges passes a provider's changes to every subscribed callback.
+// Callbacks which panic are logged, and don't prevent the others from being
+// called.
+func notifyChanges(provider ConfigProvider, changes []*ConfigChange) {
+    subMutex.Lock()
+    handlers := make([]ChangeHandler, 0, len(subMap))
+    for _, handler := range subMap {
+        handlers = append(handlers, handler)
+    }
+    subMutex.Unlock()
+
+    for i := range handlers {
+        callHandler(handlers[i], provider, changes)
+    }
+}
+
+// callHandler calls a single subscribed callback, recovering from panics.
+func callHandler(
+    handler  ChangeHandler,
+    provider ConfigProvider,
+    changes  []*ConfigChange,
+) {
+    defer func() {
+        r := recover()
+        if r != nil {
+            log.Error("Config change handler panic (%v)", r)
+        }
+    }()
+
+    handler(provider, changes)
+}
+
+
+// changeList sorts ConfigChanges by key.
+type changeList []*ConfigChange
+
+// Len returns the number of changes in the list.
+func (this changeList) Len() int {
+    return len(this)
+}
+
+// Less orders changes by key.
+func (this changeList) Less(i, j int) bool {
+    return this[i].Key < this[j].Key
+}
+
+// Swap swaps two changes in the list.
+func (this changeList) Swap(i, j int) {
+    this[i], this[j] = this[j], this[i]
+}
@@ -0,0 +1,536 @@
+//  ---------------------------------------------------------------------------
+//
+//  schema.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/str"
+)
+
+// Stdlib imports.
+import(
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Schema key types.
+const (
+    KEY_TYPE_BOOL     = "bool"
+    KEY_TYPE_DURATION = "duration"
+    KEY_TYPE_FLOAT    = "float"
+    KEY_TYPE_INT      = "int"
+    KEY_TYPE_STRING   = "string"
+    KEY_TYPE_UINT     = "uint"
+)
+
+// Types which values of each schema key type are parsed as.
+var keyTypes = map[string]reflect.Type {
+    KEY_TYPE_BOOL     : reflect.TypeOf(false),
+    KEY_TYPE_DURATION : durationType,
+    KEY_TYPE_FLOAT    : reflect.TypeOf(float64(0)),
+    KEY_TYPE_INT      : reflect.TypeOf(int64(0)),
+    KEY_TYPE_STRING   : reflect.TypeOf(""),
+    KEY_TYPE_UINT     : reflect.TypeOf(uint64(0)),
+}
+
+// Registered schema and synchronization.
+var (
+    schemaMap   = make(map[string]*KeySchema)
+    schemaMutex sync.RWMutex
+)
+
+
+// KeySchema describes a known config key. Key is the full <Section>.<Key>
+// name, and Type one of the KEY_TYPE constants. Default is documentation
+// only; Bind, or the caller's getter, applies the actual default. Min and
+// Max are inclusive bounds for numeric and duration keys, and Enum lists
+// the allowed values. Empty fields aren't checked. Keys which aren't Multi
+// may only have a single value. If Delimiter is set, each value is further
+// split by it before being checked, as Bind does for slices.
+type KeySchema struct {
+    Key         string
+    Type        string
+    Default     string
+    Delimiter   string
+    Description string
+    Enum        []string
+    Max         string
+    Min         string
+    Multi       bool
+    Required    bool
+}
+
+// ExportSchema writes the registered schema to w, as json, sorted by key.
+// The result can be loaded with ImportSchema.
+func ExportSchema(w io.Writer) error {
+    data, err := json.MarshalIndent(Schema(), "", "    ")
+    if err != nil {
+        return err
+    }
+
+    _, err = w.Write(append(data, '\n'))
+
+    return err
+}
+
+// ImportSchema reads a schema written by ExportSchema from r, and registers
+// it.
+func ImportSchema(r io.Reader) error {
+    keys := make([]*KeySchema, 0)
+
+    err := json.NewDecoder(r).Decode(&keys)
+    if err != nil {
+        return errors.New(fmt.Sprintf("Invalid schema (%v)", err))
+    }
+
+    return RegisterSchema(keys...)
+}
+
+// RegisterSchema adds the given keys to the schema of known config keys.
+// Once any keys are registered, Validate reports keys which aren't in the
+// schema. An error is returned, and no keys are registered, if any key is
+// already registered, or has an invalid type, default, bound or enum.
+func RegisterSchema(keys ...*KeySchema) error {
+    schemaMutex.Lock()
+    defer schemaMutex.Unlock()
+
+    errs := make(SchemaError, 0)
+    seen := make(map[string]bool)
+
+    for _, key := range keys {
+        _, exists := schemaMap[key.Key]
+        if exists || seen[key.Key] {
+            errs = append(errs, &KeyError {
+                Key    : key.Key,
+                Reason : "Already registered",
+            })
+            continue
+        }
+
+        seen[key.Key] = true
+
+        err := key.check()
+        if err != nil {
+            errs = append(errs, &KeyError {
+                Key    : key.Key,
+                Reason : err.Error(),
+            })
+        }
+    }
+
+    if len(errs) > 0 {
+        return errs
+    }
+
+    for _, key := range keys {
+        schemaMap[key.Key] = key
+    }
+
+    return nil
+}
+
+// Schema returns the registered schema, sorted by key.
+func Schema() []*KeySchema {
+    schemaMutex.RLock()
+    defer schemaMutex.RUnlock()
+
+    keys := make([]*KeySchema, 0, len(schemaMap))
+    for _, key := range schemaMap {
+        keys = append(keys, key)
+    }
+
+    sort.Sort(schemaList(keys))
+
+    return keys
+}
+
+// SchemaOf returns the schema of the keys which Bind would populate in the
+// struct pointed to by target, read from its field types and struct tags.
+// Slice fields are Multi, and the desc tag holds each key's description.
+//  schema, err := config.SchemaOf("Graphite", &graphiteCfg)
+//  if err == nil {
+//      err = config.RegisterSchema(schema...)
+//  }
+func SchemaOf(prefix string, target interface{}) ([]*KeySchema, error) {
+    typ := reflect.TypeOf(target)
+    if typ == nil ||
+        typ.Kind() != reflect.Ptr ||
+        typ.Elem().Kind() != reflect.Struct {
+        return nil, ErrBindTarget
+    }
+
+    keys := make([]*KeySchema, 0)
+    errs := make(SchemaError, 0)
+
+    schemaStruct(prefix, typ.Elem(), &keys, &errs)
+
+    if len(errs) > 0 {
+        return nil, errs
+    }
+
+    return keys, nil
+}
+
+// Validate checks every registered config provider against the registered
+// schema, and returns a SchemaError listing every unknown key, invalid
+// value, and missing required key, or nil if there are none. Providers
+// which can't list their keys, like the EnvProvider, are only checked for
+// the keys in the schema. Nothing is checked until a schema is registered.
+func Validate() error {
+    schema := Schema()
+    if len(schema) < 1 {
+        return nil
+    }
+
+    mutex.Lock()
+    providers := make([]ConfigProvider, 0, priList.Len())
+    for i := priList.Front(); i != nil; i = i.Next() {
+        providers = append(providers, i.Value.(ConfigProvider))
+    }
+    mutex.Unlock()
+
+    errs := make(SchemaError, 0)
+    for _, provider := range providers {
+        errs = append(errs, validateProvider(provider, schema)...)
+    }
+
+    for _, key := range schema {
+        if key.Required && GetEntries(key.Key) == nil {
+            errs = append(errs, &KeyError {
+                Key    : key.Key,
+                Reason : errMissingKey.Error(),
+            })
+        }
+    }
+
+    if len(errs) > 0 {
+        return errs
+    }
+
+    return nil
+}
+
+// ValidateProvider checks a single config provider against the registered
+// schema, as Validate does, except that required keys aren't checked, since
+// they may be set by another provider.
+func ValidateProvider(provider ConfigProvider) error {
+    schema := Schema()
+    if len(schema) < 1 {
+        return nil
+    }
+
+    errs := validateProvider(provider, schema)
+    if len(errs) > 0 {
+        return errs
+    }
+
+    return nil
+}
+
+// clearSchema removes every key from the registered schema.
+func clearSchema() {
+    schemaMutex.Lock()
+    defer schemaMutex.Unlock()
+
+    schemaMap = make(map[string]*KeySchema)
+}
+
+// getSchema returns the registered schema of the given key, or nil if it
+// isn't registered.
+func getSchema(key string) *KeySchema {
+    schemaMutex.RLock()
+    defer schemaMutex.RUnlock()
+
+    return schemaMap[key]
+}
+
+// keyTypeOf returns the schema type of fields of the given type.
+func keyTypeOf(typ reflect.Type) (string, error) {
+    switch {
+    case typ == durationType:
+        return KEY_TYPE_DURATION, nil
+    case typ.Kind() == reflect.Bool:
+        return KEY_TYPE_BOOL, nil
+    case isIntKind(typ.Kind()):
+        return KEY_TYPE_INT, nil
+    case isUintKind(typ.Kind()):
+        return KEY_TYPE_UINT, nil
+    case typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64:
+        return KEY_TYPE_FLOAT, nil
+    case typ.Kind() == reflect.String:
+        return KEY_TYPE_STRING, nil
+    }
+
+    return "", errors.New("Unsupported field type " + typ.String())
+}
+
+// schemaStruct adds the schema of each exported field of a struct type
+// under the given section prefix to keys, adding any failures to errs.
+func schemaStruct(
+    prefix string,
+    typ    reflect.Type,
+    keys   *[]*KeySchema,
+    errs   *SchemaError,
+) {
+    for i := 0; i < typ.NumField(); i++ {
+        field := typ.Field(i)
+        if field.PkgPath != "" {
+            continue    // unexported
+        }
+
+        name := field.Tag.Get(TAG_KEY)
+        if name == "-" {
+            continue
+        }
+
+        if name == "" {
+            name = field.Name
+        }
+
+        key := joinKey(prefix, name)
+
+        if isSection(field.Type) {
+            fieldType := field.Type
+            if fieldType.Kind() == reflect.Ptr {
+                fieldType = fieldType.Elem()
+            }
+
+            schemaStruct(key, fieldType, keys, errs)
+            continue
+        }
+
+        fieldType := field.Type
+        if fieldType.Kind() == reflect.Slice {
+            fieldType = fieldType.Elem()
+        }
+
+        keyType, err := keyTypeOf(fieldType)
+        if err != nil {
+            *errs = append(*errs, &KeyError {
+                Key    : key,
+                Reason : err.Error(),
+            })
+            continue
+        }
+
+        required, _ := strconv.ParseBool(field.Tag.Get(TAG_REQUIRED))
+
+        *keys = append(*keys, &KeySchema {
+            Key         : key,
+            Type        : keyType,
+            Default     : field.Tag.Get(TAG_DEFAULT),
+            Delimiter   : field.Tag.Get(TAG_DELIMITER),
+            Description : field.Tag.Get(TAG_DESC),
+            Enum        : tagList(field.Tag.Get(TAG_ENUM)),
+            Max         : field.Tag.Get(TAG_MAX),
+            Min         : field.Tag.Get(TAG_MIN),
+            Multi       : field.Type.Kind() == reflect.Slice,
+            Required    : required,
+        })
+    }
+}
+
+// validateProvider checks the keys held by a config provider against the
+// given schema.
+func validateProvider(provider ConfigProvider, schema []*KeySchema) SchemaError {
+    errs := make(SchemaError, 0)
+
+    addErr := func(key, reason string) {
+        errs = append(errs, &KeyError {
+            Key      : key,
+            Provider : provider.Name(),
+            Reason   : reason,
+        })
+    }
+
+    lister, ok := provider.(keyLister)
+    if ok {
+        for _, key := range lister.Keys() {
+            keySchema := getSchema(key)
+            if keySchema == nil {
+                addErr(key, "Unknown key")
+                continue
+            }
+
+            for _, reason := range keySchema.checkEntries(provider.GetEntriesByKey(key)) {
+                addErr(key, reason)
+            }
+        }
+
+        return errs
+    }
+
+    for _, keySchema := range schema {
+        entries := provider.GetEntriesByKey(keySchema.Key)
+        if entries == nil {
+            continue
+        }
+
+        for _, reason := range keySchema.checkEntries(entries) {
+            addErr(keySchema.Key, reason)
+        }
+    }
+
+    return errs
+}
+
+
+// check validates the schema itself: its type, and that its default, bounds
+// and enum values are of that type.
+func (this *KeySchema) check() error {
+    if this.Key == "" {
+        return errors.New("Empty key name")
+    }
+
+    typ, ok := keyTypes[this.Type]
+    if !ok {
+        return errors.New(fmt.Sprintf("Unknown type %q", this.Type))
+    }
+
+    for _, limit := range []string { this.Min, this.Max } {
+        if limit == "" {
+            continue
+        }
+
+        _, err := compareBindLimit(reflect.New(typ).Elem(), limit)
+        if err != nil {
+            return errors.New(fmt.Sprintf("Invalid bound %q (%v)", limit, err))
+        }
+    }
+
+    for _, val := range this.Enum {
+        err := parseBindVal(reflect.New(typ).Elem(), val)
+        if err != nil {
+            return errors.New("Invalid enum value: " + err.Error())
+        }
+    }
+
+    if this.Default == "" {
+        return nil
+    }
+
+    defaults := []string { this.Default }
+    if this.Multi {
+        delim := this.Delimiter
+        if delim == "" {
+            delim = DEFAULT_BIND_DELIMITER
+        }
+
+        defaults = str.DelimToStrArray(this.Default, delim)
+    }
+
+    for _, val := range defaults {
+        err := this.checkVal(val)
+        if err != nil {
+            return errors.New("Invalid default: " + err.Error())
+        }
+    }
+
+    return nil
+}
+
+// checkEntries returns the reasons, if any, that a key's entries don't
+// match its schema.
+func (this *KeySchema) checkEntries(entries []*ConfigEntry) []string {
+    reasons := make([]string, 0)
+
+    vals := make([]string, 0)
+    for _, entry := range entries {
+        for _, val := range entry.GetAllVals() {
+            if this.Delimiter == "" {
+                vals = append(vals, val)
+                continue
+            }
+
+            vals = append(vals, str.DelimToStrArray(val, this.Delimiter)...)
+        }
+    }
+
+    if !this.Multi && (len(entries) > 1 || len(vals) > 1) {
+        reasons = append(reasons, fmt.Sprintf(
+            "Single value key has %d values",
+            len(vals),
+        ))
+    }
+
+    if this.Required && len(vals) < 1 {
+        reasons = append(reasons, "Required key has no value")
+    }
+
+    for _, val := range vals {
+        err := this.checkVal(val)
+        if err != nil {
+            reasons = append(reasons, err.Error())
+        }
+    }
+
+    return reasons
+}
+
+// checkVal parses a single value as the schema's type, and checks it
+// against the schema's bounds and enum.
+func (this *KeySchema) checkVal(raw string) error {
+    val := reflect.New(keyTypes[this.Type]).Elem()
+
+    err := parseBindVal(val, raw)
+    if err != nil {
+        return errors.New(fmt.Sprintf("Invalid %s value %q", this.Type, raw))
+    }
+
+    return checkLimits(val, raw, this.Min, this.Max, this.Enum)
+}
+
+
+// SchemaError is returned by Validate, ValidateProvider, RegisterSchema and
+// SchemaOf, and lists every key which failed.
+type SchemaError []*KeyError
+
+// Error returns every failed key and its reason on one line.
+func (this SchemaError) Error() string {
+    reasons := make([]string, len(this))
+    for i := range this {
+        reasons[i] = this[i].Error()
+    }
+
+    return fmt.Sprintf(
+        "%d config schema errors: %s",
+        len(this),
+        strings.Join(reasons, "; "),
+    )
+}
+
+
+// schemaList sorts KeySchemas by key.
+type schemaList []*KeySchema
+
+// Len returns the number of keys in the list.
+func (this schemaList) Len() int {
+    return len(this)
+}
+
+// Less orders keys by name.
+func (this schemaList) Less(i, j int) bool {
+    return this[i].Key < this[j].Key
+}
+
+// Swap swaps two keys in the list.
+func (this schemaList) Swap(i, j int) {
+    this[i], this[j] = this[j], this[i]
+}
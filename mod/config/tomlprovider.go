@@ -0,0 +1,648 @@
+//  ---------------------------------------------------------------------------
+//
+//  tomlprovider.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// Stdlib imports.
+import(
+    "bufio"
+    "io/ioutil"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Toml provider module name.
+const TOML_MOD_NAME = "TomlProvider"
+
+// Toml file format.
+var tomlFormat = fileFormat {
+    modName : TOML_MOD_NAME,
+    parse   : parseToml,
+}
+
+// Formats of toml bare keys, numbers and dates.
+var (
+    tomlBareKeyExp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+    tomlDateExp    = regexp.MustCompile("^\\d{4}-\\d{2}-\\d{2}$")
+    tomlNumberExp  = regexp.MustCompile(
+        "^[+-]?(inf|nan|0x[0-9A-Fa-f_]+|0o[0-7_]+|0b[01_]+|" +
+        "[0-9_]+(\\.[0-9_]+)?([eE][+-]?[0-9_]+)?)$",
+    )
+    tomlTimeExp    = regexp.MustCompile("^[0-9:.TZtz+-]+$")
+)
+
+// Toml string escapes, other than unicode escapes.
+var tomlEscapes = map[byte]string {
+    'b'  : "\b",
+    'f'  : "\f",
+    'n'  : "\n",
+    'r'  : "\r",
+    't'  : "\t",
+    '"'  : "\"",
+    '\\' : "\\",
+}
+
+// InitTomlProvider initializes a new toml file provider for the given path,
+// registers it with the config service, and returns a pointer to the object
+// for direct use, if required. Tables and dotted keys are flattened into
+// dotted key names, so that
+//  [Graphite]
+//  SrvAddr = "127.0.0.1:2003"
+// holds the key Graphite.SrvAddr. Arrays become the values of a single
+// entry, and each table of an array of tables ([[Section]]) is flattened
+// under the array's key, so that keys can repeat, as they can in ini files.
+// Numbers, booleans and dates are kept as written, less any underscores in
+// numbers.
+func InitTomlProvider(path string, pri int) *FileProvider {
+    return initFileProvider(path, pri, &tomlFormat)
+}
+
+// parseToml parses a toml-formatted config file into the given map of
+// ConfigEntries.
+func parseToml(
+    provider *FileProvider,
+    reader   *bufio.Reader,
+    entries  map[string][]*ConfigEntry,
+) error {
+    data, err := ioutil.ReadAll(reader)
+    if err != nil {
+        return err
+    }
+
+    parser := tomlParser {
+        data    : string(data),
+        defined : make(map[string]bool),
+        line    : 1,
+        root    : make(map[string]interface{}),
+    }
+
+    err = parser.parseDocument()
+    if err != nil {
+        return err
+    }
+
+    return provider.addTree(entries, "", parser.root)
+}
+
+
+// tomlParser builds a tree of maps, lists and strings from a toml document.
+type tomlParser struct {
+    current map[string]interface{}
+    data    string
+    defined map[string]bool
+    line    int
+    pos     int
+    root    map[string]interface{}
+}
+
+// errorf returns an error prefixed with the current line number.
+func (this *tomlParser) errorf(format string, args ...interface{}) error {
+    return lineError(this.line, format, args...)
+}
+
+// advance moves past the next n bytes, counting lines.
+func (this *tomlParser) advance(n int) {
+    this.line += strings.Count(this.data[this.pos:this.pos+n], "\n")
+    this.pos  += n
+}
+
+// done returns true at the end of the document.
+func (this *tomlParser) done() bool {
+    return this.pos >= len(this.data)
+}
+
+// endLine skips trailing whitespace and a comment, and expects the end of
+// the line.
+func (this *tomlParser) endLine() error {
+    this.skipSpace()
+    this.skipComment()
+
+    switch {
+    case this.done():
+        return nil
+    case this.peek("\r\n"):
+        this.advance(2)
+        return nil
+    case this.peek("\n"):
+        this.advance(1)
+        return nil
+    }
+
+    return this.errorf("Unexpected text %q", this.rest())
+}
+
+// parseArray parses an array value. Arrays may span lines, and contain
+// comments and a trailing comma.
+func (this *tomlParser) parseArray() (interface{}, error) {
+    result := make([]interface{}, 0)
+
+    this.advance(1)
+    for {
+        this.skipSpaceLines()
+        if this.done() {
+            return nil, this.errorf("Unterminated array")
+        }
+
+        if this.peek("]") {
+            this.advance(1)
+            return result, nil
+        }
+
+        val, err := this.parseValue()
+        if err != nil {
+            return nil, err
+        }
+
+        result = append(result, val)
+
+        this.skipSpaceLines()
+        switch {
+        case this.peek(","):
+            this.advance(1)
+        case !this.peek("]"):
+            return nil, this.errorf("Expected , or ] in array")
+        }
+    }
+}
+
+// parseBareValue parses a boolean, number or date.
+func (this *tomlParser) parseBareValue() (interface{}, error) {
+    end := strings.IndexAny(this.rest(), " \t\r\n,]}#")
+    if end < 0 {
+        end = len(this.rest())
+    }
+
+    token := this.rest()[:end]
+
+    // a date may be followed by a time, after a space
+    if tomlDateExp.MatchString(token) && end + 1 < len(this.rest()) &&
+        this.rest()[end] == ' ' && isDigit(this.rest()[end+1]) {
+        timeEnd := strings.IndexAny(this.rest()[end+1:], " \t\r\n,]}#")
+        if timeEnd < 0 {
+            timeEnd = len(this.rest()) - end - 1
+        }
+
+        end   = end + 1 + timeEnd
+        token = this.rest()[:end]
+    }
+
+    switch {
+    case token == "true" || token == "false":
+    case tomlNumberExp.MatchString(token):
+        token = strings.Replace(token, "_", "", -1)
+    case len(token) > 2 && isDigit(token[0]) && tomlTimeExp.MatchString(
+        strings.Replace(token, " ", "T", 1),
+    ):
+    default:
+        return nil, this.errorf("Invalid value %q", token)
+    }
+
+    this.advance(end)
+
+    return token, nil
+}
+
+// parseBasicString parses a double quoted string, including its escapes.
+// Multi-line strings trim a newline following their opening quotes, and
+// line ending backslashes.
+func (this *tomlParser) parseBasicString(multiLine bool) (string, error) {
+    quote := "\""
+    if multiLine {
+        quote = "\"\"\""
+        this.advance(3)
+        this.skipNewline()
+    } else {
+        this.advance(1)
+    }
+
+    var text []byte
+    for {
+        if this.done() {
+            return "", this.errorf("Unterminated string")
+        }
+
+        if this.peek(quote) {
+            this.advance(len(quote))
+            return string(text), nil
+        }
+
+        c := this.data[this.pos]
+        switch {
+        case c == '\n' && !multiLine:
+            return "", this.errorf("Unterminated string")
+        case c == '\\':
+            val, err := this.parseEscape(multiLine)
+            if err != nil {
+                return "", err
+            }
+
+            text = append(text, val...)
+        default:
+            text = append(text, c)
+            this.advance(1)
+        }
+    }
+}
+
+// parseDocument parses the whole document into the parser's root table.
+func (this *tomlParser) parseDocument() error {
+    this.current = this.root
+
+    for {
+        this.skipSpaceLines()
+        if this.done() {
+            return nil
+        }
+
+        var err error
+        if this.peek("[") {
+            err = this.parseTable()
+        } else {
+            err = this.parseKeyVal(this.current)
+        }
+
+        if err != nil {
+            return err
+        }
+
+        err = this.endLine()
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// parseEscape parses a backslash escape sequence within a basic string.
+func (this *tomlParser) parseEscape(multiLine bool) (string, error) {
+    if this.pos + 1 >= len(this.data) {
+        return "", this.errorf("Unterminated string")
+    }
+
+    c := this.data[this.pos+1]
+
+    // a line ending backslash trims the following whitespace
+    if multiLine &&
+        strings.HasPrefix(strings.TrimLeft(this.rest()[1:], " \t\r"), "\n") {
+        this.advance(1)
+        this.skipSpaceLines()
+        return "", nil
+    }
+
+    val, ok := tomlEscapes[c]
+    if ok {
+        this.advance(2)
+        return val, nil
+    }
+
+    size := 0
+    switch c {
+    case 'u':
+        size = 4
+    case 'U':
+        size = 8
+    default:
+        return "", this.errorf("Invalid escape \\%c", c)
+    }
+
+    if this.pos + 2 + size > len(this.data) {
+        return "", this.errorf("Invalid unicode escape")
+    }
+
+    code, err := strconv.ParseUint(this.data[this.pos+2:this.pos+2+size], 16, 32)
+    if err != nil {
+        return "", this.errorf("Invalid unicode escape")
+    }
+
+    this.advance(2 + size)
+
+    return string(rune(code)), nil
+}
+
+// parseInlineTable parses an inline table value, which must fit on one
+// line.
+func (this *tomlParser) parseInlineTable() (interface{}, error) {
+    result := make(map[string]interface{})
+
+    this.advance(1)
+    this.skipSpace()
+
+    if this.peek("}") {
+        this.advance(1)
+        return result, nil
+    }
+
+    for {
+        err := this.parseKeyVal(result)
+        if err != nil {
+            return nil, err
+        }
+
+        this.skipSpace()
+        switch {
+        case this.peek(","):
+            this.advance(1)
+        case this.peek("}"):
+            this.advance(1)
+            return result, nil
+        default:
+            return nil, this.errorf("Expected , or } in inline table")
+        }
+    }
+}
+
+// parseKey parses a bare, quoted or dotted key, returning its parts.
+func (this *tomlParser) parseKey() ([]string, error) {
+    parts := make([]string, 0, 1)
+
+    for {
+        this.skipSpace()
+
+        var part string
+        var err  error
+
+        switch {
+        case this.peek("\""):
+            part, err = this.parseBasicString(false)
+        case this.peek("'"):
+            part, err = this.parseLiteralString(false)
+        default:
+            end := strings.IndexAny(this.rest(), " \t\r\n.=]#")
+            if end < 0 {
+                end = len(this.rest())
+            }
+
+            part = this.rest()[:end]
+            if !tomlBareKeyExp.MatchString(part) {
+                return nil, this.errorf("Invalid key %q", part)
+            }
+
+            this.advance(end)
+        }
+
+        if err != nil {
+            return nil, err
+        }
+
+        parts = append(parts, part)
+
+        this.skipSpace()
+        if !this.peek(".") {
+            return parts, nil
+        }
+
+        this.advance(1)
+    }
+}
+
+// parseKeyVal parses a key = value pair into the given table.
+func (this *tomlParser) parseKeyVal(table map[string]interface{}) error {
+    keyLine := this.line
+
+    parts, err := this.parseKey()
+    if err != nil {
+        return err
+    }
+
+    this.skipSpace()
+    if !this.peek("=") {
+        return this.errorf("Expected = after key %q", strings.Join(parts, "."))
+    }
+
+    this.advance(1)
+    this.skipSpace()
+
+    val, err := this.parseValue()
+    if err != nil {
+        return err
+    }
+
+    for _, part := range parts[:len(parts) - 1] {
+        table, err = this.subTable(table, part, keyLine)
+        if err != nil {
+            return err
+        }
+    }
+
+    key       := parts[len(parts) - 1]
+    _, exists := table[key]
+    if exists {
+        return lineError(keyLine, "Duplicate key %q", strings.Join(parts, "."))
+    }
+
+    table[key] = val
+
+    return nil
+}
+
+// parseLiteralString parses a single quoted string, which has no escapes.
+func (this *tomlParser) parseLiteralString(multiLine bool) (string, error) {
+    quote := "'"
+    if multiLine {
+        quote = "'''"
+        this.advance(3)
+        this.skipNewline()
+    } else {
+        this.advance(1)
+    }
+
+    end := strings.Index(this.rest(), quote)
+    if end < 0 ||
+        !multiLine && strings.Contains(this.rest()[:end], "\n") {
+        return "", this.errorf("Unterminated string")
+    }
+
+    text := this.rest()[:end]
+    this.advance(end + len(quote))
+
+    return text, nil
+}
+
+// parseTable parses a [table] or [[array of tables]] header, and makes it
+// the current table.
+func (this *tomlParser) parseTable() error {
+    headerLine := this.line
+    isArray    := this.peek("[[")
+
+    if isArray {
+        this.advance(2)
+    } else {
+        this.advance(1)
+    }
+
+    parts, err := this.parseKey()
+    if err != nil {
+        return err
+    }
+
+    closing := "]"
+    if isArray {
+        closing = "]]"
+    }
+
+    if !this.peek(closing) {
+        return this.errorf("Expected %s after table name", closing)
+    }
+
+    this.advance(len(closing))
+
+    table := this.root
+    for _, part := range parts[:len(parts) - 1] {
+        table, err = this.subTable(table, part, headerLine)
+        if err != nil {
+            return err
+        }
+    }
+
+    name := strings.Join(parts, ".")
+    last := parts[len(parts) - 1]
+
+    if isArray {
+        list, exists := table[last]
+        if !exists {
+            list = make([]interface{}, 0)
+        }
+
+        tables, ok := list.([]interface{})
+        if !ok || this.defined[name] {
+            return lineError(headerLine, "Key %q isn't an array of tables", name)
+        }
+
+        newTable    := make(map[string]interface{})
+        table[last]  = append(tables, newTable)
+        this.current = newTable
+
+        return nil
+    }
+
+    if this.defined[name] {
+        return lineError(headerLine, "Duplicate table %q", name)
+    }
+
+    this.defined[name] = true
+
+    this.current, err = this.subTable(table, last, headerLine)
+
+    return err
+}
+
+// parseValue parses a value of any type.
+func (this *tomlParser) parseValue() (interface{}, error) {
+    switch {
+    case this.done():
+        return nil, this.errorf("Expected a value")
+    case this.peek("\"\"\""):
+        return this.parseBasicString(true)
+    case this.peek("\""):
+        return this.parseBasicString(false)
+    case this.peek("'''"):
+        return this.parseLiteralString(true)
+    case this.peek("'"):
+        return this.parseLiteralString(false)
+    case this.peek("["):
+        return this.parseArray()
+    case this.peek("{"):
+        return this.parseInlineTable()
+    }
+
+    return this.parseBareValue()
+}
+
+// peek returns true if the unparsed data starts with the given text.
+func (this *tomlParser) peek(text string) bool {
+    return strings.HasPrefix(this.rest(), text)
+}
+
+// rest returns the unparsed data.
+func (this *tomlParser) rest() string {
+    return this.data[this.pos:]
+}
+
+// skipComment skips a comment, up to the end of its line.
+func (this *tomlParser) skipComment() {
+    if !this.peek("#") {
+        return
+    }
+
+    end := strings.Index(this.rest(), "\n")
+    if end < 0 {
+        end = len(this.rest())
+    }
+
+    this.advance(end)
+}
+
+// skipNewline skips a single newline.
+func (this *tomlParser) skipNewline() {
+    switch {
+    case this.peek("\r\n"):
+        this.advance(2)
+    case this.peek("\n"):
+        this.advance(1)
+    }
+}
+
+// skipSpace skips spaces and tabs.
+func (this *tomlParser) skipSpace() {
+    for !this.done() && (this.data[this.pos] == ' ' || this.data[this.pos] == '\t') {
+        this.advance(1)
+    }
+}
+
+// skipSpaceLines skips whitespace, newlines and comments.
+func (this *tomlParser) skipSpaceLines() {
+    for !this.done() {
+        switch this.data[this.pos] {
+        case ' ', '\t', '\r', '\n':
+            this.advance(1)
+        case '#':
+            this.skipComment()
+        default:
+            return
+        }
+    }
+}
+
+// subTable returns the named table within the given table, creating it if
+// it doesn't exist. For arrays of tables, the last table is returned.
+func (this *tomlParser) subTable(
+    table   map[string]interface{},
+    name    string,
+    lineNum int,
+) (map[string]interface{}, error) {
+    node, exists := table[name]
+    if !exists {
+        newTable   := make(map[string]interface{})
+        table[name] = newTable
+        return newTable, nil
+    }
+
+    switch val := node.(type) {
+    case map[string]interface{}:
+        return val, nil
+    case []interface{}:
+        if len(val) > 0 {
+            last, ok := val[len(val) - 1].(map[string]interface{})
+            if ok {
+                return last, nil
+            }
+        }
+    }
+
+    return nil, lineError(lineNum, "Key %q isn't a table", name)
+}
+
+
+// isDigit returns true for the ascii digits.
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
@@ -0,0 +1,632 @@
+//  ---------------------------------------------------------------------------
+//
+//  yamlprovider.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package config
+
+// Stdlib imports.
+import(
+    "bufio"
+    "errors"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// Yaml provider module name.
+const YAML_MOD_NAME = "YamlProvider"
+
+// Yaml file format.
+var yamlFormat = fileFormat {
+    modName : YAML_MOD_NAME,
+    parse   : parseYaml,
+}
+
+// InitYamlProvider initializes a new yaml file provider for the given path,
+// registers it with the config service, and returns a pointer to the object
+// for direct use, if required. Nested mappings are flattened into dotted
+// key names, and sequences of scalars become the values of a single entry.
+// Mappings within sequences are each flattened under the sequence's key, so
+// that keys can repeat, as they can in ini files.
+//
+// A practical subset of yaml is supported: block mappings and sequences,
+// flow sequences and mappings on a single line, quoted and plain scalars,
+// literal (|) and folded (>) block scalars, and comments. Anchors, aliases,
+// tags and multiple documents are rejected.
+func InitYamlProvider(path string, pri int) *FileProvider {
+    return initFileProvider(path, pri, &yamlFormat)
+}
+
+// parseYaml parses a yaml-formatted config file into the given map of
+// ConfigEntries.
+func parseYaml(
+    provider *FileProvider,
+    reader   *bufio.Reader,
+    entries  map[string][]*ConfigEntry,
+) error {
+    parser, err := newYamlParser(reader)
+    if err != nil {
+        return err
+    }
+
+    tree, err := parser.parseDocument()
+    if err != nil {
+        return err
+    }
+
+    return provider.addTree(entries, "", tree)
+}
+
+
+// newYamlParser reads a yaml document into a new yamlParser.
+func newYamlParser(reader *bufio.Reader) (*yamlParser, error) {
+    parser := yamlParser {
+        lines : make([]*yamlLine, 0),
+    }
+
+    for lineNum := 1; ; lineNum++ {
+        raw, readErr := reader.ReadString('\n')
+        if readErr != nil && readErr != io.EOF {
+            return nil, readErr
+        }
+
+        raw   = strings.TrimRight(raw, "\r\n")
+        body := strings.TrimLeft(raw, " ")
+
+        if strings.HasPrefix(body, "\t") && strings.TrimSpace(body) != "" {
+            return nil, lineError(lineNum, "Tabs can't be used for indentation")
+        }
+
+        text := stripYamlComment(body)
+
+        parser.lines = append(parser.lines, &yamlLine {
+            indent : len(raw) - len(body),
+            num    : lineNum,
+            raw    : raw,
+            text   : strings.TrimSpace(text),
+        })
+
+        if readErr == io.EOF {
+            break
+        }
+    }
+
+    return &parser, nil
+}
+
+// yamlLine is a single line of a yaml document.
+type yamlLine struct {
+    indent int
+    num    int
+    raw    string
+    text   string
+}
+
+// yamlParser builds a tree of maps, lists and strings from the lines of a
+// yaml document, by indentation.
+type yamlParser struct {
+    lines []*yamlLine
+    pos   int
+}
+
+// next returns the next line with content, skipping blank and comment
+// lines, or nil at the end of the document.
+func (this *yamlParser) next() *yamlLine {
+    for this.pos < len(this.lines) {
+        line := this.lines[this.pos]
+        if line.text != "" {
+            return line
+        }
+
+        this.pos++
+    }
+
+    return nil
+}
+
+// parseBlockScalar reads a literal (|) or folded (>) block scalar, made up
+// of the lines indented deeper than its parent.
+func (this *yamlParser) parseBlockScalar(
+    header       string,
+    parentIndent int,
+) string {
+    chomp := header[1:]
+    lines := make([]string, 0)
+
+    indent := -1
+    for this.pos < len(this.lines) {
+        line := this.lines[this.pos]
+        if line.text != "" || strings.TrimSpace(line.raw) != "" {
+            if line.indent <= parentIndent {
+                break
+            }
+
+            if indent < 0 {
+                indent = line.indent
+            }
+        }
+
+        if len(line.raw) > indent && indent > -1 {
+            lines = append(lines, line.raw[indent:])
+        } else {
+            lines = append(lines, "")
+        }
+
+        this.pos++
+    }
+
+    // trailing blank lines belong to the following content
+    trailing := 0
+    for len(lines) > 0 && lines[len(lines) - 1] == "" {
+        lines = lines[:len(lines) - 1]
+        trailing++
+    }
+
+    var text string
+    if header[0] == '|' {
+        text = strings.Join(lines, "\n")
+    } else {
+        text = foldYamlLines(lines)
+    }
+
+    switch {
+    case len(lines) < 1:
+        return ""
+    case chomp == "-":
+        return text
+    case chomp == "+":
+        return text + strings.Repeat("\n", trailing + 1)
+    }
+
+    return text + "\n"
+}
+
+// parseDocument parses the whole document, which must be a mapping.
+func (this *yamlParser) parseDocument() (interface{}, error) {
+    line := this.next()
+    if line != nil && isYamlDocMarker(line) && line.text == "---" {
+        this.pos++
+        line = this.next()
+    }
+
+    if line == nil {
+        return make(map[string]interface{}), nil
+    }
+
+    if isYamlSeqItem(line.text) {
+        return nil, lineError(line.num, "Top level must be a mapping")
+    }
+
+    tree, err := this.parseMap(line.indent)
+    if err != nil {
+        return nil, err
+    }
+
+    line = this.next()
+    if line != nil && isYamlDocMarker(line) && line.text == "..." {
+        this.pos++
+        line = this.next()
+    }
+
+    if line != nil {
+        if line.text == "---" {
+            return nil, lineError(line.num, "Multiple documents aren't supported")
+        }
+
+        return nil, lineError(line.num, "Bad indentation")
+    }
+
+    return tree, nil
+}
+
+// parseMap parses a block mapping whose keys are at the given indent.
+func (this *yamlParser) parseMap(indent int) (interface{}, error) {
+    result := make(map[string]interface{})
+
+    for {
+        line := this.next()
+        if line == nil || line.indent < indent || isYamlDocMarker(line) {
+            return result, nil
+        }
+
+        if line.indent > indent {
+            return nil, lineError(line.num, "Bad indentation")
+        }
+
+        if isYamlSeqItem(line.text) {
+            return nil, lineError(line.num, "Unexpected sequence item")
+        }
+
+        key, rest, err := splitYamlKey(line.text)
+        if err != nil {
+            return nil, lineError(line.num, "%v", err)
+        }
+
+        _, exists := result[key]
+        if exists {
+            return nil, lineError(line.num, "Duplicate key %q", key)
+        }
+
+        this.pos++
+
+        val, err := this.parseValue(rest, indent, line.num, true)
+        if err != nil {
+            return nil, err
+        }
+
+        result[key] = val
+    }
+}
+
+// parseSeq parses a block sequence whose items are at the given indent.
+func (this *yamlParser) parseSeq(indent int) (interface{}, error) {
+    result := make([]interface{}, 0)
+
+    for {
+        line := this.next()
+        if line == nil || line.indent < indent || !isYamlSeqItem(line.text) {
+            return result, nil
+        }
+
+        if line.indent > indent {
+            return nil, lineError(line.num, "Bad indentation")
+        }
+
+        rest   := strings.TrimLeft(line.text[1:], " ")
+        offset := len(line.text) - len(rest)
+
+        // a mapping started on the same line as its item
+        _, _, err := splitYamlKey(rest)
+        if rest != "" && err == nil && rest[0] != '{' && rest[0] != '[' {
+            line.indent += offset
+            line.text    = rest
+
+            val, err := this.parseMap(line.indent)
+            if err != nil {
+                return nil, err
+            }
+
+            result = append(result, val)
+            continue
+        }
+
+        this.pos++
+
+        val, err := this.parseValue(rest, indent, line.num, false)
+        if err != nil {
+            return nil, err
+        }
+
+        result = append(result, val)
+    }
+}
+
+// parseValue parses the value following a mapping key or sequence dash on
+// the given line. An empty value is followed by a nested block, or is null.
+// Sequences may be nested at the same indent as their mapping key.
+func (this *yamlParser) parseValue(
+    text    string,
+    indent  int,
+    lineNum int,
+    inMap   bool,
+) (interface{}, error) {
+    if text == "" {
+        line := this.next()
+        switch {
+        case line == nil:
+            return nil, nil
+        case line.indent > indent && isYamlSeqItem(line.text):
+            return this.parseSeq(line.indent)
+        case line.indent > indent:
+            return this.parseMap(line.indent)
+        case line.indent == indent && inMap && isYamlSeqItem(line.text):
+            return this.parseSeq(line.indent)
+        }
+
+        return nil, nil
+    }
+
+    if text[0] == '|' || text[0] == '>' {
+        switch text[1:] {
+        case "", "-", "+":
+            return this.parseBlockScalar(text, indent), nil
+        }
+
+        return nil, lineError(lineNum, "Unsupported block scalar header %q", text)
+    }
+
+    val, rest, err := parseYamlFlow(text, false)
+    if err != nil {
+        return nil, lineError(lineNum, "%v", err)
+    }
+
+    if strings.TrimSpace(rest) != "" {
+        return nil, lineError(lineNum, "Unexpected text %q", rest)
+    }
+
+    return val, nil
+}
+
+
+// foldYamlLines joins the lines of a folded block scalar, replacing single
+// line breaks with spaces. Blank lines, and lines which are more indented,
+// keep their line breaks.
+func foldYamlLines(lines []string) string {
+    var text string
+
+    for i, line := range lines {
+        if i > 0 {
+            prev := lines[i - 1]
+            switch {
+            case line == "" || prev == "":
+                text += "\n"
+            case strings.HasPrefix(line, " ") || strings.HasPrefix(prev, " "):
+                text += "\n"
+            default:
+                text += " "
+            }
+        }
+
+        text += line
+    }
+
+    return text
+}
+
+// isYamlDocMarker returns true if the given line starts (---) or ends (...)
+// a document.
+func isYamlDocMarker(line *yamlLine) bool {
+    return line.indent == 0 && (line.text == "---" || line.text == "...")
+}
+
+// isYamlSeqItem returns true if the given line text is a sequence item.
+func isYamlSeqItem(text string) bool {
+    return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseYamlFlow parses a single scalar, flow sequence or flow mapping from
+// the start of text, returning it and the text which follows it. Inside
+// flow collections, plain scalars end at commas and closing brackets.
+func parseYamlFlow(text string, inFlow bool) (interface{}, string, error) {
+    text = strings.TrimLeft(text, " ")
+    if text == "" {
+        return nil, "", nil
+    }
+
+    switch text[0] {
+    case '[':
+        return parseYamlFlowSeq(text[1:])
+    case '{':
+        return parseYamlFlowMap(text[1:])
+    case '"', '\'':
+        return parseYamlQuoted(text)
+    case '&', '*':
+        return nil, "", errors.New("Anchors and aliases aren't supported")
+    case '!':
+        return nil, "", errors.New("Tags aren't supported")
+    }
+
+    end := len(text)
+    if inFlow {
+        end = strings.IndexAny(text, ",]}")
+        if end < 0 {
+            end = len(text)
+        }
+    }
+
+    plain := strings.TrimSpace(text[:end])
+    switch plain {
+    case "~", "null", "Null", "NULL":
+        return nil, text[end:], nil
+    }
+
+    return plain, text[end:], nil
+}
+
+// parseYamlFlowMap parses the rest of a flow mapping, after its opening
+// brace.
+func parseYamlFlowMap(text string) (interface{}, string, error) {
+    result := make(map[string]interface{})
+
+    for {
+        text = strings.TrimLeft(text, " ")
+        if strings.HasPrefix(text, "}") {
+            return result, text[1:], nil
+        }
+
+        colon := yamlKeyEnd(text)
+        if colon < 0 {
+            return nil, "", errors.New("Expected key: value in flow mapping")
+        }
+
+        key, err := unquoteYamlKey(text[:colon])
+        if err != nil {
+            return nil, "", err
+        }
+
+        val, rest, err := parseYamlFlow(text[colon+1:], true)
+        if err != nil {
+            return nil, "", err
+        }
+
+        _, exists := result[key]
+        if exists {
+            return nil, "", errors.New("Duplicate key " + strconv.Quote(key))
+        }
+
+        result[key] = val
+
+        text = strings.TrimLeft(rest, " ")
+        switch {
+        case strings.HasPrefix(text, ","):
+            text = text[1:]
+        case strings.HasPrefix(text, "}"):
+        default:
+            return nil, "", errors.New("Unterminated flow mapping")
+        }
+    }
+}
+
+// parseYamlFlowSeq parses the rest of a flow sequence, after its opening
+// bracket.
+func parseYamlFlowSeq(text string) (interface{}, string, error) {
+    result := make([]interface{}, 0)
+
+    for {
+        text = strings.TrimLeft(text, " ")
+        if strings.HasPrefix(text, "]") {
+            return result, text[1:], nil
+        }
+
+        val, rest, err := parseYamlFlow(text, true)
+        if err != nil {
+            return nil, "", err
+        }
+
+        result = append(result, val)
+
+        text = strings.TrimLeft(rest, " ")
+        switch {
+        case strings.HasPrefix(text, ","):
+            text = text[1:]
+        case strings.HasPrefix(text, "]"):
+        default:
+            return nil, "", errors.New("Unterminated flow sequence")
+        }
+    }
+}
+
+// parseYamlQuoted parses a single or double quoted scalar from the start of
+// text.
+func parseYamlQuoted(text string) (interface{}, string, error) {
+    quote := text[0]
+
+    for i := 1; i < len(text); i++ {
+        switch {
+        case quote == '"' && text[i] == '\\':
+            i++
+        case quote == '\'' && text[i] == '\'' &&
+            i + 1 < len(text) && text[i+1] == '\'':
+            i++
+        case text[i] == quote:
+            if quote == '\'' {
+                val := strings.Replace(text[1:i], "''", "'", -1)
+                return val, text[i+1:], nil
+            }
+
+            val, err := strconv.Unquote(text[:i+1])
+            if err != nil {
+                return nil, "", errors.New("Invalid quoted string " + text[:i+1])
+            }
+
+            return val, text[i+1:], nil
+        }
+    }
+
+    return nil, "", errors.New("Unterminated quoted string")
+}
+
+// splitYamlKey splits a block mapping line into its key and the text of its
+// value.
+func splitYamlKey(text string) (string, string, error) {
+    colon := yamlKeyEnd(text)
+    if colon < 0 {
+        return "", "", errors.New("Expected key: value")
+    }
+
+    key, err := unquoteYamlKey(text[:colon])
+    if err != nil {
+        return "", "", err
+    }
+
+    return key, strings.TrimSpace(text[colon+1:]), nil
+}
+
+// stripYamlComment removes a trailing comment from a line. Comments start
+// with a # at the start of the line, or after whitespace, outside of
+// quoted strings.
+func stripYamlComment(text string) string {
+    var quote byte
+
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+
+        switch {
+        case quote == '"' && c == '\\':
+            i++
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            // quotes only open scalars, not words like don't
+            if i == 0 || strings.IndexByte(" [{,:-", text[i-1]) > -1 {
+                quote = c
+            }
+        case c == '#':
+            if i == 0 || text[i-1] == ' ' || text[i-1] == '\t' {
+                return text[:i]
+            }
+        }
+    }
+
+    return text
+}
+
+// unquoteYamlKey returns a mapping key, without its quotes, if quoted.
+func unquoteYamlKey(text string) (string, error) {
+    key := strings.TrimSpace(text)
+    if key == "" {
+        return "", errors.New("Empty key name")
+    }
+
+    if key[0] != '"' && key[0] != '\'' {
+        return key, nil
+    }
+
+    val, rest, err := parseYamlQuoted(key)
+    if err != nil {
+        return "", err
+    }
+
+    if strings.TrimSpace(rest) != "" {
+        return "", errors.New("Invalid key " + key)
+    }
+
+    return val.(string), nil
+}
+
+// yamlKeyEnd returns the index of the colon ending a mapping key at the
+// start of text, or -1 if there isn't one. The colon must be followed by a
+// space, or end the text, and may not be inside a quoted key.
+func yamlKeyEnd(text string) int {
+    start := 0
+    if len(text) > 0 && (text[0] == '"' || text[0] == '\'') {
+        _, rest, err := parseYamlQuoted(text)
+        if err != nil {
+            return -1
+        }
+
+        start = len(text) - len(rest)
+    }
+
+    for i := start; i < len(text); i++ {
+        if text[i] != ':' {
+            continue
+        }
+
+        if i + 1 == len(text) || text[i+1] == ' ' {
+            return i
+        }
+    }
+
+    return -1
+}
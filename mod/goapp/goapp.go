@@ -20,7 +20,9 @@ package goapp
 
 // External imports.
 import (
+    "github.com/xaevman/goat/mod/config"
     "github.com/xaevman/goat/mod/log"
+    "github.com/xaevman/goat/mod/net"
     "github.com/xaevman/goat/lib/lifecycle"
     "github.com/xaevman/goat/lib/perf"
     "github.com/xaevman/goat/lib/time"
@@ -31,6 +33,7 @@ import (
     "os"
     "os/signal"
     "sync"
+    "syscall"
 )
 
 // Built in performance timers.
@@ -64,12 +67,14 @@ var appTimerNames = []string {
 
 // Application properties.
 var (
-    appName     string
-    appPerfs    *perf.CounterSet
-    exitCode    = 0
-    initialized = false
-    runTimer    = new(time.Stopwatch)
-    stopwatch   = new(time.Stopwatch)
+    appName      string
+    appPerfs     *perf.CounterSet
+    drainTimeout = net.DEFAULT_DRAIN_TIMEOUT_SEC
+    exitCode     = 0
+    flagPriority = -1
+    initialized  = false
+    runTimer     = new(time.Stopwatch)
+    stopwatch    = new(time.Stopwatch)
 )
 
 // Synchronization helpers.
@@ -157,12 +162,38 @@ func SetCrashHandler(obj CrashHandler) {
     crashHandler = obj
 }
 
+// SetDrainTimeout sets the number of seconds the application waits, during
+// its PreShutdown phase, for network protocols to drain their connections.
+// Zero disables draining.
+func SetDrainTimeout(timeoutSec int) {
+    mutex.Lock()
+    defer mutex.Unlock()
+
+    drainTimeout = timeoutSec
+}
+
 // SetExitCode sets the exit code the application should return
 // when shutdown is complete.
 func SetExitCode(code int) {
     exitCode = code
 }
 
+// SetFlagPriority has the application install a config.FlagProvider at the
+// given priority before AppStarter.PreInit(), so that config keys can be
+// overridden from the command line. If a help flag was given, the
+// application prints the known config keys once PreInit() has registered
+// its providers, and exits. Likewise, a --schema=<file> flag writes the
+// config schema registered during PreInit() to the file as json, and exits.
+// Must be done before Start() in order to matter.
+// Passing a negative priority disables the FlagProvider, which is the
+// default.
+func SetFlagPriority(pri int) {
+    mutex.Lock()
+    defer mutex.Unlock()
+
+    flagPriority = pri
+}
+
 // SetHeartbeat sets and, if appropriate, starts the heartbeat of the
 // GoApp.
 func SetHeartbeat(intervalMs int) {
@@ -234,7 +265,7 @@ func internalInit() {
     appPerfs.EnableStats(PERF_APP_TIMER_PRE_LOOP)
 
     c := make(chan os.Signal, 0)
-    signal.Notify(c, os.Interrupt)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
     go func(){
         for {
             select {
@@ -246,6 +277,70 @@ func internalInit() {
     }()
 }
 
+// internalFlags installs the config.FlagProvider, if enabled, and returns
+// it.
+func internalFlags() *config.FlagProvider {
+    mutex.Lock()
+    pri := flagPriority
+    mutex.Unlock()
+
+    if pri < 0 {
+        return nil
+    }
+
+    return config.InitFlagProvider(pri)
+}
+
+// internalValidate checks the registered config providers against any
+// config schema registered during AppStarter.PreInit(), and logs every key
+// which fails.
+func internalValidate() {
+    err := config.Validate()
+    if err == nil {
+        return
+    }
+
+    for _, keyErr := range err.(config.SchemaError) {
+        log.Error("Config schema: %v", keyErr)
+    }
+}
+
+// exportSchema writes the config schema registered during
+// AppStarter.PreInit() to the given file, for use by config linting tools.
+func exportSchema(path string) {
+    file, err := os.Create(path)
+    if err == nil {
+        err = config.ExportSchema(file)
+        file.Close()
+    }
+
+    if err != nil {
+        log.Error("Unable to export config schema to %v (%v)", path, err)
+        SetExitCode(1)
+        return
+    }
+
+    log.Info("Config schema written to %v", path)
+}
+
+// internalDrain gracefully drains all live network protocols, so that
+// in-flight messages are delivered before AppCloser.PreShutdown() shuts them
+// down.
+func internalDrain() {
+    mutex.Lock()
+    timeoutSec := drainTimeout
+    mutex.Unlock()
+
+    if timeoutSec < 1 {
+        return
+    }
+
+    err := net.DrainAll(timeoutSec)
+    if err != nil {
+        log.Error("Network drain incomplete (%v)", err)
+    }
+}
+
 // internalShutdown performs clean-up logic that can't be overriden by
 // client code. The sequence of shutdown operations is AppCloser.PreShutdown(),
 // internalShutdown(), and then AppCloser.PostShutdown().
@@ -264,10 +359,23 @@ func startApp(name string) {
 
     appName = name
 
+    flags := internalFlags()
+
     stopwatch.Restart()
     appStarter.PreInit()
     appPerfs.Set(PERF_APP_TIMER_PRE_INIT, stopwatch.MarkMs())
 
+    if flags != nil && flags.HelpRequested() {
+        flags.PrintHelp(os.Stdout)
+        return
+    }
+
+    if flags != nil && flags.SchemaPath() != "" {
+        exportSchema(flags.SchemaPath())
+        return
+    }
+
+    internalValidate()
     internalInit()
 
     stopwatch.Restart()
@@ -303,13 +411,14 @@ func startApp(name string) {
     }
 }
 
-// internalStop marks the application as uninitialized, calls AppCloser and
-// internal shutdown code, and then lets the lifecycle syncObj know that shutdown
-// is complete.
+// internalStop marks the application as uninitialized, drains network
+// protocols, calls AppCloser and internal shutdown code, and then lets the
+// lifecycle syncObj know that shutdown is complete.
 func internalStop() {
     syncObj.StopHeart()
 
     stopwatch.Restart()
+    internalDrain()
     appCloser.PreShutdown()
     appPerfs.Set(PERF_APP_TIMER_PRE_SHUTDOWN, stopwatch.MarkMs())
 
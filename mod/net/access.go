@@ -13,12 +13,12 @@
 package net
 
 // NoSecurity implements AccessProvider in a way which always returns
-// maximum privileges (255).
+// maximum privileges (ACCESS_MAX).
 type NoSecurity struct {}
 
-// Authorize always returns 255, nil.
+// Authorize always returns ACCESS_MAX, nil.
 func (this *NoSecurity) Authorize(con Connection) (byte, error) {
-    return 255, nil
+    return ACCESS_MAX, nil
 }
 
 // Unused.
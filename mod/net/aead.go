@@ -0,0 +1,226 @@
+//  ---------------------------------------------------------------------------
+//
+//  aead.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+)
+
+// Stdlib imports.
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "errors"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Number of sequence numbers, below the highest one received from a
+// connection, which are still accepted if they haven't been seen before.
+// This allows for reordering by transports such as UDP.
+const AEAD_REPLAY_WINDOW = 64
+
+// Common error messages.
+var (
+    errAeadReplay   = errors.New("Encrypted payload replayed")
+    errAeadShortMsg = errors.New("Encrypted payload shorter than nonce")
+)
+
+
+// NewAeadCrypto creates a new AeadCrypto object which encrypts messages using
+// AES-GCM with the supplied pre-shared key. The key must be 16, 24, or 32 bytes
+// long, selecting AES-128, AES-192 or AES-256 respectively.
+func NewAeadCrypto(key []byte) (*AeadCrypto, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    newCrypto := AeadCrypto {
+        aead    : aead,
+        rcvSeqs : make(map[uint32]*replayWindow),
+        sendSeq : uint64(time.Now().UnixNano()),
+    }
+
+    return &newCrypto, nil
+}
+
+// AeadCrypto implements CryptoProvider using an authenticated cipher. Each
+// payload is sealed with a random nonce and a sequence number, which are
+// prepended to the ciphertext. The message signature and sequence number
+// are authenticated along with the payload, and payloads whose sequence
+// number has already been accepted from the same connection, or which fall
+// too far behind the newest one, are rejected as replays. Sequence numbers
+// start from the current time, so that a restarted sender isn't mistaken
+// for a replay. AeadCrypto is intended for transports, such as UDP, which
+// cannot make use of TLS.
+type AeadCrypto struct {
+    aead    cipher.AEAD
+    mutex   sync.Mutex
+    rcvSeqs map[uint32]*replayWindow
+    sendSeq uint64
+}
+
+// Close is unused in AeadCrypto.
+func (this *AeadCrypto) Close() {}
+
+// Decrypt authenticates and decrypts the payload of the supplied message,
+// and rejects it if it has been replayed.
+func (this *AeadCrypto) Decrypt(msg *Msg) error {
+    data      := msg.GetPayload()
+    nonceSize := this.aead.NonceSize()
+
+    if len(data) < nonceSize + buffer.LenUint64() {
+        return errAeadShortMsg
+    }
+
+    cursor   := nonceSize
+    seq, err := buffer.ReadUint64(data, &cursor)
+    if err != nil {
+        return err
+    }
+
+    plain, err := this.aead.Open(
+        nil,
+        data[:nonceSize],
+        data[cursor:],
+        aeadData(msg, data[nonceSize:cursor]),
+    )
+    if err != nil {
+        return err
+    }
+
+    if !this.acceptSeq(msg.From(), seq) {
+        return errAeadReplay
+    }
+
+    msg.SetPayload(plain)
+    msg.SetEncrypted(false)
+
+    return nil
+}
+
+// Encrypt seals the payload of the supplied message and sets the message's
+// encrypted flag.
+func (this *AeadCrypto) Encrypt(msg *Msg) error {
+    nonceSize := this.aead.NonceSize()
+    seqSize   := buffer.LenUint64()
+    data      := msg.GetPayload()
+    sealed    := make(
+        []byte,
+        nonceSize + seqSize,
+        nonceSize + seqSize + len(data) + this.aead.Overhead(),
+    )
+
+    _, err := rand.Read(sealed[:nonceSize])
+    if err != nil {
+        return err
+    }
+
+    cursor := nonceSize
+    buffer.WriteUint64(atomic.AddUint64(&this.sendSeq, 1), sealed, &cursor)
+
+    msg.SetEncrypted(true)
+    msg.SetPayload(this.aead.Seal(
+        sealed,
+        sealed[:nonceSize],
+        data,
+        aeadData(msg, sealed[nonceSize:]),
+    ))
+
+    return nil
+}
+
+// Init is unused in AeadCrypto.
+func (this *AeadCrypto) Init(proto *Protocol) {}
+
+// OnDisconnect discards the replay state of the given connection.
+func (this *AeadCrypto) OnDisconnect(con Connection) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    delete(this.rcvSeqs, con.Id())
+}
+
+// acceptSeq records the given sequence number as received from the given
+// connection, returning false if it is a replay.
+func (this *AeadCrypto) acceptSeq(conId uint32, seq uint64) bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    window := this.rcvSeqs[conId]
+    if window == nil {
+        this.rcvSeqs[conId] = &replayWindow { last : seq, seen : 1 }
+        return true
+    }
+
+    return window.accept(seq)
+}
+
+
+// replayWindow tracks the newest sequence number received from a connection,
+// along with which of the AEAD_REPLAY_WINDOW sequence numbers before it have
+// been received. Bit n of seen is set once last - n has been received.
+type replayWindow struct {
+    last uint64
+    seen uint64
+}
+
+// accept marks the given sequence number as received, returning false if it
+// was received before, or is too old to tell.
+func (this *replayWindow) accept(seq uint64) bool {
+    if seq > this.last {
+        shift := seq - this.last
+        if shift >= AEAD_REPLAY_WINDOW {
+            this.seen = 0
+        } else {
+            this.seen <<= shift
+        }
+
+        this.seen |= 1
+        this.last  = seq
+
+        return true
+    }
+
+    age := this.last - seq
+    if age >= AEAD_REPLAY_WINDOW || this.seen & (1 << age) != 0 {
+        return false
+    }
+
+    this.seen |= 1 << age
+
+    return true
+}
+
+
+// aeadData returns the additional authenticated data for the given message,
+// binding the ciphertext to the message's signature and sequence number.
+func aeadData(msg *Msg, seq []byte) []byte {
+    sig := msg.ExtMsgType()
+    if sig > 0xFFFF {
+        return append([]byte {
+            byte(sig >> 24), byte(sig >> 16), byte(sig >> 8), byte(sig),
+        }, seq...)
+    }
+
+    return append([]byte { byte(sig >> 8), byte(sig) }, seq...)
+}
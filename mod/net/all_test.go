@@ -14,15 +14,38 @@ package net
 
 // External imports.
 import (
+    "github.com/xaevman/goat/mod/config"
     "github.com/xaevman/goat/mod/log"
+    "github.com/xaevman/goat/lib/lifecycle"
+    "github.com/xaevman/goat/lib/perf"
     "github.com/xaevman/goat/lib/str"
 )
 
 // Stdlib imports.
 import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/ecdsa"
+    "crypto/tls"
+    "crypto/elliptic"
+    cryptorand "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/binary"
+    "encoding/pem"
     "errors"
+    "fmt"
     "hash/crc32"
+    "io"
+    "io/ioutil"
+    "math/big"
     "math/rand"
+    stdnet "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
     "sync"
     "testing"
     "time"
@@ -32,8 +55,14 @@ import (
 const (
     PING_MSG_TYPE = 25
     PONG_MSG_TYPE = 26
+    BIG_MSG_TYPE  = 27
+    EXT_MSG_TYPE  = 5000
+    WIDE_MSG_TYPE = 0x12345
 )
 
+// Payload size used by the fragmentation tests.
+const BIG_MSG_LEN = 100 * 1024
+
 // Header values for HeaderOps test.
 var headerTests = []uint16 {
     0, 1, 4, 31, 64, 501, 1002, 1023,
@@ -287,98 +316,3456 @@ func (this *PongMsgProc) Signature() uint16 {
 }
 
 
-// TestHeaderOpts runs all of the header set and get options on a variety
-// of header message type signatures.
-func TestHeaderOps(t *testing.T) {
-    for i := range headerTests {
-        testHeaders(headerTests[i], t)
+// BigEventHandler is a net.EventHandler implementation which forwards
+// new connections and received payloads to channels for inspection.
+type BigEventHandler struct {
+    allowErrs   bool
+    conChan     chan Connection
+    errChan     chan error
+    parent      *Protocol
+    rcvChan     chan []byte
+    t           *testing.T
+    timeoutChan chan *TimeoutEvent
+}
+
+// NewBigEventHandler returns a newly initialized BigEventHandler.
+func NewBigEventHandler(t *testing.T) *BigEventHandler {
+    handler := BigEventHandler {
+        conChan : make(chan Connection, 10),
+        rcvChan : make(chan []byte, 100),
+        t       : t,
     }
+
+    return &handler
 }
 
-// TestTCPSrv tests the TCPSrv class with a simple text messaging protocol.
-// Tests are performed with a variety of client counts and total message 
-// counts.
-func TestTCPSrv(t *testing.T) {
-    log.Info("")
+// Close performs no action for BigEventHandlers.
+func (this *BigEventHandler) Close() {}
 
-    // log.DebugLogs = true
+// Init saves a reference to the given protocol for future use.
+func (this *BigEventHandler) Init(proto *Protocol) {
+    this.parent = proto
+}
 
-    // srv
-    srvHandler   = new(PPEventSrv)
-    srvHandler.t = t
-    srvproto     = NewProtocol("SrvProto", srvHandler)
-    srvproto.AddSignature(pingMsgProc)
-    srvproto.AddSignature(pongMsgProc)
-    srvproto.SetAccessProvider(new(NoSecurity))
+// OnConnect forwards the new connection to conChan.
+func (this *BigEventHandler) OnConnect(con Connection) {
+    this.conChan<- con
+}
 
-    srvproto.ListenTcp(srvAddr)
+// OnDisconnect performs no action for BigEventHandlers.
+func (this *BigEventHandler) OnDisconnect(con Connection) {}
+
+// OnError forwards the error to errChan if one is set, otherwise it fails
+// the test, unless errors are expected.
+func (this *BigEventHandler) OnError(err error) {
+    if this.errChan != nil {
+        select {
+        case this.errChan<- err:
+        default:
+        }
+        return
+    }
 
-    <-time.After(1 * time.Second)
+    if this.allowErrs {
+        return
+    }
 
-    // run the tests
-    runSimpleTcpTest(1, 1, t)
-    runSimpleTcpTest(1, 10, t)
-    runSimpleTcpTest(1, 100, t)
-    runSimpleTcpTest(10, 1, t)
-    runSimpleTcpTest(10, 10, t)
-    runSimpleTcpTest(10, 100, t)
-    runSimpleTcpTest(100, 1, t)
-    runSimpleTcpTest(100, 10, t)
-    runSimpleTcpTest(100, 100, t)
+    this.t.Error(err)
+}
 
-    // shut everything down gracefully
-    srvproto.Shutdown()
+// OnReceive forwards the received payload to rcvChan.
+func (this *BigEventHandler) OnReceive(msg interface{}, fromId uint32, access byte) {
+    data, ok := msg.([]byte)
+    if !ok {
+        this.t.Errorf("unexpected type %T", msg)
+        return
+    }
+
+    this.rcvChan<- data
 }
 
-// TestUdp performs the same ping/pong network test as runSimpleTcpTest
-// but uses UDP as the transport instead.
-func TestUdp(t *testing.T) {
-    srvAddr := "127.0.0.1:8901"
-    cliAddr := "127.0.0.1:8902"
+// OnShutdown performs no action for BigEventHandlers.
+func (this *BigEventHandler) OnShutdown() {}
 
-    srvHandler   = new(PPEventSrv)
-    srvHandler.t = t
-    srvproto     = NewProtocol("UdpSrvTest", srvHandler)
-    srvproto.AddSignature(pingMsgProc)
-    srvproto.AddSignature(pongMsgProc)
-    srvproto.SetAccessProvider(new(NoSecurity))
+// OnTimeout forwards the timeout to timeoutChan if one is set, otherwise
+// it fails the test.
+func (this *BigEventHandler) OnTimeout(timeout *TimeoutEvent) {
+    if this.timeoutChan != nil {
+        this.timeoutChan<- timeout
+        return
+    }
 
-    _, err := srvproto.ListenUdp(srvAddr)
+    this.t.Errorf("Timeout: %+v", timeout)
+}
+
+
+// BigMsgProc is the message processor which handles serialization for
+// raw byte slice messages.
+type BigMsgProc struct {}
+
+// Close performs no action in BigMsgProc.
+func (this *BigMsgProc) Close() {}
+
+// Init performs no action in BigMsgProc.
+func (this *BigMsgProc) Init(proto *Protocol) {}
+
+// DeserializeMsg returns the raw payload of the received message.
+func (this *BigMsgProc) DeserializeMsg(
+    msg    *Msg,
+    access byte,
+) (interface{}, error) {
+    return msg.GetPayload(), nil
+}
+
+// SerializeMsg wraps the supplied byte slice in a new net.Msg.
+func (this *BigMsgProc) SerializeMsg(data interface{}) (*Msg, error) {
+    payload, ok := data.([]byte)
+    if !ok {
+        return nil, errors.New("Not a []byte type")
+    }
+
+    msg := NewMsg()
+    msg.SetMsgType(this.Signature())
+    msg.SetPayload(payload)
+
+    return msg, nil
+}
+
+// Signature returns BIG_MSG_TYPE.
+func (this *BigMsgProc) Signature() uint16 {
+    return BIG_MSG_TYPE
+}
+
+// RestrictedMsgProc is a BigMsgProc which requires a minimum access level.
+type RestrictedMsgProc struct {
+    BigMsgProc
+}
+
+// MinAccess returns the minimum access level for RestrictedMsgProc messages.
+func (this *RestrictedMsgProc) MinAccess() byte {
+    return 200
+}
+
+
+// ExtMsgProc is a BigMsgProc whose signature needs an extended header, and
+// which tags each message with a correlation id and sequence number.
+type ExtMsgProc struct {
+    BigMsgProc
+    corrId uint64
+    seq    uint32
+}
+
+// DeserializeMsg records the received correlation id and sequence number,
+// and returns the raw payload.
+func (this *ExtMsgProc) DeserializeMsg(
+    msg    *Msg,
+    access byte,
+) (interface{}, error) {
+    this.corrId = msg.CorrelationId()
+    this.seq    = msg.Sequence()
+
+    return msg.GetPayload(), nil
+}
+
+// SerializeMsg wraps the supplied byte slice in a new net.Msg, tagged with
+// a correlation id and sequence number.
+func (this *ExtMsgProc) SerializeMsg(data interface{}) (*Msg, error) {
+    payload, ok := data.([]byte)
+    if !ok {
+        return nil, errors.New("Not a []byte type")
+    }
+
+    msg := NewMsg()
+    msg.SetMsgType(this.Signature())
+    msg.SetPayload(payload)
+    msg.SetCorrelationId(0x1122334455667788)
+    msg.SetSequence(42)
+
+    return msg, nil
+}
+
+// Signature returns EXT_MSG_TYPE.
+func (this *ExtMsgProc) Signature() uint16 {
+    return EXT_MSG_TYPE
+}
+
+// ExtConflictProc is a different MsgProcessor type registered under
+// EXT_MSG_TYPE, to test signature conflict detection.
+type ExtConflictProc struct {
+    ExtMsgProc
+}
+
+// WideMsgProc is an ExtMsgProc registered under WIDE_MSG_TYPE, which
+// doesn't fit in a uint16.
+type WideMsgProc struct {
+    ExtMsgProc
+}
+
+// ExtSignature returns WIDE_MSG_TYPE.
+func (this *WideMsgProc) ExtSignature() uint32 {
+    return WIDE_MSG_TYPE
+}
+
+// SerializeMsg works like ExtMsgProc.SerializeMsg, but signs the message
+// with WIDE_MSG_TYPE.
+func (this *WideMsgProc) SerializeMsg(data interface{}) (*Msg, error) {
+    msg, err := this.ExtMsgProc.SerializeMsg(data)
     if err != nil {
-        t.Fatal(err.Error())
+        return nil, err
     }
 
-    <-time.After(1 * time.Second)
+    msg.SetExtMsgType(WIDE_MSG_TYPE)
 
-    cliHandler          = new(PPEventCli)
-    cliHandler.t        = t
-    cliHandler.msgCount = 100
-    cliproto            = NewProtocol("UdpCliTest", cliHandler)
-    cliproto.AddSignature(pingMsgProc)
-    cliproto.AddSignature(pongMsgProc)
-    cliproto.SetAccessProvider(new(NoSecurity))
+    return msg, nil
+}
 
-    cliSock, err := cliproto.ListenUdp(cliAddr)
+// ReconnectEventHandler is a BigEventHandler which also reports reconnect
+// and disconnect events.
+type ReconnectEventHandler struct {
+    *BigEventHandler
+    discoChan        chan Connection
+    reconnectedChan  chan Connection
+    reconnectingChan chan int
+}
+
+// NewReconnectEventHandler returns a new, initialized ReconnectEventHandler.
+func NewReconnectEventHandler(t *testing.T) *ReconnectEventHandler {
+    handler := ReconnectEventHandler {
+        BigEventHandler  : NewBigEventHandler(t),
+        discoChan        : make(chan Connection, 10),
+        reconnectedChan  : make(chan Connection, 10),
+        reconnectingChan : make(chan int, 100),
+    }
+
+    return &handler
+}
+
+// OnDisconnect reports disconnect events.
+func (this *ReconnectEventHandler) OnDisconnect(con Connection) {
+    this.discoChan<- con
+}
+
+// OnReconnected reports restored connections.
+func (this *ReconnectEventHandler) OnReconnected(con Connection) {
+    this.reconnectedChan<- con
+}
+
+// OnReconnecting reports reconnect attempts.
+func (this *ReconnectEventHandler) OnReconnecting(con Connection, attempt int) {
+    this.reconnectingChan<- attempt
+}
+
+// LevelAccess is an AccessProvider which grants every connection the same
+// access level.
+type LevelAccess struct {
+    level byte
+}
+
+// Authorize returns the provider's access level.
+func (this *LevelAccess) Authorize(con Connection) (byte, error) {
+    return this.level, nil
+}
+
+// Unused.
+func (this *LevelAccess) Close() {}
+
+// Unused.
+func (this *LevelAccess) Init(proto *Protocol) {}
+
+// DrainEventHandler is a BigEventHandler which reports peer shutdown notices,
+// and holds each received message for a while before forwarding it.
+type DrainEventHandler struct {
+    *BigEventHandler
+    delay        time.Duration
+    shutdownChan chan time.Duration
+}
+
+// NewDrainEventHandler returns a new, initialized DrainEventHandler.
+func NewDrainEventHandler(t *testing.T) *DrainEventHandler {
+    handler := DrainEventHandler {
+        BigEventHandler : NewBigEventHandler(t),
+        shutdownChan    : make(chan time.Duration, 10),
+    }
+
+    return &handler
+}
+
+// OnPeerShutdown reports the peer's grace period.
+func (this *DrainEventHandler) OnPeerShutdown(con Connection, grace time.Duration) {
+    this.shutdownChan<- grace
+}
+
+// OnReceive waits for the handler's delay before forwarding the payload.
+func (this *DrainEventHandler) OnReceive(
+    msg    interface{},
+    fromId uint32,
+    access byte,
+) {
+    <-time.After(this.delay)
+    this.BigEventHandler.OnReceive(msg, fromId, access)
+}
+
+// TestFragmentation sends messages larger than MAX_NET_MSG_LEN over both
+// TCP and UDP and validates that they are reassembled intact.
+func TestFragmentation(t *testing.T) {
+    payload := make([]byte, BIG_MSG_LEN)
+    for i := range payload {
+        payload[i] = byte(rand.Intn(256))
+    }
+
+    // tcp
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("FragTcpSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("FragTcpCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+
+    err := srv.ListenTcp("127.0.0.1:8903")
     if err != nil {
-        t.Fatal(err.Error())
+        t.Fatal(err)
     }
 
-    <-time.After(1 * time.Second)
+    err = cli.DialTcp("127.0.0.1:8903")
+    if err != nil {
+        t.Fatal(err)
+    }
 
-    waiter.Add(1)
-    err = cliproto.DialUdp(srvAddr, cliSock)
+    checkFragMsg(t, cli, <-cliHandler.conChan, srvHandler, payload)
+
+    // max size enforcement
+    cli.SetMaxMsgLen(BIG_MSG_LEN - 1)
+    cliHandler.allowErrs = true
+    con := cli.GetAllConnections()[0]
+    if cli.SendMsg(con.Id(), BIG_MSG_TYPE, payload) == nil {
+        t.Fatal("Msg larger than max size sent without error")
+    }
+
+    cli.Shutdown()
+    srv.Shutdown()
+
+    // udp
+    srvHandler = NewBigEventHandler(t)
+    srv        = NewProtocol("FragUdpSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+
+    cliHandler = NewBigEventHandler(t)
+    cli        = NewProtocol("FragUdpCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+
+    _, err = srv.ListenUdp("127.0.0.1:8904")
     if err != nil {
-        waiter.Done()
-        t.Fatal(err.Error())
+        t.Fatal(err)
     }
 
-    log.Info("Transmitting data...")
+    cliSock, err := cli.ListenUdp("127.0.0.1:8905")
+    if err != nil {
+        t.Fatal(err)
+    }
 
-    waiter.Wait()
+    err = cli.DialUdp("127.0.0.1:8904", cliSock)
+    if err != nil {
+        t.Fatal(err)
+    }
 
-    <-time.After(1 * time.Second)
+    checkFragMsg(t, cli, <-cliHandler.conChan, srvHandler, payload)
 
-    srvproto.Shutdown()
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestFragmentLimits opens reassemblies on a single connection until it
+// exceeds its in-flight fragment limits, and validates that all of its
+// reassemblies are dropped, and that fragments with forged counts are
+// rejected.
+func TestFragmentLimits(t *testing.T) {
+    proto := NewProtocol("FragLimits", NewBigEventHandler(t))
+    defer proto.Shutdown()
+
+    firstFrag := func(conId uint32) *Msg {
+        msg := NewMsg()
+        msg.SetMsgType(BIG_MSG_TYPE)
+        msg.SetPayload(make([]byte, BIG_MSG_LEN))
+
+        frame := proto.fragmentMsg(msg)[0]
+
+        frag := NewMsg()
+        frag.SetMsgType(SIG_FRAGMENT)
+        frag.SetPayload(frame[HEADER_LEN_B:])
+        frag.from = conId
+
+        return frag
+    }
+
+    checkUsage := func(conId uint32, expected int) {
+        proto.fragMutex.Lock()
+        msgs, _ := proto.fragUsage(conId)
+        proto.fragMutex.Unlock()
+
+        if msgs != expected {
+            t.Fatalf("Con %d has %d reassemblies, expected %d", conId, msgs, expected)
+        }
+    }
+
+    // message count
+    proto.SetFragmentLimits(2, 10 * BIG_MSG_LEN)
+
+    for i := 0; i < 2; i++ {
+        _, err := proto.reassembleMsg(firstFrag(1))
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    _, err := proto.reassembleMsg(firstFrag(2))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = proto.reassembleMsg(firstFrag(1))
+    if err != errFragLimit {
+        t.Fatalf("Expected fragment limit error, got %v", err)
+    }
+
+    checkUsage(1, 0)
+    checkUsage(2, 1)
+
+    // total bytes
+    proto.SetFragmentLimits(10, BIG_MSG_LEN + BIG_MSG_LEN / 2)
+
+    _, err = proto.reassembleMsg(firstFrag(3))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = proto.reassembleMsg(firstFrag(3))
+    if err != errFragLimit {
+        t.Fatalf("Expected fragment limit error, got %v", err)
+    }
+
+    checkUsage(3, 0)
+
+    // forged fragment counts are dropped before anything is allocated
+    forged := firstFrag(4)
+    copy(forged.GetPayload()[8:12], []byte{ 0xFF, 0xFF, 0xFF, 0xFF })
+
+    _, err = proto.reassembleMsg(forged)
+    if err != errFragMalformed {
+        t.Fatalf("Expected malformed fragment error, got %v", err)
+    }
+
+    checkUsage(4, 0)
+}
+
+// TestReliableOrdering feeds sequenced messages into a reliable endpoint's
+// receive window out of order and validates duplicate suppression, ordered
+// delivery, skipping of sequence numbers abandoned by the sender, and that
+// sequence numbers beyond the window are dropped.
+func TestReliableOrdering(t *testing.T) {
+    con := udpEndpoint {
+        rcvNext   : 1,
+        rcvWindow : make(map[uint32]*Msg),
+    }
+
+    msgs := make([]*Msg, 8)
+    for i := range msgs {
+        msgs[i] = NewMsg()
+        msgs[i].SetPayload([]byte{ byte(i) })
+    }
+
+    checkReady := func(ready []*Msg, expected ...int) {
+        if len(ready) != len(expected) {
+            t.Fatalf("Expected %d msgs ready, got %d", len(expected), len(ready))
+        }
+
+        for i := range expected {
+            if ready[i] != msgs[expected[i]] {
+                t.Fatalf("Msg %d delivered out of order", expected[i])
+            }
+        }
+    }
+
+    checkReady(con.deliverReliable(2, true, 1, msgs[2]))
+    checkReady(con.deliverReliable(3, true, 1, msgs[3]))
+    checkReady(con.deliverReliable(3, true, 1, msgs[3]))
+    checkReady(con.deliverReliable(1, true, 1, msgs[1]), 1, 2, 3)
+    checkReady(con.deliverReliable(2, true, 1, msgs[2]))
+
+    // sender gave up on 4, delivery should skip ahead
+    checkReady(con.deliverReliable(6, true, 4, msgs[6]))
+    checkReady(con.deliverReliable(7, true, 5, msgs[7]))
+    checkReady(con.deliverReliable(5, true, 5, msgs[5]), 5, 6, 7)
+
+    // unordered delivery passes messages through immediately
+    checkReady(con.deliverReliable(9, false, 8, msgs[1]), 1)
+    checkReady(con.deliverReliable(9, false, 8, msgs[1]))
+
+    if con.rcvNext != 8 {
+        t.Fatalf("Unexpected rcvNext %d", con.rcvNext)
+    }
+
+    // sequence numbers and low water marks beyond the window are dropped
+    checkReady(con.deliverReliable(8 + RELIABLE_WINDOW, false, 8, msgs[2]))
+    checkReady(con.deliverReliable(0xFFFFFFFF, true, 0xFFFFFFFF, msgs[3]))
+    checkReady(con.deliverReliable(10, false, 0xFFFFFFFF, msgs[4]))
+
+    if con.rcvNext != 8 || len(con.rcvWindow) != 1 {
+        t.Fatalf("Unexpected rcvNext %d, window %d", con.rcvNext, len(con.rcvWindow))
+    }
+}
+
+// TestUdpReliable sends a stream of messages over reliable, ordered UDP and
+// validates in-order delivery, acknowledgement, and retransmit exhaustion.
+func TestUdpReliable(t *testing.T) {
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("RelUdpSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetUdpDelivery(UDP_RELIABLE_ORDERED)
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("RelUdpCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetUdpDelivery(UDP_RELIABLE_ORDERED)
+    cli.SetUdpRetransmit(20, 2)
+
+    _, err := srv.ListenUdp("127.0.0.1:8906")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliSock, err := cli.ListenUdp("127.0.0.1:8907")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.DialUdp("127.0.0.1:8906", cliSock)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con := <-cliHandler.conChan
+    for i := 0; i < 50; i++ {
+        cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte{ byte(i) })
+    }
+
+    for i := 0; i < 50; i++ {
+        select {
+        case data := <-srvHandler.rcvChan:
+            if int(data[0]) != i {
+                t.Fatalf("Msg %d received out of order (expected %d)", data[0], i)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("Timed out waiting for reliable msg")
+        }
+    }
+
+    <-time.After(250 * time.Millisecond)
+
+    endpoint := con.(*udpEndpoint)
+    endpoint.relMutex.Lock()
+    pending := len(endpoint.unacked)
+    endpoint.relMutex.Unlock()
+
+    if pending > 0 {
+        t.Fatalf("%d datagrams remain unacknowledged", pending)
+    }
+
+    // nobody listening, retries should be exhausted
+    cliHandler.timeoutChan = make(chan *TimeoutEvent, 1)
+    err = cli.DialUdp("127.0.0.1:8908", cliSock)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con = <-cliHandler.conChan
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte{ 0 })
+
+    select {
+    case timeout := <-cliHandler.timeoutChan:
+        if timeout.TimeoutType != TIMEOUT_RETRANSMIT {
+            t.Fatalf("Unexpected timeout type %d", timeout.TimeoutType)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for retransmit exhaustion")
+    }
+
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestAeadCrypto validates AeadCrypto round trips, tamper detection and
+// replay detection, then sends encrypted messages between two UDP protocols.
+func TestAeadCrypto(t *testing.T) {
+    key := make([]byte, 32)
+    cryptorand.Read(key)
+
+    crypto, err := NewAeadCrypto(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    text := []byte("This is a secret test message")
+    msg  := NewMsg()
+    msg.SetMsgType(BIG_MSG_TYPE)
+    msg.SetPayload(text)
+
+    err = crypto.Encrypt(msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !GetMsgEncryptedFlag(msg.GetHeader()) {
+        t.Fatal("Encrypted flag not set after Encrypt")
+    }
+
+    if bytes.Contains(msg.GetPayload(), text) {
+        t.Fatal("Encrypted payload contains plaintext")
+    }
+
+    tampered := NewMsg()
+    tampered.SetHeader(msg.GetHeader())
+    tampered.SetPayload(append([]byte{}, msg.GetPayload()...))
+    tampered.GetPayload()[len(text) / 2] ^= 0xFF
+
+    if crypto.Decrypt(tampered) == nil {
+        t.Fatal("Tampered payload decrypted without error")
+    }
+
+    err = crypto.Decrypt(msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Equal(msg.GetPayload(), text) {
+        t.Fatal("Decrypted payload doesn't match original")
+    }
+
+    // replayed payloads are rejected, but reordered ones aren't
+    sealed := make([]*Msg, 2)
+    for i := range sealed {
+        sealed[i] = NewMsg()
+        sealed[i].SetMsgType(BIG_MSG_TYPE)
+        sealed[i].SetPayload(text)
+
+        err = crypto.Encrypt(sealed[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    open := func(sealedMsg *Msg) error {
+        copied := NewMsg()
+        copied.SetHeader(sealedMsg.GetHeader())
+        copied.SetPayload(append([]byte{}, sealedMsg.GetPayload()...))
+
+        return crypto.Decrypt(copied)
+    }
+
+    if open(sealed[1]) != nil || open(sealed[0]) != nil {
+        t.Fatal("Reordered payloads rejected")
+    }
+
+    if open(sealed[1]) != errAeadReplay || open(sealed[0]) != errAeadReplay {
+        t.Fatal("Replayed payload accepted")
+    }
+
+    // udp
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("AeadUdpSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srvCrypto, _ := NewAeadCrypto(key)
+    srv.SetCryptoProvider(srvCrypto)
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("AeadUdpCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cliCrypto, _ := NewAeadCrypto(key)
+    cli.SetCryptoProvider(cliCrypto)
+
+    _, err = srv.ListenUdp("127.0.0.1:8909")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliSock, err := cli.ListenUdp("127.0.0.1:8912")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.DialUdp("127.0.0.1:8909", cliSock)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con := <-cliHandler.conChan
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, text)
+
+    select {
+    case data := <-srvHandler.rcvChan:
+        if !bytes.Equal(data, text) {
+            t.Fatal("Received payload doesn't match original")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for encrypted msg")
+    }
+
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestTcpTLS sends a fragmented message over a TLS secured TCP connection
+// using a self-signed certificate generated for the test.
+func TestTcpTLS(t *testing.T) {
+    dir, err := ioutil.TempDir("", "goat-tls")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    certFile, keyFile := writeTestCert(t, dir)
+
+    srvTls, err := NewTLSConfig(certFile, keyFile, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliTls, err := NewTLSConfig("", "", certFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    payload := make([]byte, BIG_MSG_LEN)
+    for i := range payload {
+        payload[i] = byte(rand.Intn(256))
+    }
+
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("TlsSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("TlsCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+
+    if srv.ListenTcpTLS("127.0.0.1:8913", nil) == nil {
+        t.Fatal("ListenTcpTLS succeeded without a TLS config")
+    }
+
+    err = srv.ListenTcpTLS("127.0.0.1:8913", srvTls)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // plain tcp clients should fail the handshake
+    if cli.DialTcpTLS("127.0.0.1:8913", new(tls.Config)) == nil {
+        t.Fatal("TLS dial succeeded without trusting the server cert")
+    }
+
+    err = cli.DialTcpTLS("127.0.0.1:8913", cliTls)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    checkFragMsg(t, cli, <-cliHandler.conChan, srvHandler, payload)
+
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestCompression round trips data through each stock codec, then validates
+// codec negotiation between compressing peers and interoperability with a
+// peer which has no compression provider.
+func TestCompression(t *testing.T) {
+    text := []byte(strings.Repeat("compress me, compress me please. ", 1000))
+
+    codecs := []int { COMPRESS_FLATE, COMPRESS_GZIP, COMPRESS_LZ }
+    for _, codec := range codecs {
+        data, err := encodeCodec(codec, text)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if int(data[0]) != codec || len(data) >= len(text) {
+            t.Fatalf("Codec %d: bad encoding (%d bytes)", codec, len(data))
+        }
+
+        out, err := decodeCodec(codec, data[1:], len(text))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if !bytes.Equal(out, text) {
+            t.Fatalf("Codec %d: round trip mismatch", codec)
+        }
+
+        _, err = decodeCodec(codec, data[1:], len(text) - 1)
+        if err == nil {
+            t.Fatalf("Codec %d: decoded past max length", codec)
+        }
+    }
+
+    // tcp, both peers compress
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("CompressSrv", srvHandler)
+    srvComp    := NewCompressor(DEFAULT_COMPRESS_THRESHOLD_B)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetCompressionProvider(srvComp)
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("CompressCli", cliHandler)
+    cliComp    := NewCompressor(DEFAULT_COMPRESS_THRESHOLD_B, COMPRESS_GZIP)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetCompressionProvider(cliComp)
+    cli.SetHelloOnConnect(true)
+
+    err := srv.ListenTcp("127.0.0.1:8914")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.DialTcp("127.0.0.1:8914")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con := <-cliHandler.conChan
+    waitForCodec(t, cliComp, con, COMPRESS_GZIP)
+
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, text)
+    checkRcv(t, srvHandler, text)
+
+    if cliComp.Perfs().Value(PERF_COMPRESS_MSG_COMPRESSED) != 1 {
+        t.Fatal("Client didn't compress msg")
+    }
+
+    bytesIn  := cliComp.Perfs().Value(PERF_COMPRESS_BYTES_IN)
+    bytesOut := cliComp.Perfs().Value(PERF_COMPRESS_BYTES_OUT)
+    if bytesIn != int64(len(text)) || bytesOut >= bytesIn {
+        t.Fatalf("Bad compression counters (%d -> %d)", bytesIn, bytesOut)
+    }
+
+    // short messages stay uncompressed
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, text[:10])
+    checkRcv(t, srvHandler, text[:10])
+
+    if cliComp.Perfs().Value(PERF_COMPRESS_MSG_SKIPPED) != 1 {
+        t.Fatal("Short msg not skipped")
+    }
+
+    // peer without compression support
+    oldHandler := NewBigEventHandler(t)
+    old        := NewProtocol("CompressOld", oldHandler)
+    old.AddSignature(new(BigMsgProc))
+    old.SetAccessProvider(new(NoSecurity))
+
+    err = old.DialTcp("127.0.0.1:8914")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    <-oldHandler.conChan
+    <-srvHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    srv.SendMsg(srvCon.Id(), BIG_MSG_TYPE, text)
+    checkRcv(t, oldHandler, text)
+
+    old.Shutdown()
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestCredentialAccess logs clients in against a config backed credential
+// store and validates that per-signature access levels are enforced.
+func TestCredentialAccess(t *testing.T) {
+    dir, err := ioutil.TempDir("", "goat-login")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    iniPath := filepath.Join(dir, "users.ini")
+    iniData := fmt.Sprintf(
+        "[LoginTest.Users]\nadmin = %s, 255\nguest = %s, 10\n",
+        HashSecret("admin", "adminpass"),
+        HashSecret("guest", "guestpass"),
+    )
+
+    err = ioutil.WriteFile(iniPath, []byte(iniData), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    iniDir        := config.IniDir
+    config.IniDir  = dir
+    defer func() { config.IniDir = iniDir }()
+
+    provider := config.InitIniProvider("users.ini", 1)
+    defer config.UnregisterConfigProvider(provider)
+
+    srvHandler := NewBigEventHandler(t)
+    srvHandler.allowErrs = true
+    srv := NewProtocol("LoginSrv", srvHandler)
+    srv.AddSignature(new(RestrictedMsgProc))
+    srv.SetAccessProvider(NewCredentialAccess(
+        NewCredentialStore("LoginTest.Users"),
+    ))
+
+    err = srv.ListenTcp("127.0.0.1:8915")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    text := []byte("restricted msg")
+
+    // admin meets the minimum access level
+    admin, adminCon := loginTestCli(t, "LoginAdmin", "admin", "adminpass", true)
+    admin.SendMsg(adminCon.Id(), BIG_MSG_TYPE, text)
+    checkRcv(t, srvHandler, text)
+
+    // guest is logged in, but below the minimum access level
+    guest, guestCon := loginTestCli(t, "LoginGuest", "guest", "guestpass", true)
+    guest.SendMsg(guestCon.Id(), BIG_MSG_TYPE, text)
+
+    // bad secret
+    bad, _ := loginTestCli(t, "LoginBad", "admin", "wrongpass", false)
+
+    select {
+    case <-srvHandler.rcvChan:
+        t.Fatal("Unprivileged msg was delivered")
+    case <-time.After(1 * time.Second):
+    }
+
+    if srv.perfs.Value(PERF_PROTO_ERR_NO_ACCESS) < 1 {
+        t.Fatal("Unprivileged msg not counted")
+    }
+
+    if srv.perfs.Value(PERF_PROTO_ERR_AUTH_CLIENT) != 1 {
+        t.Fatal("Bad login not counted")
+    }
+
+    // login results are only accepted by clients waiting for one
+    forged := []byte { LOGIN_RESULT, ACCESS_MAX }
+    for _, access := range []*CredentialAccess {
+        NewCredentialAccess(nil),
+        NewCredentialAccess(NewCredentialStore("LoginTest.Users")),
+    } {
+        _, err = access.OnLogin(adminCon, forged)
+        if err == nil {
+            t.Fatal("Unsolicited login result accepted")
+        }
+
+        level, _ := access.Authorize(adminCon)
+        if level != ACCESS_NONE {
+            t.Fatalf("Unsolicited login result granted access %d", level)
+        }
+    }
+
+    bad.Shutdown()
+    guest.Shutdown()
+    admin.Shutdown()
+    srv.Shutdown()
+}
+
+// TestTcpReconnect drops and restores a dialed connection, validating that
+// the connection id is stable, queued messages are replayed, and that the
+// connection is reported as disconnected once the reconnect policy gives up.
+func TestTcpReconnect(t *testing.T) {
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("ReconnectSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+
+    cliHandler := NewReconnectEventHandler(t)
+    cli        := NewProtocol("ReconnectCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+
+    err := srv.ListenTcp("127.0.0.1:8916")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    policy            := NewReconnectPolicy()
+    policy.DelayMs     = 50
+    policy.MaxDelayMs  = 100
+    policy.MaxAttempts = 5
+
+    err = cli.DialTcpReconnect("127.0.0.1:8916", nil, policy)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con  := <-cliHandler.conChan
+    text := []byte("before disconnect")
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, text)
+    checkRcv(t, srvHandler, text)
+
+    // server drops the client
+    srvCon := <-srvHandler.conChan
+    srvCon.Close()
+
+    select {
+    case <-cliHandler.reconnectedChan:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for reconnect")
+    }
+
+    if cli.GetConnection(con.Id()) != con {
+        t.Fatal("Connection id changed across reconnect")
+    }
+
+    for len(cliHandler.reconnectingChan) > 0 {
+        <-cliHandler.reconnectingChan
+    }
+
+    text = []byte("after reconnect")
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, text)
+    checkRcv(t, srvHandler, text)
+
+    // server goes away, messages are queued until it returns
+    srv.Shutdown()
+
+    select {
+    case <-cliHandler.reconnectingChan:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for reconnect attempt")
+    }
+
+    text = []byte("queued msg")
+    cli.SendMsg(con.Id(), BIG_MSG_TYPE, text)
+
+    srvHandler = NewBigEventHandler(t)
+    srv        = NewProtocol("ReconnectSrv2", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+
+    err = srv.ListenTcp("127.0.0.1:8916")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    checkRcv(t, srvHandler, text)
+
+    // server goes away for good
+    srv.Shutdown()
+
+    select {
+    case <-cliHandler.discoChan:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for reconnect policy to give up")
+    }
+
+    if cli.GetConnection(con.Id()) != nil {
+        t.Fatal("Connection still registered after reconnect failure")
+    }
+
+    cli.Shutdown()
+}
+
+// TestKeepalive validates RTT measurement between peers with keepalives
+// enabled, that legacy TCP peers are left connected while idle, and the
+// eviction of idle UDP peers.
+func TestKeepalive(t *testing.T) {
+    srvHandler := NewReconnectEventHandler(t)
+    srv        := NewProtocol("KeepaliveSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetKeepalive(50, 500)
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("KeepaliveCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetHelloOnConnect(true)
+    cli.SetKeepalive(50, 500)
+
+    err := srv.ListenTcp("127.0.0.1:8917")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.DialTcp("127.0.0.1:8917")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    // rtt
+    <-time.After(300 * time.Millisecond)
+
+    if cli.RTT(con.Id()) <= 0 || srv.RTT(srvCon.Id()) <= 0 {
+        t.Fatal("No RTT measured")
+    }
+
+    // legacy tcp peers, which never send control messages, stay connected
+    // past the idle timeout
+    rawTcp, err := stdnet.Dial("tcp", "127.0.0.1:8917")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rawTcp.Close()
+
+    legacyCon := <-srvHandler.conChan
+
+    select {
+    case discoCon := <-srvHandler.discoChan:
+        t.Fatalf("Legacy connection evicted (%v)", discoCon.Id())
+    case <-time.After(1 * time.Second):
+    }
+
+    if srv.GetConnection(legacyCon.Id()) == nil {
+        t.Fatal("Legacy connection removed")
+    }
+
+    if cli.GetConnection(con.Id()) == nil {
+        t.Fatal("Live connection evicted")
+    }
+
+    // idle udp peer
+    _, err = srv.ListenUdp("127.0.0.1:8918")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rawUdp, err := stdnet.Dial("udp", "127.0.0.1:8918")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rawUdp.Close()
+
+    msg := NewMsg()
+    msg.SetMsgType(BIG_MSG_TYPE)
+    msg.SetPayload([]byte("hello"))
+    rawUdp.Write(msg.GetBytes())
+
+    checkRcv(t, srvHandler.BigEventHandler, []byte("hello"))
+    <-srvHandler.conChan
+
+    select {
+    case <-srvHandler.discoChan:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for idle udp eviction")
+    }
+
+    if srv.perfs.Value(PERF_PROTO_IDLE_EVICT) != 1 {
+        t.Fatal("Evictions not counted")
+    }
+
+    // the listener must survive evicting its endpoints
+    rawUdp.Write(msg.GetBytes())
+    checkRcv(t, srvHandler.BigEventHandler, []byte("hello"))
+
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestRpc validates rpc calls between peers, including large, failed,
+// timed out, cancelled and orphaned requests.
+func TestRpc(t *testing.T) {
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("RpcSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetCompressionProvider(NewCompressor(DEFAULT_COMPRESS_THRESHOLD_B))
+    srv.HandleRpc(BIG_MSG_TYPE, func(
+        req    interface{},
+        fromId uint32,
+        access byte,
+    ) (interface{}, error) {
+        data := req.([]byte)
+
+        switch string(data) {
+        case "fail":
+            return nil, errors.New("rpc failed")
+        case "slow":
+            <-time.After(500 * time.Millisecond)
+        case "hang":
+            <-time.After(5 * time.Second)
+        }
+
+        return bytes.ToUpper(data), nil
+    })
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("RpcCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetCompressionProvider(NewCompressor(DEFAULT_COMPRESS_THRESHOLD_B))
+
+    err := srv.ListenTcp("127.0.0.1:8919")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.DialTcp("127.0.0.1:8919")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    // concurrent calls
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+
+            req       := []byte(fmt.Sprintf("call %d", i))
+            resp, err := cli.Call(con.Id(), BIG_MSG_TYPE, req, 5 * time.Second)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+
+            if !bytes.Equal(resp.([]byte), bytes.ToUpper(req)) {
+                t.Errorf("Wrong response %q", resp)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    // fragmented
+    req := make([]byte, BIG_MSG_LEN)
+    for i := range req {
+        req[i] = byte('a' + rand.Intn(26))
+    }
+
+    resp, err := cli.Call(con.Id(), BIG_MSG_TYPE, req, 5 * time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Equal(resp.([]byte), bytes.ToUpper(req)) {
+        t.Fatal("Fragmented response mismatch")
+    }
+
+    // handler error
+    _, err = cli.Call(con.Id(), BIG_MSG_TYPE, []byte("fail"), 5 * time.Second)
+    if err == nil || err.Error() != "rpc failed" {
+        t.Fatalf("Expected handler error, got %v", err)
+    }
+
+    // timeout
+    _, err = cli.Call(con.Id(), BIG_MSG_TYPE, []byte("slow"), 100 * time.Millisecond)
+    if err != context.DeadlineExceeded {
+        t.Fatalf("Expected timeout, got %v", err)
+    }
+
+    if cli.perfs.Value(PERF_PROTO_RPC_TIMEOUT) != 1 {
+        t.Fatal("Timeout not counted")
+    }
+
+    // cancellation
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        <-time.After(100 * time.Millisecond)
+        cancel()
+    }()
+
+    _, err = cli.CallContext(ctx, con.Id(), BIG_MSG_TYPE, []byte("slow"))
+    if err != context.Canceled {
+        t.Fatalf("Expected cancellation, got %v", err)
+    }
+
+    // no handler
+    srvHandler.allowErrs = true
+    srv.HandleRpc(BIG_MSG_TYPE, nil)
+
+    _, err = cli.Call(con.Id(), BIG_MSG_TYPE, []byte("none"), 5 * time.Second)
+    if err != ErrNoRpcHandler {
+        t.Fatalf("Expected ErrNoRpcHandler, got %v", err)
+    }
+
+    // orphaned by disconnect
+    srv.HandleRpc(BIG_MSG_TYPE, func(
+        req    interface{},
+        fromId uint32,
+        access byte,
+    ) (interface{}, error) {
+        <-time.After(5 * time.Second)
+        return req, nil
+    })
+
+    go func() {
+        <-time.After(100 * time.Millisecond)
+        srvCon.Close()
+    }()
+
+    _, err = cli.Call(con.Id(), BIG_MSG_TYPE, []byte("hang"), 5 * time.Second)
+    if err != ErrRpcClosed {
+        t.Fatalf("Expected ErrRpcClosed, got %v", err)
+    }
+
+    cli.Shutdown()
+    srv.Shutdown()
+}
+
+// TestTransports sends messages through full protocol pipelines over the
+// in-memory and unix domain socket transports.
+func TestTransports(t *testing.T) {
+    dir, err := ioutil.TempDir("", "goat-transport")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    addrs := map[string]string {
+        TRANSPORT_MEM  : "transport-test",
+        TRANSPORT_UNIX : filepath.Join(dir, "transport.sock"),
+    }
+
+    for transport, addr := range addrs {
+        srvHandler := NewBigEventHandler(t)
+        srv        := NewProtocol("TransportSrv" + transport, srvHandler)
+        srv.AddSignature(new(BigMsgProc))
+        srv.SetAccessProvider(new(NoSecurity))
+
+        cliHandler := NewBigEventHandler(t)
+        cli        := NewProtocol("TransportCli" + transport, cliHandler)
+        cli.AddSignature(new(BigMsgProc))
+        cli.SetAccessProvider(new(NoSecurity))
+
+        err := srv.Listen(transport, addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        err = srv.Listen(transport, addr)
+        if err == nil {
+            t.Fatalf("Listened twice on %s %s", transport, addr)
+        }
+
+        err = cli.Dial(transport, addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        con    := <-cliHandler.conChan
+        srvCon := <-srvHandler.conChan
+
+        data := make([]byte, BIG_MSG_LEN)
+        for i := range data {
+            data[i] = byte(rand.Intn(256))
+        }
+
+        err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, data)
+        if err != nil {
+            t.Fatal(err)
+        }
+        checkRcv(t, srvHandler, data)
+
+        err = srv.SendMsg(srvCon.Id(), BIG_MSG_TYPE, []byte("reply"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        checkRcv(t, cliHandler, []byte("reply"))
+
+        err = cli.SendMsgPriority(con.Id(), BIG_MSG_TYPE, data, PRIORITY_LOW)
+        if err != nil {
+            t.Fatal(err)
+        }
+        checkRcv(t, srvHandler, data)
+
+        cli.Shutdown()
+        srv.Shutdown()
+    }
+
+    cli := NewProtocol("TransportCliErr", NewBigEventHandler(t))
+    defer cli.Shutdown()
+
+    if cli.Dial("bogus", "nowhere") == nil {
+        t.Fatal("Dialed unknown transport")
+    }
+
+    if cli.Dial(TRANSPORT_MEM, "transport-test") == nil {
+        t.Fatal("Dialed closed in-memory listener")
+    }
+}
+
+// TestWebSocket exchanges messages between protocols over the WebSocket
+// transport, and validates that plain HTTP requests are refused.
+func TestWebSocket(t *testing.T) {
+    InitHttpSrv("127.0.0.1:8920")
+
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("WebSocketSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("WebSocketCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+
+    err := srv.Listen(TRANSPORT_WS, "/wstest")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if srv.Listen(TRANSPORT_WS, "/wstest") == nil {
+        t.Fatal("Listened twice on the same path")
+    }
+
+    // wait for the http server to come up
+    for i := 0; i < 50; i++ {
+        err = cli.Dial(TRANSPORT_WS, "ws://127.0.0.1:8920/wstest")
+        if err == nil {
+            break
+        }
+
+        <-time.After(100 * time.Millisecond)
+    }
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    data := make([]byte, BIG_MSG_LEN)
+    for i := range data {
+        data[i] = byte(rand.Intn(256))
+    }
+
+    err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkRcv(t, srvHandler, data)
+
+    err = srv.SendMsg(srvCon.Id(), BIG_MSG_TYPE, []byte("reply"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkRcv(t, cliHandler, []byte("reply"))
+
+    resp, err := http.Get("http://127.0.0.1:8920/wstest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Fatalf("Plain request not refused (%s)", resp.Status)
+    }
+
+    // cross-origin upgrades are refused unless the origin is allowed
+    req, err := http.NewRequest("GET", "http://127.0.0.1:8920/wstest", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+    req.Header.Set("Sec-WebSocket-Version", "13")
+    req.Header.Set("Origin", "http://evil.example")
+
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("Cross-origin upgrade not refused (%s)", resp.Status)
+    }
+
+    if !wsOriginAllowed(req, []string { "http://evil.example" }) ||
+        !wsOriginAllowed(req, []string { "*" }) {
+        t.Fatal("Allowed origin refused")
+    }
+
+    req.Header.Set("Origin", "http://127.0.0.1:8920")
+    if !wsOriginAllowed(req, nil) {
+        t.Fatal("Same-origin request refused")
+    }
+
+    req.Header.Del("Origin")
+    if !wsOriginAllowed(req, []string { "http://evil.example" }) {
+        t.Fatal("Request without origin refused")
+    }
+
+    // continuations are accepted only while a fragmented frame is open
+    local, remote := stdnet.Pipe()
+    wsCon         := newWsConn(local, bufio.NewReader(local), false)
+
+    go func() {
+        remote.Write([]byte {
+            WS_OP_BINARY, wsMaskBit | 1, 0, 0, 0, 0, 'a',
+            wsFinBit | WS_OP_CONTINUATION, wsMaskBit | 1, 0, 0, 0, 0, 'b',
+            wsFinBit | WS_OP_CONTINUATION, wsMaskBit | 1, 0, 0, 0, 0, 'c',
+        })
+    }()
+
+    buffer := make([]byte, 2)
+    for _, expected := range []string { "a", "b" } {
+        count, err := wsCon.Read(buffer)
+        if err != nil || string(buffer[:count]) != expected {
+            t.Fatalf("Fragment read %q (%v), expected %q", buffer[:count], err, expected)
+        }
+    }
+
+    closeChan := make(chan []byte, 1)
+    go func() {
+        frame := make([]byte, 4)
+        io.ReadFull(remote, frame)
+        closeChan <- frame
+    }()
+
+    _, err = wsCon.Read(buffer)
+    if err != errWsProtocol {
+        t.Fatalf("Stray continuation accepted (%v)", err)
+    }
+
+    frame := <-closeChan
+    if frame[0] != wsFinBit | WS_OP_CLOSE ||
+        binary.BigEndian.Uint16(frame[2:]) != WS_CLOSE_PROTOCOL {
+        t.Fatalf("Stray continuation close frame % x", frame)
+    }
+
+    local.Close()
+    remote.Close()
+
+    cli.Shutdown()
+    srv.Shutdown()
+
+    resp, err = http.Get("http://127.0.0.1:8920/wstest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode != http.StatusNotFound {
+        t.Fatalf("Stopped path still served (%s)", resp.Status)
+    }
+}
+
+// TestTopics subscribes clients to a topic shared by two federated servers,
+// and validates that published messages reach subscribers on both.
+func TestTopics(t *testing.T) {
+    newProto := func(name string) (*Protocol, *BigEventHandler) {
+        handler := NewBigEventHandler(t)
+        proto   := NewProtocol(name, handler)
+        proto.AddSignature(new(BigMsgProc))
+        proto.SetAccessProvider(new(NoSecurity))
+
+        return proto, handler
+    }
+
+    dial := func(proto, srv *Protocol, addr string) Connection {
+        err := proto.Dial(TRANSPORT_MEM, addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        con := <-proto.evtHandler.(*BigEventHandler).conChan
+        <-srv.evtHandler.(*BigEventHandler).conChan
+
+        return con
+    }
+
+    srvA, srvAHandler := newProto("TopicSrvA")
+    srvB, srvBHandler := newProto("TopicSrvB")
+    cli1, cli1Handler := newProto("TopicCli1")
+    cli2, cli2Handler := newProto("TopicCli2")
+    cli3, _           := newProto("TopicCli3")
+
+    err := srvA.Listen(TRANSPORT_MEM, "topic-a")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = srvB.Listen(TRANSPORT_MEM, "topic-b")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con1 := dial(cli1, srvB, "topic-b")
+    con2 := dial(cli2, srvA, "topic-a")
+    con3 := dial(cli3, srvA, "topic-a")
+    peer := dial(srvB, srvA, "topic-a")
+
+    if cli1.Subscribe(con1.Id(), "") == nil {
+        t.Fatal("Subscribed to empty topic name")
+    }
+
+    err = cli1.Subscribe(con1.Id(), "room")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli2.Subscribe(con2.Id(), "room")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = srvB.Federate(peer.Id(), "room")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForTopic(t, "TopicSrvA", "room", 1, 1)
+    waitForTopic(t, "TopicSrvB", "room", 1, 1)
+
+    if fmt.Sprint(srvA.Topics()) != "[room]" {
+        t.Fatalf("Unexpected topics %v", srvA.Topics())
+    }
+
+    // only subscribers and peers may publish
+    srvAHandler.errChan = make(chan error, 1)
+
+    data := []byte("not subscribed")
+    err   = cli3.PublishTo(con3.Id(), "room", BIG_MSG_TYPE, data)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForErr(t, srvAHandler, "Publish denied")
+
+    // subscriptions are limited per connection
+    srvA.SetTopicLimit(1)
+
+    err = cli3.Subscribe(con3.Id(), "lobby")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForTopic(t, "TopicSrvA", "lobby", 1, 0)
+
+    err = cli3.Subscribe(con3.Id(), "other")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForErr(t, srvAHandler, "Subscription denied")
+
+    // subscribers need publish access
+    srvA.SetAccessProvider(&LevelAccess { level : 1 })
+
+    data = []byte("no publish access")
+    err  = cli3.PublishTo(con3.Id(), "lobby", BIG_MSG_TYPE, data)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForErr(t, srvAHandler, "Publish denied")
+    srvA.SetAccessProvider(new(NoSecurity))
+    srvAHandler.errChan = nil
+
+    // publish through srvA, which forwards to srvB
+    data = []byte("published")
+    err  = cli2.PublishTo(con2.Id(), "room", BIG_MSG_TYPE, data)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    checkRcv(t, srvAHandler, data)
+    checkRcv(t, cli2Handler, data)
+    checkRcv(t, srvBHandler, data)
+    checkRcv(t, cli1Handler, data)
+
+    perfsA := perf.GetCounterSet(perfName("TopicSrvA.Topic.room"))
+    if perfsA.Value(PERF_TOPIC_PUBLISH) != 1 ||
+        perfsA.Value(PERF_TOPIC_DELIVER) != 2 {
+        t.Fatalf("Unexpected topic perfs %v", perfsA)
+    }
+
+    perfsB := perf.GetCounterSet(perfName("TopicSrvB.Topic.room"))
+    if perfsB.Value(PERF_TOPIC_RCV_PEER) != 1 ||
+        perfsB.Value(PERF_TOPIC_DELIVER) != 1 {
+        t.Fatalf("Unexpected topic perfs %v", perfsB)
+    }
+
+    // publish locally on srvB after cli2 leaves the topic
+    err = cli2.Unsubscribe(con2.Id(), "room")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForTopic(t, "TopicSrvA", "room", 0, 1)
+
+    data = []byte("local")
+    err  = srvB.Publish("room", BIG_MSG_TYPE, data)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    checkRcv(t, cli1Handler, data)
+    checkRcv(t, srvAHandler, data)
+
+    select {
+    case <-cli2Handler.rcvChan:
+        t.Fatal("Unsubscribed client received published msg")
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    // topics are removed once their last member leaves
+    con1.Close()
+    peer.Close()
+
+    for i := 0; i < 50 && len(srvB.Topics()) > 0; i++ {
+        <-time.After(100 * time.Millisecond)
+    }
+
+    if len(srvB.Topics()) > 0 {
+        t.Fatalf("Topics not removed %v", srvB.Topics())
+    }
+
+    if perf.GetCounterSet(perfName("TopicSrvB.Topic.room")) != nil {
+        t.Fatal("Topic perfs not removed")
+    }
+
+    cli1.Shutdown()
+    cli2.Shutdown()
+    cli3.Shutdown()
+    srvB.Shutdown()
+    srvA.Shutdown()
+}
+
+// TestSendQueue validates the send queue overflow policies, and that a
+// stalled member doesn't block a BroadcastGroup.
+func TestSendQueue(t *testing.T) {
+    syncObj := lifecycle.New()
+    msg     := func(b byte) []byte { return []byte { b, b, b, b } }
+
+    limits := SendQueueLimits { MaxBytes : 8, MaxMsgs : 3 }
+
+    // drop newest
+    limits.Policy = SEND_QUEUE_DROP_NEWEST
+    q            := newSendQueue(limits)
+    q.push(msg(1), PRIORITY_NORMAL, 1, syncObj)
+    q.push(msg(2), PRIORITY_NORMAL, 1, syncObj)
+    if q.push(msg(3), PRIORITY_NORMAL, 1, syncObj) != pushDropped {
+        t.Fatal("Newest msg not dropped at byte limit")
+    }
+
+    if !bytes.Equal(q.pop(), msg(1)) || !bytes.Equal(q.pop(), msg(2)) {
+        t.Fatal("Unexpected queue contents after drop newest")
+    }
+
+    // drop oldest
+    limits.Policy = SEND_QUEUE_DROP_OLDEST
+    q             = newSendQueue(limits)
+    for i := 1; i <= 3; i++ {
+        if q.push(msg(byte(i)), PRIORITY_NORMAL, 1, syncObj) != pushOk {
+            t.Fatal("Msg not queued with drop oldest")
+        }
+    }
+
+    if !bytes.Equal(q.pop(), msg(2)) || !bytes.Equal(q.pop(), msg(3)) {
+        t.Fatal("Unexpected queue contents after drop oldest")
+    }
+
+    if q.pop() != nil {
+        t.Fatal("Queue not empty")
+    }
+
+    // oversized msgs are accepted by an empty queue
+    if q.push(make([]byte, 16), PRIORITY_NORMAL, 1, syncObj) != pushOk {
+        t.Fatal("Oversized msg rejected by empty queue")
+    }
+
+    // disconnect
+    limits.MaxBytes = 0
+    limits.Policy   = SEND_QUEUE_DISCONNECT
+    q               = newSendQueue(limits)
+    for i := 0; i < 3; i++ {
+        q.push(msg(0), PRIORITY_NORMAL, 1, syncObj)
+    }
+
+    if q.push(msg(0), PRIORITY_NORMAL, 1, syncObj) != pushOverflow {
+        t.Fatal("Overflow not reported at msg limit")
+    }
+
+    // block waits for room
+    limits.Policy = SEND_QUEUE_BLOCK
+    q             = newSendQueue(limits)
+    for i := 0; i < 3; i++ {
+        q.push(msg(0), PRIORITY_NORMAL, 1, syncObj)
+    }
+
+    go func() {
+        <-time.After(100 * time.Millisecond)
+        q.pop()
+    }()
+
+    if q.push(msg(0), PRIORITY_NORMAL, 5, syncObj) != pushOk {
+        t.Fatal("Blocked msg not queued after room was made")
+    }
+
+    if q.push(msg(0), PRIORITY_NORMAL, 0, syncObj) != pushTimeout {
+        t.Fatal("Full queue didn't time out")
+    }
+
+    if sendqPerfs.Value(PERF_SENDQ_HIGH_WATER_MSGS) < 3 {
+        t.Fatal("High water mark not recorded")
+    }
+
+    // classes are interleaved by weight
+    q = newSendQueue(SendQueueLimits {})
+    for _, priority := range []int { PRIORITY_LOW, PRIORITY_NORMAL, PRIORITY_HIGH } {
+        for i := 0; i < 5; i++ {
+            q.push(msg(byte(priority)), priority, 1, syncObj)
+        }
+    }
+
+    sentHigh := sendqPerfs.Value(PERF_SENDQ_SENT_HIGH)
+    expected := []int {
+        PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_HIGH, PRIORITY_HIGH,
+        PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_NORMAL, PRIORITY_NORMAL,
+        PRIORITY_LOW,
+        PRIORITY_NORMAL,
+        PRIORITY_LOW, PRIORITY_LOW, PRIORITY_LOW, PRIORITY_LOW,
+    }
+
+    for i := range expected {
+        data := q.pop()
+        if data == nil || int(data[0]) != expected[i] {
+            t.Fatalf("Unexpected priority at %d (%v / %d)", i, data, expected[i])
+        }
+    }
+
+    if sendqPerfs.Value(PERF_SENDQ_SENT_HIGH) - sentHigh != 5 {
+        t.Fatal("High priority sends not counted")
+    }
+
+    // a stalled group member doesn't block the others
+    newCon := func(socket stdnet.Conn, maxMsgs int) *tcpCon {
+        con := tcpCon {
+            id          : NextNetID(),
+            sendQ       : newSendQueue(SendQueueLimits { MaxMsgs : maxMsgs }),
+            socket      : socket,
+            syncObj     : lifecycle.New(),
+            timeoutChan : make(chan *TimeoutEvent, 100),
+        }
+        con.startHandlers()
+
+        return &con
+    }
+
+    slowEnd, slowRemote := stdnet.Pipe()
+    fastEnd, fastRemote := stdnet.Pipe()
+    defer slowRemote.Close()
+
+    slow := newCon(slowEnd, 2)
+    fast := newCon(fastEnd, 10)
+
+    rcvd := make(chan int)
+    go func() {
+        total := 0
+        buf   := make([]byte, 64)
+        for total < 40 {
+            count, err := fastRemote.Read(buf)
+            if err != nil {
+                break
+            }
+            total += count
+        }
+        rcvd<- total
+    }()
+
+    group := NewBroadcastGroup("sendqueue")
+    group.AddConnection(slow)
+    group.AddConnection(fast)
+
+    for i := 0; i < 10; i++ {
+        group.Send(msg(byte(i)), DEFAULT_MSG_TIMEOUT_SEC)
+    }
+
+    select {
+    case total := <-rcvd:
+        if total != 40 {
+            t.Fatalf("Fast member received %d / 40 bytes", total)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Group send blocked by stalled member")
+    }
+
+    if len(slow.timeoutChan) < 1 {
+        t.Fatal("No send timeouts reported for stalled member")
+    }
+
+    slow.Close()
+    fast.Close()
+}
+
+// TestHandshake validates that peers exchange version and capability
+// information on connect, that incompatible peers are disconnected, and
+// that messages the remote peer can't handle are rejected before sending.
+func TestHandshake(t *testing.T) {
+    srvHandler          := NewBigEventHandler(t)
+    srvHandler.allowErrs = true
+    srv                 := NewProtocol("HandshakeSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.AddSignature(new(PingMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetVersion("handshake", 3, 2)
+    defer srv.Shutdown()
+
+    err := srv.Listen(TRANSPORT_MEM, "handshake-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("HandshakeCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetHelloOnConnect(true)
+    cli.SetVersion("handshake", 2, 1)
+    defer cli.Shutdown()
+
+    err = cli.Dial(TRANSPORT_MEM, "handshake-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    srvInfo := waitForPeer(t, cli, con.Id())
+    cliInfo := waitForPeer(t, srv, srvCon.Id())
+
+    if srvInfo.Name != "handshake" || srvInfo.Version != 3 || srvInfo.MinVersion != 2 {
+        t.Fatalf("Bad server info: %+v", srvInfo)
+    }
+
+    if !srvInfo.Supports(PING_MSG_TYPE) || !srvInfo.Supports(BIG_MSG_TYPE) {
+        t.Fatalf("Server signatures missing: %v", srvInfo.Signatures)
+    }
+
+    if cliInfo.Version != 2 || cliInfo.Supports(PING_MSG_TYPE) {
+        t.Fatalf("Bad client info: %+v", cliInfo)
+    }
+
+    err = srv.SendMsg(srvCon.Id(), PING_MSG_TYPE, new(PPMsg))
+    if err == nil {
+        t.Fatal("Sent unsupported signature to client")
+    }
+
+    if srv.perfs.Value(PERF_PROTO_ERR_PEER_UNSUPPORTED) != 1 {
+        t.Fatal("Unsupported signature not counted")
+    }
+
+    err = srv.SendMsg(srvCon.Id(), BIG_MSG_TYPE, []byte("supported"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkRcv(t, cliHandler, []byte("supported"))
+
+    bad := map[string]uint32 {
+        "handshake" : 1,
+        "other"     : 3,
+    }
+
+    for name, version := range bad {
+        badHandler          := NewBigEventHandler(t)
+        badHandler.allowErrs = true
+        badCli              := NewProtocol("HandshakeBad" + name, badHandler)
+        badCli.AddSignature(new(BigMsgProc))
+        badCli.SetAccessProvider(new(NoSecurity))
+        badCli.SetHelloOnConnect(true)
+        badCli.SetVersion(name, version, 1)
+
+        errs := srv.perfs.Value(PERF_PROTO_ERR_HANDSHAKE)
+
+        err = badCli.Dial(TRANSPORT_MEM, "handshake-test")
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        <-badHandler.conChan
+        <-srvHandler.conChan
+
+        for i := 0; i < 50; i++ {
+            if srv.perfs.Value(PERF_PROTO_ERR_HANDSHAKE) > errs &&
+                badCli.perfs.Value(PERF_PROTO_DISCONNECT) > 0 {
+                break
+            }
+
+            <-time.After(100 * time.Millisecond)
+        }
+
+        if srv.perfs.Value(PERF_PROTO_ERR_HANDSHAKE) <= errs {
+            t.Fatalf("Incompatible peer accepted (%s v%d)", name, version)
+        }
+
+        if badCli.perfs.Value(PERF_PROTO_DISCONNECT) < 1 {
+            t.Fatalf("Incompatible peer not disconnected (%s v%d)", name, version)
+        }
+
+        badCli.Shutdown()
+    }
+
+    if srv.perfs.Value(PERF_PROTO_HANDSHAKE) != 1 {
+        t.Fatalf(
+            "Expected 1 successful handshake, got %d",
+            srv.perfs.Value(PERF_PROTO_HANDSHAKE),
+        )
+    }
+}
+
+// TestLegacyPeer connects to a server as an older build would, without ever
+// sending a control message, and validates that the server sends nothing
+// the older build wouldn't understand.
+func TestLegacyPeer(t *testing.T) {
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("LegacySrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetCompressionProvider(NewCompressor(DEFAULT_COMPRESS_THRESHOLD_B))
+    srv.SetKeepalive(50, 5000)
+    srv.SetVersion("legacy", 2, 1)
+    defer srv.Shutdown()
+
+    err := srv.ListenTcp("127.0.0.1:8921")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conn, err := stdnet.Dial("tcp", "127.0.0.1:8921")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    srvCon := <-srvHandler.conChan
+
+    msg := NewMsg()
+    msg.SetMsgType(BIG_MSG_TYPE)
+    msg.SetPayload([]byte("legacy"))
+
+    _, err = conn.Write(msg.GetBytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkRcv(t, srvHandler, []byte("legacy"))
+
+    err = srv.SendMsg(srvCon.Id(), BIG_MSG_TYPE, []byte("reply"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+
+    frame := make([]byte, HEADER_LEN_B + len("reply"))
+    _, err = io.ReadFull(conn, frame)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    header, _ := GetMsgHeader(frame)
+    if GetMsgSig(header) != BIG_MSG_TYPE {
+        t.Fatalf("Legacy peer sent sig %d", GetMsgSig(header))
+    }
+
+    // nothing else may follow
+    conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+
+    _, err = conn.Read(frame)
+    if err == nil {
+        header, _ = GetMsgHeader(frame)
+        t.Fatalf("Legacy peer sent sig %d", GetMsgSig(header))
+    }
+
+    if srv.PeerInfo(srvCon.Id()) != nil {
+        t.Fatal("Legacy peer has handshake info")
+    }
+}
+
+// TestExtendedHeader round trips messages with extended headers, both
+// through the header helpers and between protocols, including fragmented
+// messages and rpc envelopes, and validates that standard messages are
+// framed as before.
+func TestExtendedHeader(t *testing.T) {
+    std := NewMsg()
+    std.SetMsgType(BIG_MSG_TYPE)
+    std.SetPayload([]byte("standard"))
+
+    header, _ := GetMsgHeader(std.GetBytes())
+    if GetMsgExtendedFlag(header) || GetMsgSig(header) != BIG_MSG_TYPE {
+        t.Fatal("Standard msg framed with extended header")
+    }
+
+    if len(std.GetBytes()) != HEADER_LEN_B + len("standard") {
+        t.Fatal("Standard msg length changed")
+    }
+
+    ext := NewMsg()
+    ext.SetMsgType(BIG_MSG_TYPE)
+    ext.SetMsgType(EXT_MSG_TYPE)
+    ext.SetPayload([]byte("extended"))
+    ext.SetCorrelationId(7)
+    ext.SetSequence(9)
+
+    data      := ext.GetBytes()
+    header, _  = GetMsgHeader(data)
+    if !GetMsgExtendedFlag(header) || GetMsgSig(header) != SIG_EXTENDED {
+        t.Fatalf("Bad extended header %x", header)
+    }
+
+    if len(data) != ext.Len() {
+        t.Fatalf("Len mismatch (%d / %d)", len(data), ext.Len())
+    }
+
+    // feed the frame a byte at a time, followed by the next frame
+    stream := append(data, std.GetBytes()...)
+    rcv    := NewMsg()
+
+    var complete bool
+    for len(stream) > 0 && !complete {
+        var leftover []byte
+
+        leftover, complete = rcv.addData(stream[:1])
+        if leftover != nil {
+            t.Fatal("Unexpected leftover data")
+        }
+
+        stream = stream[1:]
+    }
+
+    if !complete || rcv.malformed || !rcv.isValid() {
+        t.Fatal("Extended msg not parsed")
+    }
+
+    if rcv.MsgType() != EXT_MSG_TYPE ||
+        rcv.CorrelationId() != 7 ||
+        rcv.Sequence() != 9 ||
+        string(rcv.GetPayload()) != "extended" ||
+        GetMsgExtendedFlag(rcv.GetHeader()) {
+        t.Fatalf("Bad extended msg: %+v", rcv)
+    }
+
+    next := NewMsg()
+    _, complete = next.addData(stream)
+    if !complete || next.MsgType() != BIG_MSG_TYPE || !next.isValid() {
+        t.Fatal("Standard msg following extended msg not parsed")
+    }
+
+    sigFlags, envData := ext.envelope()
+    opened            := NewMsg()
+    err               := opened.openEnvelope(sigFlags, envData)
+    if err != nil ||
+        opened.MsgType() != EXT_MSG_TYPE ||
+        opened.Sequence() != 9 ||
+        string(opened.GetPayload()) != "extended" {
+        t.Fatalf("Envelope round trip failed (%v)", err)
+    }
+
+    wide := NewMsg()
+    wide.SetExtMsgType(WIDE_MSG_TYPE)
+    wide.SetPayload([]byte("wide"))
+
+    wideRcv    := NewMsg()
+    _, complete = wideRcv.addData(wide.GetBytes())
+    if !complete ||
+        wideRcv.ExtMsgType() != WIDE_MSG_TYPE ||
+        wideRcv.MsgType() != SIG_EXTENDED {
+        t.Fatalf("Wide signature not carried (%x)", wideRcv.ExtMsgType())
+    }
+
+    bad := make([]byte, len(data))
+    copy(bad, data)
+    bad[HEADER_LEN_B] = 2
+
+    badMsg := NewMsg()
+    badMsg.addData(bad)
+    if !badMsg.malformed {
+        t.Fatal("Malformed extended header accepted")
+    }
+
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("ExtHeaderSrv", srvHandler)
+    srvProc    := new(ExtMsgProc)
+    srv.AddSignature(srvProc)
+    srv.AddSignature(new(WideMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.HandleRpc(EXT_MSG_TYPE, func(req interface{}, fromId uint32, access byte) (interface{}, error) {
+        return req, nil
+    })
+    defer srv.Shutdown()
+
+    cliHandler          := NewBigEventHandler(t)
+    cliHandler.allowErrs = true
+    cli                 := NewProtocol("ExtHeaderCli", cliHandler)
+    cliProc             := new(ExtMsgProc)
+    cli.AddSignature(cliProc)
+    cli.AddSignature(new(WideMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetHelloOnConnect(true)
+    defer cli.Shutdown()
+
+    err = srv.Listen(TRANSPORT_MEM, "ext-header-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.Dial(TRANSPORT_MEM, "ext-header-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    waitForPeer(t, cli, con.Id())
+    waitForPeer(t, srv, srvCon.Id())
+
+    payload := make([]byte, BIG_MSG_LEN)
+    for i := range payload {
+        payload[i] = byte(rand.Intn(256))
+    }
+
+    for _, size := range []int { 100, BIG_MSG_LEN } {
+        err = cli.SendMsg(con.Id(), EXT_MSG_TYPE, payload[:size])
+        if err != nil {
+            t.Fatal(err)
+        }
+        checkRcv(t, srvHandler, payload[:size])
+
+        if srvProc.corrId != 0x1122334455667788 || srvProc.seq != 42 {
+            t.Fatalf("Extended fields lost (%x, %d)", srvProc.corrId, srvProc.seq)
+        }
+    }
+
+    resp, err := cli.Call(con.Id(), EXT_MSG_TYPE, []byte("rpc"), 5 * time.Second)
+    if err != nil || string(resp.([]byte)) != "rpc" {
+        t.Fatalf("Extended rpc failed (%v)", err)
+    }
+
+    // signatures above 0xFFFF are carried in full
+    err = cli.SendExtMsg(con.Id(), WIDE_MSG_TYPE, payload[:100])
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkRcv(t, srvHandler, payload[:100])
+
+    // peers which never sent a hello can't receive extended headers
+    cli.dropPeer(con.Id())
+
+    err = cli.SendMsg(con.Id(), EXT_MSG_TYPE, payload[:100])
+    if err == nil {
+        t.Fatal("Extended signature sent to legacy peer")
+    }
+}
+
+// TestSignatureRegistry validates that conflicting signature registrations
+// across protocols are detected, and rejected in strict mode.
+func TestSignatureRegistry(t *testing.T) {
+    first := NewProtocol("SigRegFirst", NewBigEventHandler(t))
+    first.AddSignature(new(ExtMsgProc))
+    defer first.Shutdown()
+
+    same := NewProtocol("SigRegSame", NewBigEventHandler(t))
+    same.AddSignature(new(ExtMsgProc))
+    defer same.Shutdown()
+
+    if len(SignatureConflicts()) != 0 {
+        t.Fatalf("Unexpected conflicts: %v", SignatureConflicts())
+    }
+
+    owners := SignatureOwners(EXT_MSG_TYPE)
+    if len(owners) != 2 || owners[0] != "SigRegFirst" || owners[1] != "SigRegSame" {
+        t.Fatalf("Bad owners: %v", owners)
+    }
+
+    SetStrictSignatures(true)
+
+    strict := NewProtocol("SigRegStrict", NewBigEventHandler(t))
+    strict.AddSignature(new(ExtConflictProc))
+    defer strict.Shutdown()
+
+    SetStrictSignatures(false)
+
+    if strict.sigMap[EXT_MSG_TYPE] != nil {
+        t.Fatal("Conflicting signature registered in strict mode")
+    }
+
+    lax := NewProtocol("SigRegLax", NewBigEventHandler(t))
+    lax.AddSignature(new(ExtConflictProc))
+
+    conflicts := SignatureConflicts()
+    if len(conflicts[EXT_MSG_TYPE]) != 3 {
+        t.Fatalf("Conflict not detected: %v", conflicts)
+    }
+
+    lax.Shutdown()
+
+    if len(SignatureConflicts()) != 0 {
+        t.Fatal("Conflict remains after shutdown")
+    }
+
+    same.DeleteSignature(same.sigMap[EXT_MSG_TYPE])
+
+    owners = SignatureOwners(EXT_MSG_TYPE)
+    if len(owners) != 1 || owners[0] != "SigRegFirst" {
+        t.Fatalf("Bad owners after delete: %v", owners)
+    }
+}
+
+// TestRateLimit validates the per-connection message limits, connection
+// caps and bans, and that limits are reloaded from the config service.
+func TestRateLimit(t *testing.T) {
+    bucket := new(tokenBucket)
+    now    := time.Now()
+
+    for i := 0; i < 10; i++ {
+        if !bucket.take(1, 10, now) {
+            t.Fatalf("Token %d refused", i)
+        }
+    }
+
+    if bucket.take(1, 10, now) {
+        t.Fatal("Empty bucket accepted a token")
+    }
+
+    if !bucket.take(1, 10, now.Add(100 * time.Millisecond)) {
+        t.Fatal("Bucket didn't refill")
+    }
+
+    if !new(tokenBucket).take(100, 10, now) {
+        t.Fatal("Oversized request refused by a full bucket")
+    }
+
+    // bans are opt-in, and peers without an ip are limited individually
+    if NewRateLimits().BanStrikes != 0 {
+        t.Fatal("Bans enabled by default")
+    }
+
+    if rateKey(1, memAddr("rate-test")) == rateKey(2, memAddr("rate-test")) {
+        t.Fatal("In-memory peers share a rate key")
+    }
+
+    srvHandler        := NewBigEventHandler(t)
+    srvHandler.errChan = make(chan error, 100)
+    srv               := NewProtocol("RateSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetRateLimits(&RateLimits {
+        ConMsgsPerSec      : 5,
+        MaxConsPerListener : 1,
+    })
+    defer srv.Shutdown()
+
+    err := srv.ListenTcp("127.0.0.1:8922")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliHandler          := NewBigEventHandler(t)
+    cliHandler.allowErrs = true
+    cli                 := NewProtocol("RateCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    defer cli.Shutdown()
+
+    err = cli.DialTcp("127.0.0.1:8922")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    for i := 0; i < 20; i++ {
+        err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte("flood"))
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    rateErr := waitForRateErr(t, srvHandler, ErrRateLimited)
+    if rateErr.ConId != srvCon.Id() {
+        t.Fatalf("Rate error for con %v, expected %v", rateErr.ConId, srvCon.Id())
+    }
+
+    if srv.perfs.Value(PERF_PROTO_RATE_LIMITED) < 1 {
+        t.Fatal("Dropped msgs not counted")
+    }
+
+    received := len(srvHandler.rcvChan)
+    if received < 1 || received >= 20 {
+        t.Fatalf("Expected some msgs to be dropped, received %d / 20", received)
+    }
+
+    // the listener is full
+    err = cli.DialTcp("127.0.0.1:8922")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    waitForRateErr(t, srvHandler, ErrConRefused)
+
+    if srv.perfs.Value(PERF_PROTO_RATE_REFUSED) != 1 {
+        t.Fatal("Refused connection not counted")
+    }
+
+    // repeat offenders are banned
+    srv.SetRateLimits(&RateLimits {
+        BanSec        : 60,
+        BanStrikes    : 3,
+        ConMsgsPerSec : 1,
+    })
+
+    for i := 0; i < 10; i++ {
+        cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte("flood"))
+    }
+
+    waitForRateErr(t, srvHandler, ErrIpBanned)
+
+    ip := rateKey(srvCon.Id(), srvCon.RemoteAddr())
+    if bans := srv.Bans(); len(bans) != 1 || bans[0] != ip {
+        t.Fatalf("Expected %s to be banned, got %v", ip, bans)
+    }
+
+    if srv.perfs.Value(PERF_PROTO_RATE_BAN) != 1 {
+        t.Fatal("Ban not counted")
+    }
+
+    for i := 0; i < 50 && srv.GetConnection(srvCon.Id()) != nil; i++ {
+        <-time.After(100 * time.Millisecond)
+    }
+
+    if srv.GetConnection(srvCon.Id()) != nil {
+        t.Fatal("Banned connection left open")
+    }
+
+    refused := srv.perfs.Value(PERF_PROTO_RATE_REFUSED)
+
+    err = cli.DialTcp("127.0.0.1:8922")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for i := 0; i < 50 && srv.perfs.Value(PERF_PROTO_RATE_REFUSED) == refused; i++ {
+        <-time.After(100 * time.Millisecond)
+    }
+
+    if srv.perfs.Value(PERF_PROTO_RATE_REFUSED) == refused {
+        t.Fatal("Banned address admitted")
+    }
+
+    srv.Unban(ip)
+
+    err = cli.DialTcp("127.0.0.1:8922")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    select {
+    case <-srvHandler.conChan:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Unbanned address refused")
+    }
+
+    // limits are reloaded from config
+    dir, err := ioutil.TempDir("", "goat-rate")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    iniDir        := config.IniDir
+    config.IniDir  = dir
+    defer func() { config.IniDir = iniDir }()
+
+    for _, limit := range []int { 7, 9 } {
+        err = ioutil.WriteFile(
+            filepath.Join(dir, "rate.ini"),
+            []byte(fmt.Sprintf("[RateTest]\nConMsgsPerSec = %d\n", limit)),
+            0600,
+        )
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        provider := config.InitIniProvider("rate.ini", 1)
+
+        if limit == 7 {
+            srv.WatchRateLimits("RateTest")
+            defer srv.WatchRateLimits("")
+        } else {
+            srv.rateMutex.Lock()
+            srv.rateReload = time.Time{}
+            srv.rateMutex.Unlock()
+        }
+
+        for i := 0; i < 50 && srv.GetRateLimits().ConMsgsPerSec != limit; i++ {
+            <-time.After(100 * time.Millisecond)
+        }
+
+        config.UnregisterConfigProvider(provider)
+
+        if srv.GetRateLimits().ConMsgsPerSec != limit {
+            t.Fatalf("Limits not loaded: %+v", srv.GetRateLimits())
+        }
+    }
+}
+
+// TestCapture records a protocol's traffic, including a fragmented message,
+// decodes the capture with the protocol's MsgProcessors, and replays it
+// against a second server.
+func TestCapture(t *testing.T) {
+    dir, err := ioutil.TempDir("", "goat-capture")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    srvPath    := filepath.Join(dir, "srv.cap")
+    globalPath := filepath.Join(dir, "global.cap")
+
+    srvCap, err := CreateCapture(srvPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    globalCap, err := CreateCapture(globalPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    SetCapture(globalCap)
+
+    big := make([]byte, BIG_MSG_LEN)
+    for i := range big {
+        big[i] = byte(rand.Intn(256))
+    }
+
+    payloads := [][]byte { []byte("one"), big, []byte("three") }
+
+    srvHandler := NewBigEventHandler(t)
+    srv        := NewProtocol("CaptureSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    srv.SetCapture(srvCap)
+    defer srv.Shutdown()
+
+    err = srv.Listen(TRANSPORT_MEM, "capture-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("CaptureCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetHelloOnConnect(true)
+    defer cli.Shutdown()
+
+    err = cli.Dial(TRANSPORT_MEM, "capture-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    for i := range payloads {
+        err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, payloads[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        checkRcv(t, srvHandler, payloads[i])
+    }
+
+    SetCapture(nil)
+    srv.SetCapture(nil)
+    srvCap.Close()
+    globalCap.Close()
+
+    // decode
+    reader, err := OpenCapture(srvPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    decoder := NewCaptureDecoder(srv)
+    decoded := make([][]byte, 0)
+    inbound := make(map[uint16]bool)
+
+    for {
+        rec, err := reader.Next()
+        if err == io.EOF {
+            break
+        }
+
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if rec.Proto != "CaptureSrv" || rec.ConId != srvCon.Id() {
+            t.Fatalf("Unexpected record: %+v", rec)
+        }
+
+        msg, obj, err := decoder.Decode(rec)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if msg == nil {
+            continue
+        }
+
+        if rec.Direction == CAPTURE_IN {
+            inbound[msg.MsgType()] = true
+        }
+
+        if obj != nil {
+            decoded = append(decoded, obj.([]byte))
+        }
+    }
+
+    reader.Close()
+
+    if !inbound[SIG_HELLO] || !inbound[BIG_MSG_TYPE] {
+        t.Fatalf("Inbound msgs missing from capture: %v", inbound)
+    }
+
+    if len(decoded) != len(payloads) {
+        t.Fatalf("Decoded %d / %d msgs", len(decoded), len(payloads))
+    }
+
+    for i := range payloads {
+        if !bytes.Equal(decoded[i], payloads[i]) {
+            t.Fatalf("Decoded msg %d doesn't match", i)
+        }
+    }
+
+    // the global capture records both sides
+    reader, err = OpenCapture(globalPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    protos := make(map[string]int)
+    for {
+        rec, err := reader.Next()
+        if err != nil {
+            break
+        }
+
+        protos[rec.Proto]++
+    }
+
+    reader.Close()
+
+    if protos["CaptureSrv"] < 1 || protos["CaptureCli"] < 1 {
+        t.Fatalf("Global capture incomplete: %v", protos)
+    }
+
+    // replay
+    replayHandler := NewBigEventHandler(t)
+    replaySrv     := NewProtocol("CaptureReplay", replayHandler)
+    replaySrv.AddSignature(new(BigMsgProc))
+    replaySrv.SetAccessProvider(new(NoSecurity))
+    defer replaySrv.Shutdown()
+
+    err = replaySrv.Listen(TRANSPORT_MEM, "capture-replay")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = cli.Dial(TRANSPORT_MEM, "capture-replay")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    replayCon := <-cliHandler.conChan
+    <-replayHandler.conChan
+
+    reader, err = OpenCapture(srvPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reader.Close()
+
+    sent, err := Replay(reader, replayCon, NewReplayOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if sent < len(payloads) {
+        t.Fatalf("Replayed %d frames", sent)
+    }
+
+    for i := range payloads {
+        checkRcv(t, replayHandler, payloads[i])
+    }
+
+    // corrupt captures
+    _, err = NewCaptureReader(bytes.NewReader([]byte("NOTACAP")))
+    if err != ErrCaptureMalformed {
+        t.Fatalf("Expected ErrCaptureMalformed, got %v", err)
+    }
+
+    _, err = NewCaptureReader(bytes.NewReader([]byte(CAPTURE_MAGIC + "\x09")))
+    if err != ErrCaptureVersion {
+        t.Fatalf("Expected ErrCaptureVersion, got %v", err)
+    }
+}
+
+// TestDispatch validates that the ordered dispatch model preserves the order
+// of each connection's messages, that the parallel model runs handlers
+// concurrently, and that handler latency is recorded.
+func TestDispatch(t *testing.T) {
+    srvHandler := NewDrainEventHandler(t)
+    srv        := NewProtocol("DispatchSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    defer srv.Shutdown()
+
+    err := srv.Listen(TRANSPORT_MEM, "dispatch-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliHandler := NewBigEventHandler(t)
+    cli        := NewProtocol("DispatchCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    defer cli.Shutdown()
+
+    err = cli.Dial(TRANSPORT_MEM, "dispatch-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con := <-cliHandler.conChan
+    <-srvHandler.conChan
+
+    // ordered
+    srv.SetDispatch(DISPATCH_ORDERED, 4)
+    if srv.dispatchPerfs.Value(PERF_DISPATCH_WORKERS) != 4 {
+        t.Fatal("Dispatch workers not counted")
+    }
+
+    for i := 0; i < 50; i++ {
+        err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte { byte(i) })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for i := 0; i < 50; i++ {
+        checkRcv(t, srvHandler.BigEventHandler, []byte { byte(i) })
+    }
+
+    // parallel
+    srvHandler.delay = 200 * time.Millisecond
+    srv.SetDispatch(DISPATCH_PARALLEL, 8)
+
+    slow  := srv.dispatchPerfs.Value(PERF_DISPATCH_HANDLER_SLOW)
+    start := time.Now()
+
+    for i := 0; i < 8; i++ {
+        err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte { byte(i) })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    received := make(map[byte]bool)
+    for i := 0; i < 8; i++ {
+        select {
+        case data := <-srvHandler.rcvChan:
+            received[data[0]] = true
+        case <-time.After(5 * time.Second):
+            t.Fatal("Timed out waiting for msg")
+        }
+    }
+
+    if len(received) != 8 {
+        t.Fatalf("Received %d / 8 distinct msgs", len(received))
+    }
+
+    if time.Since(start) > time.Second {
+        t.Fatalf("Parallel handlers took %v", time.Since(start))
+    }
+
+    if srv.dispatchPerfs.Value(PERF_DISPATCH_HANDLER_SLOW) != slow + 8 {
+        t.Fatal("Slow handlers not counted")
+    }
+
+    stats := srv.dispatchPerfs.Get(PERF_DISPATCH_HANDLER_US).Stats()
+    if stats.Max() < 200000 {
+        t.Fatalf("Unexpected max handler latency %v us", stats.Max())
+    }
+
+    // back to single
+    srv.SetDispatch(DISPATCH_SINGLE, 0)
+    if srv.dispatchPerfs.Value(PERF_DISPATCH_WORKERS) != 0 {
+        t.Fatal("Dispatch workers not reset")
+    }
+}
+
+// TestDrain validates that draining a protocol notifies its clients, waits
+// for running handlers and queued messages, refuses new connections, and
+// gives up at its deadline.
+func TestDrain(t *testing.T) {
+    srvHandler      := NewDrainEventHandler(t)
+    srvHandler.delay = 500 * time.Millisecond
+    srv             := NewProtocol("DrainSrv", srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    defer srv.Shutdown()
+
+    err := srv.Listen(TRANSPORT_MEM, "drain-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cliHandler := NewDrainEventHandler(t)
+    cli        := NewProtocol("DrainCli", cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    cli.SetHelloOnConnect(true)
+    defer cli.Shutdown()
+
+    err = cli.Dial(TRANSPORT_MEM, "drain-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con    := <-cliHandler.conChan
+    srvCon := <-srvHandler.conChan
+
+    // the server's handler is still running when the drain starts
+    err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte("slow"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    <-time.After(100 * time.Millisecond)
+
+    big := make([]byte, BIG_MSG_LEN)
+    for i := range big {
+        big[i] = byte(rand.Intn(256))
+    }
+
+    for i := 0; i < 10; i++ {
+        err = srv.SendMsg(srvCon.Id(), BIG_MSG_TYPE, big)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    start := time.Now()
+
+    err = srv.Drain(5)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if time.Since(start) < 300 * time.Millisecond {
+        t.Fatal("Drain didn't wait for the running handler")
+    }
+
+    select {
+    case data := <-srvHandler.rcvChan:
+        if string(data) != "slow" {
+            t.Fatal("Received payload doesn't match original")
+        }
+    default:
+        t.Fatal("Handler not complete after drain")
+    }
+
+    select {
+    case grace := <-cliHandler.shutdownChan:
+        if grace != 5 * time.Second {
+            t.Fatalf("Unexpected shutdown grace %v", grace)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for shutdown notice")
+    }
+
+    for i := 0; i < 10; i++ {
+        checkRcv(t, cliHandler.BigEventHandler, big)
+    }
+
+    // new connections are refused
+    err = cli.Dial(TRANSPORT_MEM, "drain-test")
+    if err == nil {
+        t.Fatal("Connection accepted while draining")
+    }
+
+    // the deadline is reached while a handler is still running
+    timeouts := srv.perfs.Value(PERF_PROTO_DRAIN_TIMEOUT)
+
+    err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, []byte("slow"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    <-time.After(100 * time.Millisecond)
+
+    err = srv.Drain(0)
+    if err != ErrDrainTimeout {
+        t.Fatalf("Expected drain timeout, got %v", err)
+    }
+
+    if srv.perfs.Value(PERF_PROTO_DRAIN_TIMEOUT) != timeouts + 1 {
+        t.Fatal("Drain timeout not counted")
+    }
+
+    checkRcv(t, srvHandler.BigEventHandler, []byte("slow"))
+}
+
+// TestBufferPool validates the buffer size classes, that received messages
+// are framed in pooled buffers which are reused once released, and that
+// send queues release the frames they discard.
+func TestBufferPool(t *testing.T) {
+    SetBufferPooling(true)
+    defer SetBufferPooling(false)
+
+    small := getSlab(10)
+    if len(small.buf) != 10 || cap(small.buf) != bufClasses[0] {
+        t.Fatalf("Unexpected slab len %d, cap %d", len(small.buf), cap(small.buf))
+    }
+    putSlab(small)
+
+    puts  := bufPerfs.Value(PERF_BUF_PUT)
+    large := getSlab(MAX_FRAME_LEN_B + 1)
+    putSlab(large)
+
+    if bufPerfs.Value(PERF_BUF_PUT) != puts {
+        t.Fatal("Oversize buffer returned to a pool")
+    }
+
+    // receive a message with an extended header
+    payload := bytes.Repeat([]byte("pool"), 25)
+
+    out := NewMsg()
+    out.SetMsgType(BIG_MSG_TYPE)
+    out.SetCorrelationId(42)
+    out.SetPayload(payload)
+    frame := out.GetBytes()
+    out.Release()
+
+    msg := NewMsg()
+    _, complete := msg.addData(frame)
+    if !complete {
+        t.Fatal("Message not complete")
+    }
+
+    if !bytes.Equal(msg.GetPayload(), payload) || msg.CorrelationId() != 42 {
+        t.Fatal("Pooled message doesn't match original")
+    }
+
+    if msg.slab == nil || cap(msg.slab.buf) != 256 {
+        t.Fatal("Payload not read into a pooled buffer")
+    }
+
+    msg.Release()
+    if msg.GetPayload() != nil || msg.slab != nil {
+        t.Fatal("Released message not reset")
+    }
+
+    // pooled messages allocate less than unpooled ones
+    rcv := func() {
+        msg := NewMsg()
+        msg.addData(frame)
+        msg.Release()
+    }
+
+    pooled := testing.AllocsPerRun(100, rcv)
+
+    SetBufferPooling(false)
+    unpooled := testing.AllocsPerRun(100, rcv)
+    SetBufferPooling(true)
+
+    if pooled >= unpooled {
+        t.Fatalf("Pooled allocs %v >= unpooled allocs %v", pooled, unpooled)
+    }
+
+    // dropped frames are released
+    limits        := NewSendQueueLimits()
+    limits.MaxMsgs = 1
+    limits.Policy  = SEND_QUEUE_DROP_OLDEST
+
+    q       := newSendQueue(*limits)
+    syncObj := lifecycle.New()
+    first   := getSlab(16)
+
+    q.pushFrame(
+        queuedFrame { data : first.buf, slab : first },
+        PRIORITY_NORMAL,
+        1,
+        syncObj,
+    )
+    puts = bufPerfs.Value(PERF_BUF_PUT)
+    q.push([]byte("second"), PRIORITY_NORMAL, 1, syncObj)
+
+    if bufPerfs.Value(PERF_BUF_PUT) != puts + 1 {
+        t.Fatal("Dropped frame not released")
+    }
+
+    if !bytes.Equal(q.pop(), []byte("second")) {
+        t.Fatal("Unexpected queued frame")
+    }
+}
+
+// BenchmarkRcvMsg measures allocations per received message. The unpooled
+// case reproduces the receive path as it was before buffer pooling: a copy
+// of each read, and a fresh Msg and payload buffer per message.
+func BenchmarkRcvMsg(b *testing.B) {
+    out := NewMsg()
+    out.SetMsgType(BIG_MSG_TYPE)
+    out.SetPayload(bytes.Repeat([]byte("bench"), 200))
+    frame := out.GetBytes()
+
+    b.Run("pooled", func(b *testing.B) {
+        SetBufferPooling(true)
+        defer SetBufferPooling(false)
+
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            msg := NewMsg()
+            msg.addData(frame)
+            msg.Release()
+        }
+    })
+
+    b.Run("unpooled", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            cpBuffer := make([]byte, len(frame))
+            copy(cpBuffer, frame)
+
+            msg := NewMsg()
+            msg.addData(cpBuffer)
+        }
+    })
+}
+
+// BenchmarkSendFrame measures allocations per framed outbound message, with
+// frames built in pooled buffers, and with GetBytes.
+func BenchmarkSendFrame(b *testing.B) {
+    msg := NewMsg()
+    msg.SetMsgType(BIG_MSG_TYPE)
+    msg.SetPayload(bytes.Repeat([]byte("bench"), 200))
+
+    b.Run("pooled", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            frame := getSlab(msg.Len())
+            msg.writeFrame(frame.buf)
+            putSlab(frame)
+        }
+    })
+
+    b.Run("unpooled", func(b *testing.B) {
+        b.ReportAllocs()
+        for i := 0; i < b.N; i++ {
+            msg.GetBytes()
+        }
+    })
+}
+
+// BenchmarkRoundTrip measures allocations per message sent and received
+// between two protocols over the in-memory transport, with and without
+// buffer pooling.
+func BenchmarkRoundTrip(b *testing.B) {
+    b.Run("pooled", func(b *testing.B) {
+        SetBufferPooling(true)
+        defer SetBufferPooling(false)
+
+        benchRoundTrip(b, "pooled")
+    })
+
+    b.Run("unpooled", func(b *testing.B) {
+        benchRoundTrip(b, "unpooled")
+    })
+}
+
+// TestHeaderOpts runs all of the header set and get options on a variety
+// of header message type signatures.
+func TestHeaderOps(t *testing.T) {
+    for i := range headerTests {
+        testHeaders(headerTests[i], t)
+    }
+}
+
+// TestTCPSrv tests the TCPSrv class with a simple text messaging protocol.
+// Tests are performed with a variety of client counts and total message 
+// counts.
+func TestTCPSrv(t *testing.T) {
+    log.Info("")
+
+    // log.DebugLogs = true
+
+    // srv
+    srvHandler   = new(PPEventSrv)
+    srvHandler.t = t
+    srvproto     = NewProtocol("SrvProto", srvHandler)
+    srvproto.AddSignature(pingMsgProc)
+    srvproto.AddSignature(pongMsgProc)
+    srvproto.SetAccessProvider(new(NoSecurity))
+
+    srvproto.ListenTcp(srvAddr)
+
+    <-time.After(1 * time.Second)
+
+    // run the tests
+    runSimpleTcpTest(1, 1, t)
+    runSimpleTcpTest(1, 10, t)
+    runSimpleTcpTest(1, 100, t)
+    runSimpleTcpTest(10, 1, t)
+    runSimpleTcpTest(10, 10, t)
+    runSimpleTcpTest(10, 100, t)
+    runSimpleTcpTest(100, 1, t)
+    runSimpleTcpTest(100, 10, t)
+    runSimpleTcpTest(100, 100, t)
+
+    // shut everything down gracefully
+    srvproto.Shutdown()
+}
+
+// TestUdp performs the same ping/pong network test as runSimpleTcpTest
+// but uses UDP as the transport instead.
+func TestUdp(t *testing.T) {
+    srvAddr := "127.0.0.1:8901"
+    cliAddr := "127.0.0.1:8902"
+
+    srvHandler   = new(PPEventSrv)
+    srvHandler.t = t
+    srvproto     = NewProtocol("UdpSrvTest", srvHandler)
+    srvproto.AddSignature(pingMsgProc)
+    srvproto.AddSignature(pongMsgProc)
+    srvproto.SetAccessProvider(new(NoSecurity))
+
+    _, err := srvproto.ListenUdp(srvAddr)
+    if err != nil {
+        t.Fatal(err.Error())
+    }
+
+    <-time.After(1 * time.Second)
+
+    cliHandler          = new(PPEventCli)
+    cliHandler.t        = t
+    cliHandler.msgCount = 100
+    cliproto            = NewProtocol("UdpCliTest", cliHandler)
+    cliproto.AddSignature(pingMsgProc)
+    cliproto.AddSignature(pongMsgProc)
+    cliproto.SetAccessProvider(new(NoSecurity))
+
+    cliSock, err := cliproto.ListenUdp(cliAddr)
+    if err != nil {
+        t.Fatal(err.Error())
+    }
+
+    <-time.After(1 * time.Second)
+
+    waiter.Add(1)
+    err = cliproto.DialUdp(srvAddr, cliSock)
+    if err != nil {
+        waiter.Done()
+        t.Fatal(err.Error())
+    }
+
+    log.Info("Transmitting data...")
+
+    waiter.Wait()
+
+    <-time.After(1 * time.Second)
+
+    srvproto.Shutdown()
+}
+
+// checkRcv waits for the given handler to receive a message, and validates
+// that it matches the expected data.
+func checkRcv(t *testing.T, handler *BigEventHandler, expected []byte) {
+    select {
+    case data := <-handler.rcvChan:
+        if !bytes.Equal(data, expected) {
+            t.Fatal("Received payload doesn't match original")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for msg")
+    }
+}
+
+// benchRoundTrip sends b.N messages from a client protocol to a server
+// protocol, waiting for each to be received.
+func benchRoundTrip(b *testing.B, name string) {
+    srvHandler          := NewBigEventHandler(nil)
+    srvHandler.allowErrs = true
+    srv                 := NewProtocol("BenchSrv-" + name, srvHandler)
+    srv.AddSignature(new(BigMsgProc))
+    srv.SetAccessProvider(new(NoSecurity))
+    defer srv.Shutdown()
+
+    err := srv.Listen(TRANSPORT_MEM, "bench-" + name)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    cliHandler          := NewBigEventHandler(nil)
+    cliHandler.allowErrs = true
+    cli                 := NewProtocol("BenchCli-" + name, cliHandler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(new(NoSecurity))
+    defer cli.Shutdown()
+
+    err = cli.Dial(TRANSPORT_MEM, "bench-" + name)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    con     := <-cliHandler.conChan
+    payload := bytes.Repeat([]byte("bench"), 200)
+    <-srvHandler.conChan
+
+    b.ReportAllocs()
+    b.ResetTimer()
+
+    for i := 0; i < b.N; i++ {
+        err = cli.SendMsg(con.Id(), BIG_MSG_TYPE, payload)
+        if err != nil {
+            b.Fatal(err)
+        }
+
+        select {
+        case <-srvHandler.rcvChan:
+        case <-time.After(5 * time.Second):
+            b.Fatal("Timed out waiting for msg")
+        }
+    }
+}
+
+// waitForTopic waits for the named protocol's topic perf counters to report
+// the expected number of subscribers and peers.
+func waitForTopic(t *testing.T, proto, topic string, subs, peers int64) {
+    name := perfName(proto + ".Topic." + topic)
+
+    for i := 0; i < 50; i++ {
+        perfs := perf.GetCounterSet(name)
+        if perfs != nil &&
+            perfs.Value(PERF_TOPIC_SUBSCRIBERS) == subs &&
+            perfs.Value(PERF_TOPIC_PEERS) == peers {
+            return
+        }
+
+        <-time.After(100 * time.Millisecond)
+    }
+
+    t.Fatalf("Timed out waiting for topic %s (proto %s)", topic, proto)
+}
+
+// waitForErr waits for the given handler to report an error containing the
+// given text.
+func waitForErr(t *testing.T, handler *BigEventHandler, text string) {
+    deadline := time.After(5 * time.Second)
+
+    for {
+        select {
+        case err := <-handler.errChan:
+            if strings.Contains(err.Error(), text) {
+                return
+            }
+        case <-deadline:
+            t.Fatalf("Timed out waiting for error (%s)", text)
+        }
+    }
+}
+
+// waitForPeer waits for the given connection to complete its handshake.
+func waitForPeer(t *testing.T, proto *Protocol, conId uint32) *PeerInfo {
+    for i := 0; i < 50; i++ {
+        info := proto.PeerInfo(conId)
+        if info != nil {
+            return info
+        }
+
+        <-time.After(100 * time.Millisecond)
+    }
+
+    t.Fatalf("Timed out waiting for handshake (con %v)", conId)
+    return nil
+}
+
+// waitForRateErr waits for the given handler to report a RateLimitError
+// wrapping the given error.
+func waitForRateErr(
+    t       *testing.T,
+    handler *BigEventHandler,
+    target  error,
+) *RateLimitError {
+    deadline := time.After(5 * time.Second)
+
+    for {
+        select {
+        case err := <-handler.errChan:
+            rateErr, ok := err.(*RateLimitError)
+            if ok && rateErr.Err == target {
+                return rateErr
+            }
+        case <-deadline:
+            t.Fatalf("Timed out waiting for rate error (%v)", target)
+        }
+    }
+}
+
+// waitForCodec waits for the given Compressor to negotiate the expected
+// codec with a remote peer.
+func waitForCodec(t *testing.T, comp *Compressor, con Connection, codec int) {
+    for i := 0; i < 50; i++ {
+        if comp.codecFor(con) == codec {
+            return
+        }
+
+        <-time.After(100 * time.Millisecond)
+    }
+
+    t.Fatalf("Timed out negotiating codec %d", codec)
+}
+
+// loginTestCli connects a new client protocol to the login test server,
+// using the given credentials, and waits for the login to complete. If the
+// login is expected to fail, the wait is allowed to time out.
+func loginTestCli(
+    t           *testing.T,
+    name        string,
+    user        string,
+    secret      string,
+    expectLogin bool,
+) (*Protocol, Connection) {
+    handler := NewBigEventHandler(t)
+    handler.allowErrs = true
+
+    loginChan := make(chan byte, 1)
+    access    := NewCredentialAccess(nil)
+    access.SetCredentials(user, secret)
+    access.SetLoginHandler(func(con Connection, level byte) {
+        loginChan<- level
+    })
+
+    cli := NewProtocol(name, handler)
+    cli.AddSignature(new(BigMsgProc))
+    cli.SetAccessProvider(access)
+
+    err := cli.DialTcp("127.0.0.1:8915")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    con := <-handler.conChan
+
+    select {
+    case <-loginChan:
+    case <-time.After(1 * time.Second):
+        if expectLogin {
+            t.Fatalf("Timed out logging in as %s", user)
+        }
+    }
+
+    return cli, con
+}
+
+// checkFragMsg sends the given payload from the client protocol over con
+// and validates that the server handler receives an identical copy.
+func checkFragMsg(
+    t          *testing.T,
+    cli        *Protocol,
+    con        Connection,
+    srvHandler *BigEventHandler,
+    payload    []byte,
+) {
+    err := cli.SendMsg(con.Id(), BIG_MSG_TYPE, payload)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    select {
+    case data := <-srvHandler.rcvChan:
+        if !bytes.Equal(data, payload) {
+            t.Fatalf("Reassembled payload mismatch (%d / %d)", len(data), len(payload))
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Timed out waiting for fragmented msg")
+    }
+
+    if cli.perfs.Value(PERF_PROTO_FRAG_SEND) < 2 {
+        t.Fatal("Msg was not fragmented")
+    }
+}
+
+// writeTestCert generates a self-signed certificate and key for 127.0.0.1,
+// writes them to the given directory in PEM format, and returns their paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := x509.Certificate {
+        BasicConstraintsValid : true,
+        IPAddresses           : []stdnet.IP { stdnet.ParseIP("127.0.0.1") },
+        IsCA                  : true,
+        KeyUsage              : x509.KeyUsageDigitalSignature |
+            x509.KeyUsageCertSign,
+        ExtKeyUsage           : []x509.ExtKeyUsage {
+            x509.ExtKeyUsageServerAuth,
+            x509.ExtKeyUsageClientAuth,
+        },
+        NotAfter              : time.Now().Add(1 * time.Hour),
+        NotBefore             : time.Now().Add(-1 * time.Hour),
+        SerialNumber          : big.NewInt(1),
+        Subject               : pkix.Name { CommonName : "goat test" },
+    }
+
+    certDer, err := x509.CreateCertificate(
+        cryptorand.Reader,
+        &template,
+        &template,
+        &key.PublicKey,
+        key,
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certFile := filepath.Join(dir, "cert.pem")
+    keyFile  := filepath.Join(dir, "key.pem")
+
+    certPem := pem.EncodeToMemory(&pem.Block { Type : "CERTIFICATE", Bytes : certDer })
+    keyPem  := pem.EncodeToMemory(&pem.Block { Type : "EC PRIVATE KEY", Bytes : keyDer })
+
+    if ioutil.WriteFile(certFile, certPem, 0600) != nil {
+        t.Fatal("Unable to write test cert")
+    }
+
+    if ioutil.WriteFile(keyFile, keyPem, 0600) != nil {
+        t.Fatal("Unable to write test key")
+    }
+
+    return certFile, keyFile
 }
 
 // runSimpleTcpTest spawns the given number of clients and asks them to send the
@@ -75,6 +75,19 @@ func (this *BroadcastGroup) Close() {
     this.conList = make(map[uint32]Connection, 0)
 }
 
+// GetAllConnections returns a slice containing all member Connection objects.
+func (this *BroadcastGroup) GetAllConnections() []Connection {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    cons := make([]Connection, 0, len(this.conList))
+    for _, con := range this.conList {
+        cons = append(cons, con)
+    }
+
+    return cons
+}
+
 // GetConnection returns the member Connection object matching the given id
 // if one exists, otherwise returns nil.
 func (this *BroadcastGroup) GetConnection(id uint32) Connection {
@@ -117,16 +130,22 @@ func (this *BroadcastGroup) RemoveConnection(id uint32) {
 }
 
 // Send transmits a slice of bytes to member Connections in the
-// BroadcastGroup.
+// BroadcastGroup. Members are sent to without waiting for room in their
+// send queues, so that one slow member can't stall the group. Members whose
+// queues are full handle the message according to their overflow policy,
+// with SEND_QUEUE_BLOCK reporting an immediate TIMEOUT_SEND.
 func (this *BroadcastGroup) Send(data []byte, timeoutSec int) {
+    this.sendPriority(data, timeoutSec, PRIORITY_NORMAL)
+}
+
+// sendPriority transmits a slice of bytes to member Connections in the
+// given priority class, without waiting, as Send does.
+func (this *BroadcastGroup) sendPriority(data []byte, timeoutSec, priority int) {
     if data == nil {
         return
     }
 
-    this.mutex.RLock()
-    defer this.mutex.RUnlock()
-
-    for k, _ := range this.conList {
-        this.conList[k].Send(data, timeoutSec)
+    for _, con := range this.GetAllConnections() {
+        sendPriority(con, data, 0, priority)
     }
 }
@@ -0,0 +1,179 @@
+//  ---------------------------------------------------------------------------
+//
+//  bufpool.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/perf"
+)
+
+// Stdlib imports.
+import (
+    "sync"
+    "sync/atomic"
+)
+
+// Largest frame which can be drawn from the buffer pools: a full header,
+// the largest extended header, and a max size payload.
+const MAX_FRAME_LEN_B = HEADER_LEN_B + EXT_HEADER_MAX_LEN_B + MAX_NET_MSG_LEN
+
+// Buffer size classes. Received payloads and outbound frames are drawn from
+// the pool of the smallest class they fit in. Anything larger than the
+// largest class is allocated, and left to the garbage collector.
+var bufClasses = [...]int {
+    64,
+    256,
+    1024,
+    4096,
+    16384,
+    MAX_FRAME_LEN_B,
+}
+
+// Perf counters.
+const (
+    PERF_BUF_ALLOC = iota
+    PERF_BUF_GET
+    PERF_BUF_PUT
+    PERF_BUF_UNPOOLED
+    PERF_BUF_COUNT
+)
+
+// Perf counter friendly names.
+var bufPerfNames = []string {
+    "Allocated",
+    "Get",
+    "Put",
+    "Unpooled",
+}
+
+// Global buffer pool perf object.
+var bufPerfs = perf.NewCounterSet(
+    "Module.Net.Buffers",
+    PERF_BUF_COUNT,
+    bufPerfNames,
+)
+
+// Buffer and message pools.
+var (
+    bufPools   [len(bufClasses)]sync.Pool
+    bufPoolsOn int32
+    msgPool    = sync.Pool {
+        New : func() interface{} {
+            return new(Msg)
+        },
+    }
+)
+
+// init sets up the allocator of each buffer size class.
+func init() {
+    for i := range bufPools {
+        size := bufClasses[i]
+        bufPools[i].New = func() interface{} {
+            bufPerfs.Increment(PERF_BUF_ALLOC)
+            return &slab { buf : make([]byte, size) }
+        }
+    }
+}
+
+
+// SetBufferPooling enables or disables the reuse of message buffers and Msg
+// objects. Pooling is disabled by default, so received payloads stay valid
+// after they have been deserialized. Only enable it once every registered
+// MsgProcessor copies any part of the payload it keeps.
+func SetBufferPooling(enabled bool) {
+    if enabled {
+        atomic.StoreInt32(&bufPoolsOn, 1)
+    } else {
+        atomic.StoreInt32(&bufPoolsOn, 0)
+    }
+}
+
+// bufPooling returns true if buffer pooling is enabled.
+func bufPooling() bool {
+    return atomic.LoadInt32(&bufPoolsOn) == 1
+}
+
+// bufClass returns the index of the smallest size class which can hold
+// size bytes, or -1 if size exceeds every class.
+func bufClass(size int) int {
+    for i := range bufClasses {
+        if size <= bufClasses[i] {
+            return i
+        }
+    }
+
+    return -1
+}
+
+// getMsg returns a zeroed Msg from the message pool.
+func getMsg() *Msg {
+    if !bufPooling() {
+        return new(Msg)
+    }
+
+    return msgPool.Get().(*Msg)
+}
+
+// getSlab returns a buffer of the given length, drawn from the pool of the
+// smallest size class which fits it.
+func getSlab(size int) *slab {
+    class := bufClass(size)
+    if class < 0 || !bufPooling() {
+        bufPerfs.Increment(PERF_BUF_UNPOOLED)
+        return &slab { buf : make([]byte, size) }
+    }
+
+    bufPerfs.Increment(PERF_BUF_GET)
+
+    s    := bufPools[class].Get().(*slab)
+    s.buf = s.buf[:size]
+
+    return s
+}
+
+// putMsg returns a Msg to the message pool.
+func putMsg(msg *Msg) {
+    *msg = Msg{}
+
+    if bufPooling() {
+        msgPool.Put(msg)
+    }
+}
+
+// putSlab returns a buffer to the pool of its size class. Buffers which
+// weren't drawn from a pool are dropped.
+func putSlab(s *slab) {
+    class := bufClass(cap(s.buf))
+    if class < 0 || cap(s.buf) != bufClasses[class] || !bufPooling() {
+        return
+    }
+
+    bufPerfs.Increment(PERF_BUF_PUT)
+
+    s.buf = s.buf[:cap(s.buf)]
+    bufPools[class].Put(s)
+}
+
+
+// slab is a pooled buffer. Buffers are pooled behind a pointer, so that
+// handing them to and from a sync.Pool doesn't allocate.
+type slab struct {
+    buf []byte
+}
+
+// slabSender is implemented by connections which can take ownership of an
+// outbound frame built in a pooled buffer, returning the buffer to its pool
+// once the frame has been written.
+type slabSender interface {
+    sendSlab(s *slab, timeoutSec, priority int)
+}
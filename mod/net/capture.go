@@ -0,0 +1,663 @@
+//  ---------------------------------------------------------------------------
+//
+//  capture.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+    "github.com/xaevman/goat/lib/perf"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    stdnet "net"
+    "os"
+    "sync"
+    "time"
+)
+
+// Capture file format
+//
+// [0-6]   magic ("GOATCAP")
+// [7]     format version
+//
+// Followed by one record per framed message.
+//
+// [0-7]   timestamp, in nanoseconds since the unix epoch (uint64)
+// [8-11]  connection id (uint32)
+// [12]    direction (uint8)
+// [13-16] protocol name length (uint32)
+// [17-]   protocol name
+// [-4]    frame length (uint32)
+// [-n]    frame, exactly as written to or read from the connection
+const (
+    CAPTURE_MAGIC   = "GOATCAP"
+    CAPTURE_VERSION = 1
+)
+
+// Capture record directions.
+const (
+    CAPTURE_IN = iota
+    CAPTURE_OUT
+)
+
+// Maximum length of a captured frame or protocol name.
+const (
+    MAX_CAPTURE_FRAME_LEN = HEADER_LEN_B + EXT_HEADER_MAX_LEN_B + MAX_NET_MSG_LEN
+    MAX_CAPTURE_NAME_LEN  = 1024
+)
+
+// Perf counters.
+const (
+    PERF_CAPTURE_BYTES = iota
+    PERF_CAPTURE_ERRORS
+    PERF_CAPTURE_RECORDS
+    PERF_CAPTURE_COUNT
+)
+
+// Perf counter friendly names.
+var capturePerfNames = []string {
+    "Bytes",
+    "Errors",
+    "Records",
+}
+
+// Global capture perf object, shared by all captures.
+var capturePerfs = perf.NewCounterSet(
+    "Module.Net.Capture",
+    PERF_CAPTURE_COUNT,
+    capturePerfNames,
+)
+
+// Common error messages.
+var (
+    ErrCaptureClosed    = errors.New("Capture closed")
+    ErrCaptureMalformed = errors.New("Malformed capture file")
+    ErrCaptureVersion   = errors.New("Unsupported capture file version")
+)
+
+// Global capture, which records the traffic of every protocol, and its
+// synchronization.
+var (
+    captureAll   *Capture
+    captureMutex sync.RWMutex
+)
+
+// Friendly names of the reserved signatures.
+var reservedSigNames = map[uint16]string {
+    SIG_ACK      : "SIG_ACK",
+    SIG_COMPRESS : "SIG_COMPRESS",
+    SIG_EXTENDED : "SIG_EXTENDED",
+    SIG_FRAGMENT : "SIG_FRAGMENT",
+    SIG_HELLO    : "SIG_HELLO",
+    SIG_LOGIN    : "SIG_LOGIN",
+    SIG_PING     : "SIG_PING",
+    SIG_PONG     : "SIG_PONG",
+    SIG_RELIABLE : "SIG_RELIABLE",
+    SIG_RPC_REQ  : "SIG_RPC_REQ",
+    SIG_RPC_RESP : "SIG_RPC_RESP",
+    SIG_SHUTDOWN : "SIG_SHUTDOWN",
+    SIG_TOPIC    : "SIG_TOPIC",
+}
+
+
+// CreateCapture creates a new capture file at the given path, truncating
+// any existing file.
+func CreateCapture(path string) (*Capture, error) {
+    file, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+
+    capture, err := NewCapture(file)
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    return capture, nil
+}
+
+// NewCapture writes a capture file header to the given writer and returns a
+// new Capture which records to it. The writer is closed along with the
+// Capture if it implements io.Closer.
+func NewCapture(w io.Writer) (*Capture, error) {
+    newCapture := Capture {
+        out : bufio.NewWriter(w),
+    }
+
+    closer, ok := w.(io.Closer)
+    if ok {
+        newCapture.closer = closer
+    }
+
+    _, err := newCapture.out.WriteString(CAPTURE_MAGIC)
+    if err == nil {
+        err = newCapture.out.WriteByte(CAPTURE_VERSION)
+    }
+
+    if err == nil {
+        err = newCapture.out.Flush()
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &newCapture, nil
+}
+
+// SetCapture records the traffic of every protocol to the given Capture,
+// in addition to any capture set on the protocol itself. Passing nil stops
+// the global capture. The previous Capture is not closed.
+func SetCapture(capture *Capture) {
+    captureMutex.Lock()
+    defer captureMutex.Unlock()
+
+    captureAll = capture
+}
+
+// SigName returns the name of a reserved signature, or the signature number
+// for user signatures.
+func SigName(sig uint16) string {
+    name, ok := reservedSigNames[sig]
+    if ok {
+        return name
+    }
+
+    return fmt.Sprintf("%d", sig)
+}
+
+// Capture records framed messages, as they pass between protocols and their
+// connections, to a capture file. A Capture may be shared by any number of
+// protocols.
+type Capture struct {
+    closed bool
+    closer io.Closer
+    mutex  sync.Mutex
+    out    *bufio.Writer
+}
+
+// Close flushes the capture, and closes its underlying writer.
+func (this *Capture) Close() error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.closed {
+        return nil
+    }
+
+    this.closed = true
+
+    err := this.out.Flush()
+
+    if this.closer != nil {
+        closeErr := this.closer.Close()
+        if err == nil {
+            err = closeErr
+        }
+    }
+
+    return err
+}
+
+// Record writes a single frame to the capture. Records are flushed as they
+// are written, so that a capture survives a crash.
+func (this *Capture) Record(
+    protoName string,
+    conId     uint32,
+    direction byte,
+    frame     []byte,
+) error {
+    cursor := 0
+    record := make(
+        []byte,
+        buffer.LenUint64() +
+        buffer.LenUint32() +
+        buffer.LenByte() +
+        buffer.LenString(protoName) +
+        buffer.LenUint32(),
+    )
+
+    buffer.WriteUint64(uint64(time.Now().UnixNano()), record, &cursor)
+    buffer.WriteUint32(conId, record, &cursor)
+    buffer.WriteByte(direction, record, &cursor)
+    buffer.WriteString(protoName, record, &cursor)
+    buffer.WriteUint32(uint32(len(frame)), record, &cursor)
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.closed {
+        return ErrCaptureClosed
+    }
+
+    _, err := this.out.Write(record)
+    if err == nil {
+        _, err = this.out.Write(frame)
+    }
+
+    if err == nil {
+        err = this.out.Flush()
+    }
+
+    if err != nil {
+        capturePerfs.Increment(PERF_CAPTURE_ERRORS)
+        return err
+    }
+
+    capturePerfs.Increment(PERF_CAPTURE_RECORDS)
+    capturePerfs.Add(PERF_CAPTURE_BYTES, int64(len(record) + len(frame)))
+
+    return nil
+}
+
+
+// OpenCapture opens the capture file at the given path for reading.
+func OpenCapture(path string) (*CaptureReader, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+
+    reader, err := NewCaptureReader(file)
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    reader.closer = file
+
+    return reader, nil
+}
+
+// NewCaptureReader validates the capture file header at the start of the
+// given reader, and returns a new CaptureReader positioned at the first
+// record.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+    newReader := CaptureReader {
+        in : bufio.NewReader(r),
+    }
+
+    header := make([]byte, len(CAPTURE_MAGIC) + 1)
+
+    _, err := io.ReadFull(newReader.in, header)
+    if err != nil || string(header[:len(CAPTURE_MAGIC)]) != CAPTURE_MAGIC {
+        return nil, ErrCaptureMalformed
+    }
+
+    if header[len(CAPTURE_MAGIC)] != CAPTURE_VERSION {
+        return nil, ErrCaptureVersion
+    }
+
+    return &newReader, nil
+}
+
+// CaptureReader reads records from a capture file.
+type CaptureReader struct {
+    closer io.Closer
+    in     *bufio.Reader
+}
+
+// Close closes the capture file, if the reader was opened with OpenCapture.
+func (this *CaptureReader) Close() error {
+    if this.closer == nil {
+        return nil
+    }
+
+    return this.closer.Close()
+}
+
+// Next returns the next record in the capture, or io.EOF once all records
+// have been read.
+func (this *CaptureReader) Next() (*CaptureRecord, error) {
+    var err error
+
+    cursor := 0
+    fixed  := make(
+        []byte,
+        buffer.LenUint64() + buffer.LenUint32() + buffer.LenByte(),
+    )
+
+    _, err = io.ReadFull(this.in, fixed)
+    if err == io.EOF {
+        return nil, io.EOF
+    }
+
+    if err != nil {
+        return nil, ErrCaptureMalformed
+    }
+
+    nanos, _ := buffer.ReadUint64(fixed, &cursor)
+
+    rec      := new(CaptureRecord)
+    rec.Time  = time.Unix(0, int64(nanos))
+
+    rec.ConId, _     = buffer.ReadUint32(fixed, &cursor)
+    rec.Direction, _ = buffer.ReadByte(fixed, &cursor)
+
+    name, err := this.readField(MAX_CAPTURE_NAME_LEN)
+    if err != nil {
+        return nil, err
+    }
+
+    rec.Proto = string(name)
+
+    rec.Frame, err = this.readField(MAX_CAPTURE_FRAME_LEN)
+    if err != nil {
+        return nil, err
+    }
+
+    return rec, nil
+}
+
+// readField reads a length prefixed field of up to maxLen bytes.
+func (this *CaptureReader) readField(maxLen int) ([]byte, error) {
+    cursor := 0
+    lenBuf := make([]byte, buffer.LenUint32())
+
+    _, err := io.ReadFull(this.in, lenBuf)
+    if err != nil {
+        return nil, ErrCaptureMalformed
+    }
+
+    fieldLen, _ := buffer.ReadUint32(lenBuf, &cursor)
+    if int(fieldLen) > maxLen {
+        return nil, ErrCaptureMalformed
+    }
+
+    field := make([]byte, fieldLen)
+
+    _, err = io.ReadFull(this.in, field)
+    if err != nil {
+        return nil, ErrCaptureMalformed
+    }
+
+    return field, nil
+}
+
+
+// CaptureRecord is a single framed message read from a capture file.
+type CaptureRecord struct {
+    ConId     uint32
+    Direction byte
+    Frame     []byte
+    Proto     string
+    Time      time.Time
+}
+
+// Msg parses the record's frame into a Msg. The message's payload is left
+// as it was on the wire, still encrypted or compressed if it was sent that
+// way.
+func (this *CaptureRecord) Msg() (*Msg, error) {
+    msg := NewMsg()
+    msg.SetConnection(&captureCon { id : this.ConId })
+
+    leftover, complete := msg.addData(this.Frame)
+    if !complete || msg.malformed || len(leftover) > 0 {
+        return nil, ErrCaptureMalformed
+    }
+
+    return msg, nil
+}
+
+
+// NewCaptureDecoder returns a new CaptureDecoder which decodes messages
+// with the MsgProcessors, and the crypto and compression providers,
+// registered with the given protocol.
+func NewCaptureDecoder(proto *Protocol) *CaptureDecoder {
+    newDecoder := CaptureDecoder {
+        ids   : make(map[captureKey]uint32),
+        proto : proto,
+    }
+
+    return &newDecoder
+}
+
+// CaptureDecoder turns capture records back into the messages they carried.
+// Fragmented messages are reassembled, so a decoder should be fed every
+// record of a capture, in order.
+type CaptureDecoder struct {
+    ids   map[captureKey]uint32
+    proto *Protocol
+}
+
+// Decode parses a capture record, returning its message and, for messages
+// of registered signatures, the deserialized object. Both are nil for
+// fragments of messages which aren't complete yet. Reserved signatures are
+// returned without an object, as they have no MsgProcessor.
+func (this *CaptureDecoder) Decode(rec *CaptureRecord) (*Msg, interface{}, error) {
+    msg, err := rec.Msg()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if !msg.isValid() {
+        return msg, nil, errBadChecksum
+    }
+
+    if msg.MsgType() == SIG_FRAGMENT {
+        // fragment ids are only unique per connection and direction
+        msg.SetConnection(&captureCon { id : this.reassemblyId(rec) })
+
+        msg, err = this.proto.reassembleMsg(msg)
+        if err != nil || msg == nil {
+            return nil, nil, err
+        }
+    }
+
+    if isReservedSig(msg.ExtMsgType()) {
+        return msg, nil, nil
+    }
+
+    obj, _, err := this.proto.unpackMsg(msg, ACCESS_MAX)
+    if err != nil {
+        return msg, nil, err
+    }
+
+    return msg, obj, nil
+}
+
+// reassemblyId returns the connection id used to reassemble fragments of
+// the given record.
+func (this *CaptureDecoder) reassemblyId(rec *CaptureRecord) uint32 {
+    key := captureKey {
+        conId     : rec.ConId,
+        direction : rec.Direction,
+    }
+
+    id, ok := this.ids[key]
+    if !ok {
+        id            = uint32(len(this.ids) + 1)
+        this.ids[key] = id
+    }
+
+    return id
+}
+
+
+// NewReplayOptions returns a new ReplayOptions populated with default
+// values, which replay all inbound messages other than control messages,
+// as fast as possible.
+func NewReplayOptions() *ReplayOptions {
+    newOpts := ReplayOptions {
+        Direction : CAPTURE_IN,
+        SkipCtrl  : true,
+    }
+
+    return &newOpts
+}
+
+// Replay reads records from a capture, and sends the frames of those which
+// match the given options to a connection, exactly as they were captured.
+// Replaying the inbound traffic of a server against a live server
+// reproduces what its clients sent. The number of frames sent is returned.
+func Replay(
+    reader *CaptureReader,
+    con    Connection,
+    opts   *ReplayOptions,
+) (int, error) {
+    var last time.Time
+
+    if opts == nil {
+        opts = NewReplayOptions()
+    }
+
+    sent := 0
+
+    for {
+        rec, err := reader.Next()
+        if err == io.EOF {
+            return sent, nil
+        }
+
+        if err != nil {
+            return sent, err
+        }
+
+        if !opts.matches(rec) {
+            continue
+        }
+
+        if opts.Speed > 0 && !last.IsZero() {
+            delay := float64(rec.Time.Sub(last)) / opts.Speed
+            <-time.After(time.Duration(delay))
+        }
+
+        last = rec.Time
+
+        con.Send(rec.Frame, DEFAULT_MSG_TIMEOUT_SEC)
+        sent++
+    }
+}
+
+// ReplayOptions selects the records sent by Replay. ConId and Proto match
+// any connection or protocol when left empty. Speed scales the delays
+// between records, with 1 replaying in real time, and 0 sending without
+// delay.
+type ReplayOptions struct {
+    ConId     uint32
+    Direction byte
+    Proto     string
+    SkipCtrl  bool
+    Speed     float64
+}
+
+// matches returns true if the given record should be replayed.
+func (this *ReplayOptions) matches(rec *CaptureRecord) bool {
+    if rec.Direction != this.Direction {
+        return false
+    }
+
+    if this.ConId != 0 && rec.ConId != this.ConId {
+        return false
+    }
+
+    if this.Proto != "" && rec.Proto != this.Proto {
+        return false
+    }
+
+    if !this.SkipCtrl {
+        return true
+    }
+
+    header, err := GetMsgHeader(rec.Frame)
+
+    return err == nil && !isCtrlSig(uint32(GetMsgSig(header)))
+}
+
+
+// SetCapture records the protocol's traffic to the given Capture, in
+// addition to the global capture, if any. Passing nil stops the capture.
+// The previous Capture is not closed.
+func (this *Protocol) SetCapture(capture *Capture) {
+    captureMutex.Lock()
+    defer captureMutex.Unlock()
+
+    this.capture = capture
+}
+
+// captureFrame records a frame sent to or received from the given connection
+// to the protocol's capture and to the global capture, if either is set.
+func (this *Protocol) captureFrame(con Connection, direction byte, frame []byte) {
+    captureMutex.RLock()
+    captures := []*Capture { this.capture, captureAll }
+    captureMutex.RUnlock()
+
+    if captures[0] == captures[1] {
+        captures = captures[:1]
+    }
+
+    for i := range captures {
+        if captures[i] == nil {
+            continue
+        }
+
+        err := captures[i].Record(this.name, con.Id(), direction, frame)
+        if err != nil {
+            log.Error("Capture failed (proto: %s, err: %v)", this.name, err)
+        }
+    }
+}
+
+// capturing returns true if the protocol's traffic is being captured.
+func (this *Protocol) capturing() bool {
+    captureMutex.RLock()
+    defer captureMutex.RUnlock()
+
+    return this.capture != nil || captureAll != nil
+}
+
+
+// captureCon stands in for the connection a captured message arrived on.
+type captureCon struct {
+    id uint32
+}
+
+// Close performs no action for captureCons.
+func (this *captureCon) Close() {}
+
+// Id returns the captured connection id.
+func (this *captureCon) Id() uint32 {
+    return this.id
+}
+
+// Key returns an empty string for captureCons.
+func (this *captureCon) Key() string {
+    return ""
+}
+
+// LocalAddr returns nil for captureCons.
+func (this *captureCon) LocalAddr() stdnet.Addr {
+    return nil
+}
+
+// RemoteAddr returns nil for captureCons.
+func (this *captureCon) RemoteAddr() stdnet.Addr {
+    return nil
+}
+
+// Send performs no action for captureCons.
+func (this *captureCon) Send(data []byte, timeoutSec int) {}
+
+
+// captureKey identifies one direction of a captured connection.
+type captureKey struct {
+    conId     uint32
+    direction byte
+}
@@ -0,0 +1,333 @@
+//  ---------------------------------------------------------------------------
+//
+//  compress.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/lz"
+    "github.com/xaevman/goat/lib/perf"
+)
+
+// Stdlib imports.
+import (
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "sync"
+)
+
+// Compression codecs. Compressed payloads are prefixed with the id of the
+// codec used to compress them.
+const (
+    COMPRESS_NONE = iota
+    COMPRESS_FLATE
+    COMPRESS_GZIP
+    COMPRESS_LZ
+)
+
+// Payloads smaller than this are sent uncompressed by default.
+const DEFAULT_COMPRESS_THRESHOLD_B = 256
+
+// Perf counters.
+const (
+    PERF_COMPRESS_BYTES_IN = iota
+    PERF_COMPRESS_BYTES_OUT
+    PERF_COMPRESS_DECOMPRESS_BYTES_IN
+    PERF_COMPRESS_DECOMPRESS_BYTES_OUT
+    PERF_COMPRESS_MSG_COMPRESSED
+    PERF_COMPRESS_MSG_SKIPPED
+    PERF_COMPRESS_COUNT
+)
+
+// Perf counter friendly names.
+var compressPerfNames = []string {
+    "BytesIn",
+    "BytesOut",
+    "DecompressBytesIn",
+    "DecompressBytesOut",
+    "MsgCompressed",
+    "MsgSkipped",
+}
+
+// Common error messages.
+var (
+    errCompressTooLarge = errors.New("Decompressed payload exceeds max size")
+    errCompressNoCodec  = errors.New("Compressed payload missing codec id")
+)
+
+
+// NewCompressor creates a new Compressor which compresses payloads of at
+// least threshold bytes using the first of the supplied codecs, in order of
+// preference, that the remote peer supports. If no codecs are supplied,
+// COMPRESS_LZ, COMPRESS_FLATE and COMPRESS_GZIP are offered.
+func NewCompressor(threshold int, codecs ...int) *Compressor {
+    if len(codecs) < 1 {
+        codecs = []int { COMPRESS_LZ, COMPRESS_FLATE, COMPRESS_GZIP }
+    }
+
+    newCompressor := Compressor {
+        codecs    : codecs,
+        peers     : make(map[uint32][]int),
+        threshold : threshold,
+    }
+
+    return &newCompressor
+}
+
+// Compressor implements CompressionProvider and CompressionNegotiator. Peers
+// advertise the codecs they are able to decode after their handshake, and
+// payloads are only compressed once the remote peer's capabilities are
+// known, so that peers without compression support continue to receive
+// uncompressed messages.
+type Compressor struct {
+    codecs    []int
+    mutex     sync.RWMutex
+    peers     map[uint32][]int
+    perfs     *perf.CounterSet
+    proto     *Protocol
+    threshold int
+}
+
+// Capabilities returns the list of codecs supported by this Compressor, in
+// order of preference, encoded for transmission.
+func (this *Compressor) Capabilities() []byte {
+    caps := make([]byte, len(this.codecs))
+    for i := range this.codecs {
+        caps[i] = byte(this.codecs[i])
+    }
+
+    return caps
+}
+
+// Close is unused in Compressor.
+func (this *Compressor) Close() {}
+
+// Compress compresses the supplied message's payload, if it meets the size
+// threshold and its destination supports one of this Compressor's codecs.
+func (this *Compressor) Compress(msg *Msg) error {
+    data  := msg.GetPayload()
+    codec := COMPRESS_NONE
+
+    if len(data) >= this.threshold {
+        codec = this.codecFor(msg.Connection())
+    }
+
+    if codec == COMPRESS_NONE {
+        this.perfs.Increment(PERF_COMPRESS_MSG_SKIPPED)
+        return nil
+    }
+
+    out, err := encodeCodec(codec, data)
+    if err != nil {
+        return err
+    }
+
+    // not worth it
+    if len(out) >= len(data) {
+        this.perfs.Increment(PERF_COMPRESS_MSG_SKIPPED)
+        return nil
+    }
+
+    msg.SetPayload(out)
+    msg.SetCompressed(true)
+
+    this.perfs.Increment(PERF_COMPRESS_MSG_COMPRESSED)
+    this.perfs.Add(PERF_COMPRESS_BYTES_IN, int64(len(data)))
+    this.perfs.Add(PERF_COMPRESS_BYTES_OUT, int64(len(out)))
+
+    return nil
+}
+
+// Decompress decompresses the supplied message's payload using the codec
+// identified in its first byte.
+func (this *Compressor) Decompress(msg *Msg) error {
+    data := msg.GetPayload()
+    if len(data) < 1 {
+        return errCompressNoCodec
+    }
+
+    out, err := decodeCodec(int(data[0]), data[1:], this.proto.getMaxMsgLen())
+    if err != nil {
+        return err
+    }
+
+    msg.SetPayload(out)
+    msg.SetCompressed(false)
+
+    this.perfs.Add(PERF_COMPRESS_DECOMPRESS_BYTES_IN, int64(len(data)))
+    this.perfs.Add(PERF_COMPRESS_DECOMPRESS_BYTES_OUT, int64(len(out)))
+
+    return nil
+}
+
+// Init saves a reference to the parent protocol and registers the
+// Compressor's perf counters.
+func (this *Compressor) Init(proto *Protocol) {
+    this.proto = proto
+    this.perfs = perf.NewCounterSet(
+        perfName(fmt.Sprintf("%s.Compression", proto.name)),
+        PERF_COMPRESS_COUNT,
+        compressPerfNames,
+    )
+}
+
+// OnCapabilities records the codecs supported by the given remote peer.
+func (this *Compressor) OnCapabilities(con Connection, data []byte) {
+    caps := make([]int, len(data))
+    for i := range data {
+        caps[i] = int(data[i])
+    }
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.peers[con.Id()] = caps
+}
+
+// OnDisconnect discards the capabilities of the given remote peer.
+func (this *Compressor) OnDisconnect(con Connection) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    delete(this.peers, con.Id())
+}
+
+// Perfs returns the CounterSet tracking this Compressor's activity.
+func (this *Compressor) Perfs() *perf.CounterSet {
+    return this.perfs
+}
+
+// codecFor returns the preferred codec supported by the given connection.
+// For BroadcastGroups, the preferred codec supported by every member of the
+// group is returned.
+func (this *Compressor) codecFor(con Connection) int {
+    if con == nil {
+        return COMPRESS_NONE
+    }
+
+    members := []Connection { con }
+
+    group, ok := con.(*BroadcastGroup)
+    if ok {
+        members = group.GetAllConnections()
+        if len(members) < 1 {
+            return COMPRESS_NONE
+        }
+    }
+
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    for _, codec := range this.codecs {
+        supported := true
+        for i := range members {
+            if !hasCodec(this.peers[members[i].Id()], codec) {
+                supported = false
+                break
+            }
+        }
+
+        if supported {
+            return codec
+        }
+    }
+
+    return COMPRESS_NONE
+}
+
+// decodeCodec decompresses the supplied data with the given codec, refusing
+// to produce more than maxLen bytes of output.
+func decodeCodec(codec int, data []byte, maxLen int) ([]byte, error) {
+    var reader io.Reader
+    var err    error
+
+    switch codec {
+    case COMPRESS_FLATE:
+        reader = flate.NewReader(bytes.NewReader(data))
+    case COMPRESS_GZIP:
+        reader, err = gzip.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, err
+        }
+    case COMPRESS_LZ:
+        return lz.Decompress(data, maxLen)
+    default:
+        return nil, errors.New(fmt.Sprintf("Unknown compression codec %d", codec))
+    }
+
+    out, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxLen) + 1))
+    if err != nil {
+        return nil, err
+    }
+
+    if len(out) > maxLen {
+        return nil, errCompressTooLarge
+    }
+
+    return out, nil
+}
+
+// encodeCodec compresses the supplied data with the given codec, returning
+// the codec id followed by the compressed data.
+func encodeCodec(codec int, data []byte) ([]byte, error) {
+    var buf    bytes.Buffer
+    var writer io.WriteCloser
+    var err    error
+
+    buf.WriteByte(byte(codec))
+
+    switch codec {
+    case COMPRESS_FLATE:
+        writer, err = flate.NewWriter(&buf, flate.BestSpeed)
+        if err != nil {
+            return nil, err
+        }
+    case COMPRESS_GZIP:
+        writer, err = gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+        if err != nil {
+            return nil, err
+        }
+    case COMPRESS_LZ:
+        buf.Write(lz.Compress(data))
+        return buf.Bytes(), nil
+    default:
+        return nil, errors.New(fmt.Sprintf("Unknown compression codec %d", codec))
+    }
+
+    _, err = writer.Write(data)
+    if err != nil {
+        return nil, err
+    }
+
+    err = writer.Close()
+    if err != nil {
+        return nil, err
+    }
+
+    return buf.Bytes(), nil
+}
+
+// hasCodec returns true if the given codec is present in the list.
+func hasCodec(codecs []int, codec int) bool {
+    for i := range codecs {
+        if codecs[i] == codec {
+            return true
+        }
+    }
+
+    return false
+}
@@ -0,0 +1,191 @@
+//  ---------------------------------------------------------------------------
+//
+//  control.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "fmt"
+)
+
+// rcvCtrlMsg handles messages addressed to one of the reserved signatures
+// used internally by the net service. Unknown reserved signatures are
+// dropped, rather than treated as errors, so that newer peers may introduce
+// new control messages without breaking older builds.
+func (this *Protocol) rcvCtrlMsg(msg *Msg) {
+    sig := msg.MsgType()
+
+    this.markCtrl(msg.Connection().Id(), ctrlPeerCapable)
+
+    switch sig {
+    case SIG_HELLO:
+        this.rcvHello(msg)
+    case SIG_LOGIN:
+        this.rcvLogin(msg)
+    case SIG_PING:
+        this.rcvPing(msg)
+    case SIG_PONG:
+        this.rcvPong(msg)
+    case SIG_SHUTDOWN:
+        this.rcvShutdown(msg)
+    case SIG_COMPRESS:
+        this.rcvCompress(msg)
+    default:
+        log.Debug(
+            "Unknown control msg (sig %v, proto %s). Dropping msg",
+            sig,
+            this.name,
+        )
+    }
+}
+
+// sendCtrlMsg frames the supplied payload as a control message of the given
+// reserved signature and sends it directly to the connection with high
+// priority, bypassing the compression and encryption stages of the send
+// pipeline.
+func (this *Protocol) sendCtrlMsg(con Connection, sig uint16, payload []byte) {
+    msg := NewMsg()
+    msg.SetMsgType(sig)
+    msg.SetPayload(payload)
+
+    this.sendFrame(con, msg.GetBytes(), DEFAULT_MSG_TIMEOUT_SEC, PRIORITY_HIGH)
+}
+
+// ctrlConnect sends the protocol's handshake, if SetHelloOnConnect is
+// enabled, followed by the hello message of the registered AccessNegotiator,
+// if any, to a newly connected client. Compression capabilities are only
+// sent once the peer has shown that it negotiates compression.
+func (this *Protocol) ctrlConnect(con Connection) {
+    this.objMutex.RLock()
+    helloConnect        := this.helloConnect
+    accessNeg, accessOk := this.security.(AccessNegotiator)
+    this.objMutex.RUnlock()
+
+    if helloConnect {
+        this.sendHello(con)
+    }
+
+    if accessOk {
+        hello := accessNeg.Hello(con)
+        if hello != nil {
+            this.sendCtrlMsg(con, SIG_LOGIN, hello)
+        }
+    }
+}
+
+// ctrlDisconnect notifies any registered providers which negotiate with, or
+// track the state of, remote peers that a client has disconnected.
+func (this *Protocol) ctrlDisconnect(con Connection) {
+    this.objMutex.RLock()
+    accessNeg, accessOk := this.security.(AccessNegotiator)
+    compNeg, compOk     := this.compressor.(CompressionNegotiator)
+    cryptoTrk, cryptoOk := this.crypto.(CryptoTracker)
+    this.objMutex.RUnlock()
+
+    if accessOk {
+        accessNeg.OnDisconnect(con)
+    }
+
+    if compOk {
+        compNeg.OnDisconnect(con)
+    }
+
+    if cryptoOk {
+        cryptoTrk.OnDisconnect(con)
+    }
+}
+
+// isCtrlSig returns true for reserved signatures which are handled by the
+// net service before authorization. Fragments, rpc envelopes and topic
+// messages carry user messages, and so pass through the full receive
+// pipeline.
+func isCtrlSig(sig uint32) bool {
+    switch sig {
+    case SIG_FRAGMENT, SIG_RPC_REQ, SIG_RPC_RESP, SIG_TOPIC:
+        return false
+    }
+
+    return isReservedSig(sig)
+}
+
+// rcvCompress passes the compression capabilities of a remote peer to the
+// registered CompressionNegotiator, and answers with our own, if they
+// haven't been sent yet.
+func (this *Protocol) rcvCompress(msg *Msg) {
+    this.objMutex.RLock()
+    negotiator, ok := this.compressor.(CompressionNegotiator)
+    this.objMutex.RUnlock()
+
+    if !ok {
+        return
+    }
+
+    negotiator.OnCapabilities(msg.Connection(), msg.GetPayload())
+    this.sendCompress(msg.Connection())
+}
+
+// sendCompress sends the compression capabilities of the registered
+// CompressionNegotiator, if any, to the given connection, unless they have
+// already been sent.
+func (this *Protocol) sendCompress(con Connection) {
+    this.objMutex.RLock()
+    negotiator, ok := this.compressor.(CompressionNegotiator)
+    this.objMutex.RUnlock()
+
+    if !ok || !this.markCtrl(con.Id(), ctrlSentCompress) {
+        return
+    }
+
+    this.sendCtrlMsg(con, SIG_COMPRESS, negotiator.Capabilities())
+}
+
+// rcvLogin passes a login message to the registered AccessNegotiator, sending
+// its reply, if any, back to the remote peer. The connection is closed if the
+// login fails.
+func (this *Protocol) rcvLogin(msg *Msg) {
+    con := msg.Connection()
+
+    this.objMutex.RLock()
+    negotiator, ok := this.security.(AccessNegotiator)
+    this.objMutex.RUnlock()
+
+    if !ok {
+        log.Debug(
+            "Login msg received, but no AccessNegotiator (proto %s). Dropping msg",
+            this.name,
+        )
+        return
+    }
+
+    reply, err := negotiator.OnLogin(con, msg.GetPayload())
+    if reply != nil {
+        this.sendCtrlMsg(con, SIG_LOGIN, reply)
+    }
+
+    if err != nil {
+        this.perfs.Increment(PERF_PROTO_ERR_AUTH_CLIENT)
+        this.errChan<- errors.New(fmt.Sprintf(
+            "Login failed (proto: %s, con: %v, err: %v)",
+            this.name,
+            con.Id(),
+            err,
+        ))
+
+        go con.Close()
+    }
+}
@@ -0,0 +1,263 @@
+//  ---------------------------------------------------------------------------
+//
+//  dispatch.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/perf"
+)
+
+// Stdlib imports.
+import (
+    "runtime"
+    "sync"
+    "time"
+)
+
+// Dispatch models, which decide how received messages are handed to the
+// EventHandler.
+//
+// DISPATCH_SINGLE calls OnReceive from the protocol's event loop, one
+// message at a time, with the EventHandler locked. DISPATCH_ORDERED hashes
+// each connection to one of a pool of workers, so that messages from
+// different connections are handled in parallel, while messages from the
+// same connection are handled in the order they were received.
+// DISPATCH_PARALLEL hands each message to the next free worker, with no
+// ordering guarantees.
+//
+// Under the concurrent models, OnReceive and OnPublish may be called from
+// several goroutines at once, but never at the same time as the
+// EventHandler's other callbacks.
+const (
+    DISPATCH_SINGLE = iota
+    DISPATCH_ORDERED
+    DISPATCH_PARALLEL
+)
+
+// Dispatch defaults. A worker count of zero uses one worker per CPU.
+const (
+    DEFAULT_DISPATCH_WORKERS = 0
+    MAX_DISPATCH_WORKERS     = 256
+)
+
+// Perf counters.
+const (
+    PERF_DISPATCH_BUSY = iota
+    PERF_DISPATCH_HANDLER_US
+    PERF_DISPATCH_HANDLER_1MS
+    PERF_DISPATCH_HANDLER_10MS
+    PERF_DISPATCH_HANDLER_100MS
+    PERF_DISPATCH_HANDLER_SLOW
+    PERF_DISPATCH_QUEUED
+    PERF_DISPATCH_WAIT_US
+    PERF_DISPATCH_WORKERS
+    PERF_DISPATCH_COUNT
+)
+
+// Perf counter friendly names.
+var dispatchPerfNames = []string {
+    "BusyWorkers",
+    "HandlerUs",
+    "HandlerUnder1Ms",
+    "HandlerUnder10Ms",
+    "HandlerUnder100Ms",
+    "HandlerOver100Ms",
+    "Queued",
+    "QueueWaitUs",
+    "Workers",
+}
+
+
+// newDispatchPerfs creates the dispatch perf counters of the named protocol,
+// with statistics enabled on the latency counters.
+func newDispatchPerfs(pName string) *perf.CounterSet {
+    perfs := perf.NewCounterSet(
+        perfName(pName + ".Dispatch"),
+        PERF_DISPATCH_COUNT,
+        dispatchPerfNames,
+    )
+
+    perfs.EnableStats(PERF_DISPATCH_HANDLER_US)
+    perfs.EnableStats(PERF_DISPATCH_WAIT_US)
+
+    return perfs
+}
+
+// dispatchJob is a received message waiting to be handed to the EventHandler.
+type dispatchJob struct {
+    handle func()
+    queued time.Time
+}
+
+// dispatchPool is the set of workers used by the concurrent dispatch models.
+// Ordered pools have one queue per worker. Parallel pools share one queue
+// between all workers.
+type dispatchPool struct {
+    queues []chan *dispatchJob
+    wg     sync.WaitGroup
+}
+
+// push queues a job on the worker owning the given connection, blocking
+// while that worker's queue is full.
+func (this *dispatchPool) push(conId uint32, job *dispatchJob) {
+    this.queues[conId % uint32(len(this.queues))]<- job
+}
+
+
+// SetDispatch selects the dispatch model used for messages received after
+// the call, and the number of workers used by the concurrent models. Jobs
+// queued under the previous model are completed first. SetDispatch must not
+// be called from within an EventHandler callback.
+func (this *Protocol) SetDispatch(mode, workers int) {
+    if workers < 1 {
+        workers = runtime.NumCPU()
+    }
+
+    if workers > MAX_DISPATCH_WORKERS {
+        workers = MAX_DISPATCH_WORKERS
+    }
+
+    var pool *dispatchPool
+
+    switch mode {
+    case DISPATCH_ORDERED:
+        pool = this.startPool(workers, workers)
+    case DISPATCH_PARALLEL:
+        pool = this.startPool(1, workers)
+    default:
+        workers = 0
+    }
+
+    this.dispatchMutex.Lock()
+    old              := this.dispatchPool
+    this.dispatchPool = pool
+    this.dispatchMutex.Unlock()
+
+    this.stopPool(old)
+
+    this.dispatchPerfs.Set(PERF_DISPATCH_WORKERS, int64(workers))
+}
+
+// dispatch hands a received message's handler to the protocol's dispatch
+// model, along with the id of the connection which sent it. Queued handlers
+// count as running for the purposes of Drain.
+func (this *Protocol) dispatch(conId uint32, handle func()) {
+    this.beginHandler()
+
+    job := dispatchJob {
+        handle : handle,
+        queued : time.Now(),
+    }
+
+    this.dispatchMutex.RLock()
+    pool := this.dispatchPool
+    if pool == nil {
+        this.dispatchMutex.RUnlock()
+        this.runJob(&job, false)
+        return
+    }
+
+    this.dispatchPerfs.Increment(PERF_DISPATCH_QUEUED)
+    pool.push(conId, &job)
+    this.dispatchMutex.RUnlock()
+}
+
+// runDispatchWorker runs in its own goroutine, handling jobs from the given
+// queue until it is closed.
+func (this *Protocol) runDispatchWorker(
+    pool  *dispatchPool,
+    queue chan *dispatchJob,
+) {
+    defer pool.wg.Done()
+
+    for job := range queue {
+        this.dispatchPerfs.Add(PERF_DISPATCH_QUEUED, -1)
+        this.runJob(job, true)
+    }
+}
+
+// runJob calls a job's handler and records its latency. Concurrent jobs
+// share the EventHandler with each other, but not with its other callbacks.
+func (this *Protocol) runJob(job *dispatchJob, concurrent bool) {
+    defer this.endHandler()
+
+    start := time.Now()
+    this.dispatchPerfs.Set(
+        PERF_DISPATCH_WAIT_US,
+        int64(start.Sub(job.queued) / time.Microsecond),
+    )
+
+    this.dispatchPerfs.Increment(PERF_DISPATCH_BUSY)
+
+    if concurrent {
+        this.evtMutex.RLock()
+        job.handle()
+        this.evtMutex.RUnlock()
+    } else {
+        this.evtMutex.Lock()
+        job.handle()
+        this.evtMutex.Unlock()
+    }
+
+    this.dispatchPerfs.Add(PERF_DISPATCH_BUSY, -1)
+
+    elapsed := time.Since(start)
+    this.dispatchPerfs.Set(
+        PERF_DISPATCH_HANDLER_US,
+        int64(elapsed / time.Microsecond),
+    )
+
+    switch {
+    case elapsed < time.Millisecond:
+        this.dispatchPerfs.Increment(PERF_DISPATCH_HANDLER_1MS)
+    case elapsed < 10 * time.Millisecond:
+        this.dispatchPerfs.Increment(PERF_DISPATCH_HANDLER_10MS)
+    case elapsed < 100 * time.Millisecond:
+        this.dispatchPerfs.Increment(PERF_DISPATCH_HANDLER_100MS)
+    default:
+        this.dispatchPerfs.Increment(PERF_DISPATCH_HANDLER_SLOW)
+    }
+}
+
+// startPool creates a dispatch pool with the given number of queues and
+// workers, and starts its workers.
+func (this *Protocol) startPool(queues, workers int) *dispatchPool {
+    pool := dispatchPool {
+        queues : make([]chan *dispatchJob, queues),
+    }
+
+    for i := range pool.queues {
+        pool.queues[i] = make(chan *dispatchJob, QUEUE_BUFFERS)
+    }
+
+    pool.wg.Add(workers)
+    for i := 0; i < workers; i++ {
+        go this.runDispatchWorker(&pool, pool.queues[i % queues])
+    }
+
+    return &pool
+}
+
+// stopPool closes the queues of a dispatch pool, and waits for its workers to
+// finish the jobs already queued.
+func (this *Protocol) stopPool(pool *dispatchPool) {
+    if pool == nil {
+        return
+    }
+
+    for i := range pool.queues {
+        close(pool.queues[i])
+    }
+
+    pool.wg.Wait()
+}
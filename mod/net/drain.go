@@ -0,0 +1,241 @@
+//  ---------------------------------------------------------------------------
+//
+//  drain.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Drain defaults.
+const (
+    DEFAULT_DRAIN_TIMEOUT_SEC = 10
+    DRAIN_POLL_MS             = 10
+)
+
+// Common error messages.
+var (
+    ErrDraining     = errors.New("Protocol is draining")
+    ErrDrainTimeout = errors.New("Drain deadline reached with work outstanding")
+)
+
+// DrainHandler may optionally be implemented by an EventHandler which wants
+// to know when a remote peer begins a graceful shutdown. OnPeerShutdown is
+// called with the time the peer will wait for outstanding messages before
+// closing the connection.
+type DrainHandler interface {
+    OnPeerShutdown(con Connection, grace time.Duration)
+}
+
+// flusher is implemented by connections which queue outbound messages.
+// flushed returns true once everything queued has been written.
+type flusher interface {
+    flushed() bool
+}
+
+
+// DrainAll drains every live protocol in parallel, waiting up to timeoutSec
+// seconds. ErrDrainTimeout is returned if any protocol failed to drain in
+// time.
+func DrainAll(timeoutSec int) error {
+    routeMutex.RLock()
+    protos := make([]*Protocol, 0, len(liveProtos))
+    for proto, _ := range liveProtos {
+        protos = append(protos, proto)
+    }
+    routeMutex.RUnlock()
+
+    var result error
+    var mutex  sync.Mutex
+    var wg     sync.WaitGroup
+
+    for i := range protos {
+        wg.Add(1)
+        go func(proto *Protocol) {
+            defer wg.Done()
+
+            err := proto.Drain(timeoutSec)
+            if err != nil {
+                mutex.Lock()
+                result = err
+                mutex.Unlock()
+            }
+        }(protos[i])
+    }
+
+    wg.Wait()
+
+    return result
+}
+
+
+// Drain gracefully winds down the protocol's traffic, in preparation for
+// Shutdown. Stream listeners are stopped and new connections are refused,
+// every connection which accepts control messages is sent a SIG_SHUTDOWN
+// message, and Drain then waits up to timeoutSec seconds for outbound queues
+// to be written and for in-progress OnReceive, OnPublish and rpc handlers to
+// return. Connections are left open. ErrDrainTimeout is returned if the deadline is reached
+// first. Drain must not be called from within an EventHandler callback.
+func (this *Protocol) Drain(timeoutSec int) error {
+    deadline := time.Now().Add(time.Duration(timeoutSec) * time.Second)
+
+    this.objMutex.Lock()
+    first        := !this.draining
+    this.draining  = true
+
+    stopped := make([]NetConnector, 0, len(this.netObjects))
+    kept    := make([]NetConnector, 0, len(this.netObjects))
+    for _, obj := range this.netObjects {
+        // udp listeners also carry the traffic of their endpoints
+        _, packet := obj.(*udpSrv)
+        if packet {
+            kept = append(kept, obj)
+        } else {
+            stopped = append(stopped, obj)
+        }
+    }
+    this.netObjects = kept
+    this.objMutex.Unlock()
+
+    for _, obj := range stopped {
+        obj.Stop()
+    }
+
+    if first {
+        this.perfs.Increment(PERF_PROTO_DRAIN)
+
+        cursor  := 0
+        payload := make([]byte, buffer.LenUint32())
+        buffer.WriteUint32(uint32(timeoutSec * 1000), payload, &cursor)
+
+        for _, con := range this.GetAllConnections() {
+            // older peers disconnect on unknown messages
+            if !this.ctrlCapable(con.Id()) {
+                continue
+            }
+
+            this.sendCtrlMsg(con, SIG_SHUTDOWN, payload)
+        }
+    }
+
+    for !this.drained() {
+        if time.Now().After(deadline) {
+            this.perfs.Increment(PERF_PROTO_DRAIN_TIMEOUT)
+            log.Error(
+                "Drain timed out after %v sec (proto %s, handlers %v)",
+                timeoutSec,
+                this.name,
+                atomic.LoadInt32(&this.handlers),
+            )
+            return ErrDrainTimeout
+        }
+
+        <-time.After(DRAIN_POLL_MS * time.Millisecond)
+    }
+
+    log.Debug("Proto %s drained", this.name)
+
+    return nil
+}
+
+// SetDrainTimeout sets the number of seconds Shutdown spends draining the
+// protocol before closing its connections. Zero, the default, disables
+// draining.
+func (this *Protocol) SetDrainTimeout(timeoutSec int) {
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.drainTimeout = timeoutSec
+}
+
+// beginHandler marks the start of a call into user message handling code,
+// which Drain waits for.
+func (this *Protocol) beginHandler() {
+    atomic.AddInt32(&this.handlers, 1)
+}
+
+// drained returns true once no user handlers are running, and every
+// connection's outbound queue has been written.
+func (this *Protocol) drained() bool {
+    if atomic.LoadInt32(&this.handlers) > 0 {
+        return false
+    }
+
+    for _, con := range this.GetAllConnections() {
+        queue, ok := con.(flusher)
+        if ok && !queue.flushed() {
+            return false
+        }
+    }
+
+    return true
+}
+
+// endHandler marks the end of a call started with beginHandler.
+func (this *Protocol) endHandler() {
+    atomic.AddInt32(&this.handlers, -1)
+}
+
+// getDrainTimeout returns the drain timeout used by Shutdown.
+func (this *Protocol) getDrainTimeout() int {
+    this.objMutex.RLock()
+    defer this.objMutex.RUnlock()
+
+    return this.drainTimeout
+}
+
+// isDraining returns true once Drain has been called.
+func (this *Protocol) isDraining() bool {
+    this.objMutex.RLock()
+    defer this.objMutex.RUnlock()
+
+    return this.draining
+}
+
+// rcvShutdown handles a remote peer's SIG_SHUTDOWN message, passing it on to
+// the EventHandler if it implements DrainHandler.
+func (this *Protocol) rcvShutdown(msg *Msg) {
+    cursor       := 0
+    graceMs, err := buffer.ReadUint32(msg.GetPayload(), &cursor)
+    if err != nil {
+        return
+    }
+
+    this.perfs.Increment(PERF_PROTO_PEER_SHUTDOWN)
+
+    log.Debug(
+        "Peer shutting down (proto %s, con %v, grace %v ms)",
+        this.name,
+        msg.From(),
+        graceMs,
+    )
+
+    this.evtMutex.Lock()
+    handler, ok := this.evtHandler.(DrainHandler)
+    if ok {
+        handler.OnPeerShutdown(
+            msg.Connection(),
+            time.Duration(graceMs) * time.Millisecond,
+        )
+    }
+    this.evtMutex.Unlock()
+}
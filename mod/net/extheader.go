@@ -0,0 +1,159 @@
+//  ---------------------------------------------------------------------------
+//
+//  extheader.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+)
+
+// Extended header
+//
+// [0]     extended header length, including this byte (uint8)
+// [1]     optional field flags (uint8)
+// [2-5]   msgtype (uint32)
+// [6-9]   payload length (uint32)
+// [10-17] correlation id (uint64), if EXT_FIELD_CORRELATION is set
+// [-4]    sequence number (uint32), if EXT_FIELD_SEQUENCE is set
+//
+// Receivers skip any trailing bytes they don't understand, so that newer
+// builds may append fields without breaking older ones.
+const (
+    EXT_HEADER_MIN_LEN_B = 10
+    EXT_HEADER_MAX_LEN_B = 255
+    MAX_EXT_MSG_TYPE     = 0xFFFFFFFF
+)
+
+// Optional extended header fields.
+const (
+    EXT_FIELD_CORRELATION = 1 << iota
+    EXT_FIELD_SEQUENCE
+)
+
+// Common error messages.
+var ErrExtHeaderMalformed = errors.New("Malformed extended msg header")
+
+
+// ExtHeader holds the contents of an extended message header.
+type ExtHeader struct {
+    CorrelationId uint64
+    Fields        byte
+    PayloadLen    uint32
+    Sequence      uint32
+    Sig           uint32
+}
+
+// GetExtHeader reads an extended header from the start of the supplied
+// buffer.
+func GetExtHeader(extData []byte) (*ExtHeader, error) {
+    var err error
+
+    cursor := 0
+    ext    := new(ExtHeader)
+
+    extLen, err := buffer.ReadByte(extData, &cursor)
+    if err != nil ||
+        extLen < EXT_HEADER_MIN_LEN_B ||
+        int(extLen) > len(extData) {
+        return nil, ErrExtHeaderMalformed
+    }
+
+    extData = extData[:extLen]
+
+    ext.Fields, err = buffer.ReadByte(extData, &cursor)
+    if err != nil {
+        return nil, ErrExtHeaderMalformed
+    }
+
+    ext.Sig, err = buffer.ReadUint32(extData, &cursor)
+    if err != nil {
+        return nil, ErrExtHeaderMalformed
+    }
+
+    ext.PayloadLen, err = buffer.ReadUint32(extData, &cursor)
+    if err != nil {
+        return nil, ErrExtHeaderMalformed
+    }
+
+    if ext.Fields & EXT_FIELD_CORRELATION != 0 {
+        ext.CorrelationId, err = buffer.ReadUint64(extData, &cursor)
+        if err != nil {
+            return nil, ErrExtHeaderMalformed
+        }
+    }
+
+    if ext.Fields & EXT_FIELD_SEQUENCE != 0 {
+        ext.Sequence, err = buffer.ReadUint32(extData, &cursor)
+        if err != nil {
+            return nil, ErrExtHeaderMalformed
+        }
+    }
+
+    return ext, nil
+}
+
+// GetExtHeaderLen returns the length of the extended header at the start of
+// the supplied buffer.
+func GetExtHeaderLen(extData []byte) int {
+    if len(extData) < 1 {
+        return 0
+    }
+
+    return int(extData[0])
+}
+
+// Len returns the encoded length of the extended header.
+func (this *ExtHeader) Len() int {
+    extLen := EXT_HEADER_MIN_LEN_B
+
+    if this.Fields & EXT_FIELD_CORRELATION != 0 {
+        extLen += buffer.LenUint64()
+    }
+
+    if this.Fields & EXT_FIELD_SEQUENCE != 0 {
+        extLen += buffer.LenUint32()
+    }
+
+    return extLen
+}
+
+// SetExtHeader writes the supplied extended header to the start of a raw
+// data buffer.
+func SetExtHeader(ext *ExtHeader, extData []byte) error {
+    extLen := ext.Len()
+    if len(extData) < extLen {
+        return ErrBufferTooSmall
+    }
+
+    cursor := 0
+
+    buffer.WriteByte(byte(extLen), extData, &cursor)
+    buffer.WriteByte(ext.Fields, extData, &cursor)
+    buffer.WriteUint32(ext.Sig, extData, &cursor)
+    buffer.WriteUint32(ext.PayloadLen, extData, &cursor)
+
+    if ext.Fields & EXT_FIELD_CORRELATION != 0 {
+        buffer.WriteUint64(ext.CorrelationId, extData, &cursor)
+    }
+
+    if ext.Fields & EXT_FIELD_SEQUENCE != 0 {
+        buffer.WriteUint32(ext.Sequence, extData, &cursor)
+    }
+
+    return nil
+}
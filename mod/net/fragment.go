@@ -0,0 +1,314 @@
+//  ---------------------------------------------------------------------------
+//
+//  fragment.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "sync/atomic"
+    "time"
+)
+
+// Fragmentation constants.
+//
+// Fragment payload
+// [0-3]   fragment id (uint32)
+// [4-7]   fragment index (uint32)
+// [8-11]  fragment count (uint32)
+// [12-15] original msgtype and flags (uint32)
+// [16-19] original payload length (uint32)
+// [20-23] crc32 checksum of original payload (uint32)
+// [24-]   payload chunk
+//
+// If the extended header flag is set in the original msgtype and flags, the
+// original payload is prefixed with the message's ExtHeader.
+//
+// Messages longer than FRAG_THRESHOLD_B are fragmented. The threshold leaves
+// room for the reliable UDP envelope within MAX_NET_MSG_LEN. Each connection
+// may have at most DEFAULT_MAX_FRAG_MSGS messages, and DEFAULT_MAX_FRAG_BYTES
+// bytes, in reassembly at once, unless changed with SetFragmentLimits.
+const (
+    DEFAULT_FRAG_TIMEOUT_SEC = DEFAULT_MSG_TIMEOUT_SEC
+    DEFAULT_MAX_FRAG_BYTES   = 2 * DEFAULT_MAX_MSG_LEN
+    DEFAULT_MAX_FRAG_MSGS    = 8
+    DEFAULT_MAX_MSG_LEN      = 16 * 1024 * 1024
+    FRAG_HEADER_LEN_B        = 24
+    FRAG_THRESHOLD_B         = MAX_NET_MSG_LEN - RELIABLE_OVERHEAD_B
+    FRAG_CHUNK_LEN_B         = FRAG_THRESHOLD_B - HEADER_LEN_B - FRAG_HEADER_LEN_B
+)
+
+// Common error messages.
+var (
+    errFragLimit     = errors.New(
+        "Connection exceeded its in-flight fragment limits",
+    )
+    errFragMalformed = errors.New("Malformed message fragment received")
+    errFragMismatch  = errors.New(
+        "Message fragment doesn't match in-progress reassembly",
+    )
+)
+
+
+// fragKey uniquely identifies a message being reassembled.
+type fragKey struct {
+    conId  uint32
+    fragId uint32
+}
+
+// fragBuffer holds the state of a single message being reassembled from
+// its fragments.
+type fragBuffer struct {
+    checksum uint32
+    count    uint32
+    data     []byte
+    header   uint64
+    received []bool
+    rcvCount uint32
+    started  time.Time
+}
+
+// fragmentMsg splits the supplied msg into a series of fully framed
+// SIG_FRAGMENT messages, each of which fits within FRAG_THRESHOLD_B.
+func (this *Protocol) fragmentMsg(msg *Msg) [][]byte {
+    sigFlags, payload := msg.envelope()
+
+    fragId   := atomic.AddUint32(&this.fragId, 1)
+    count    := (len(payload) + FRAG_CHUNK_LEN_B - 1) / FRAG_CHUNK_LEN_B
+    checksum := crc32.ChecksumIEEE(payload)
+    frames   := make([][]byte, count)
+
+    for i := 0; i < count; i++ {
+        start := i * FRAG_CHUNK_LEN_B
+        end   := start + FRAG_CHUNK_LEN_B
+        if end > len(payload) {
+            end = len(payload)
+        }
+
+        cursor  := 0
+        fragBuf := make([]byte, FRAG_HEADER_LEN_B + end - start)
+
+        buffer.WriteUint32(fragId, fragBuf, &cursor)
+        buffer.WriteUint32(uint32(i), fragBuf, &cursor)
+        buffer.WriteUint32(uint32(count), fragBuf, &cursor)
+        buffer.WriteUint32(sigFlags, fragBuf, &cursor)
+        buffer.WriteUint32(uint32(len(payload)), fragBuf, &cursor)
+        buffer.WriteUint32(checksum, fragBuf, &cursor)
+        copy(fragBuf[cursor:], payload[start:end])
+
+        frag := NewMsg()
+        frag.SetMsgType(SIG_FRAGMENT)
+        frag.SetPayload(fragBuf)
+
+        frames[i] = frag.GetBytes()
+    }
+
+    this.perfs.Add(PERF_PROTO_FRAG_SEND, int64(count))
+
+    return frames
+}
+
+// dropFragments discards any in-progress reassemblies belonging to the
+// given connection id.
+func (this *Protocol) dropFragments(conId uint32) {
+    this.fragMutex.Lock()
+    defer this.fragMutex.Unlock()
+
+    this.dropFragmentsLocked(conId)
+}
+
+// dropFragmentsLocked discards any in-progress reassemblies belonging to the
+// given connection id. The caller must hold the fragment mutex.
+func (this *Protocol) dropFragmentsLocked(conId uint32) {
+    for k, v := range this.fragMap {
+        if k.conId != conId {
+            continue
+        }
+
+        this.perfs.Add(PERF_PROTO_FRAG_IN_FLIGHT, -int64(v.rcvCount))
+        delete(this.fragMap, k)
+    }
+}
+
+// expireFragments discards any in-progress reassemblies which have exceeded
+// the protocol's fragment timeout, notifying the EventHandler of each.
+func (this *Protocol) expireFragments() {
+    expired := make([]*TimeoutEvent, 0)
+
+    this.fragMutex.Lock()
+    timeout := time.Duration(this.fragTimeout) * time.Second
+    for k, v := range this.fragMap {
+        if time.Since(v.started) < timeout {
+            continue
+        }
+
+        this.perfs.Add(PERF_PROTO_FRAG_IN_FLIGHT, -int64(v.rcvCount))
+        delete(this.fragMap, k)
+
+        evt            := new(TimeoutEvent)
+        evt.Data        = k.fragId
+        evt.MessageType = GetMsgSig(v.header)
+        evt.ParentId    = k.conId
+        evt.TimeoutType = TIMEOUT_REASSEMBLY
+
+        expired = append(expired, evt)
+    }
+    this.fragMutex.Unlock()
+
+    for i := range expired {
+        this.onTimeout(expired[i])
+    }
+}
+
+// fragUsage returns the number of messages, and the total bytes, in
+// reassembly for the given connection id. The caller must hold the fragment
+// mutex.
+func (this *Protocol) fragUsage(conId uint32) (msgs, bytes int) {
+    for k, v := range this.fragMap {
+        if k.conId != conId {
+            continue
+        }
+
+        msgs++
+        bytes += len(v.data)
+    }
+
+    return msgs, bytes
+}
+
+// reassembleMsg adds the supplied SIG_FRAGMENT message to its in-progress
+// reassembly. Once all fragments of the original message have arrived, the
+// reassembled Msg is returned. Otherwise, reassembleMsg returns nil. If
+// starting a new reassembly would take the connection over its fragment
+// limits, every reassembly of the connection is dropped, and errFragLimit
+// is returned.
+func (this *Protocol) reassembleMsg(frag *Msg) (*Msg, error) {
+    var fragId, index, count, sigFlags, totalLen, checksum uint32
+    var err error
+
+    cursor := 0
+    data   := frag.GetPayload()
+
+    fields := []*uint32 {
+        &fragId, &index, &count, &sigFlags, &totalLen, &checksum,
+    }
+
+    for i := range fields {
+        *fields[i], err = buffer.ReadUint32(data, &cursor)
+        if err != nil {
+            return nil, errFragMalformed
+        }
+    }
+
+    this.fragMutex.Lock()
+    defer this.fragMutex.Unlock()
+
+    // validate the sender supplied sizes before anything is allocated
+    if totalLen < 1 {
+        return nil, errFragMalformed
+    }
+
+    if int(totalLen) > this.maxMsgLen {
+        return nil, errors.New(fmt.Sprintf(
+            "Fragmented msg exceeds max size (%d / %d). Dropping msg",
+            totalLen,
+            this.maxMsgLen,
+        ))
+    }
+
+    chunks := (int(totalLen) + FRAG_CHUNK_LEN_B - 1) / FRAG_CHUNK_LEN_B
+    if int(count) != chunks || index >= count {
+        return nil, errFragMalformed
+    }
+
+    chunk := data[cursor:]
+    start := int(index) * FRAG_CHUNK_LEN_B
+
+    if start + len(chunk) > int(totalLen) {
+        return nil, errFragMalformed
+    }
+
+    if index < count - 1 && len(chunk) != FRAG_CHUNK_LEN_B {
+        return nil, errFragMalformed
+    }
+
+    key := fragKey { conId : frag.From(), fragId : fragId }
+    buf := this.fragMap[key]
+    if buf == nil {
+        msgs, bytes := this.fragUsage(key.conId)
+        if msgs >= this.fragMaxMsgs || bytes + int(totalLen) > this.fragMaxBytes {
+            this.dropFragmentsLocked(key.conId)
+            return nil, errFragLimit
+        }
+
+        buf = &fragBuffer {
+            checksum : checksum,
+            count    : count,
+            data     : make([]byte, totalLen),
+            header   : uint64(uint16(sigFlags)),
+            received : make([]bool, count),
+            started  : time.Now(),
+        }
+
+        this.fragMap[key] = buf
+    }
+
+    if buf.count != count ||
+        len(buf.data) != int(totalLen) ||
+        buf.checksum != checksum {
+        return nil, errFragMismatch
+    }
+
+    this.perfs.Increment(PERF_PROTO_FRAG_RCV)
+
+    if buf.received[index] {
+        return nil, nil
+    }
+
+    copy(buf.data[start:], chunk)
+    buf.received[index] = true
+    buf.rcvCount++
+
+    this.perfs.Increment(PERF_PROTO_FRAG_IN_FLIGHT)
+
+    if buf.rcvCount < buf.count {
+        return nil, nil
+    }
+
+    delete(this.fragMap, key)
+    this.perfs.Add(PERF_PROTO_FRAG_IN_FLIGHT, -int64(buf.rcvCount))
+
+    if crc32.ChecksumIEEE(buf.data) != buf.checksum {
+        return nil, errBadChecksum
+    }
+
+    msg := NewMsg()
+    msg.SetConnection(frag.Connection())
+
+    err = msg.openEnvelope(uint32(uint16(buf.header)), buf.data)
+    if err != nil {
+        return nil, err
+    }
+
+    header := msg.GetHeader()
+    SetMsgChecksum(&header, crc32.ChecksumIEEE(msg.GetPayload()))
+    msg.SetHeader(header)
+
+    return msg, nil
+}
@@ -0,0 +1,429 @@
+//  ---------------------------------------------------------------------------
+//
+//  handshake.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "fmt"
+    "sort"
+)
+
+// Capability flags advertised in the SIG_HELLO handshake.
+const (
+    HELLO_CAP_COMPRESS = 1 << iota
+    HELLO_CAP_COMPRESS_NEGOTIATED
+    HELLO_CAP_CRYPTO
+    HELLO_CAP_EXT_HEADER
+)
+
+// Control message state flags, tracked for each connection.
+const (
+    ctrlPeerCapable = 1 << iota
+    ctrlSentCompress
+    ctrlSentHello
+)
+
+// Common error messages.
+var (
+    errHelloMalformed = errors.New("Malformed hello msg")
+    errPeerNoExt      = errors.New("Extended headers not supported by remote peer")
+    errPeerNoSig      = errors.New("Signature not supported by remote peer")
+)
+
+
+// PeerInfo describes a remote peer, as advertised in the SIG_HELLO message
+// it sends when connecting. Older builds disconnect peers which send them
+// unknown messages, so a protocol only sends its hello on connect if
+// SetHelloOnConnect is enabled, and otherwise answers the hellos it
+// receives. A peer which never sends a hello is treated as an older build
+// supporting everything, and is never sent control messages it didn't ask
+// for.
+//
+// [0-3]  protocol name length
+// [4-]   protocol name
+// [-4]   version
+// [-4]   minimum supported version
+// [-4]   max message size
+// [-1]   capability flags
+// [-4]   signature count
+// [-4n]  signatures
+type PeerInfo struct {
+    Caps       byte
+    MaxMsgLen  int
+    MinVersion uint32
+    Name       string
+    Signatures []uint32
+    Version    uint32
+}
+
+// Supports returns true if the peer advertised the given signature.
+func (this *PeerInfo) Supports(sig uint32) bool {
+    i := sort.Search(len(this.Signatures), func(i int) bool {
+        return this.Signatures[i] >= sig
+    })
+
+    return i < len(this.Signatures) && this.Signatures[i] == sig
+}
+
+
+// PeerInfo returns the handshake information sent by the remote peer of the
+// given connection, or nil if it hasn't sent any.
+func (this *Protocol) PeerInfo(id uint32) *PeerInfo {
+    this.peerMutex.RLock()
+    defer this.peerMutex.RUnlock()
+
+    return this.peerMap[id]
+}
+
+// SetHelloOnConnect sets whether the protocol sends its SIG_HELLO handshake
+// to every peer as soon as it connects. Otherwise, which is the default, a
+// hello is only sent in reply to a peer's hello, so that older peers, which
+// disconnect on unknown messages, never receive one. Enable it on clients
+// once the servers they connect to have been upgraded.
+func (this *Protocol) SetHelloOnConnect(enabled bool) {
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.helloConnect = enabled
+}
+
+// SetVersion sets the protocol name and version advertised to remote peers
+// when connecting, along with the oldest version of the protocol this build
+// can talk to. Connections to peers which advertise a different name, or
+// whose version range doesn't overlap with ours, are rejected. An empty
+// name matches any peer. Signatures and providers should be registered
+// before listening or dialing, as they're advertised as part of the same
+// handshake.
+func (this *Protocol) SetVersion(name string, version, minVersion uint32) {
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.version     = version
+    this.versionMin  = minVersion
+    this.versionName = name
+}
+
+// checkPeer returns an error, and reports it to the protocol's error
+// channel, if the remote peer of the given connection advertised that it
+// doesn't support the given message's signature, or its length plus the
+// given envelope overhead. Optional extended header fields are dropped from
+// messages to peers which don't support extended headers, while signatures
+// which need an extended header are rejected.
+func (this *Protocol) checkPeer(cli Connection, msg *Msg, overhead int) error {
+    var err error
+
+    sig        := msg.ExtMsgType()
+    payloadLen := len(msg.GetPayload()) + overhead
+    info       := this.PeerInfo(cli.Id())
+    extOk      := this.peerExt(cli)
+
+    if !extOk {
+        msg.clearExtFields()
+    }
+
+    switch {
+    case !extOk && sig > MAX_MSG_TYPE:
+        err = errors.New(fmt.Sprintf(
+            "%v (sig %v, con %v, proto %s)",
+            errPeerNoExt,
+            sig,
+            cli.Id(),
+            this.name,
+        ))
+    case info == nil:
+        return nil
+    case !info.Supports(sig):
+        err = errors.New(fmt.Sprintf(
+            "%v (sig %v, con %v, proto %s)",
+            errPeerNoSig,
+            sig,
+            cli.Id(),
+            this.name,
+        ))
+    case info.MaxMsgLen > 0 && payloadLen > info.MaxMsgLen:
+        err = errors.New(fmt.Sprintf(
+            "Msg exceeds remote peer's max size (%d / %d, con %v). Dropping msg",
+            payloadLen,
+            info.MaxMsgLen,
+            cli.Id(),
+        ))
+    }
+
+    if err != nil {
+        this.perfs.Increment(PERF_PROTO_ERR_PEER_UNSUPPORTED)
+        this.errChan<- err
+    }
+
+    return err
+}
+
+// ctrlCapable returns true once the remote peer of the given connection
+// has sent a control message, showing that it accepts them.
+func (this *Protocol) ctrlCapable(conId uint32) bool {
+    this.peerMutex.RLock()
+    defer this.peerMutex.RUnlock()
+
+    return this.ctrlMap[conId] & ctrlPeerCapable != 0
+}
+
+// dropPeer discards the handshake information and control message state of
+// a departing connection.
+func (this *Protocol) dropPeer(conId uint32) {
+    this.peerMutex.Lock()
+    defer this.peerMutex.Unlock()
+
+    delete(this.ctrlMap, conId)
+    delete(this.peerMap, conId)
+}
+
+// markCtrl sets the given control message state flags of a connection, and
+// returns true if any of them weren't already set.
+func (this *Protocol) markCtrl(conId uint32, flags byte) bool {
+    this.peerMutex.Lock()
+    defer this.peerMutex.Unlock()
+
+    old                 := this.ctrlMap[conId]
+    this.ctrlMap[conId]  = old | flags
+
+    return old & flags != flags
+}
+
+// hello builds this protocol's SIG_HELLO payload.
+func (this *Protocol) hello() []byte {
+    this.objMutex.RLock()
+    defer this.objMutex.RUnlock()
+
+    caps := byte(HELLO_CAP_EXT_HEADER)
+
+    if this.compressor != nil {
+        caps |= HELLO_CAP_COMPRESS
+
+        _, ok := this.compressor.(CompressionNegotiator)
+        if ok {
+            caps |= HELLO_CAP_COMPRESS_NEGOTIATED
+        }
+    }
+
+    if this.crypto != nil {
+        caps |= HELLO_CAP_CRYPTO
+    }
+
+    sigs := make([]uint32, 0, len(this.sigMap))
+    for k, _ := range this.sigMap {
+        sigs = append(sigs, k)
+    }
+
+    cursor  := 0
+    payload := make(
+        []byte,
+        buffer.LenString(this.versionName) +
+        buffer.LenUint32() * (4 + len(sigs)) +
+        buffer.LenByte(),
+    )
+
+    buffer.WriteString(this.versionName, payload, &cursor)
+    buffer.WriteUint32(this.version, payload, &cursor)
+    buffer.WriteUint32(this.versionMin, payload, &cursor)
+    buffer.WriteUint32(uint32(this.getMaxMsgLen()), payload, &cursor)
+    buffer.WriteByte(caps, payload, &cursor)
+    buffer.WriteUint32(uint32(len(sigs)), payload, &cursor)
+
+    for i := range sigs {
+        buffer.WriteUint32(sigs[i], payload, &cursor)
+    }
+
+    return payload
+}
+
+// parseHello decodes a SIG_HELLO payload.
+func parseHello(data []byte) (*PeerInfo, error) {
+    var err error
+
+    cursor := 0
+    info   := new(PeerInfo)
+    vals   := make([]uint32, 3)
+
+    info.Name, err = buffer.ReadString(data, &cursor)
+    if err != nil {
+        return nil, errHelloMalformed
+    }
+
+    for i := range vals {
+        vals[i], err = buffer.ReadUint32(data, &cursor)
+        if err != nil {
+            return nil, errHelloMalformed
+        }
+    }
+
+    info.Version    = vals[0]
+    info.MinVersion = vals[1]
+    info.MaxMsgLen  = int(vals[2])
+
+    info.Caps, err = buffer.ReadByte(data, &cursor)
+    if err != nil {
+        return nil, errHelloMalformed
+    }
+
+    count, err := buffer.ReadUint32(data, &cursor)
+    if err != nil || int(count) > (len(data) - cursor) / buffer.LenUint32() {
+        return nil, errHelloMalformed
+    }
+
+    info.Signatures = make([]uint32, count)
+    for i := range info.Signatures {
+        sig, err := buffer.ReadUint32(data, &cursor)
+        if err != nil {
+            return nil, errHelloMalformed
+        }
+
+        info.Signatures[i] = sig
+    }
+
+    sort.Slice(info.Signatures, func(i, j int) bool {
+        return info.Signatures[i] < info.Signatures[j]
+    })
+
+    return info, nil
+}
+
+// peerExt returns true if the remote peer of the given connection, or of
+// every member of the given BroadcastGroup, supports extended headers.
+func (this *Protocol) peerExt(cli Connection) bool {
+    cons := []Connection { cli }
+
+    group, ok := cli.(*BroadcastGroup)
+    if ok {
+        cons = group.GetAllConnections()
+    }
+
+    for i := range cons {
+        info := this.PeerInfo(cons[i].Id())
+        if info == nil || info.Caps & HELLO_CAP_EXT_HEADER == 0 {
+            return false
+        }
+    }
+
+    return true
+}
+
+// rcvHello validates the handshake sent by a remote peer, recording it for
+// the life of the connection, and answers with our own, if it hasn't been
+// sent yet, followed by our compression capabilities, if the peer
+// negotiates compression. Incompatible peers are disconnected.
+func (this *Protocol) rcvHello(msg *Msg) {
+    con       := msg.Connection()
+    info, err := parseHello(msg.GetPayload())
+    if err == nil {
+        err = this.checkHello(info)
+    }
+
+    if err != nil {
+        this.perfs.Increment(PERF_PROTO_ERR_HANDSHAKE)
+        this.errChan<- errors.New(fmt.Sprintf(
+            "Handshake rejected (proto: %s, con: %v, err: %v)",
+            this.name,
+            con.Id(),
+            err,
+        ))
+
+        go con.Close()
+        return
+    }
+
+    this.peerMutex.Lock()
+    this.peerMap[con.Id()] = info
+    this.peerMutex.Unlock()
+
+    this.perfs.Increment(PERF_PROTO_HANDSHAKE)
+
+    this.sendHello(con)
+
+    if info.Caps & HELLO_CAP_COMPRESS_NEGOTIATED != 0 {
+        this.sendCompress(con)
+    }
+
+    log.Debug(
+        "Handshake from con %v (proto %s): %s v%d",
+        con.Id(),
+        this.name,
+        info.Name,
+        info.Version,
+    )
+}
+
+// sendHello sends the protocol's SIG_HELLO handshake to the given
+// connection, unless it has already been sent.
+func (this *Protocol) sendHello(con Connection) {
+    if !this.markCtrl(con.Id(), ctrlSentHello) {
+        return
+    }
+
+    this.sendCtrlMsg(con, SIG_HELLO, this.hello())
+}
+
+// checkHello returns an error describing why a remote peer is incompatible
+// with this protocol, or nil if it isn't.
+func (this *Protocol) checkHello(info *PeerInfo) error {
+    this.objMutex.RLock()
+    defer this.objMutex.RUnlock()
+
+    if this.versionName != "" && info.Name != "" && info.Name != this.versionName {
+        return errors.New(fmt.Sprintf(
+            "Protocol name mismatch (local %q, remote %q)",
+            this.versionName,
+            info.Name,
+        ))
+    }
+
+    if info.Version < this.versionMin {
+        return errors.New(fmt.Sprintf(
+            "Remote version %d is older than the minimum supported (%d)",
+            info.Version,
+            this.versionMin,
+        ))
+    }
+
+    if this.version < info.MinVersion {
+        return errors.New(fmt.Sprintf(
+            "Local version %d is older than the remote minimum (%d)",
+            this.version,
+            info.MinVersion,
+        ))
+    }
+
+    remoteCrypto := info.Caps & HELLO_CAP_CRYPTO != 0
+    if remoteCrypto != (this.crypto != nil) {
+        return errors.New(fmt.Sprintf(
+            "Encryption mismatch (local %v, remote %v)",
+            this.crypto != nil,
+            remoteCrypto,
+        ))
+    }
+
+    compressAlways := info.Caps & HELLO_CAP_COMPRESS != 0 &&
+        info.Caps & HELLO_CAP_COMPRESS_NEGOTIATED == 0
+    if compressAlways && this.compressor == nil {
+        return errors.New(
+            "Remote peer compresses, but no CompressionProvider registered",
+        )
+    }
+
+    return nil
+}
@@ -0,0 +1,218 @@
+//  ---------------------------------------------------------------------------
+//
+//  keepalive.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "time"
+)
+
+// Keepalive defaults.
+const (
+    DEFAULT_KEEPALIVE_MS    = 5 * 1000
+    DEFAULT_IDLE_TIMEOUT_MS = 30 * 1000
+)
+
+// Weight given to each new RTT sample in a connection's smoothed RTT.
+const RTT_SMOOTHING = 0.125
+
+
+// keepalive tracks liveness and round trip time for a single connection.
+type keepalive struct {
+    lastPing time.Time
+    lastRcv  time.Time
+    rtt      time.Duration
+}
+
+
+// RTT returns the smoothed round trip time measured by keepalive pings for
+// the connection with the given id. RTT returns zero if keepalives are
+// disabled or no pong has been received yet.
+func (this *Protocol) RTT(id uint32) time.Duration {
+    this.kaMutex.Lock()
+    defer this.kaMutex.Unlock()
+
+    ka := this.kaMap[id]
+    if ka == nil {
+        return 0
+    }
+
+    return ka.rtt
+}
+
+// SetKeepalive enables keepalive pings, sent to each connection every
+// intervalMs milliseconds. Connections which send nothing, including pongs,
+// for idleTimeoutMs milliseconds are closed and evicted from the protocol.
+// An interval of zero disables keepalives. Older peers disconnect on unknown
+// messages, so pings are only sent to peers which have sent a control
+// message, such as a handshake or a ping of their own. Other peers can't be
+// told apart from quiet ones, so they are never evicted, with the exception
+// of UDP endpoints, which have no other way of being detected as gone.
+func (this *Protocol) SetKeepalive(intervalMs, idleTimeoutMs int) {
+    this.kaMutex.Lock()
+    defer this.kaMutex.Unlock()
+
+    this.kaIntervalMs = intervalMs
+    this.kaTimeoutMs  = idleTimeoutMs
+}
+
+// checkKeepalives is called from the protocol heartbeat, and pings live
+// connections which accept control messages, and evicts idle ones.
+func (this *Protocol) checkKeepalives() {
+    this.kaMutex.Lock()
+    interval := time.Duration(this.kaIntervalMs) * time.Millisecond
+    timeout  := time.Duration(this.kaTimeoutMs) * time.Millisecond
+    this.kaMutex.Unlock()
+
+    if interval < 1 {
+        return
+    }
+
+    now := time.Now()
+
+    for _, con := range this.GetAllConnections() {
+        // groups are pinged through their members
+        _, ok := con.(*BroadcastGroup)
+        if ok {
+            continue
+        }
+
+        this.kaMutex.Lock()
+        ka := this.kaMap[con.Id()]
+        if ka == nil {
+            ka = &keepalive { lastRcv : now }
+            this.kaMap[con.Id()] = ka
+        }
+
+        // connections being re-established aren't idle
+        rCon, ok := con.(*reconnectCon)
+        if ok && !rCon.connected() {
+            ka.lastRcv = now
+            this.kaMutex.Unlock()
+            continue
+        }
+
+        _, udp  := con.(*udpEndpoint)
+        capable := this.ctrlCapable(con.Id())
+
+        idle := timeout > 0 && now.Sub(ka.lastRcv) > timeout
+        if idle && !capable && !udp {
+            idle = false
+        }
+
+        ping := !idle && capable && now.Sub(ka.lastPing) >= interval
+
+        if ping {
+            ka.lastPing = now
+        }
+        this.kaMutex.Unlock()
+
+        if idle {
+            this.evictIdle(con)
+        } else if ping {
+            this.sendPing(con, now)
+        }
+    }
+}
+
+// dropKeepalive discards keepalive state for the given connection.
+func (this *Protocol) dropKeepalive(id uint32) {
+    this.kaMutex.Lock()
+    defer this.kaMutex.Unlock()
+
+    delete(this.kaMap, id)
+}
+
+// evictIdle closes and unregisters an idle connection.
+func (this *Protocol) evictIdle(con Connection) {
+    log.Info(
+        "Evicting idle connection %v (%v) from proto %s",
+        con.Id(),
+        con.RemoteAddr(),
+        this.name,
+    )
+
+    this.perfs.Increment(PERF_PROTO_IDLE_EVICT)
+
+    // udp endpoints may share their listener's socket, so they're removed
+    // from the protocol rather than closed
+    endpoint, ok := con.(*udpEndpoint)
+    if ok {
+        this.dropUDPEndpoint(endpoint)
+    } else {
+        go con.Close()
+    }
+
+    this.onDisconnect(con)
+}
+
+// rcvPing answers a keepalive ping by echoing its payload.
+func (this *Protocol) rcvPing(msg *Msg) {
+    this.sendCtrlMsg(msg.Connection(), SIG_PONG, msg.GetPayload())
+}
+
+// rcvPong updates the round trip time of the connection which answered one
+// of our pings.
+func (this *Protocol) rcvPong(msg *Msg) {
+    cursor    := 0
+    sent, err := buffer.ReadUint64(msg.GetPayload(), &cursor)
+    if err != nil {
+        return
+    }
+
+    sample := time.Since(time.Unix(0, int64(sent)))
+    if sample < 0 {
+        return
+    }
+
+    this.kaMutex.Lock()
+    defer this.kaMutex.Unlock()
+
+    ka := this.kaMap[msg.Connection().Id()]
+    if ka == nil {
+        return
+    }
+
+    if ka.rtt == 0 {
+        ka.rtt = sample
+    } else {
+        ka.rtt += time.Duration(float64(sample - ka.rtt) * RTT_SMOOTHING)
+    }
+}
+
+// sendPing sends a keepalive ping, stamped with the time it was sent, to the
+// given connection.
+func (this *Protocol) sendPing(con Connection, now time.Time) {
+    cursor  := 0
+    payload := make([]byte, buffer.LenUint64())
+    buffer.WriteUint64(uint64(now.UnixNano()), payload, &cursor)
+
+    this.sendCtrlMsg(con, SIG_PING, payload)
+}
+
+// touchKeepalive records that data was received from the given connection.
+func (this *Protocol) touchKeepalive(id uint32) {
+    this.kaMutex.Lock()
+    defer this.kaMutex.Unlock()
+
+    ka := this.kaMap[id]
+    if ka != nil {
+        ka.lastRcv = time.Now()
+    }
+}
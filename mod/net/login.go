@@ -0,0 +1,372 @@
+//  ---------------------------------------------------------------------------
+//
+//  login.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/config"
+)
+
+// Stdlib imports.
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+)
+
+// Access levels.
+const (
+    ACCESS_NONE = 0
+    ACCESS_MAX  = 255
+)
+
+// Login message types. Each SIG_LOGIN payload begins with one of these.
+//
+// Challenge (server -> client)
+// [0]    LOGIN_CHALLENGE
+// [1-32] nonce
+//
+// Response (client -> server)
+// [0]    LOGIN_RESPONSE
+// [1]    user name length
+// [2-]   user name
+// [-32]  HMAC-SHA256(secret hash, nonce + user name)
+//
+// Result (server -> client)
+// [0]    LOGIN_RESULT
+// [1]    granted access level (ACCESS_NONE if denied)
+const (
+    LOGIN_CHALLENGE = iota
+    LOGIN_RESPONSE
+    LOGIN_RESULT
+)
+
+// Length of the random challenge sent to connecting clients.
+const LOGIN_NONCE_LEN_B = 32
+
+// Common error messages.
+var (
+    errLoginBadMsg      = errors.New("Malformed login message")
+    errLoginDenied      = errors.New("Login denied")
+    errLoginNoChallenge = errors.New("Login response without challenge")
+    errLoginNoCreds     = errors.New("Login requested, but no credentials set")
+    errLoginNoStore     = errors.New("Login received, but no credential store")
+    errLoginUnexpected  = errors.New("Login result without pending login")
+)
+
+
+// HashSecret returns the hex encoded hash of the given user's secret, in the
+// form expected by CredentialStore.
+func HashSecret(name, secret string) string {
+    return hex.EncodeToString(hashSecret(name, secret))
+}
+
+// NewCredentialStore creates a new CredentialStore which looks up user
+// credentials from the config service under the given section.
+func NewCredentialStore(section string) *CredentialStore {
+    newStore := CredentialStore {
+        section : section,
+    }
+
+    return &newStore
+}
+
+// CredentialStore retrieves user credentials from the config service. Each
+// user is stored as a key named for the user within the store's section,
+// whose values are the user's hashed secret (see HashSecret) and access level.
+//
+// [Net.Users]
+// admin = 4c1f...9a0e, 255
+//
+// Hashed secrets are used as the key for the login exchange, and so should be
+// protected in the same way as the secrets themselves.
+type CredentialStore struct {
+    section string
+}
+
+// Lookup returns the hashed secret and access level registered for the given
+// user.
+func (this *CredentialStore) Lookup(name string) ([]byte, byte, error) {
+    if name == "" || strings.Contains(name, ".") {
+        return nil, ACCESS_NONE, errors.New(fmt.Sprintf(
+            "Invalid user name %q",
+            name,
+        ))
+    }
+
+    key        := fmt.Sprintf("%s.%s", this.section, name)
+    hashStr, _ := config.GetVal(key, 0, "")
+    if hashStr == "" {
+        return nil, ACCESS_NONE, errors.New(fmt.Sprintf(
+            "Unknown user %q",
+            name,
+        ))
+    }
+
+    hash, err := hex.DecodeString(hashStr)
+    if err != nil {
+        return nil, ACCESS_NONE, err
+    }
+
+    access, _ := config.GetUint8Val(key, 1, ACCESS_NONE)
+
+    return hash, access, nil
+}
+
+
+// NewCredentialAccess creates a new CredentialAccess object. If store is non-nil,
+// connecting peers are challenged to log in and are granted the access level
+// registered for their user in the store. Use SetCredentials to log in to
+// remote peers which issue challenges.
+func NewCredentialAccess(store *CredentialStore) *CredentialAccess {
+    newAccess := CredentialAccess {
+        access     : make(map[uint32]byte),
+        challenges : make(map[uint32][]byte),
+        pending    : make(map[uint32]bool),
+        store      : store,
+        users      : make(map[uint32]string),
+    }
+
+    return &newAccess
+}
+
+// CredentialAccess implements AccessProvider and AccessNegotiator using a
+// challenge-response login exchange, so that secrets never cross the wire.
+// Connections have no access until they log in, and access levels are cached
+// per connection until it disconnects. Remote peers which accept our login
+// are granted the access level they report, which is only accepted by
+// clients (created without a credential store) which answered a challenge
+// on that connection.
+type CredentialAccess struct {
+    access     map[uint32]byte
+    challenges map[uint32][]byte
+    handler    func(con Connection, access byte)
+    mutex      sync.RWMutex
+    name       string
+    pending    map[uint32]bool
+    secretHash []byte
+    store      *CredentialStore
+    users      map[uint32]string
+}
+
+// Authorize returns the cached access level for the given connection.
+func (this *CredentialAccess) Authorize(con Connection) (byte, error) {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    return this.access[con.Id()], nil
+}
+
+// Close is unused in CredentialAccess.
+func (this *CredentialAccess) Close() {}
+
+// Hello returns a new login challenge for the given connection, if a
+// credential store is registered.
+func (this *CredentialAccess) Hello(con Connection) []byte {
+    if this.store == nil {
+        return nil
+    }
+
+    nonce := make([]byte, LOGIN_NONCE_LEN_B)
+    _, err := rand.Read(nonce)
+    if err != nil {
+        return nil
+    }
+
+    this.mutex.Lock()
+    this.challenges[con.Id()] = nonce
+    this.mutex.Unlock()
+
+    return append([]byte { LOGIN_CHALLENGE }, nonce...)
+}
+
+// Init is unused in CredentialAccess.
+func (this *CredentialAccess) Init(proto *Protocol) {}
+
+// OnDisconnect discards cached state for the given connection.
+func (this *CredentialAccess) OnDisconnect(con Connection) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    delete(this.access, con.Id())
+    delete(this.challenges, con.Id())
+    delete(this.pending, con.Id())
+    delete(this.users, con.Id())
+}
+
+// OnLogin processes a login message from the given connection, returning
+// the reply to be sent, if any. An error is returned if the login fails.
+func (this *CredentialAccess) OnLogin(con Connection, data []byte) ([]byte, error) {
+    if len(data) < 1 {
+        return nil, errLoginBadMsg
+    }
+
+    switch data[0] {
+    case LOGIN_CHALLENGE:
+        return this.onChallenge(con, data[1:])
+    case LOGIN_RESPONSE:
+        return this.onResponse(con, data[1:])
+    case LOGIN_RESULT:
+        return nil, this.onResult(con, data[1:])
+    }
+
+    return nil, errLoginBadMsg
+}
+
+// SetCredentials sets the user name and secret used to answer login
+// challenges from remote peers.
+func (this *CredentialAccess) SetCredentials(name, secret string) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.name       = name
+    this.secretHash = hashSecret(name, secret)
+}
+
+// SetLoginHandler sets a function to be called when a remote peer accepts
+// our login. Messages sent to the peer before then are dropped.
+func (this *CredentialAccess) SetLoginHandler(handler func(con Connection, access byte)) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    this.handler = handler
+}
+
+// User returns the name of the user logged in on the given connection.
+func (this *CredentialAccess) User(id uint32) string {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    return this.users[id]
+}
+
+// onChallenge answers a login challenge with our credentials, and marks the
+// connection as waiting for the login result.
+func (this *CredentialAccess) onChallenge(con Connection, nonce []byte) ([]byte, error) {
+    if len(nonce) != LOGIN_NONCE_LEN_B {
+        return nil, errLoginBadMsg
+    }
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.name == "" || len(this.name) > 255 {
+        return nil, errLoginNoCreds
+    }
+
+    reply := []byte { LOGIN_RESPONSE, byte(len(this.name)) }
+    reply  = append(reply, this.name...)
+    reply  = append(reply, loginMac(this.secretHash, nonce, this.name)...)
+
+    this.pending[con.Id()] = true
+
+    return reply, nil
+}
+
+// onResponse validates a client's answer to our challenge and caches the
+// user's access level.
+func (this *CredentialAccess) onResponse(con Connection, data []byte) ([]byte, error) {
+    if this.store == nil {
+        return nil, errLoginNoStore
+    }
+
+    if len(data) < 1 || len(data) != 1 + int(data[0]) + sha256.Size {
+        return nil, errLoginBadMsg
+    }
+
+    name := string(data[1:1 + data[0]])
+    mac  := data[1 + data[0]:]
+
+    this.mutex.Lock()
+    nonce := this.challenges[con.Id()]
+    delete(this.challenges, con.Id())
+    this.mutex.Unlock()
+
+    if nonce == nil {
+        return nil, errLoginNoChallenge
+    }
+
+    denied := []byte { LOGIN_RESULT, ACCESS_NONE }
+
+    secretHash, access, err := this.store.Lookup(name)
+    if err != nil {
+        return denied, err
+    }
+
+    if access == ACCESS_NONE || !hmac.Equal(mac, loginMac(secretHash, nonce, name)) {
+        return denied, errors.New(fmt.Sprintf(
+            "Login denied for user %q",
+            name,
+        ))
+    }
+
+    this.mutex.Lock()
+    this.access[con.Id()] = access
+    this.users[con.Id()]  = name
+    this.mutex.Unlock()
+
+    return []byte { LOGIN_RESULT, access }, nil
+}
+
+// onResult handles the outcome of our login to a remote peer. Results are
+// only accepted by clients, on connections where we answered a challenge and
+// are still waiting for the result.
+func (this *CredentialAccess) onResult(con Connection, data []byte) error {
+    if len(data) != 1 {
+        return errLoginBadMsg
+    }
+
+    this.mutex.Lock()
+    pending := this.pending[con.Id()]
+    delete(this.pending, con.Id())
+
+    if !pending || this.store != nil {
+        this.mutex.Unlock()
+        return errLoginUnexpected
+    }
+
+    if data[0] == ACCESS_NONE {
+        this.mutex.Unlock()
+        return errLoginDenied
+    }
+
+    this.access[con.Id()] = data[0]
+    handler := this.handler
+    this.mutex.Unlock()
+
+    if handler != nil {
+        handler(con, data[0])
+    }
+
+    return nil
+}
+
+// hashSecret returns the hash of the given user's secret.
+func hashSecret(name, secret string) []byte {
+    hash := sha256.Sum256([]byte(name + ":" + secret))
+    return hash[:]
+}
+
+// loginMac returns the proof of the given secret hash for a login challenge.
+func loginMac(secretHash, nonce []byte, name string) []byte {
+    mac := hmac.New(sha256.New, secretHash)
+    mac.Write(nonce)
+    mac.Write([]byte(name))
+
+    return mac.Sum(nil)
+}
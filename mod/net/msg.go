@@ -19,29 +19,36 @@ import (
 
 
 // NewMsg initializes a new Msg object and returns a pointer to it for use.
+// Msg objects are drawn from a pool, and may be handed back to it with
+// Release once they are no longer needed.
 func NewMsg() *Msg {
-    newMsg := Msg {
-        con        : nil,
-        cursor     : 0,
-        data       : nil,
-        from       : 0,
-        header     : 0,
-        hdrBuffer  : make([]byte, HEADER_LEN_B),
-        timeoutSec : DEFAULT_MSG_TIMEOUT_SEC,
-    }
+    newMsg           := getMsg()
+    newMsg.hdrBuffer  = newMsg.hdrArray[:HEADER_LEN_B]
+    newMsg.hdrLen     = HEADER_LEN_B
+    newMsg.priority   = PRIORITY_NORMAL
+    newMsg.timeoutSec = DEFAULT_MSG_TIMEOUT_SEC
 
-    return &newMsg
+    return newMsg
 }
 
 // Msg represents the baseline structure of data used for packaging
 // network messages to be sent via the net service.
 type Msg struct {   
     con        Connection
+    corrId     uint64
     cursor     int
     data       []byte
+    extFields  byte
+    extSig     uint32
     from       uint32
+    hdrArray   [HEADER_LEN_B + EXT_HEADER_MAX_LEN_B]byte
     hdrBuffer  []byte
+    hdrLen     int
     header     uint64
+    malformed  bool
+    priority   int
+    seq        uint32
+    slab       *slab
     timeoutSec int
 }
 
@@ -51,6 +58,23 @@ func (this *Msg) Connection() Connection {
     return this.con
 }
 
+// CorrelationId returns the correlation id carried in this message's
+// extended header, if any.
+func (this *Msg) CorrelationId() uint64 {
+    return this.corrId
+}
+
+// ExtMsgType returns the full message signature. Unlike MsgType, it
+// returns signatures above 0xFFFF, which can only be carried in an extended
+// header.
+func (this *Msg) ExtMsgType() uint32 {
+    if this.extSig != 0 {
+        return this.extSig
+    }
+
+    return uint32(GetMsgSig(this.header))
+}
+
 // From returns the local network ID of the network endpoint which
 // received this message.
 func (this *Msg) From() uint32 {
@@ -58,12 +82,11 @@ func (this *Msg) From() uint32 {
 }
 
 // GetBytes retreives the Msg, fully serialized with header and
-// payload, for transmission.
+// payload, for transmission. Messages which need an extended header are
+// serialized with one.
 func (this *Msg) GetBytes() []byte {
-    buffer := make([]byte, len(this.data) + HEADER_LEN_B)
-
-    SetMsgHeader(this.header, buffer)
-    SetMsgPayload(this.data, buffer)
+    buffer := make([]byte, this.Len())
+    this.writeFrame(buffer)
 
     return buffer
 }
@@ -81,7 +104,48 @@ func (this *Msg) GetPayload() []byte {
 // Len returns the overall size of the data contained within the
 // Msg object, including header and payload.
 func (this *Msg) Len() int {
-    return HEADER_LEN_B + len(this.data)
+    ext := this.extHeader()
+    if ext == nil {
+        return HEADER_LEN_B + len(this.data)
+    }
+
+    return HEADER_LEN_B + ext.Len() + len(this.data)
+}
+
+// MsgType returns the message signature, whether it is carried in the
+// standard header or an extended one. Signatures above 0xFFFF are returned
+// as SIG_EXTENDED; use ExtMsgType to read them.
+func (this *Msg) MsgType() uint16 {
+    sig := this.ExtMsgType()
+    if sig > 0xFFFF {
+        return SIG_EXTENDED
+    }
+
+    return uint16(sig)
+}
+
+// Priority returns the priority class this message is sent in.
+func (this *Msg) Priority() int {
+    return this.priority
+}
+
+// Sequence returns the sequence number carried in this message's extended
+// header, if any.
+func (this *Msg) Sequence() uint32 {
+    return this.seq
+}
+
+// Release hands this message, and the pooled buffer its payload was received
+// into, back to the net service for reuse. Received messages are released
+// by the protocol once they have been deserialized, so when buffer pooling
+// is enabled MsgProcessors must copy any part of the payload they want to
+// keep. A message must not be used in any way after it has been released.
+func (this *Msg) Release() {
+    if this.slab != nil {
+        putSlab(this.slab)
+    }
+
+    putMsg(this)
 }
 
 // SetConnection sets the connection associated with this msg.
@@ -90,6 +154,14 @@ func (this *Msg) SetConnection(parentCon Connection) {
     this.from = parentCon.Id()
 }
 
+// SetCorrelationId sets a correlation id, which is carried to the remote
+// peer in an extended header. Correlation ids are dropped when sending to
+// peers which don't support extended headers.
+func (this *Msg) SetCorrelationId(corrId uint64) {
+    this.corrId     = corrId
+    this.extFields |= EXT_FIELD_CORRELATION
+}
+
 // SetCompressed sets the compressed flag in this message's header.
 func (this *Msg) SetCompressed(value bool) {
     SetMsgCompressedFlag(&this.header, value)
@@ -105,9 +177,25 @@ func (this *Msg) SetHeader(header uint64) {
     this.header = header
 }
 
-// SetMsgType sets the message signature in this message's header.
+// SetExtMsgType works like SetMsgType, but accepts the full range of
+// signatures which an extended header can carry.
+func (this *Msg) SetExtMsgType(msgType uint32) {
+    this.extSig = 0
+    this.header = this.header &^ msgFlagsMask
+
+    if msgType > MAX_MSG_TYPE {
+        this.extSig = msgType
+        msgType     = SIG_EXTENDED
+    }
+
+    SetMsgSig(&this.header, uint16(msgType))
+}
+
+// SetMsgType sets the message signature in this message's header, replacing
+// any previous signature. Signatures above MAX_MSG_TYPE are carried in an
+// extended header.
 func (this *Msg) SetMsgType(msgType uint16) {
-    SetMsgSig(&this.header, msgType)
+    this.SetExtMsgType(uint32(msgType))
 }
 
 // SetPayload sets the payload buffer for this message and recalculates
@@ -116,6 +204,21 @@ func (this *Msg) SetPayload(data []byte) {
     this.data = data
 }
 
+// SetPriority sets the priority class (PRIORITY_HIGH, PRIORITY_NORMAL or
+// PRIORITY_LOW) this message is sent in. The priority is local to the
+// sender, and isn't transmitted.
+func (this *Msg) SetPriority(priority int) {
+    this.priority = priority
+}
+
+// SetSequence sets a sequence number, which is carried to the remote peer
+// in an extended header. Sequence numbers are dropped when sending to peers
+// which don't support extended headers.
+func (this *Msg) SetSequence(seq uint32) {
+    this.extFields |= EXT_FIELD_SEQUENCE
+    this.seq        = seq
+}
+
 // SetTimeout sets this message's timeout (in seconds).
 func (this *Msg) SetTimeout(timeoutSec int) {
     this.timeoutSec = timeoutSec
@@ -133,30 +236,29 @@ func (this *Msg) TimeoutSec() int {
 func (this *Msg) addData(newData []byte) ([]byte, bool) {
     var dataCount, hdrCount int
 
-    // build header
-    if this.cursor < HEADER_LEN_B {
-        hdrCount     = copy(this.hdrBuffer[this.cursor:], newData)
-        this.cursor += hdrCount
+    // build header, and extended header if there is one
+    for this.cursor < this.hdrLen {
+        count        := copy(this.hdrBuffer[this.cursor:], newData[hdrCount:])
+        this.cursor += count
+        hdrCount    += count
 
-        if this.cursor < HEADER_LEN_B {
+        if this.cursor < this.hdrLen {
             // header not yet complete
             return nil, false
         }
 
         // header complete, intialize the rest of the object
-        hdr, err := GetMsgHeader(this.hdrBuffer)
-        if err != nil {
-            panic ("hdrBuffer not large enough to hold header")
+        if !this.parseHeader() {
+            // the rest of the stream can't be framed
+            this.malformed = true
+            this.data      = make([]byte, 0)
+            return nil, true
         }
-
-        this.header    = hdr
-        this.data      = make([]byte, GetMsgSize(this.header))
-        this.hdrBuffer = nil
     }
 
     // fill data buffer
     dataCount = copy(
-        this.data[this.cursor - HEADER_LEN_B:],
+        this.data[this.cursor - this.hdrLen:],
         newData[hdrCount:],
     )
 
@@ -168,12 +270,12 @@ func (this *Msg) addData(newData []byte) ([]byte, bool) {
         return newData[dataCount + hdrCount:], true
     }
 
-    if this.cursor > len(this.data) + HEADER_LEN_B {
+    if this.cursor > len(this.data) + this.hdrLen {
         panic("net.Msg buffer overflow (cursor > buffer length)")
     }
 
     // message complete, no data left over
-    if this.cursor == len(this.data) + HEADER_LEN_B {
+    if this.cursor == len(this.data) + this.hdrLen {
         return nil, true
     }
 
@@ -181,6 +283,166 @@ func (this *Msg) addData(newData []byte) ([]byte, bool) {
     return nil, false
 }
 
+// allocData draws the buffer a received payload is read into from the
+// buffer pools. The header buffer is no longer needed once the payload
+// length is known.
+func (this *Msg) allocData(size int) {
+    this.slab      = getSlab(size)
+    this.data      = this.slab.buf
+    this.hdrBuffer = nil
+}
+
+// clearExtFields drops the optional extended header fields from this
+// message.
+func (this *Msg) clearExtFields() {
+    this.corrId    = 0
+    this.extFields = 0
+    this.seq       = 0
+}
+
+// envelope returns the signature and flags, and the data, with which this
+// message is carried inside of fragment, rpc and topic envelopes. The
+// extended header, if there is one, is carried at the start of the data.
+func (this *Msg) envelope() (uint32, []byte) {
+    ext := this.extHeader()
+    if ext == nil {
+        return uint32(uint16(this.header)), this.data
+    }
+
+    header := this.header & msgTypeMask
+    SetMsgSig(&header, SIG_EXTENDED)
+    SetMsgExtendedFlag(&header, true)
+
+    data := make([]byte, ext.Len() + len(this.data))
+    SetExtHeader(ext, data)
+    copy(data[ext.Len():], this.data)
+
+    return uint32(uint16(header)), data
+}
+
+// extHeader returns the extended header needed to carry this message, or
+// nil if the standard header is sufficient.
+func (this *Msg) extHeader() *ExtHeader {
+    if this.extSig == 0 && this.extFields == 0 {
+        return nil
+    }
+
+    ext := ExtHeader {
+        CorrelationId : this.corrId,
+        Fields        : this.extFields,
+        PayloadLen    : uint32(len(this.data)),
+        Sequence      : this.seq,
+        Sig           : this.ExtMsgType(),
+    }
+
+    return &ext
+}
+
+// openEnvelope sets this message's header and payload from the signature,
+// flags and data carried in an envelope, as produced by envelope().
+func (this *Msg) openEnvelope(sigFlags uint32, data []byte) error {
+    this.header = uint64(uint16(sigFlags))
+    this.data   = data
+
+    if !GetMsgExtendedFlag(this.header) {
+        return nil
+    }
+
+    ext, err := GetExtHeader(data)
+    if err != nil {
+        return err
+    }
+
+    if int(ext.PayloadLen) != len(data) - GetExtHeaderLen(data) {
+        return ErrExtHeaderMalformed
+    }
+
+    this.data = data[GetExtHeaderLen(data):]
+    this.setExt(ext)
+
+    return nil
+}
+
+// parseHeader decodes the header once it has been read off of the line,
+// allocating the payload buffer. If the extended header flag is set, the
+// header buffer is first grown to hold the extended header, and parsing
+// resumes once it has been read. Returns false if the header is malformed.
+func (this *Msg) parseHeader() bool {
+    if this.hdrLen == HEADER_LEN_B {
+        hdr, err := GetMsgHeader(this.hdrBuffer)
+        if err != nil {
+            panic ("hdrBuffer not large enough to hold header")
+        }
+
+        this.header = hdr
+
+        if GetMsgExtendedFlag(hdr) {
+            extLen := int(GetMsgSize(hdr))
+            if extLen < EXT_HEADER_MIN_LEN_B || extLen > EXT_HEADER_MAX_LEN_B {
+                return false
+            }
+
+            this.hdrLen    = HEADER_LEN_B + extLen
+            this.hdrBuffer = this.hdrArray[:this.hdrLen]
+
+            return true
+        }
+
+        this.allocData(int(GetMsgSize(this.header)))
+
+        return true
+    }
+
+    ext, err := GetExtHeader(this.hdrBuffer[HEADER_LEN_B:])
+    if err != nil || ext.PayloadLen > MAX_NET_MSG_LEN {
+        return false
+    }
+
+    this.allocData(int(ext.PayloadLen))
+    this.setExt(ext)
+
+    return true
+}
+
+// setExt applies a received extended header to this message. The extended
+// header flag is cleared, and signatures which fit in the standard header
+// are moved back into it, so that received messages look the same as those
+// built locally.
+func (this *Msg) setExt(ext *ExtHeader) {
+    SetMsgExtendedFlag(&this.header, false)
+
+    this.corrId    = ext.CorrelationId
+    this.extFields = ext.Fields & (EXT_FIELD_CORRELATION | EXT_FIELD_SEQUENCE)
+    this.seq       = ext.Sequence
+
+    this.SetExtMsgType(ext.Sig)
+}
+
+// writeFrame serializes this message, with header and payload, into the
+// given buffer, which must be at least Len() bytes long. Messages which need
+// an extended header are serialized with one.
+func (this *Msg) writeFrame(buffer []byte) {
+    ext := this.extHeader()
+    if ext == nil {
+        SetMsgHeader(this.header, buffer)
+        SetMsgPayload(this.data, buffer)
+
+        return
+    }
+
+    extLen := ext.Len()
+    header := this.header & msgTypeMask
+
+    SetMsgSig(&header, SIG_EXTENDED)
+    SetMsgExtendedFlag(&header, true)
+    SetMsgSize(&header, extLen)
+    SetMsgChecksum(&header, crc32.ChecksumIEEE(this.data))
+    SetMsgHeader(header, buffer)
+    SetExtHeader(ext, buffer[HEADER_LEN_B:])
+
+    copy(buffer[HEADER_LEN_B + extLen:], this.data)
+}
+
 // isValid computes the checksum on received payload data and compares it
 // to the checksum transmitted in the message header. Returns true if the
 // checksums match, and false if not.
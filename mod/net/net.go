@@ -18,7 +18,7 @@
 //      flags
 //          11: compressed
 //          12: encrypted
-//          13: reserved
+//          13: extended header
 //          14: reserved
 //          15: reserved
 //          16: reserved
@@ -27,6 +27,17 @@
 // [2-3]     msgsize (uint16)
 // [4-7]     crc32 checksum of payload (uint32)
 // [8-32767] payload is msg size
+//
+// Messages whose signature doesn't fit in 10 bits, or which carry a
+// correlation id or sequence number, are sent with the extended header flag
+// set, SIG_EXTENDED in the msgtype field, and the length of an ExtHeader in
+// the msgsize field. The ExtHeader follows the standard header, and carries
+// the full signature and payload length. Extended headers are only sent to
+// peers which advertise support for them in their handshake.
+//
+// Messages whose payload exceeds MAX_NET_MSG_LEN are transparently split
+// into SIG_FRAGMENT messages by the sending Protocol and reassembled by the
+// receiving Protocol before being handed to the registered MsgProcessor.
 package net
 
 // External imports.
@@ -63,10 +74,31 @@ const (
     MAX_NET_MSG_LEN = 32 * 1024
 )
 
+// Reserved message signatures. Signatures from MAX_USER_MSG_TYPE up to
+// MAX_MSG_TYPE are used internally by the net service and cannot be
+// registered by user code.
+const (
+    MAX_USER_MSG_TYPE = 999
+    SIG_ACK           = 1021
+    SIG_COMPRESS      = 1020
+    SIG_LOGIN         = 1019
+    SIG_PING          = 1018
+    SIG_PONG          = 1017
+    SIG_RPC_REQ       = 1016
+    SIG_RPC_RESP      = 1015
+    SIG_TOPIC         = 1014
+    SIG_HELLO         = 1013
+    SIG_EXTENDED      = 1012
+    SIG_SHUTDOWN      = 1011
+    SIG_FRAGMENT      = 1023
+    SIG_RELIABLE      = 1022
+)
+
 // Message flag bitwise offsets.
 const (
     msgCompressedOffset = 11
     msgEncryptedOffset  = 12
+    msgExtendedOffset   = 13
 )
 
 // Msg flag masks.
@@ -81,9 +113,11 @@ var netId uint32 = 50
 
 // Routing map and synchronization.
 var (
+    liveProtos = make(map[*Protocol]bool)
     protoMap   = make(map[string]*Protocol)
     routeMutex sync.RWMutex
-    sigMap     = make(map[uint16]*Protocol)
+    sigMap     = make(map[uint32]map[*Protocol]MsgProcessor)
+    strictSigs = false
 )
 
 // Common error messages.
@@ -107,10 +141,22 @@ type AccessProvider interface {
     Init(proto *Protocol)
 }
 
+// AccessNegotiator may optionally be implemented by an AccessProvider which
+// authenticates peers with a login exchange. Hello() is sent to each new
+// connection as a SIG_LOGIN control message, if non-nil. SIG_LOGIN messages
+// from remote peers are delivered to OnLogin(), whose reply is sent back to
+// the peer, if non-nil. Connections are closed if OnLogin() returns an error.
+type AccessNegotiator interface {
+    Hello(con Connection) []byte
+    OnDisconnect(con Connection)
+    OnLogin(con Connection, data []byte) ([]byte, error)
+}
+
 // CompressionProvider specifies the interface which network protocols will
 // use to compress/decompress network messages. All outgoing messages flow
 // through Compress(). Only messages received with the compression header bit
-// set will flow through Decompress().
+// set will flow through Decompress(). Compress() is responsible for setting
+// the compression flag on the messages it compresses.
 type CompressionProvider interface {
     Close()
     Compress(msg *Msg) error
@@ -118,6 +164,18 @@ type CompressionProvider interface {
     Init(proto *Protocol)
 }
 
+// CompressionNegotiator may optionally be implemented by a CompressionProvider
+// which needs to exchange capabilities with remote peers. Capabilities() is
+// sent to each connection as a SIG_COMPRESS control message once the remote
+// peer has shown that it negotiates compression, through its handshake or
+// its own SIG_COMPRESS message, and the remote peer's capabilities are
+// delivered to OnCapabilities() as they arrive.
+type CompressionNegotiator interface {
+    Capabilities() []byte
+    OnCapabilities(con Connection, data []byte)
+    OnDisconnect(con Connection)
+}
+
 // Connection specifies the common interface that is used by AccessProvider
 // objects to provide authentication for network objects. A given AccessProvider
 // may validate based on none, one, or many pieces of the exposed data.
@@ -141,8 +199,27 @@ type CryptoProvider interface {
     Init(proto *Protocol)
 }
 
+// CryptoTracker may optionally be implemented by a CryptoProvider which keeps
+// state for each remote peer, such as the sequence numbers used to detect
+// replays. OnDisconnect() is called as each connection is removed.
+type CryptoTracker interface {
+    OnDisconnect(con Connection)
+}
+
+// ExtMsgProcessor may optionally be implemented by a MsgProcessor whose
+// signature doesn't fit in a uint16. Such processors are registered under
+// ExtSignature(), rather than Signature(), and their messages are sent with
+// Protocol.SendExtMsg.
+type ExtMsgProcessor interface {
+    MsgProcessor
+    ExtSignature() uint32
+}
+
 // MsgProcessor specifies the interface which user code should implement
 // to define the serialization behavior of a given message signature.
+// When SetBufferPooling is enabled, received messages and their payload
+// buffers are released for reuse once DeserializeMsg returns, so the object
+// it returns must not refer to the payload without copying it.
 type MsgProcessor interface {
     Close()
     DeserializeMsg(msg *Msg, access byte) (interface{}, error)
@@ -151,6 +228,22 @@ type MsgProcessor interface {
     Signature() uint16
 }
 
+// PriorityMsgProcessor may optionally be implemented by a MsgProcessor whose
+// messages should be sent in a priority class other than PRIORITY_NORMAL.
+// Protocol.SendMsgPriority overrides the declared class for a single send.
+type PriorityMsgProcessor interface {
+    MsgProcessor
+    Priority() int
+}
+
+// RestrictedMsgProcessor may optionally be implemented by a MsgProcessor
+// which requires a minimum access level. Messages from connections with a
+// lower access level are dropped before they are deserialized.
+type RestrictedMsgProcessor interface {
+    MsgProcessor
+    MinAccess() byte
+}
+
 // NetConnector represents a connector to another network device. Some 
 // example implmentations of NetConnector are the built-in TCP and UDP
 // client and server objects.
@@ -161,6 +254,8 @@ type NetConnector interface {
 
 // EventHandler represents the interface that user code should implement
 // to handle events from a given protocol registered in the network layer.
+// Depending on the protocol's dispatch model, OnReceive may be called from
+// several goroutines at once. See Protocol.SetDispatch.
 type EventHandler interface {
     Close()
     Init(proto *Protocol)
@@ -184,6 +279,12 @@ func GetMsgEncryptedFlag(header uint64) bool {
     return (header & (1 << msgEncryptedOffset)) != 0
 }
 
+// GetMsgExtendedFlag retrieves bit 13 of the message header, which is used
+// to specify whether an ExtHeader follows the standard header or not.
+func GetMsgExtendedFlag(header uint64) bool {
+    return (header & (1 << msgExtendedOffset)) != 0
+}
+
 // GetMsgHeader retrieves the 64bit header from a raw message buffer.
 func GetMsgHeader(msgData []byte) (uint64, error) {
     if len(msgData) < HEADER_LEN_B {
@@ -287,6 +388,16 @@ func SetMsgEncryptedFlag(header *uint64, val bool) {
     }
 }
 
+// SetMsgExtendedFlag sets bit 13 of a raw header object, which is used to
+// specify whether an ExtHeader follows the standard header or not.
+func SetMsgExtendedFlag(header *uint64, val bool) {
+    if val {
+        *header = *header | (1 << msgExtendedOffset)
+    } else {
+        *header = *header &^ (1 << msgExtendedOffset)
+    }
+}
+
 // SetMsgHeader sets the first 8 bytes of a raw data buffer with the supplied
 // header.
 func SetMsgHeader(header uint64, msgData []byte) error {
@@ -353,6 +464,23 @@ func SetMsgSize(header *uint64, size int) error {
     return nil
 }
 
+// isReservedSig returns true if the given signature is reserved for use by
+// the net service. Signatures above MAX_MSG_TYPE are carried in extended
+// headers, and are available to user code.
+func isReservedSig(sig uint32) bool {
+    return sig > MAX_USER_MSG_TYPE && sig <= MAX_MSG_TYPE
+}
+
+// procSig returns the signature the given MsgProcessor is registered under.
+func procSig(proc MsgProcessor) uint32 {
+    ext, ok := proc.(ExtMsgProcessor)
+    if ok {
+        return ext.ExtSignature()
+    }
+
+    return uint32(proc.Signature())
+}
+
 // ValidateMsgHeader does some simple validation of the header in a raw
 // data buffer.
 func ValidateMsgHeader(msgData []byte) bool {
@@ -22,33 +22,57 @@ import (
 
 // Stdlib imports.
 import (
+    "crypto/tls"
     "errors"
     "fmt"
     stdnet "net"
     "sync"
+    "time"
 )
 
+// Protocol heartbeat interval, used to drive periodic maintenance tasks.
+const PROTO_HEARTBEAT_MS = 100
+
 // Perf counters.
 const (
     PERF_PROTO_CONNECT = iota
     PERF_PROTO_DISCONNECT
+    PERF_PROTO_DRAIN
+    PERF_PROTO_DRAIN_TIMEOUT
     PERF_PROTO_ERR_AUTH_CLIENT
     PERF_PROTO_ERR_DESERIALIZE
+    PERF_PROTO_ERR_FRAGMENT
+    PERF_PROTO_ERR_HANDSHAKE
     PERF_PROTO_ERR_MAX_MSG_SIZE
     PERF_PROTO_ERR_NO_ACCESS
     PERF_PROTO_ERR_NO_PROVIDER
+    PERF_PROTO_ERR_PEER_UNSUPPORTED
     PERF_PROTO_ERR_RCV_CHECKSUM
     PERF_PROTO_ERR_RCV_CON_NIL
     PERF_PROTO_ERR_RCV_DECRYPT
     PERF_PROTO_ERR_RCV_DECOMPRESS
+    PERF_PROTO_ERR_RCV_MALFORMED
     PERF_PROTO_ERR_SEND_COMPRESS
     PERF_PROTO_ERR_SEND_ENCRYPT
     PERF_PROTO_ERR_SEND_INVALID_CLI
     PERF_PROTO_ERR_SEND_INVALID_MSG_TYPE
     PERF_PROTO_ERR_SERIALIZE
+    PERF_PROTO_FRAG_IN_FLIGHT
+    PERF_PROTO_FRAG_RCV
+    PERF_PROTO_FRAG_SEND
+    PERF_PROTO_HANDSHAKE
+    PERF_PROTO_IDLE_EVICT
+    PERF_PROTO_PEER_SHUTDOWN
+    PERF_PROTO_RATE_BAN
+    PERF_PROTO_RATE_LIMITED
+    PERF_PROTO_RATE_REFUSED
     PERF_PROTO_RCV_BYTES
     PERF_PROTO_RCV_OK
     PERF_PROTO_RCV_TOTAL
+    PERF_PROTO_RPC_CALL
+    PERF_PROTO_RPC_ERROR
+    PERF_PROTO_RPC_SERVE
+    PERF_PROTO_RPC_TIMEOUT
     PERF_PROTO_SEND_BYTES
     PERF_PROTO_SEND_OK
     PERF_PROTO_SEND_TOTAL
@@ -56,6 +80,8 @@ const (
     PERF_PROTO_TIMEOUT_DISCONNECT
     PERF_PROTO_TIMEOUT_GENERAL
     PERF_PROTO_TIMEOUT_RCV
+    PERF_PROTO_TIMEOUT_REASSEMBLY
+    PERF_PROTO_TIMEOUT_RETRANSMIT
     PERF_PROTO_TIMEOUT_SEND
     PERF_PROTO_COUNT
 )
@@ -64,23 +90,42 @@ const (
 var protoPerfNames = []string {
     "Connect",
     "Disconnect",
+    "Drain",
+    "DrainTimeout",
     "ErrorAuthClient",
     "ErrorDeserialize",
+    "ErrorFragment",
+    "ErrorHandshake",
     "ErrorExceedMaxMsgSize",
     "ErrorNoAccess",
     "ErrorNoProvider",
+    "ErrorPeerUnsupported",
     "ErrorReceiveChecksum",
     "ErrorReceiveConNil",
     "ErrorReceiveDecrypt",
     "ErrorReceiveDecompress",
+    "ErrorReceiveMalformed",
     "ErrorSendCompress",
     "ErrorSendEncrypt",
     "ErrorSendInvalidCli",
     "ErrorSendInvalidMsgType",
     "ErrorSerialize",
+    "FragmentsInFlight",
+    "FragmentsReceived",
+    "FragmentsSent",
+    "Handshake",
+    "IdleEviction",
+    "PeerShutdown",
+    "RateBan",
+    "RateLimited",
+    "RateRefused",
     "ReceiveBytes",
     "ReceiveSuccess",
     "ReceiveTotal",
+    "RpcCall",
+    "RpcError",
+    "RpcServe",
+    "RpcTimeout",
     "SendBytes",
     "SendSuccess",
     "SendTotal",
@@ -88,6 +133,8 @@ var protoPerfNames = []string {
     "DisconnectTimeout",
     "GeneralTimeout",
     "ReceiveTimeout",
+    "ReassemblyTimeout",
+    "RetransmitTimeout",
     "SendTimeout",
 }
 
@@ -119,26 +166,59 @@ func perfName(baseName string) string {
 // Protocol object and returns a pointer to it for use.
 func NewProtocol(pName string, evtHandler EventHandler) *Protocol {
     newProto := Protocol{
-        cliMap       : make(map[uint32]Connection, 0),
-        connectChan  : make(chan Connection, QUEUE_BUFFERS),
-        discoChan    : make(chan Connection, QUEUE_BUFFERS),
-        errChan      : make(chan error, QUEUE_BUFFERS),
-        evtHandler   : evtHandler,
-        name         : pName,
-        netObjects   : make([]NetConnector, 0),
-        perfs        : perf.NewCounterSet(
+        cliMap        : make(map[uint32]Connection, 0),
+        connectChan   : make(chan Connection, QUEUE_BUFFERS),
+        ctrlMap       : make(map[uint32]byte),
+        discoChan     : make(chan Connection, QUEUE_BUFFERS),
+        dispatchPerfs : newDispatchPerfs(pName),
+        errChan       : make(chan error, QUEUE_BUFFERS),
+        evtHandler    : evtHandler,
+        fragMap       : make(map[fragKey]*fragBuffer),
+        fragMaxBytes  : DEFAULT_MAX_FRAG_BYTES,
+        fragMaxMsgs   : DEFAULT_MAX_FRAG_MSGS,
+        fragTimeout   : DEFAULT_FRAG_TIMEOUT_SEC,
+        kaMap         : make(map[uint32]*keepalive),
+        maxMsgLen     : DEFAULT_MAX_MSG_LEN,
+        name          : pName,
+        netObjects    : make([]NetConnector, 0),
+        peerMap       : make(map[uint32]*PeerInfo),
+        perfs         : perf.NewCounterSet(
             perfName(pName), 
             PERF_PROTO_COUNT, 
             protoPerfNames,
         ),
-        rcvChan      : make(chan *Msg, QUEUE_BUFFERS),
-        sigMap       : make(map[uint16]MsgProcessor, 0),
-        syncObj      : lifecycle.New(),
-        timeoutChan  : make(chan *TimeoutEvent, QUEUE_BUFFERS),
-        udpEndpoints : make(map[string]*udpEndpoint),
+        rateBans      : make(map[string]time.Time),
+        rateCons      : make(map[uint32]*rateCon),
+        rateIps       : make(map[string]*rateIp),
+        rateLimits    : *NewRateLimits(),
+        rateListeners : make(map[string]int),
+        rcvChan       : make(chan *Msg, QUEUE_BUFFERS),
+        rpcHandlers   : make(map[uint16]RpcHandler),
+        rpcPending    : make(map[uint32]*rpcCall),
+        sendLimits    : *NewSendQueueLimits(),
+        sigMap        : make(map[uint32]MsgProcessor, 0),
+        syncObj       : lifecycle.New(),
+        timeoutChan   : make(chan *TimeoutEvent, QUEUE_BUFFERS),
+        topicAccess   : DEFAULT_FEDERATION_ACCESS,
+        topicMap      : make(map[string]*topic),
+        topicMaxSubs  : DEFAULT_MAX_TOPIC_SUBS,
+        topicPerfs    : perf.NewCounterSetGroup(
+            perfName(pName + ".Topic"),
+            PERF_TOPIC_COUNT,
+            topicPerfNames,
+        ),
+        topicPublish  : DEFAULT_PUBLISH_ACCESS,
+        topicRemote   : make(map[uint32]map[string]byte),
+        udpEndpoints  : make(map[string]*udpEndpoint),
+        udpMode       : UDP_UNRELIABLE,
+        udpRetries    : DEFAULT_MAX_RETRIES,
+        udpRetryMs    : DEFAULT_RETRANSMIT_MS,
     }
 
+    registerProto(&newProto)
+
     newProto.evtHandler.Init(&newProto)
+    newProto.syncObj.StartHeart(PROTO_HEARTBEAT_MS)
     go newProto.handleEvents()
 
     return &newProto
@@ -149,25 +229,74 @@ func NewProtocol(pName string, evtHandler EventHandler) *Protocol {
 // providers which will be used as a part of the messaging pipeline for those
 // message types.
 type Protocol struct {
-    cliMap       map[uint32]Connection
-    cliMutex     sync.RWMutex
-    compressor   CompressionProvider
-    connectChan  chan Connection
-    crypto       CryptoProvider
-    discoChan    chan Connection
-    errChan      chan error
-    evtHandler   EventHandler
-    evtMutex     sync.RWMutex
-    name         string
-    netObjects   []NetConnector
-    objMutex     sync.RWMutex
-    perfs        *perf.CounterSet
-    rcvChan      chan *Msg
-    security     AccessProvider
-    sigMap       map[uint16]MsgProcessor
-    syncObj      *lifecycle.Lifecycle
-    timeoutChan  chan *TimeoutEvent
-    udpEndpoints map[string]*udpEndpoint
+    cliMap        map[uint32]Connection
+    capture       *Capture
+    cliMutex      sync.RWMutex
+    compressor    CompressionProvider
+    connectChan   chan Connection
+    crypto        CryptoProvider
+    ctrlMap       map[uint32]byte
+    discoChan     chan Connection
+    dispatchMutex sync.RWMutex
+    dispatchPerfs *perf.CounterSet
+    dispatchPool  *dispatchPool
+    drainTimeout  int
+    draining      bool
+    errChan       chan error
+    evtHandler    EventHandler
+    evtMutex      sync.RWMutex
+    fragId        uint32
+    fragMap       map[fragKey]*fragBuffer
+    fragMaxBytes  int
+    fragMaxMsgs   int
+    fragMutex     sync.Mutex
+    fragTimeout   int
+    handlers      int32
+    helloConnect  bool
+    kaIntervalMs  int
+    kaMap         map[uint32]*keepalive
+    kaMutex       sync.Mutex
+    kaTimeoutMs   int
+    maxMsgLen     int
+    name          string
+    netObjects    []NetConnector
+    objMutex      sync.RWMutex
+    peerMap       map[uint32]*PeerInfo
+    peerMutex     sync.RWMutex
+    perfs         *perf.CounterSet
+    rateBans      map[string]time.Time
+    rateCons      map[uint32]*rateCon
+    rateIps       map[string]*rateIp
+    rateLimits    RateLimits
+    rateListeners map[string]int
+    rateMutex     sync.Mutex
+    rateReload    time.Time
+    rateSection   string
+    rcvChan       chan *Msg
+    rpcHandlers   map[uint16]RpcHandler
+    rpcId         uint32
+    rpcMutex      sync.Mutex
+    rpcPending    map[uint32]*rpcCall
+    security      AccessProvider
+    sendLimits    SendQueueLimits
+    sigMap        map[uint32]MsgProcessor
+    syncObj       *lifecycle.Lifecycle
+    timeoutChan   chan *TimeoutEvent
+    topicAccess   byte
+    topicMap      map[string]*topic
+    topicMaxSubs  int
+    topicMutex    sync.RWMutex
+    topicPerfs    *perf.CounterSetGroup
+    topicPublish  byte
+    topicRemote   map[uint32]map[string]byte
+    udpEndpoints  map[string]*udpEndpoint
+    udpMode       int
+    udpRetries    int
+    udpRetryMs    int
+    version       uint32
+    versionMin    uint32
+    versionName   string
+    wsOrigins     []string
 }
 
 // AddSignature registers a message type signature and its associated message 
@@ -180,21 +309,37 @@ func (this *Protocol) AddSignature(proc MsgProcessor) {
     this.objMutex.Lock()
     defer this.objMutex.Unlock()
 
-    if this.sigMap[proc.Signature()] != nil {
+    sig := procSig(proc)
+
+    if isReservedSig(sig) {
+        log.Error(
+            "MsgProcessor signature reserved (sig: %v), aborting registration",
+            sig,
+        )
+        return
+    }
+
+    if this.sigMap[sig] != nil {
         log.Error(
             "MsgProcessor already registered (sig: %v), aborting registration",
-            proc.Signature(),
+            sig,
         )
         return
     }
 
+    err := registerSig(this, proc)
+    if err != nil {
+        log.Error("%v, aborting registration", err)
+        return
+    }
+
     proc.Init(this)
 
-    this.sigMap[proc.Signature()] = proc
+    this.sigMap[sig] = proc
 
     log.Info(
         "Signature %d registered in protocol %s",
-        proc.Signature(), 
+        sig, 
         this.name,
     )
 }
@@ -209,23 +354,25 @@ func (this *Protocol) DeleteSignature(proc MsgProcessor) {
     this.objMutex.Lock()
     defer this.objMutex.Unlock()
 
-    if this.sigMap[proc.Signature()] != proc {
+    sig := procSig(proc)
+
+    if this.sigMap[sig] != proc {
         log.Error(
             "MsgProcessor registered, but doesn't match the call "+
                 "to unregister (sig: %v). Aborting...",
-            proc.Signature(),
+            sig,
         )
         return
     }
 
-    proc = this.sigMap[proc.Signature()]
     proc.Close()
 
-    delete(this.sigMap, proc.Signature())
+    delete(this.sigMap, sig)
+    unregisterSig(this, sig)
 
     log.Info(
         "Signature %d unregistered from protocol %s", 
-        proc.Signature(), 
+        sig, 
         this.name,
     )
 }
@@ -233,24 +380,23 @@ func (this *Protocol) DeleteSignature(proc MsgProcessor) {
 // DialTcp attempts to create a TCP connection to the given
 // network address.
 func (this *Protocol) DialTcp(addr string) error {
-    conn, err := stdnet.Dial("tcp", addr)
+    return this.Dial(TRANSPORT_TCP, addr)
+}
+
+// DialTcpTLS attempts to create a TLS secured TCP connection to the given
+// network address, using the supplied TLS configuration.
+func (this *Protocol) DialTcpTLS(addr string, tlsConfig *tls.Config) error {
+    if tlsConfig == nil {
+        return errNoTLSConfig
+    }
+
+    conn, err := tls.Dial("tcp", addr, tlsConfig)
     if err != nil {
         log.Error("%v", err)
         return err
     }
 
-    tCon := tcpCon {
-        discoChan   : this.discoChan,
-        id          : NextNetID(),
-        rcvChan     : this.rcvChan,
-        socket      : conn.(*stdnet.TCPConn),
-        syncObj     : lifecycle.New(),
-        timeoutChan : this.timeoutChan,
-        writeChan   : make(chan []byte, QUEUE_BUFFERS),
-    }
-
-    tCon.startHandlers()
-    this.onConnect(&tCon)
+    this.startTcpCon(conn)
 
     return nil
 }
@@ -263,7 +409,7 @@ func (this *Protocol) DialUdp(addr string, socket *stdnet.UDPConn) error {
         return err
     }
 
-    this.getUDPEndpoint(addrObj, socket)
+    this.getUDPEndpoint(addrObj, socket, "")
 
     return nil
 }
@@ -297,10 +443,21 @@ func (this *Protocol) GetConnection(id uint32) Connection {
 // ListenTcp attempts to set up a tcpSrv instance listening on the given
 // address.
 func (this *Protocol) ListenTcp(addr string) error {
+    return this.Listen(TRANSPORT_TCP, addr)
+}
+
+// ListenTcpTLS attempts to set up a TLS secured tcpSrv instance listening on
+// the given address. See LoadTLSConfig for building a TLS configuration from
+// certificate and key files registered with the config service.
+func (this *Protocol) ListenTcpTLS(addr string, tlsConfig *tls.Config) error {
+    if tlsConfig == nil {
+        return errNoTLSConfig
+    }
+
     this.objMutex.Lock()
     defer this.objMutex.Unlock()
 
-    tcpSrv         := newtcpSrv(this)
+    tcpSrv         := newtcpSrv(this, tlsConfig)
     this.netObjects = append(this.netObjects, tcpSrv)
 
     _, err := tcpSrv.Start(addr)
@@ -342,9 +499,46 @@ func (this *Protocol) RegisterConnection(con Connection) {
     this.cliMap[con.Id()] = con
 }
 
+// SendExtMsg works like SendMsg, but accepts the full range of signatures
+// which an ExtMsgProcessor may be registered under.
+func (this *Protocol) SendExtMsg(id uint32, sig uint32, msg interface{}) error {
+    return this.sendMsg(id, sig, msg)
+}
+
 // SendMsg transmits the supplied message to the target connection Id.
 func (this *Protocol) SendMsg(id uint32, sig uint16, msg interface{}) error {
-    this.sendMsg(id, sig, msg)
+    return this.sendMsg(id, uint32(sig), msg)
+}
+
+// SendMsgPriority transmits the supplied message to the target connection
+// Id in the given priority class, overriding the class declared by the
+// signature's MsgProcessor.
+func (this *Protocol) SendMsgPriority(
+    id       uint32,
+    sig      uint16,
+    msg      interface{},
+    priority int,
+) error {
+    defer this.perfs.Increment(PERF_PROTO_SEND_TOTAL)
+
+    cli, err := this.getSendCon(id)
+    if err != nil {
+        return err
+    }
+
+    built, err := this.buildMsg(cli, uint32(sig), msg)
+    if err != nil {
+        return err
+    }
+
+    err = this.checkPeer(cli, built, 0)
+    if err != nil {
+        return err
+    }
+
+    built.SetPriority(priority)
+    this.sendFrames(cli, built)
+
     return nil
 }
 
@@ -368,7 +562,9 @@ func (this *Protocol) SetAccessProvider(provider AccessProvider) {
 
 // SetCompressionProvider sets the CompressionProvider object responsible for
 // handling compression and decompression of messages passing through the
-// protocol.
+// protocol. Providers implementing CompressionNegotiator only advertise their
+// capabilities to connections established after they are registered, so the
+// provider should be set before listening or dialing.
 func (this *Protocol) SetCompressionProvider(provider CompressionProvider) {
     if provider == nil {
         return
@@ -403,25 +599,94 @@ func (this *Protocol) SetCryptoProvider(provider CryptoProvider) {
     provider.Init(this)
 }
 
+// SetFragmentLimits sets the maximum number of fragmented messages, and the
+// maximum total size in bytes of those messages, which a single connection
+// may have in reassembly at once. A connection which exceeds either limit
+// has its reassemblies dropped, and is disconnected.
+func (this *Protocol) SetFragmentLimits(maxMsgs, maxBytes int) {
+    this.fragMutex.Lock()
+    defer this.fragMutex.Unlock()
+
+    this.fragMaxBytes = maxBytes
+    this.fragMaxMsgs  = maxMsgs
+}
+
+// SetFragmentTimeout sets the number of seconds that a partially received,
+// fragmented message is held for reassembly before being discarded.
+func (this *Protocol) SetFragmentTimeout(timeoutSec int) {
+    this.fragMutex.Lock()
+    defer this.fragMutex.Unlock()
+
+    this.fragTimeout = math.IClamp(
+        timeoutSec,
+        MIN_TIMEOUT_SEC,
+        MAX_TIMEOUT_SEC,
+    )
+}
+
+// SetMaxMsgLen sets the maximum payload size, in bytes, of messages sent or
+// received by this protocol. Payloads larger than MAX_NET_MSG_LEN are
+// fragmented for transmission and reassembled on receipt.
+func (this *Protocol) SetMaxMsgLen(size int) {
+    this.fragMutex.Lock()
+    defer this.fragMutex.Unlock()
+
+    this.maxMsgLen = size
+}
+
+// SetUdpDelivery sets the delivery mode (UDP_UNRELIABLE, UDP_RELIABLE, or
+// UDP_RELIABLE_ORDERED) used by UDP endpoints created after the call.
+// Reliable endpoints sequence and acknowledge every datagram, retransmitting
+// with exponential backoff and suppressing duplicates on receipt. Datagrams
+// which exhaust their retries are reported via TIMEOUT_RETRANSMIT events.
+func (this *Protocol) SetUdpDelivery(mode int) {
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.udpMode = mode
+}
+
+// SetUdpRetransmit sets the initial retransmit delay, in milliseconds, and
+// the maximum number of retransmit attempts used by reliable UDP endpoints
+// created after the call.
+func (this *Protocol) SetUdpRetransmit(initialMs, maxRetries int) {
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.udpRetryMs = math.IClamp(initialMs, 1, MAX_RETRANSMIT_MS)
+    this.udpRetries = maxRetries
+}
+
 // Shutdown removes the Protocol from the net service, also unregistering all
-// associated message type signatures in the process.
+// associated message type signatures in the process. If a drain timeout has
+// been set, the protocol is drained before its connections are closed.
 func (this *Protocol) Shutdown() {
+    drainTimeout := this.getDrainTimeout()
+    if drainTimeout > 0 {
+        this.Drain(drainTimeout)
+    }
+
     this.evtMutex.Lock()
     this.evtHandler.Close()
     this.evtMutex.Unlock()
 
     this.objMutex.Lock()
-    defer this.objMutex.Unlock()
-    
     for _, obj := range this.netObjects {
         obj.Stop()
     }
+    this.objMutex.Unlock()
 
-    for k, _ := range this.cliMap {
-        this.cliMap[k].Close()
+    // the event loop needs objMutex to process the resulting disconnects
+    for _, con := range this.GetAllConnections() {
+        con.Close()
     }
 
+    unregisterProto(this)
+
     this.syncObj.Shutdown()
+
+    // finish handling messages already queued with dispatch workers
+    this.SetDispatch(DISPATCH_SINGLE, 0)
 }
 
 // getAccess queries this Protocol's AccessProvider and returns its access level.
@@ -451,6 +716,62 @@ func (this *Protocol) getAccess(con Connection) byte {
     return access
 }
 
+// getMaxMsgLen returns the maximum payload size for messages passing
+// through the protocol.
+func (this *Protocol) getMaxMsgLen() int {
+    this.fragMutex.Lock()
+    defer this.fragMutex.Unlock()
+
+    return this.maxMsgLen
+}
+
+// acceptTcpCon wraps a newly accepted connection in a tcpCon object, queues
+// it for registration with the protocol and starts its IO handlers.
+// Connections refused by the protocol's rate limits are closed.
+func (this *Protocol) acceptTcpCon(conn stdnet.Conn, listener string) {
+    id  := NextNetID()
+    err := this.admitCon(id, listener, conn.RemoteAddr())
+    if err != nil {
+        conn.Close()
+        return
+    }
+
+    cli := tcpCon{
+        discoChan    : this.discoChan,
+        id           : id,
+        rcvChan      : this.rcvChan,
+        sendQ        : newSendQueue(this.getSendQueueLimits()),
+        shutdownChan : this.syncObj.QueryShutdown(),
+        socket       : conn,
+        syncObj      : lifecycle.New(),
+        timeoutChan  : this.timeoutChan,
+    }
+
+    this.connectChan <- &cli
+
+    cli.startHandlers()
+
+    tcpPerfs.Increment(PERF_TCP_CONNECTIONS)
+}
+
+// startTcpCon wraps a newly dialed connection in a tcpCon object, starts
+// its IO handlers and registers it with the protocol.
+func (this *Protocol) startTcpCon(conn stdnet.Conn) {
+    tCon := tcpCon {
+        discoChan    : this.discoChan,
+        id           : NextNetID(),
+        rcvChan      : this.rcvChan,
+        sendQ        : newSendQueue(this.getSendQueueLimits()),
+        shutdownChan : this.syncObj.QueryShutdown(),
+        socket       : conn,
+        syncObj      : lifecycle.New(),
+        timeoutChan  : this.timeoutChan,
+    }
+
+    tCon.startHandlers()
+    this.onConnect(&tCon)
+}
+
 // assertUDPAddr wraps a type assertion from net.Addr to *net.UDPAddr into a more
 // succinct API.
 func assertUDPAddr(addr stdnet.Addr) (*stdnet.UDPAddr, error) {
@@ -469,9 +790,13 @@ func assertUDPAddr(addr stdnet.Addr) (*stdnet.UDPAddr, error) {
 
 // getUDPEndpoint looks up and returns a pointer to the given address' 
 // udpEndpoint object, creating a new one if no such object exists yet.
+// Endpoints created for datagrams received by a listener are subject to the
+// protocol's connection caps and bans. Dialed endpoints pass an empty
+// listener.
 func (this *Protocol) getUDPEndpoint(
-    addr   stdnet.Addr, 
-    socket *stdnet.UDPConn,
+    addr     stdnet.Addr, 
+    socket   *stdnet.UDPConn,
+    listener string,
 ) (*udpEndpoint, error) {
 
     this.objMutex.RLock()
@@ -498,22 +823,39 @@ func (this *Protocol) getUDPEndpoint(
     }
 
     if !exist {
+        id     := NextNetID()
+        limits := this.getSendQueueLimits()
+
+        if listener != "" {
+            err := this.admitCon(id, listener, addr)
+            if err != nil {
+                return nil, err
+            }
+        }
+
         this.objMutex.Lock()
 
         obj, exist = this.udpEndpoints[rAddrStr]
         if exist {
             this.objMutex.Unlock()
+            this.releaseCon(id)
             return obj, nil
         }
 
         obj             = new(udpEndpoint)
         obj.discoChan   = this.discoChan
-        obj.id          = NextNetID()
+        obj.id          = id
+        obj.maxRetries  = this.udpRetries
+        obj.mode        = this.udpMode
+        obj.rcvNext     = 1
+        obj.rcvWindow   = make(map[uint32]*Msg)
         obj.remoteAddr  = addr
+        obj.retryMs     = this.udpRetryMs
+        obj.sendQ       = newSendQueue(limits)
         obj.socket      = socket
         obj.syncObj     = lifecycle.New()
         obj.timeoutChan = this.timeoutChan
-        obj.writeChan   = make(chan []byte, QUEUE_BUFFERS)
+        obj.unacked     = make(map[uint32]*unackedDatagram)
         obj.startHandlers()
 
         this.udpEndpoints[rAddrStr] = obj
@@ -531,6 +873,25 @@ func (this *Protocol) getUDPEndpoint(
     return obj, nil
 }
 
+// dropUDPEndpoint stops the given UDP endpoint and removes it from the
+// protocol, so that a new endpoint is created if the remote peer returns.
+// Sockets are only closed for dialed endpoints, which own their socket.
+func (this *Protocol) dropUDPEndpoint(endpoint *udpEndpoint) {
+    this.objMutex.Lock()
+    for k, v := range this.udpEndpoints {
+        if v == endpoint {
+            delete(this.udpEndpoints, k)
+        }
+    }
+    this.objMutex.Unlock()
+
+    go endpoint.syncObj.Shutdown()
+
+    if endpoint.remoteAddr == nil {
+        endpoint.socket.Close()
+    }
+}
+
 // handleEvents is launched within a new go routine when a new protocol is
 // instantiated. handleEvents runs continuously and feeds events from the
 // protocol layer to the user's registered EventHandler.
@@ -547,6 +908,8 @@ func (this *Protocol) handleEvents() {
             this.rcvMsg(msg)
         case timeout := <-this.timeoutChan:
             this.onTimeout(timeout)
+        case <-this.syncObj.QueryHeartbeat():
+            this.onHeartbeat()
         case <-this.syncObj.QueryShutdown():
             this.evtMutex.Lock()
             this.evtHandler.OnShutdown()
@@ -566,6 +929,8 @@ func (this *Protocol) onConnect(con Connection) {
     this.cliMap[con.Id()] = con
     this.cliMutex.Unlock()
     
+    this.ctrlConnect(con)
+
     this.evtMutex.Lock()
     this.evtHandler.OnConnect(con)
     this.evtMutex.Unlock()
@@ -577,6 +942,8 @@ func (this *Protocol) onConnect(con Connection) {
 
 // onDisconnect is notified by the net service of clients leaving the system.
 func (this *Protocol) onDisconnect(con Connection) {
+    this.releaseCon(con.Id())
+
     this.cliMutex.Lock()
     if this.cliMap[con.Id()] == nil {
         this.cliMutex.Unlock()
@@ -586,6 +953,14 @@ func (this *Protocol) onDisconnect(con Connection) {
     delete(this.cliMap, con.Id())
     this.cliMutex.Unlock()
 
+    this.dropFragments(con.Id())
+    this.dropKeepalive(con.Id())
+    this.failRpcs(con.Id())
+    this.dropTopics(con.Id())
+    this.dropPeer(con.Id())
+
+    this.ctrlDisconnect(con)
+
     this.evtMutex.Lock()
     this.evtHandler.OnDisconnect(con)
     this.evtMutex.Unlock()
@@ -604,6 +979,14 @@ func (this *Protocol) onError(err error) {
     this.evtMutex.Unlock()
 }
 
+// onHeartbeat is called periodically from the protocol's event loop
+// and is responsible for running time-based maintenance tasks.
+func (this *Protocol) onHeartbeat() {
+    this.expireFragments()
+    this.checkKeepalives()
+    this.checkRateLimits()
+}
+
 // onTimeout is called when a timeout event bubbles up from underlying
 // NetConnections. onTimeout logs the type of timeout and then bubbles
 // the event up to the registered event handler.
@@ -617,6 +1000,10 @@ func (this *Protocol) onTimeout(timeout *TimeoutEvent) {
         this.perfs.Increment(PERF_PROTO_TIMEOUT_GENERAL)
     case TIMEOUT_RCV:
         this.perfs.Increment(PERF_PROTO_TIMEOUT_RCV)
+    case TIMEOUT_REASSEMBLY:
+        this.perfs.Increment(PERF_PROTO_TIMEOUT_REASSEMBLY)
+    case TIMEOUT_RETRANSMIT:
+        this.perfs.Increment(PERF_PROTO_TIMEOUT_RETRANSMIT)
     case TIMEOUT_SEND:
         this.perfs.Increment(PERF_PROTO_TIMEOUT_SEND)
     }
@@ -629,19 +1016,44 @@ func (this *Protocol) onTimeout(timeout *TimeoutEvent) {
 // rcvMsg is the message pipeline for incoming messages. First, the message
 // CRC is validated. Second, the msg is checked for a valid reference to a live
 // NetConnection object. Next, the registered AccessProvider is queried to make 
-// sure the message is allowed to pass. Then, the header is cracked open and
+// sure the message is allowed to pass. Fragmented messages are then held until
+// all of their fragments have been received and reassembled. Then, the header is cracked open and
 // message signature retreived. The header is checked against registered signatures
 // and the appropriate MsgHandler retreived. Next, the message is passed through 
 // registered Decryption and Decompression processes if registered and necessary. 
 // Finally, the pre-processed message is passed to the message processor for
 // deserialization. If all of the steps in the pipeline complete successfully, the 
-// completed message is passed to the registered EventHandler.
+// completed message is dispatched to the registered EventHandler. The message
+// is released once the pipeline is done with it.
 func (this *Protocol) rcvMsg(msg *Msg) {
     defer this.perfs.Increment(PERF_PROTO_RCV_TOTAL)
+    defer msg.Release()
+
+    if this.capturing() && msg.Connection() != nil {
+        this.captureFrame(msg.Connection(), CAPTURE_IN, msg.GetBytes())
+    }
+
+    if msg.malformed {
+        this.perfs.Increment(PERF_PROTO_ERR_RCV_MALFORMED)
+        this.errChan<- errors.New(fmt.Sprintf(
+            "%v (proto: %s, con: %v). Closing connection",
+            ErrExtHeaderMalformed,
+            this.name,
+            msg.From(),
+        ))
+
+        if msg.Connection() != nil {
+            this.rateStrike(msg.Connection())
+            go msg.Connection().Close()
+        }
+
+        return
+    }
 
     if !msg.isValid() {
         this.perfs.Increment(PERF_PROTO_ERR_RCV_CHECKSUM)
         this.errChan<- errBadChecksum
+        this.rateStrike(msg.Connection())
         return
     }
 
@@ -665,6 +1077,18 @@ func (this *Protocol) rcvMsg(msg *Msg) {
         return
     }
 
+    if !this.checkRate(msgCon, msg.Len()) {
+        return
+    }
+
+    this.touchKeepalive(msgCon.Id())
+
+    // control messages, such as logins, are handled before authorization
+    if isCtrlSig(msg.ExtMsgType()) {
+        this.rcvCtrlMsg(msg)
+        return
+    }
+
     access := this.getAccess(msgCon)
     if access < 1 {
         this.perfs.Increment(PERF_PROTO_ERR_NO_ACCESS)
@@ -672,8 +1096,94 @@ func (this *Protocol) rcvMsg(msg *Msg) {
         return
     }
 
+    if msg.MsgType() == SIG_FRAGMENT {
+        fullMsg, err := this.reassembleMsg(msg)
+        if err == errFragLimit {
+            go msgCon.Close()
+        }
+
+        if err != nil {
+            this.perfs.Increment(PERF_PROTO_ERR_FRAGMENT)
+            this.errChan<- errors.New(fmt.Sprintf(
+                "Error reassembling message (proto: %s, err: %v)",
+                this.name,
+                err,
+            ))
+            return
+        }
+
+        if fullMsg == nil {
+            return
+        }
+        defer fullMsg.Release()
+
+        msg = fullMsg
+    }
+
+    sig := msg.ExtMsgType()
+
+    if sig == SIG_RPC_REQ || sig == SIG_RPC_RESP {
+        this.rcvRpc(msg, access)
+        return
+    }
+
+    if sig == SIG_TOPIC {
+        this.rcvTopic(msg, access)
+        return
+    }
+
+    if isReservedSig(sig) {
+        this.rcvCtrlMsg(msg)
+        return
+    }
+
+    dataLen  := int64(msg.Len())
+    obj, err := this.decodeMsg(msg, access)
+    if err != nil {
+        return
+    }
+
+    fromId := msg.From()
+    this.dispatch(fromId, func() {
+        this.evtHandler.OnReceive(obj, fromId, access)
+    })
+
+    this.perfs.Increment(PERF_PROTO_RCV_OK)
+    this.perfs.Add(PERF_PROTO_RCV_BYTES, dataLen)
+}
+
+// decodeMsg passes a received message through the registered decryption and
+// decompression providers, and then deserializes it with the MsgProcessor
+// registered for its signature. Failures are reported to the protocol's
+// error channel before being returned. Connections which send signatures
+// without a MsgProcessor are closed.
+func (this *Protocol) decodeMsg(msg *Msg, access byte) (interface{}, error) {
+    obj, perfId, err := this.unpackMsg(msg, access)
+    if err == nil {
+        return obj, nil
+    }
+
+    this.perfs.Increment(perfId)
+    this.errChan<- err
+
+    this.objMutex.RLock()
+    proc := this.sigMap[msg.ExtMsgType()]
+    this.objMutex.RUnlock()
+
+    if proc == nil {
+        this.rateStrike(msg.Connection())
+        go msg.Connection().Close()
+    }
+
+    return nil, err
+}
+
+// unpackMsg does the work of decodeMsg without reporting failures, returning
+// the perf counter which a failure should be counted against instead.
+func (this *Protocol) unpackMsg(msg *Msg, access byte) (interface{}, int, error) {
+    msgCon    := msg.Connection()
     msgHeader := msg.GetHeader()
-    sig       := GetMsgSig(msgHeader)
+    sig       := msg.ExtMsgType()
 
     this.objMutex.RLock()
     defer this.objMutex.RUnlock()
@@ -681,106 +1191,118 @@ func (this *Protocol) rcvMsg(msg *Msg) {
     proc := this.sigMap[sig]
 
     if proc == nil {
-        this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
-        this.errChan<- errors.New(fmt.Sprintf(
+        err := errors.New(fmt.Sprintf(
             "No valid message processor (sig %v). Dropping message", 
             sig,
         ))
-        go msgCon.Close()
-        return
+        return nil, PERF_PROTO_ERR_NO_PROVIDER, err
+    }
+
+    restricted, ok := proc.(RestrictedMsgProcessor)
+    if ok && access < restricted.MinAccess() {
+        err := errors.New(fmt.Sprintf(
+            "Access denied (sig %v, con %v, access %v / %v). Dropping message",
+            sig,
+            msgCon.Id(),
+            access,
+            restricted.MinAccess(),
+        ))
+        return nil, PERF_PROTO_ERR_NO_ACCESS, err
     }
 
     if GetMsgEncryptedFlag(msgHeader) {
         if this.crypto == nil {
-            this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
-            this.errChan<- errors.New(fmt.Sprintf(
+            err := errors.New(fmt.Sprintf(
                 "Encryption flag set, but no encrpytion provider." +
                 "Dropping message (proto: %s)",
                 this.name,
             ))
-            return
+            return nil, PERF_PROTO_ERR_NO_PROVIDER, err
         }
 
         err := this.crypto.Decrypt(msg)
         if err != nil {
-            this.perfs.Increment(PERF_PROTO_ERR_RCV_DECRYPT)
-            this.errChan<- errors.New(fmt.Sprintf(
+            err = errors.New(fmt.Sprintf(
                 "Error decrypting message (proto: %s, err: %v)",
                 this.name,
                 err,
             ))
-            return
+            return nil, PERF_PROTO_ERR_RCV_DECRYPT, err
         }
     }
 
     if GetMsgCompressedFlag(msgHeader) {
         if this.compressor == nil {
-            this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
-            this.errChan<- errors.New(fmt.Sprintf(
+            err := errors.New(fmt.Sprintf(
                 "Compression flag set, but no compression provider."+
                 "Dropping message (proto: %s)",
                 this.name,
             ))
-            return
+            return nil, PERF_PROTO_ERR_NO_PROVIDER, err
         }
 
         err := this.compressor.Decompress(msg)
         if err != nil {
-            this.perfs.Increment(PERF_PROTO_ERR_RCV_DECOMPRESS)
-            this.errChan<- errors.New(fmt.Sprintf(
+            err = errors.New(fmt.Sprintf(
                 "Error decompressing message (proto: %s, err: %v)",
                 this.name,
                 err,
             ))
-            return
+            return nil, PERF_PROTO_ERR_RCV_DECOMPRESS, err
         }
     }
 
-    dataLen  := int64(msg.Len())
     obj, err := proc.DeserializeMsg(msg, access)
     if err != nil {
-        this.perfs.Increment(PERF_PROTO_ERR_DESERIALIZE)
-        this.errChan<- errors.New(fmt.Sprintf(
+        err = errors.New(fmt.Sprintf(
             "Error deserializing message (proto: %s, err: %v)",
             this.name,
             err,
         ))
+        return nil, PERF_PROTO_ERR_DESERIALIZE, err
     }
 
-    this.evtMutex.Lock()
-    this.evtHandler.OnReceive(obj, msg.From(), access)
-    this.evtMutex.Unlock()
-
-    this.perfs.Increment(PERF_PROTO_RCV_OK)
-    this.perfs.Add(PERF_PROTO_RCV_BYTES, dataLen)
+    return obj, 0, nil
 }
 
 // sendMsg distributes the given msg to a registerd client with that id,
 // if one exists. First, the send pipeline validates the targeted netID.
-// Second, the desired signature is checked against registered signatures and
-// the appropriate MsgProcessor retrieved. Next, the message is passed through
-// registered Compression and Encryption providers, if registered. Finally,
-// if the message passes through the pipeline without error, it is sent via the
-// requested net id.
-func (this *Protocol) sendMsg(id uint32, sig uint16, obj interface{}) error {
+// The message is then built by buildMsg and, if it passes through the
+// pipeline without error, it is sent via the requested net id.
+func (this *Protocol) sendMsg(id uint32, sig uint32, obj interface{}) error {
     defer this.perfs.Increment(PERF_PROTO_SEND_TOTAL)
 
-    this.cliMutex.RLock()
-    cli := this.cliMap[id]
-    this.cliMutex.RUnlock()
-
-    if cli == nil {
-        this.perfs.Increment(PERF_PROTO_ERR_SEND_INVALID_CLI)
-        err := errors.New(fmt.Sprintf(
-            "sendMsg failed: Client %v doesn't exist.",
-            id,
-        ))
+    cli, err := this.getSendCon(id)
+    if err != nil {
+        return err
+    }
 
-        this.errChan<- err
+    msg, err := this.buildMsg(cli, sig, obj)
+    if err != nil {
+        return err
+    }
 
+    err = this.checkPeer(cli, msg, 0)
+    if err != nil {
         return err
     }
 
+    this.sendFrames(cli, msg)
+
+    return nil
+}
+
+// buildMsg runs the given object through the send pipeline for the target
+// connection. The desired signature is checked against registered signatures
+// and the appropriate MsgProcessor retrieved. Next, the message is passed
+// through registered Compression and Encryption providers, if registered.
+// All outgoing messages flow through a registered CryptoProvider. Finally,
+// the message is checked against the protocol's max message size.
+func (this *Protocol) buildMsg(
+    cli Connection,
+    sig uint32,
+    obj interface{},
+) (*Msg, error) {
     this.objMutex.RLock()
     defer this.objMutex.RUnlock()
 
@@ -796,7 +1318,7 @@ func (this *Protocol) sendMsg(id uint32, sig uint16, obj interface{}) error {
 
         this.errChan<- err
 
-        return err
+        return nil, err
     }
 
     msg, err := proc.SerializeMsg(obj)
@@ -809,68 +1331,160 @@ func (this *Protocol) sendMsg(id uint32, sig uint16, obj interface{}) error {
         
         this.errChan<- err
 
-        return err
+        return nil, err
     }
 
-    if msg.Len() > MAX_NET_MSG_LEN {
-        this.perfs.Increment(PERF_PROTO_ERR_MAX_MSG_SIZE)
-        err := errors.New(fmt.Sprintf(
-            "Msg exceeds max size (%d / %d). Dropping msg",
-            msg.Len(),
-            MAX_NET_MSG_LEN,
-        ))
-
-        this.errChan<- err
-
-        return err
+    prioritized, ok := proc.(PriorityMsgProcessor)
+    if ok {
+        msg.SetPriority(prioritized.Priority())
     }
 
-    if GetMsgCompressedFlag(msg.GetHeader()) {
-        if this.compressor == nil {
-            this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
-            this.errChan<- errNoCompProvider
-            return errNoCompProvider
-        }
+    // compression providers may choose a codec based on the destination
+    msg.SetConnection(cli)
 
+    if this.compressor != nil {
         err := this.compressor.Compress(msg)
         if err != nil {
             this.perfs.Increment(PERF_PROTO_ERR_SEND_COMPRESS)
             this.errChan<- errors.New(fmt.Sprintf(
                 "Error compressing data: %v", err,
             ))
-            return err
+            return nil, err
         }
+    } else if GetMsgCompressedFlag(msg.GetHeader()) {
+        this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
+        this.errChan<- errNoCompProvider
+        return nil, errNoCompProvider
     }
 
-    if GetMsgEncryptedFlag(msg.GetHeader()) {
-        if this.crypto == nil {
-            this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
-            this.errChan<- errNoCryptoProvider
-            return errNoCryptoProvider
-        }
-
+    if this.crypto != nil {
         err := this.crypto.Encrypt(msg)
         if err != nil {
             this.perfs.Increment(PERF_PROTO_ERR_SEND_ENCRYPT)
             this.errChan<- errors.New(fmt.Sprintf(
                 "Error encrypting data: %v", err,
             ))
-            return err
+            return nil, err
         }
+    } else if GetMsgEncryptedFlag(msg.GetHeader()) {
+        this.perfs.Increment(PERF_PROTO_ERR_NO_PROVIDER)
+        this.errChan<- errNoCryptoProvider
+        return nil, errNoCryptoProvider
+    }
+
+    err = this.checkMsgLen(len(msg.GetPayload()))
+    if err != nil {
+        return nil, err
+    }
+
+    return msg, nil
+}
+
+// checkMsgLen returns an error, and reports it to the protocol's error
+// channel, if the given payload length exceeds the protocol's max message
+// size.
+func (this *Protocol) checkMsgLen(payloadLen int) error {
+    maxMsgLen := this.getMaxMsgLen()
+    if payloadLen <= maxMsgLen {
+        return nil
+    }
+
+    this.perfs.Increment(PERF_PROTO_ERR_MAX_MSG_SIZE)
+    err := errors.New(fmt.Sprintf(
+        "Msg exceeds max size (%d / %d). Dropping msg",
+        payloadLen,
+        maxMsgLen,
+    ))
+
+    this.errChan<- err
+
+    return err
+}
+
+// getSendCon returns the registered client with the given id, reporting an
+// error if no such client exists.
+func (this *Protocol) getSendCon(id uint32) (Connection, error) {
+    this.cliMutex.RLock()
+    cli := this.cliMap[id]
+    this.cliMutex.RUnlock()
+
+    if cli == nil {
+        this.perfs.Increment(PERF_PROTO_ERR_SEND_INVALID_CLI)
+        err := errors.New(fmt.Sprintf(
+            "sendMsg failed: Client %v doesn't exist.",
+            id,
+        ))
+
+        this.errChan<- err
+
+        return nil, err
     }
 
+    return cli, nil
+}
+
+// sendFrame sends a single frame to the given connection, recording it to
+// the protocol's capture, if any.
+func (this *Protocol) sendFrame(
+    cli        Connection,
+    frame      []byte,
+    timeoutSec int,
+    priority   int,
+) {
+    if this.capturing() {
+        this.captureFrame(cli, CAPTURE_OUT, frame)
+    }
+
+    sendPriority(cli, frame, timeoutSec, priority)
+}
+
+// sendSlab sends a single frame built in a pooled buffer to the given
+// connection, as sendFrame does. Connections which can't take ownership of
+// the buffer are sent the frame, and the buffer is left to the garbage
+// collector.
+func (this *Protocol) sendSlab(
+    cli        Connection,
+    frame      *slab,
+    timeoutSec int,
+    priority   int,
+) {
+    if this.capturing() {
+        this.captureFrame(cli, CAPTURE_OUT, frame.buf)
+    }
+
+    sender, ok := cli.(slabSender)
+    if ok {
+        sender.sendSlab(frame, timeoutSec, priority)
+        return
+    }
+
+    sendPriority(cli, frame.buf, timeoutSec, priority)
+}
+
+// sendFrames transmits a fully built message to the given connection in the
+// message's priority class, fragmenting it first if it is too large to be
+// sent in a single frame.
+func (this *Protocol) sendFrames(cli Connection, msg *Msg) {
     timeoutSec := math.IClamp(
         msg.TimeoutSec(), 
         MIN_TIMEOUT_SEC, 
         MAX_TIMEOUT_SEC,
     )
 
-    dataLen := int64(msg.Len())
+    dataLen  := int64(msg.Len())
+    priority := msg.Priority()
 
-    cli.Send(msg.GetBytes(), timeoutSec)
+    if msg.Len() > FRAG_THRESHOLD_B {
+        frames := this.fragmentMsg(msg)
+        for i := range frames {
+            this.sendFrame(cli, frames[i], timeoutSec, priority)
+        }
+    } else {
+        frame := getSlab(msg.Len())
+        msg.writeFrame(frame.buf)
+        this.sendSlab(cli, frame, timeoutSec, priority)
+    }
 
     this.perfs.Increment(PERF_PROTO_SEND_OK)
     this.perfs.Add(PERF_PROTO_SEND_BYTES, dataLen)
-
-    return nil
 }
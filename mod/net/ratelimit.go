@@ -0,0 +1,603 @@
+//  ---------------------------------------------------------------------------
+//
+//  ratelimit.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/config"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "fmt"
+    stdnet "net"
+    "sort"
+    "time"
+)
+
+// Rate limit config key names, relative to the section passed to
+// LoadRateLimits.
+const (
+    RATE_KEY_BAN_SEC               = "BanSec"
+    RATE_KEY_BAN_STRIKES           = "BanStrikes"
+    RATE_KEY_CON_BYTES_PER_SEC     = "ConBytesPerSec"
+    RATE_KEY_CON_MSGS_PER_SEC      = "ConMsgsPerSec"
+    RATE_KEY_IP_BYTES_PER_SEC      = "IpBytesPerSec"
+    RATE_KEY_IP_MSGS_PER_SEC       = "IpMsgsPerSec"
+    RATE_KEY_MAX_CONS_PER_IP       = "MaxConsPerIp"
+    RATE_KEY_MAX_CONS_PER_LISTENER = "MaxConsPerListener"
+)
+
+// Rate limit defaults. A limit of zero is unlimited. Bans are disabled until
+// BanStrikes is set.
+const (
+    DEFAULT_BAN_SEC           = 60
+    DEFAULT_BAN_STRIKES       = 0
+    DEFAULT_RATE_RELOAD_SEC   = 5
+    DEFAULT_STRIKE_WINDOW_SEC = 60
+)
+
+// Common error messages.
+var (
+    ErrConRefused  = errors.New("Connection limit reached")
+    ErrIpBanned    = errors.New("Remote address temporarily banned")
+    ErrRateLimited = errors.New("Rate limit exceeded")
+)
+
+
+// LoadRateLimits builds a RateLimits object from the values registered with
+// the config service under the given section (ex. Net.RateLimit.ConMsgsPerSec).
+// Missing keys keep their default values.
+func LoadRateLimits(section string) *RateLimits {
+    limits := NewRateLimits()
+
+    fields := map[string]*int {
+        RATE_KEY_BAN_SEC               : &limits.BanSec,
+        RATE_KEY_BAN_STRIKES           : &limits.BanStrikes,
+        RATE_KEY_CON_BYTES_PER_SEC     : &limits.ConBytesPerSec,
+        RATE_KEY_CON_MSGS_PER_SEC      : &limits.ConMsgsPerSec,
+        RATE_KEY_IP_BYTES_PER_SEC      : &limits.IpBytesPerSec,
+        RATE_KEY_IP_MSGS_PER_SEC       : &limits.IpMsgsPerSec,
+        RATE_KEY_MAX_CONS_PER_IP       : &limits.MaxConsPerIp,
+        RATE_KEY_MAX_CONS_PER_LISTENER : &limits.MaxConsPerListener,
+    }
+
+    for key, val := range fields {
+        *val, _ = config.GetIntVal(configKey(section, key), 0, *val)
+    }
+
+    return limits
+}
+
+// NewRateLimits returns a new RateLimits populated with default values.
+// Traffic is unlimited, and nobody is banned, by default.
+func NewRateLimits() *RateLimits {
+    newLimits := RateLimits {
+        BanSec     : DEFAULT_BAN_SEC,
+        BanStrikes : DEFAULT_BAN_STRIKES,
+    }
+
+    return &newLimits
+}
+
+// RateLimits bounds the traffic a protocol accepts from each connection and
+// from each remote IP address, along with the number of connections each
+// listener and each remote IP may hold open. A limit of zero is unlimited.
+//
+// Message and byte rates are enforced by token buckets which hold up to one
+// second's worth of traffic, so short bursts are absorbed. Messages beyond
+// the limit are dropped. Each dropped message, bad checksum, malformed
+// header or unknown signature counts as a strike against the remote IP, and
+// an IP which collects BanStrikes strikes within a minute is disconnected
+// and refused for BanSec seconds. Automatic bans are disabled while either
+// ban value is zero, which is the default. Peers without an IP address, such
+// as in-memory and unix connections, are limited and banned individually.
+type RateLimits struct {
+    BanSec             int
+    BanStrikes         int
+    ConBytesPerSec     int
+    ConMsgsPerSec      int
+    IpBytesPerSec      int
+    IpMsgsPerSec       int
+    MaxConsPerIp       int
+    MaxConsPerListener int
+}
+
+
+// RateLimitError is reported to the EventHandler's OnError method when a
+// connection is refused, banned, or has messages dropped for exceeding the
+// protocol's rate limits.
+type RateLimitError struct {
+    ConId uint32
+    Err   error
+    Ip    string
+}
+
+// Error returns a description of the violation.
+func (this *RateLimitError) Error() string {
+    return fmt.Sprintf("%v (con: %v, ip: %s)", this.Err, this.ConId, this.Ip)
+}
+
+
+// Ban disconnects all connections from the given remote IP address, and
+// refuses new ones for the given number of seconds.
+func (this *Protocol) Ban(ip string, durationSec int) {
+    this.rateMutex.Lock()
+    ids := this.banIp(ip, time.Duration(durationSec) * time.Second)
+    this.rateMutex.Unlock()
+
+    this.closeCons(ids)
+}
+
+// Bans returns the sorted list of currently banned remote IP addresses.
+func (this *Protocol) Bans() []string {
+    this.rateMutex.Lock()
+    defer this.rateMutex.Unlock()
+
+    now  := time.Now()
+    bans := make([]string, 0, len(this.rateBans))
+
+    for ip, expires := range this.rateBans {
+        if now.Before(expires) {
+            bans = append(bans, ip)
+        }
+    }
+
+    sort.Strings(bans)
+
+    return bans
+}
+
+// GetRateLimits returns a copy of the protocol's current rate limits.
+func (this *Protocol) GetRateLimits() *RateLimits {
+    this.rateMutex.Lock()
+    defer this.rateMutex.Unlock()
+
+    limits := this.rateLimits
+
+    return &limits
+}
+
+// SetRateLimits replaces the protocol's rate limits. New limits apply
+// immediately to existing connections, though connections already above a
+// lowered connection cap are left open. Passing nil restores the defaults.
+func (this *Protocol) SetRateLimits(limits *RateLimits) {
+    if limits == nil {
+        limits = NewRateLimits()
+    }
+
+    this.rateMutex.Lock()
+    defer this.rateMutex.Unlock()
+
+    this.rateLimits = *limits
+}
+
+// Unban lifts a ban on the given remote IP address, and clears its strikes.
+func (this *Protocol) Unban(ip string) {
+    this.rateMutex.Lock()
+    defer this.rateMutex.Unlock()
+
+    delete(this.rateBans, ip)
+
+    state := this.rateIps[ip]
+    if state != nil {
+        state.strikes = 0
+    }
+}
+
+// WatchRateLimits loads the protocol's rate limits from the given config
+// section, as LoadRateLimits does, and reloads them every
+// DEFAULT_RATE_RELOAD_SEC seconds so that limits may be changed without a
+// restart. Passing an empty section stops watching.
+func (this *Protocol) WatchRateLimits(section string) {
+    this.rateMutex.Lock()
+    this.rateSection = section
+    this.rateReload  = time.Now()
+    this.rateMutex.Unlock()
+
+    if section != "" {
+        this.SetRateLimits(LoadRateLimits(section))
+    }
+}
+
+// admitCon checks a newly accepted connection against the protocol's bans
+// and connection caps, reserving a slot for it under the given listener if
+// it is admitted. Refusals are counted, and reported to the protocol's
+// error channel unless the remote address is banned, so that a banned host
+// can't flood the EventHandler. All connections are refused quietly while
+// the protocol is draining.
+func (this *Protocol) admitCon(
+    id       uint32,
+    listener string,
+    addr     stdnet.Addr,
+) error {
+    var err error
+
+    if this.isDraining() {
+        log.Debug("Refused con %v from %v while draining", id, addr)
+        return ErrDraining
+    }
+
+    ip := rateKey(id, addr)
+
+    this.rateMutex.Lock()
+
+    limits := this.rateLimits
+    state  := this.getRateIp(ip)
+
+    switch {
+    case this.isBanned(ip, time.Now()):
+        this.rateMutex.Unlock()
+        this.perfs.Increment(PERF_PROTO_RATE_REFUSED)
+        log.Debug("Refused con %v from banned ip %s", id, ip)
+        return ErrIpBanned
+    case limits.MaxConsPerIp > 0 && state.cons >= limits.MaxConsPerIp:
+        err = ErrConRefused
+    case limits.MaxConsPerListener > 0 &&
+        this.rateListeners[listener] >= limits.MaxConsPerListener:
+        err = ErrConRefused
+    }
+
+    if err == nil {
+        state.cons++
+        this.rateListeners[listener]++
+        this.rateCons[id] = &rateCon {
+            admitted : true,
+            ip       : ip,
+            listener : listener,
+        }
+    }
+
+    this.rateMutex.Unlock()
+
+    if err != nil {
+        this.perfs.Increment(PERF_PROTO_RATE_REFUSED)
+        log.Debug("Refused con %v from ip %s (listener %s)", id, ip, listener)
+        this.errChan<- &RateLimitError {
+            ConId : id,
+            Err   : err,
+            Ip    : ip,
+        }
+    }
+
+    return err
+}
+
+// banIp bans the given remote IP address for the given duration, and
+// returns the ids of its connections, which the caller should close once it
+// has released the rate mutex. The caller must hold the rate mutex.
+func (this *Protocol) banIp(ip string, duration time.Duration) []uint32 {
+    this.rateBans[ip] = time.Now().Add(duration)
+    this.perfs.Increment(PERF_PROTO_RATE_BAN)
+
+    log.Info(
+        "Banned ip %s for %v (proto %s)",
+        ip,
+        duration,
+        this.name,
+    )
+
+    ids := make([]uint32, 0)
+    for id, state := range this.rateCons {
+        if state.ip == ip {
+            ids = append(ids, id)
+        }
+    }
+
+    return ids
+}
+
+// checkRate charges a received message against the rate limits of the
+// connection it arrived on and of its remote IP, returning false if the
+// message should be dropped. The first message dropped after a connection
+// goes over its limits is reported to the protocol's error channel.
+func (this *Protocol) checkRate(con Connection, dataLen int) bool {
+    now := time.Now()
+
+    this.rateMutex.Lock()
+
+    limits := this.rateLimits
+    state  := this.getRateCon(con)
+    ipObj  := this.getRateIp(state.ip)
+
+    if this.isBanned(state.ip, now) {
+        this.rateMutex.Unlock()
+        go con.Close()
+        return false
+    }
+
+    ok := state.msgs.take(1, limits.ConMsgsPerSec, now) &&
+        state.bytes.take(dataLen, limits.ConBytesPerSec, now) &&
+        ipObj.msgs.take(1, limits.IpMsgsPerSec, now) &&
+        ipObj.bytes.take(dataLen, limits.IpBytesPerSec, now)
+
+    if ok {
+        state.limited = false
+        this.rateMutex.Unlock()
+        return true
+    }
+
+    report       := !state.limited
+    state.limited = true
+    ids          := this.strike(state.ip, now)
+
+    this.rateMutex.Unlock()
+
+    this.perfs.Increment(PERF_PROTO_RATE_LIMITED)
+
+    if report {
+        this.errChan<- &RateLimitError {
+            ConId : con.Id(),
+            Err   : ErrRateLimited,
+            Ip    : state.ip,
+        }
+    }
+
+    this.closeCons(ids)
+
+    return false
+}
+
+// checkRateLimits runs from the protocol heartbeat. It reloads watched rate
+// limits when they're due, and forgets expired bans and idle addresses.
+func (this *Protocol) checkRateLimits() {
+    now := time.Now()
+
+    this.rateMutex.Lock()
+
+    section := this.rateSection
+    reload  := section != "" &&
+        now.Sub(this.rateReload) >= DEFAULT_RATE_RELOAD_SEC * time.Second
+    if reload {
+        this.rateReload = now
+    }
+
+    for ip, expires := range this.rateBans {
+        if !now.Before(expires) {
+            delete(this.rateBans, ip)
+        }
+    }
+
+    for ip, state := range this.rateIps {
+        if state.cons < 1 && now.Sub(state.lastSeen) > strikeWindow() {
+            delete(this.rateIps, ip)
+        }
+    }
+
+    this.rateMutex.Unlock()
+
+    if !reload {
+        return
+    }
+
+    limits := LoadRateLimits(section)
+    if *limits != *this.GetRateLimits() {
+        log.Info("Rate limits reloaded from %s (proto %s)", section, this.name)
+        this.SetRateLimits(limits)
+    }
+}
+
+// closeCons closes the registered connections with the given ids.
+func (this *Protocol) closeCons(ids []uint32) {
+    for i := range ids {
+        con := this.GetConnection(ids[i])
+        if con == nil {
+            continue
+        }
+
+        this.errChan<- &RateLimitError {
+            ConId : ids[i],
+            Err   : ErrIpBanned,
+            Ip    : rateKey(ids[i], con.RemoteAddr()),
+        }
+
+        go con.Close()
+    }
+}
+
+// getRateCon returns the rate limiting state of the given connection,
+// creating it if the connection wasn't admitted through a listener. The
+// caller must hold the rate mutex.
+func (this *Protocol) getRateCon(con Connection) *rateCon {
+    state := this.rateCons[con.Id()]
+    if state != nil {
+        return state
+    }
+
+    state = &rateCon {
+        ip : rateKey(con.Id(), con.RemoteAddr()),
+    }
+
+    this.rateCons[con.Id()] = state
+
+    return state
+}
+
+// getRateIp returns the rate limiting state of the given remote IP address,
+// creating it if it doesn't exist yet. The caller must hold the rate mutex.
+func (this *Protocol) getRateIp(ip string) *rateIp {
+    state := this.rateIps[ip]
+    if state == nil {
+        state            = new(rateIp)
+        this.rateIps[ip] = state
+    }
+
+    state.lastSeen = time.Now()
+
+    return state
+}
+
+// isBanned returns true if the given remote IP address is currently banned.
+// The caller must hold the rate mutex.
+func (this *Protocol) isBanned(ip string, now time.Time) bool {
+    expires, ok := this.rateBans[ip]
+
+    return ok && now.Before(expires)
+}
+
+// rateStrike counts a protocol violation, such as a bad checksum or an
+// unknown signature, against the remote IP of the given connection.
+func (this *Protocol) rateStrike(con Connection) {
+    if con == nil {
+        return
+    }
+
+    this.rateMutex.Lock()
+    state := this.getRateCon(con)
+    ids   := this.strike(state.ip, time.Now())
+    this.rateMutex.Unlock()
+
+    this.closeCons(ids)
+}
+
+// releaseCon frees the rate limiting state of a departing connection, along
+// with its connection slot if it was admitted through a listener.
+func (this *Protocol) releaseCon(id uint32) {
+    this.rateMutex.Lock()
+    defer this.rateMutex.Unlock()
+
+    state := this.rateCons[id]
+    if state == nil {
+        return
+    }
+
+    delete(this.rateCons, id)
+
+    if !state.admitted {
+        return
+    }
+
+    ipObj := this.rateIps[state.ip]
+    if ipObj != nil {
+        ipObj.cons--
+    }
+
+    this.rateListeners[state.listener]--
+    if this.rateListeners[state.listener] < 1 {
+        delete(this.rateListeners, state.listener)
+    }
+}
+
+// strike counts a violation against the given remote IP address, banning it
+// once it reaches the configured number of strikes. The ids of connections
+// to be closed are returned. The caller must hold the rate mutex.
+func (this *Protocol) strike(ip string, now time.Time) []uint32 {
+    limits := this.rateLimits
+    state  := this.getRateIp(ip)
+
+    if now.Sub(state.firstStrike) > strikeWindow() {
+        state.firstStrike = now
+        state.strikes     = 0
+    }
+
+    state.strikes++
+
+    if limits.BanSec < 1 || limits.BanStrikes < 1 ||
+        state.strikes < limits.BanStrikes ||
+        this.isBanned(ip, now) {
+        return nil
+    }
+
+    state.strikes = 0
+
+    return this.banIp(ip, time.Duration(limits.BanSec) * time.Second)
+}
+
+
+// rateCon holds the rate limiting state of a single connection.
+type rateCon struct {
+    admitted bool
+    bytes    tokenBucket
+    ip       string
+    limited  bool
+    listener string
+    msgs     tokenBucket
+}
+
+// rateIp holds the rate limiting state of a single remote IP address.
+type rateIp struct {
+    bytes       tokenBucket
+    cons        int
+    firstStrike time.Time
+    lastSeen    time.Time
+    msgs        tokenBucket
+    strikes     int
+}
+
+
+// tokenBucket is a token bucket rate limiter. The bucket holds up to one
+// second's worth of tokens, and starts out full.
+type tokenBucket struct {
+    last   time.Time
+    tokens float64
+}
+
+// take refills the bucket at the given rate, and then removes n tokens from
+// it, returning false if there aren't enough. A request larger than the
+// bucket is allowed once the bucket is full, leaving it in debt, so that a
+// single large message can't be blocked forever. A rate below 1 is
+// unlimited.
+func (this *tokenBucket) take(n, rate int, now time.Time) bool {
+    if rate < 1 {
+        return true
+    }
+
+    capacity := float64(rate)
+
+    if this.last.IsZero() {
+        this.tokens = capacity
+    } else {
+        this.tokens += now.Sub(this.last).Seconds() * capacity
+        if this.tokens > capacity {
+            this.tokens = capacity
+        }
+    }
+
+    this.last = now
+
+    need := float64(n)
+    if need > capacity {
+        need = capacity
+    }
+
+    if this.tokens < need {
+        return false
+    }
+
+    this.tokens -= float64(n)
+
+    return true
+}
+
+
+// rateKey returns the key under which the rate limits and bans of the
+// given connection are tracked. This is the host portion of its remote
+// address, or the connection id for peers without one, such as in-memory
+// and unix connections, so that they aren't all limited as a single host.
+func rateKey(id uint32, addr stdnet.Addr) string {
+    if addr != nil {
+        host, _, err := stdnet.SplitHostPort(addr.String())
+        if err == nil && host != "" {
+            return host
+        }
+    }
+
+    return fmt.Sprintf("con-%d", id)
+}
+
+// strikeWindow returns the period over which strikes are counted.
+func strikeWindow() time.Duration {
+    return DEFAULT_STRIKE_WINDOW_SEC * time.Second
+}
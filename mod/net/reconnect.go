@@ -0,0 +1,457 @@
+//  ---------------------------------------------------------------------------
+//
+//  reconnect.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/log"
+    "github.com/xaevman/goat/lib/lifecycle"
+)
+
+// Stdlib imports.
+import (
+    "crypto/tls"
+    "math/rand"
+    stdnet "net"
+    "sync"
+    "time"
+)
+
+// Reconnect policy defaults.
+const (
+    DEFAULT_RECONNECT_ATTEMPTS     = 10
+    DEFAULT_RECONNECT_DELAY_MS     = 250
+    DEFAULT_RECONNECT_JITTER       = 0.2
+    DEFAULT_RECONNECT_MAX_DELAY_MS = 30 * 1000
+    DEFAULT_RECONNECT_QUEUE_LEN    = 1000
+)
+
+
+// ReconnectHandler may optionally be implemented by an EventHandler which
+// wants to be notified as connections dialed with DialTcpReconnect are
+// re-established. OnReconnecting is called before each reconnect attempt,
+// and OnReconnected once the connection is restored. If all attempts fail,
+// OnDisconnect is called as usual.
+type ReconnectHandler interface {
+    OnReconnected(con Connection)
+    OnReconnecting(con Connection, attempt int)
+}
+
+// NewReconnectPolicy returns a new ReconnectPolicy populated with default
+// values.
+func NewReconnectPolicy() *ReconnectPolicy {
+    newPolicy := ReconnectPolicy {
+        DelayMs     : DEFAULT_RECONNECT_DELAY_MS,
+        Jitter      : DEFAULT_RECONNECT_JITTER,
+        MaxAttempts : DEFAULT_RECONNECT_ATTEMPTS,
+        MaxDelayMs  : DEFAULT_RECONNECT_MAX_DELAY_MS,
+        QueueLen    : DEFAULT_RECONNECT_QUEUE_LEN,
+    }
+
+    return &newPolicy
+}
+
+// ReconnectPolicy controls how a dialed connection is re-established after
+// it is lost. The delay before each attempt starts at DelayMs and doubles
+// with each failed attempt, up to MaxDelayMs, and is randomly varied by up
+// to +/- Jitter (a fraction of the delay). MaxAttempts limits the number of
+// consecutive failed attempts before giving up; zero retries forever.
+// Messages sent while disconnected are queued, up to QueueLen messages, and
+// replayed once the connection is restored. The oldest messages are dropped
+// when the queue is full.
+type ReconnectPolicy struct {
+    DelayMs     int
+    Jitter      float64
+    MaxAttempts int
+    MaxDelayMs  int
+    QueueLen    int
+}
+
+// delay returns the time to wait before the given reconnect attempt.
+func (this *ReconnectPolicy) delay(attempt int) time.Duration {
+    delayMs := float64(this.DelayMs)
+    for i := 1; i < attempt && delayMs < float64(this.MaxDelayMs); i++ {
+        delayMs *= 2
+    }
+
+    if delayMs > float64(this.MaxDelayMs) {
+        delayMs = float64(this.MaxDelayMs)
+    }
+
+    delayMs += delayMs * this.Jitter * (rand.Float64() * 2 - 1)
+    if delayMs < 0 {
+        delayMs = 0
+    }
+
+    return time.Duration(delayMs) * time.Millisecond
+}
+
+
+// DialTcpReconnect attempts to create a TCP connection to the given network
+// address, which is automatically re-established according to the supplied
+// policy when it is lost. If tlsConfig is non-nil, the connection is secured
+// with TLS. The connection keeps the same net id across reconnects, and
+// OnDisconnect is only called once it is closed or the policy gives up.
+func (this *Protocol) DialTcpReconnect(
+    addr      string,
+    tlsConfig *tls.Config,
+    policy    *ReconnectPolicy,
+) error {
+    _, err := this.dialTcpReconnect(addr, tlsConfig, policy)
+    return err
+}
+
+// dialTcpReconnect implements DialTcpReconnect, returning the new logical
+// connection.
+func (this *Protocol) dialTcpReconnect(
+    addr      string,
+    tlsConfig *tls.Config,
+    policy    *ReconnectPolicy,
+) (*reconnectCon, error) {
+    if policy == nil {
+        policy = NewReconnectPolicy()
+    }
+
+    rCon := reconnectCon {
+        addr      : addr,
+        discoChan : make(chan Connection, QUEUE_BUFFERS),
+        id        : NextNetID(),
+        policy    : *policy,
+        proto     : this,
+        syncObj   : lifecycle.New(),
+        tlsConfig : tlsConfig,
+    }
+
+    conn, err := rCon.dial()
+    if err != nil {
+        log.Error("%v", err)
+        return nil, err
+    }
+
+    rCon.cur = rCon.newTcpCon(conn)
+    rCon.cur.startHandlers()
+
+    go rCon.run()
+
+    this.onConnect(&rCon)
+
+    return &rCon, nil
+}
+
+
+// reconnectCon is a logical connection, which wraps the current underlying
+// tcpCon and replaces it when it is lost.
+type reconnectCon struct {
+    addr      string
+    cur       *tcpCon
+    discoChan chan Connection
+    id        uint32
+    mutex     sync.Mutex
+    policy    ReconnectPolicy
+    proto     *Protocol
+    queue     [][]byte
+    syncObj   *lifecycle.Lifecycle
+    tlsConfig *tls.Config
+}
+
+// Close stops reconnect attempts and closes the underlying connection.
+func (this *reconnectCon) Close() {
+    go this.syncObj.Shutdown()
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.cur != nil {
+        this.cur.Close()
+    }
+}
+
+// Id returns the logical net id of this connection, which remains stable
+// across reconnects.
+func (this *reconnectCon) Id() uint32 {
+    return this.id
+}
+
+// Key returns the key information assigned to this connection.
+func (this *reconnectCon) Key() string {
+    return ""
+}
+
+// LocalAddr returns the local endpoint address of the current underlying
+// connection, or nil while disconnected.
+func (this *reconnectCon) LocalAddr() stdnet.Addr {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.cur == nil {
+        return nil
+    }
+
+    return this.cur.LocalAddr()
+}
+
+// RemoteAddr returns the remote endpoint address of the current underlying
+// connection, or nil while disconnected.
+func (this *reconnectCon) RemoteAddr() stdnet.Addr {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.cur == nil {
+        return nil
+    }
+
+    return this.cur.RemoteAddr()
+}
+
+// Send passes data to the current underlying connection, or queues it for
+// replay if the connection is being re-established.
+func (this *reconnectCon) Send(data []byte, timeoutSec int) {
+    this.sendPriority(data, timeoutSec, PRIORITY_NORMAL)
+}
+
+// sendPriority passes data to the current underlying connection in the
+// given priority class, or queues it for replay if the connection is being
+// re-established. Replayed messages are all sent with normal priority.
+func (this *reconnectCon) sendPriority(data []byte, timeoutSec, priority int) {
+    this.mutex.Lock()
+    cur := this.cur
+    if cur == nil {
+        this.enqueue(data)
+    }
+    this.mutex.Unlock()
+
+    if cur != nil {
+        cur.sendPriority(data, timeoutSec, priority)
+    }
+}
+
+// sendSlab passes a frame built in a pooled buffer to the current underlying
+// connection, or queues it for replay, without its pooled buffer, if the
+// connection is being re-established.
+func (this *reconnectCon) sendSlab(s *slab, timeoutSec, priority int) {
+    this.mutex.Lock()
+    cur := this.cur
+    if cur == nil {
+        this.enqueue(s.buf)
+    }
+    this.mutex.Unlock()
+
+    if cur != nil {
+        cur.sendSlab(s, timeoutSec, priority)
+    }
+}
+
+// connected returns true if the underlying connection is established.
+func (this *reconnectCon) connected() bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.cur != nil
+}
+
+// dial opens a new socket to the remote address.
+func (this *reconnectCon) dial() (stdnet.Conn, error) {
+    if this.tlsConfig != nil {
+        return tls.Dial("tcp", this.addr, this.tlsConfig)
+    }
+
+    return stdnet.Dial("tcp", this.addr)
+}
+
+// flushed returns true once all data sent to the connection has been
+// written to the line. Data queued for replay while the connection is being
+// re-established is still outstanding.
+func (this *reconnectCon) flushed() bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.cur == nil {
+        return len(this.queue) < 1
+    }
+
+    return this.cur.flushed()
+}
+
+// enqueue adds data to the replay queue, dropping the oldest entry if the
+// queue is full. The caller must hold this.mutex.
+func (this *reconnectCon) enqueue(data []byte) {
+    if this.policy.QueueLen < 1 {
+        tcpPerfs.Increment(PERF_TCP_RECONNECT_QUEUE_DROP)
+        return
+    }
+
+    if len(this.queue) >= this.policy.QueueLen {
+        this.queue = this.queue[1:]
+        tcpPerfs.Increment(PERF_TCP_RECONNECT_QUEUE_DROP)
+    }
+
+    this.queue = append(this.queue, data)
+}
+
+// newTcpCon creates a new underlying tcpCon for the given socket, which
+// shares this connection's net id and reports its messages to the protocol
+// as coming from this logical connection.
+func (this *reconnectCon) newTcpCon(conn stdnet.Conn) *tcpCon {
+    tCon := tcpCon {
+        discoChan    : this.discoChan,
+        id           : this.id,
+        parent       : this,
+        rcvChan      : this.proto.rcvChan,
+        sendQ        : newSendQueue(this.proto.getSendQueueLimits()),
+        shutdownChan : this.proto.syncObj.QueryShutdown(),
+        socket       : conn,
+        syncObj      : lifecycle.New(),
+        timeoutChan  : this.proto.timeoutChan,
+    }
+
+    return &tCon
+}
+
+// reconnect attempts to re-establish the connection, according to the
+// reconnect policy. reconnect returns false if the policy gives up or the
+// connection is closed.
+func (this *reconnectCon) reconnect() bool {
+    handler, _ := this.proto.evtHandler.(ReconnectHandler)
+
+    for attempt := 1; ; attempt++ {
+        if this.policy.MaxAttempts > 0 && attempt > this.policy.MaxAttempts {
+            tcpPerfs.Increment(PERF_TCP_RECONNECT_FAIL)
+            log.Error(
+                "Giving up reconnecting to %s after %d attempts",
+                this.addr,
+                this.policy.MaxAttempts,
+            )
+            return false
+        }
+
+        if handler != nil {
+            this.proto.evtMutex.Lock()
+            handler.OnReconnecting(this, attempt)
+            this.proto.evtMutex.Unlock()
+        }
+
+        select {
+        case <-time.After(this.policy.delay(attempt)):
+        case <-this.syncObj.QueryShutdown():
+            return false
+        }
+
+        tcpPerfs.Increment(PERF_TCP_RECONNECT_ATTEMPT)
+
+        conn, err := this.dial()
+        if err != nil {
+            log.Debug("Reconnect attempt %d to %s failed (%v)", attempt, this.addr, err)
+            continue
+        }
+
+        tCon := this.newTcpCon(conn)
+        tCon.startHandlers()
+
+        // the remote peer sees a new connection, so renegotiate before
+        // replaying queued messages
+        this.proto.dropFragments(this.id)
+        this.proto.dropPeer(this.id)
+        this.proto.ctrlDisconnect(this)
+        this.proto.ctrlConnect(tCon)
+        this.proto.resubscribe(this.id, tCon)
+
+        this.mutex.Lock()
+        for i := range this.queue {
+            tCon.Send(this.queue[i], DEFAULT_MSG_TIMEOUT_SEC)
+        }
+        this.queue = nil
+        this.cur   = tCon
+        this.mutex.Unlock()
+
+        tcpPerfs.Increment(PERF_TCP_RECONNECT_OK)
+        log.Info("Reconnected to %s (attempt %d)", this.addr, attempt)
+
+        if handler != nil {
+            this.proto.evtMutex.Lock()
+            handler.OnReconnected(this)
+            this.proto.evtMutex.Unlock()
+        }
+
+        return true
+    }
+}
+
+// run runs in its own goroutine, watching for the loss of the underlying
+// connection and re-establishing it. Once the connection is closed, or the
+// reconnect policy gives up, the disconnect is reported to the protocol.
+func (this *reconnectCon) run() {
+    for this.syncObj.QueryRun() {
+        select {
+        case con := <-this.discoChan:
+            this.mutex.Lock()
+            lost := this.cur != nil && con == Connection(this.cur)
+            if lost {
+                this.requeue()
+                this.cur = nil
+            }
+            this.mutex.Unlock()
+
+            if !lost || !this.syncObj.QueryRun() {
+                continue
+            }
+
+            if !this.reconnect() {
+                this.stop()
+                return
+            }
+        case <-this.syncObj.QueryShutdown():
+        }
+    }
+
+    this.stop()
+}
+
+// requeue moves messages which were never written to the lost connection
+// to the front of the replay queue. The caller must hold this.mutex.
+func (this *reconnectCon) requeue() {
+    pending   := this.cur.sendQ.drain()
+    queue     := this.queue
+    this.queue = nil
+
+    for i := range pending {
+        this.enqueue(pending[i])
+    }
+
+    for i := range queue {
+        this.enqueue(queue[i])
+    }
+}
+
+// stop reports the disconnect to the protocol and completes shutdown. The
+// report is given up on if the protocol is shutting down, or doesn't accept
+// it in time.
+func (this *reconnectCon) stop() {
+    this.mutex.Lock()
+    if this.cur != nil {
+        this.cur.Close()
+    }
+    this.mutex.Unlock()
+
+    select {
+    case this.proto.discoChan<- this:
+    case <-time.After(QUEUE_TIMEOUT_SEC * time.Second):
+        log.Error("reconnectCon stop timeout")
+    case <-this.proto.syncObj.QueryShutdown():
+    }
+
+    if this.syncObj.QueryRun() {
+        go this.syncObj.Shutdown()
+    }
+
+    this.syncObj.ShutdownComplete()
+}
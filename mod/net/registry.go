@@ -0,0 +1,167 @@
+//  ---------------------------------------------------------------------------
+//
+//  registry.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "sort"
+)
+
+// Common error messages.
+var errSigConflict = errors.New("Signature conflicts with another protocol")
+
+
+// SetStrictSignatures controls what happens when a protocol registers a
+// signature which another live protocol has already registered with a
+// different type of MsgProcessor. By default, the conflict is logged, and
+// the registration proceeds. In strict mode, the registration is aborted.
+func SetStrictSignatures(strict bool) {
+    routeMutex.Lock()
+    defer routeMutex.Unlock()
+
+    strictSigs = strict
+}
+
+// SignatureConflicts returns each signature which is registered by more than
+// one live protocol with different types of MsgProcessor, mapped to the
+// sorted names of the protocols registering it.
+func SignatureConflicts() map[uint32][]string {
+    routeMutex.RLock()
+    defer routeMutex.RUnlock()
+
+    conflicts := make(map[uint32][]string)
+
+    for sig, owners := range sigMap {
+        types := make(map[reflect.Type]bool)
+        for _, proc := range owners {
+            types[reflect.TypeOf(proc)] = true
+        }
+
+        if len(types) < 2 {
+            continue
+        }
+
+        conflicts[sig] = ownerNames(owners)
+    }
+
+    return conflicts
+}
+
+// SignatureOwners returns the sorted names of the live protocols which have
+// the given signature registered.
+func SignatureOwners(sig uint32) []string {
+    routeMutex.RLock()
+    defer routeMutex.RUnlock()
+
+    return ownerNames(sigMap[sig])
+}
+
+// ownerNames returns the sorted names of the given signature owners.
+func ownerNames(owners map[*Protocol]MsgProcessor) []string {
+    names := make([]string, 0, len(owners))
+    for proto, _ := range owners {
+        names = append(names, proto.name)
+    }
+
+    sort.Strings(names)
+
+    return names
+}
+
+// registerProto adds the given protocol to the set of live protocols.
+func registerProto(proto *Protocol) {
+    routeMutex.Lock()
+    defer routeMutex.Unlock()
+
+    liveProtos[proto] = true
+}
+
+// registerSig records the given protocol as an owner of the processor's
+// signature, checking for conflicting registrations in other protocols.
+// Conflicts are logged, and returned as errors in strict mode.
+func registerSig(proto *Protocol, proc MsgProcessor) error {
+    routeMutex.Lock()
+    defer routeMutex.Unlock()
+
+    sig    := procSig(proc)
+    owners := sigMap[sig]
+
+    for other, otherProc := range owners {
+        if reflect.TypeOf(otherProc) == reflect.TypeOf(proc) {
+            continue
+        }
+
+        err := errors.New(fmt.Sprintf(
+            "%v (sig: %v, proto: %s %T, other: %s %T)",
+            errSigConflict,
+            sig,
+            proto.name,
+            proc,
+            other.name,
+            otherProc,
+        ))
+
+        if strictSigs {
+            return err
+        }
+
+        log.Error("%v", err)
+    }
+
+    if owners == nil {
+        owners      = make(map[*Protocol]MsgProcessor)
+        sigMap[sig] = owners
+    }
+
+    owners[proto] = proc
+
+    return nil
+}
+
+// unregisterProto removes the given protocol from the set of live protocols,
+// and from all signatures it owns.
+func unregisterProto(proto *Protocol) {
+    routeMutex.Lock()
+    defer routeMutex.Unlock()
+
+    delete(liveProtos, proto)
+
+    for sig, owners := range sigMap {
+        delete(owners, proto)
+
+        if len(owners) < 1 {
+            delete(sigMap, sig)
+        }
+    }
+}
+
+// unregisterSig removes the given protocol as an owner of a signature.
+func unregisterSig(proto *Protocol, sig uint32) {
+    routeMutex.Lock()
+    defer routeMutex.Unlock()
+
+    owners := sigMap[sig]
+    delete(owners, proto)
+
+    if len(owners) < 1 {
+        delete(sigMap, sig)
+    }
+}
@@ -0,0 +1,357 @@
+//  ---------------------------------------------------------------------------
+//
+//  reliable.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+)
+
+// Stdlib imports.
+import (
+    "sort"
+    "time"
+)
+
+// UDP delivery modes.
+const (
+    UDP_UNRELIABLE = iota
+    UDP_RELIABLE
+    UDP_RELIABLE_ORDERED
+)
+
+// Reliable delivery constants.
+//
+// Reliable envelope payload (SIG_RELIABLE)
+// [0-3]  sequence number (uint32)
+// [4]    ordered flag (byte)
+// [5-8]  sender's oldest unacknowledged sequence number (uint32)
+// [9-]   original framed message (header + payload)
+//
+// Ack payload (SIG_ACK)
+// [0-3]  acknowledged sequence number (uint32)
+//
+// Receivers only accept sequence numbers, and low water marks, within
+// RELIABLE_WINDOW of the next sequence number they expect. Datagrams beyond
+// the window are dropped without being acknowledged, and are retransmitted
+// by the sender once the window has moved on.
+const (
+    DEFAULT_RETRANSMIT_MS  = 200
+    DEFAULT_MAX_RETRIES    = 8
+    MAX_RETRANSMIT_MS      = 5000
+    RELIABLE_HEADER_LEN_B  = 9
+    RELIABLE_OVERHEAD_B    = HEADER_LEN_B + RELIABLE_HEADER_LEN_B
+    RELIABLE_WINDOW        = 1024
+    RETRANSMIT_INTERVAL_MS = 50
+)
+
+
+// unackedDatagram represents a reliable datagram which has been sent, but
+// not yet acknowledged by the remote endpoint.
+type unackedDatagram struct {
+    data     []byte
+    inner    []byte
+    nextSend time.Time
+    retries  int
+}
+
+// ackReliable removes the given sequence number from the endpoint's list of
+// unacknowledged datagrams.
+func (this *udpEndpoint) ackReliable(msg *Msg) {
+    cursor   := 0
+    seq, err := buffer.ReadUint32(msg.GetPayload(), &cursor)
+    if err != nil {
+        return
+    }
+
+    this.relMutex.Lock()
+    defer this.relMutex.Unlock()
+
+    delete(this.unacked, seq)
+}
+
+// lowWaterMark returns the oldest sequence number which has not yet been
+// acknowledged by the remote endpoint. relMutex must be held by the caller.
+func (this *udpEndpoint) lowWaterMark() uint32 {
+    low := this.sendSeq + 1
+    for k, _ := range this.unacked {
+        if k < low {
+            low = k
+        }
+    }
+
+    return low
+}
+
+// receiveReliable processes an incoming reliable envelope, acknowledging it
+// and returning any messages which are now ready for delivery, in the order
+// in which they should be delivered.
+func (this *udpEndpoint) receiveReliable(msg *Msg) []*Msg {
+    var err      error
+    var lowWater uint32
+    var ordered  byte
+    var seq      uint32
+
+    cursor := 0
+    data   := msg.GetPayload()
+
+    seq, err = buffer.ReadUint32(data, &cursor)
+    if err != nil {
+        return nil
+    }
+
+    ordered, err = buffer.ReadByte(data, &cursor)
+    if err != nil {
+        return nil
+    }
+
+    lowWater, err = buffer.ReadUint32(data, &cursor)
+    if err != nil {
+        return nil
+    }
+
+    inner := NewMsg()
+    inner.SetConnection(msg.Connection())
+
+    _, complete := inner.addData(data[cursor:])
+    if !complete {
+        inner.Release()
+        return nil
+    }
+
+    if !this.inWindow(seq, lowWater) {
+        udpPerfs.Increment(PERF_UDP_MSG_OUT_OF_WINDOW)
+        inner.Release()
+        return nil
+    }
+
+    this.sendAck(seq)
+
+    return this.deliverReliable(seq, ordered != 0, lowWater, inner)
+}
+
+// inWindow returns true if the given sequence number and low water mark both
+// fall within the endpoint's receive window. Sequence numbers below the
+// window are duplicates, which are still acknowledged.
+func (this *udpEndpoint) inWindow(seq, lowWater uint32) bool {
+    this.relMutex.Lock()
+    defer this.relMutex.Unlock()
+
+    return this.inWindowLocked(seq, lowWater)
+}
+
+// inWindowLocked is the implementation of inWindow. relMutex must be held by
+// the caller.
+func (this *udpEndpoint) inWindowLocked(seq, lowWater uint32) bool {
+    limit := uint64(this.rcvNext) + RELIABLE_WINDOW
+
+    return uint64(seq) < limit && uint64(lowWater) < limit
+}
+
+// deliverReliable updates the receive window with the supplied message,
+// suppressing duplicates, and returns the messages which are ready to be
+// handed up to the protocol layer. Messages outside of the receive window
+// are dropped.
+func (this *udpEndpoint) deliverReliable(
+    seq      uint32,
+    ordered  bool,
+    lowWater uint32,
+    msg      *Msg,
+) []*Msg {
+    this.relMutex.Lock()
+    defer this.relMutex.Unlock()
+
+    if !this.inWindowLocked(seq, lowWater) {
+        msg.Release()
+        return nil
+    }
+
+    _, seen := this.rcvWindow[seq]
+    if seq < this.rcvNext || seen {
+        udpPerfs.Increment(PERF_UDP_MSG_DUPLICATE)
+        msg.Release()
+        return nil
+    }
+
+    ready := make([]*Msg, 0)
+
+    if ordered {
+        this.rcvWindow[seq] = msg
+    } else {
+        this.rcvWindow[seq] = nil
+        ready = append(ready, msg)
+    }
+
+    // the sender has given up on anything below lowWater, skip ahead
+    if lowWater > seq {
+        lowWater = seq
+    }
+
+    if this.rcvNext < lowWater {
+        skipped := make([]uint32, 0)
+        for k, _ := range this.rcvWindow {
+            if k < lowWater {
+                skipped = append(skipped, k)
+            }
+        }
+
+        sort.Slice(skipped, func(i, j int) bool {
+            return skipped[i] < skipped[j]
+        })
+
+        for i := range skipped {
+            pending := this.rcvWindow[skipped[i]]
+            if pending != nil {
+                ready = append(ready, pending)
+            }
+
+            delete(this.rcvWindow, skipped[i])
+        }
+
+        this.rcvNext = lowWater
+    }
+
+    for {
+        pending, exist := this.rcvWindow[this.rcvNext]
+        if !exist {
+            break
+        }
+
+        if pending != nil {
+            ready = append(ready, pending)
+        }
+
+        delete(this.rcvWindow, this.rcvNext)
+        this.rcvNext++
+    }
+
+    return ready
+}
+
+// retransmit resends any unacknowledged datagrams whose retransmit timer
+// has expired, and raises TIMEOUT_RETRANSMIT events for those which have
+// exhausted their retries.
+func (this *udpEndpoint) retransmit() {
+    now    := time.Now()
+    failed := make([]*unackedDatagram, 0)
+    resend := make([][]byte, 0)
+
+    this.relMutex.Lock()
+    for k, v := range this.unacked {
+        if now.Before(v.nextSend) {
+            continue
+        }
+
+        if v.retries >= this.maxRetries {
+            delete(this.unacked, k)
+            failed = append(failed, v)
+            continue
+        }
+
+        v.retries++
+        v.nextSend = now.Add(this.retryDelay(v.retries))
+        resend     = append(resend, v.data)
+    }
+    this.relMutex.Unlock()
+
+    for i := range resend {
+        _, err := this.write(resend[i])
+        if err != nil {
+            continue
+        }
+
+        udpPerfs.Increment(PERF_UDP_MSG_RETRANSMIT)
+    }
+
+    for i := range failed {
+        sig         := uint16(0)
+        header, err := GetMsgHeader(failed[i].inner)
+        if err == nil {
+            sig = GetMsgSig(header)
+        }
+
+        this.notifyTimeout(TIMEOUT_RETRANSMIT, sig, this.id, failed[i].inner)
+    }
+}
+
+// retryDelay returns the exponential backoff delay to apply before the
+// given retransmit attempt.
+func (this *udpEndpoint) retryDelay(retries int) time.Duration {
+    delayMs := this.retryMs
+    for i := 0; i < retries && delayMs < MAX_RETRANSMIT_MS; i++ {
+        delayMs *= 2
+    }
+
+    if delayMs > MAX_RETRANSMIT_MS {
+        delayMs = MAX_RETRANSMIT_MS
+    }
+
+    return time.Duration(delayMs) * time.Millisecond
+}
+
+// sendAck transmits an acknowledgement for the given sequence number back
+// to the remote endpoint.
+func (this *udpEndpoint) sendAck(seq uint32) {
+    cursor  := 0
+    payload := make([]byte, buffer.LenUint32())
+    buffer.WriteUint32(seq, payload, &cursor)
+
+    ack := NewMsg()
+    ack.SetMsgType(SIG_ACK)
+    ack.SetPayload(payload)
+
+    _, err := this.write(ack.GetBytes())
+    if err != nil {
+        return
+    }
+
+    udpPerfs.Increment(PERF_UDP_ACK_SEND)
+}
+
+// wrapReliable assigns the next sequence number to the supplied framed
+// message, wraps it in a reliable envelope, and tracks it for retransmission
+// until acknowledged.
+func (this *udpEndpoint) wrapReliable(data []byte) []byte {
+    this.relMutex.Lock()
+    defer this.relMutex.Unlock()
+
+    this.sendSeq++
+
+    ordered := byte(0)
+    if this.mode == UDP_RELIABLE_ORDERED {
+        ordered = 1
+    }
+
+    cursor  := 0
+    payload := make([]byte, RELIABLE_HEADER_LEN_B + len(data))
+
+    buffer.WriteUint32(this.sendSeq, payload, &cursor)
+    buffer.WriteByte(ordered, payload, &cursor)
+    buffer.WriteUint32(this.lowWaterMark(), payload, &cursor)
+    copy(payload[cursor:], data)
+
+    envelope := NewMsg()
+    envelope.SetMsgType(SIG_RELIABLE)
+    envelope.SetPayload(payload)
+
+    wrapped := envelope.GetBytes()
+    envelope.Release()
+
+    this.unacked[this.sendSeq] = &unackedDatagram {
+        data     : wrapped,
+        inner    : data,
+        nextSend : time.Now().Add(this.retryDelay(0)),
+    }
+
+    return wrapped
+}
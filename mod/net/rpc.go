@@ -0,0 +1,403 @@
+//  ---------------------------------------------------------------------------
+//
+//  rpc.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// Rpc status codes. Each SIG_RPC_REQ and SIG_RPC_RESP payload begins with
+// an envelope, which wraps a message of a registered signature. Responses
+// are matched to their requests by the correlation id carried in the
+// extended header of the envelope.
+//
+// [0]   status
+// [1-4] wrapped message signature and flags
+// [5-]  wrapped message payload
+//
+// Requests are always sent with RPC_OK. For RPC_ERROR responses, the
+// wrapped payload is the error text returned by the remote handler.
+const (
+    RPC_OK = iota
+    RPC_ERROR
+    RPC_NO_HANDLER
+)
+
+// Rpc envelope constants.
+const (
+    MAX_RPC_ID       = 0xFFFFFFFF
+    RPC_HEADER_LEN_B = 5
+)
+
+// Common error messages.
+var (
+    ErrNoRpcHandler = errors.New("No rpc handler registered for signature")
+    ErrRpcClosed    = errors.New("Connection closed before rpc response")
+    errRpcMalformed = errors.New("Malformed rpc envelope")
+)
+
+
+// RpcHandler is a function which serves rpc requests of a given signature,
+// registered with Protocol.HandleRpc. The returned object is sent back to
+// the caller using the same signature. Errors are returned to the caller as
+// the result of its Call.
+type RpcHandler func(req interface{}, fromId uint32, access byte) (interface{}, error)
+
+
+// rpcCall tracks an outstanding rpc request.
+type rpcCall struct {
+    conId  uint32
+    result chan rpcResult
+}
+
+// rpcResult holds the outcome of an rpc request.
+type rpcResult struct {
+    obj interface{}
+    err error
+}
+
+
+// Call sends req to the connection with the given id as an rpc request,
+// and waits up to timeout for the response. The request and response are
+// both serialized by the MsgProcessor registered for sig, and the remote
+// peer must have registered an RpcHandler for sig with HandleRpc.
+// context.DeadlineExceeded is returned if no response arrives in time.
+func (this *Protocol) Call(
+    id      uint32,
+    sig     uint16,
+    req     interface{},
+    timeout time.Duration,
+) (interface{}, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    return this.CallContext(ctx, id, sig, req)
+}
+
+// CallContext works like Call, but waits for the response until the given
+// context is done, returning the context's error if it is cancelled or
+// expires first.
+func (this *Protocol) CallContext(
+    ctx context.Context,
+    id  uint32,
+    sig uint16,
+    req interface{},
+) (interface{}, error) {
+    this.perfs.Increment(PERF_PROTO_RPC_CALL)
+
+    cli, err := this.getSendCon(id)
+    if err != nil {
+        return nil, err
+    }
+
+    msg, err := this.buildMsg(cli, uint32(sig), req)
+    if err != nil {
+        return nil, err
+    }
+
+    err = this.checkPeer(cli, msg, RPC_HEADER_LEN_B)
+    if err != nil {
+        return nil, err
+    }
+
+    call := rpcCall {
+        conId  : id,
+        result : make(chan rpcResult, 1),
+    }
+
+    corrId := atomic.AddUint32(&this.rpcId, 1)
+
+    this.rpcMutex.Lock()
+    this.rpcPending[corrId] = &call
+    this.rpcMutex.Unlock()
+
+    err = this.sendRpc(cli, SIG_RPC_REQ, corrId, RPC_OK, msg)
+    if err != nil {
+        this.dropRpc(corrId)
+        return nil, err
+    }
+
+    select {
+    case result := <-call.result:
+        if result.err != nil {
+            this.perfs.Increment(PERF_PROTO_RPC_ERROR)
+        }
+        return result.obj, result.err
+    case <-ctx.Done():
+        this.dropRpc(corrId)
+
+        if ctx.Err() == context.DeadlineExceeded {
+            this.perfs.Increment(PERF_PROTO_RPC_TIMEOUT)
+        }
+
+        return nil, ctx.Err()
+    }
+}
+
+// HandleRpc registers a function to serve rpc requests of the given
+// signature. The signature's MsgProcessor must also be registered with
+// AddSignature. Passing a nil handler removes the existing registration.
+// Handlers are run in their own goroutine, so that slow requests don't
+// block the protocol's event loop.
+func (this *Protocol) HandleRpc(sig uint16, handler RpcHandler) {
+    this.rpcMutex.Lock()
+    defer this.rpcMutex.Unlock()
+
+    if handler == nil {
+        delete(this.rpcHandlers, sig)
+        return
+    }
+
+    if this.rpcHandlers[sig] != nil {
+        log.Error(
+            "RpcHandler already registered (sig: %v), aborting registration",
+            sig,
+        )
+        return
+    }
+
+    this.rpcHandlers[sig] = handler
+}
+
+// dropRpc removes an outstanding rpc request, so that late responses are
+// ignored.
+func (this *Protocol) dropRpc(corrId uint32) {
+    this.rpcMutex.Lock()
+    defer this.rpcMutex.Unlock()
+
+    delete(this.rpcPending, corrId)
+}
+
+// failRpcs fails all outstanding rpc requests sent to the given connection.
+func (this *Protocol) failRpcs(conId uint32) {
+    this.rpcMutex.Lock()
+    defer this.rpcMutex.Unlock()
+
+    for k, v := range this.rpcPending {
+        if v.conId != conId {
+            continue
+        }
+
+        delete(this.rpcPending, k)
+        v.result<- rpcResult { err : ErrRpcClosed }
+    }
+}
+
+// rcvRpc unwraps a received rpc envelope and routes it as either a request
+// or the response to one of our outstanding requests. Envelopes without a
+// correlation id are malformed.
+func (this *Protocol) rcvRpc(msg *Msg, access byte) {
+    if msg.extFields & EXT_FIELD_CORRELATION == 0 ||
+        msg.CorrelationId() > MAX_RPC_ID {
+        this.rpcMalformed(msg)
+        return
+    }
+
+    corrId      := uint32(msg.CorrelationId())
+    cursor      := 0
+    data        := msg.GetPayload()
+    status, err := buffer.ReadByte(data, &cursor)
+    if err != nil {
+        this.rpcMalformed(msg)
+        return
+    }
+
+    sigFlags, err := buffer.ReadUint32(data, &cursor)
+    if err != nil {
+        this.rpcMalformed(msg)
+        return
+    }
+
+    inner := NewMsg()
+    inner.SetConnection(msg.Connection())
+
+    err = inner.openEnvelope(sigFlags, data[cursor:])
+    if err != nil || isReservedSig(inner.ExtMsgType()) {
+        this.rpcMalformed(msg)
+        return
+    }
+
+    if msg.MsgType() == SIG_RPC_REQ {
+        this.rcvRpcReq(inner, corrId, access)
+    } else {
+        this.rcvRpcResp(inner, corrId, status, access)
+    }
+}
+
+// rcvRpcReq decodes an rpc request and passes it to the registered
+// RpcHandler in a new goroutine, sending the handler's result back to the
+// caller.
+func (this *Protocol) rcvRpcReq(msg *Msg, corrId uint32, access byte) {
+    con := msg.Connection()
+    sig := msg.MsgType()
+
+    this.rpcMutex.Lock()
+    handler := this.rpcHandlers[sig]
+    this.rpcMutex.Unlock()
+
+    if handler == nil {
+        this.errChan<- errors.New(fmt.Sprintf(
+            "No rpc handler registered (sig %v, con %v). Rejecting request",
+            sig,
+            con.Id(),
+        ))
+        this.sendRpcStatus(con, corrId, sig, RPC_NO_HANDLER, nil)
+        return
+    }
+
+    req, err := this.decodeMsg(msg, access)
+    if err != nil {
+        this.sendRpcStatus(con, corrId, sig, RPC_ERROR, []byte(err.Error()))
+        return
+    }
+
+    this.perfs.Increment(PERF_PROTO_RPC_SERVE)
+
+    this.beginHandler()
+    go func() {
+        defer this.endHandler()
+
+        resp, err := handler(req, msg.From(), access)
+        if err != nil {
+            this.sendRpcStatus(con, corrId, sig, RPC_ERROR, []byte(err.Error()))
+            return
+        }
+
+        respMsg, err := this.buildMsg(con, uint32(sig), resp)
+        if err == nil {
+            err = this.checkPeer(con, respMsg, RPC_HEADER_LEN_B)
+        }
+
+        if err != nil {
+            this.sendRpcStatus(con, corrId, sig, RPC_ERROR, []byte(err.Error()))
+            return
+        }
+
+        this.sendRpc(con, SIG_RPC_RESP, corrId, RPC_OK, respMsg)
+    }()
+}
+
+// rcvRpcResp decodes an rpc response and delivers it to the waiting caller.
+// Responses to unknown or expired requests, or from a connection other than
+// the one the request was sent to, are dropped.
+func (this *Protocol) rcvRpcResp(
+    msg    *Msg,
+    corrId uint32,
+    status byte,
+    access byte,
+) {
+    this.rpcMutex.Lock()
+    call := this.rpcPending[corrId]
+    if call != nil && call.conId == msg.From() {
+        delete(this.rpcPending, corrId)
+    } else {
+        call = nil
+    }
+    this.rpcMutex.Unlock()
+
+    if call == nil {
+        log.Debug(
+            "Rpc response for unknown request %v (con %v, proto %s). Dropping msg",
+            corrId,
+            msg.From(),
+            this.name,
+        )
+        return
+    }
+
+    var result rpcResult
+
+    switch status {
+    case RPC_OK:
+        result.obj, result.err = this.decodeMsg(msg, access)
+    case RPC_NO_HANDLER:
+        result.err = ErrNoRpcHandler
+    default:
+        result.err = errors.New(string(msg.GetPayload()))
+    }
+
+    call.result<- result
+}
+
+// rpcMalformed reports a malformed rpc envelope.
+func (this *Protocol) rpcMalformed(msg *Msg) {
+    this.perfs.Increment(PERF_PROTO_ERR_DESERIALIZE)
+    this.errChan<- errors.New(fmt.Sprintf(
+        "%v (proto: %s, con: %v). Dropping msg",
+        errRpcMalformed,
+        this.name,
+        msg.From(),
+    ))
+}
+
+// sendRpc wraps a fully built message in an rpc envelope, tagged with the
+// given correlation id, and sends it to the given connection.
+func (this *Protocol) sendRpc(
+    cli    Connection,
+    sig    uint16,
+    corrId uint32,
+    status byte,
+    msg    *Msg,
+) error {
+    sigFlags, data := msg.envelope()
+
+    cursor  := 0
+    payload := make([]byte, RPC_HEADER_LEN_B + len(data))
+
+    buffer.WriteByte(status, payload, &cursor)
+    buffer.WriteUint32(sigFlags, payload, &cursor)
+    copy(payload[cursor:], data)
+
+    err := this.checkMsgLen(len(payload))
+    if err != nil {
+        return err
+    }
+
+    envelope := NewMsg()
+    envelope.SetMsgType(sig)
+    envelope.SetPayload(payload)
+    envelope.SetCorrelationId(uint64(corrId))
+    envelope.SetPriority(msg.Priority())
+    envelope.SetTimeout(msg.TimeoutSec())
+
+    this.sendFrames(cli, envelope)
+
+    return nil
+}
+
+// sendRpcStatus sends an rpc response which carries a status code, and
+// optionally error text, rather than a message.
+func (this *Protocol) sendRpcStatus(
+    cli    Connection,
+    corrId uint32,
+    sig    uint16,
+    status byte,
+    data   []byte,
+) {
+    msg := NewMsg()
+    msg.SetMsgType(sig)
+    msg.SetPayload(data)
+
+    this.sendRpc(cli, SIG_RPC_RESP, corrId, status, msg)
+}
@@ -0,0 +1,431 @@
+//  ---------------------------------------------------------------------------
+//
+//  sendqueue.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/lifecycle"
+    "github.com/xaevman/goat/lib/perf"
+)
+
+// Stdlib imports.
+import (
+    "sync"
+    "time"
+)
+
+// Send queue overflow policies, which decide what happens when a message is
+// sent to a connection whose outbound queue is full.
+//
+// SEND_QUEUE_BLOCK waits for room, up to the send timeout, and then reports
+// a TIMEOUT_SEND event. SEND_QUEUE_DROP_OLDEST discards queued messages to
+// make room. SEND_QUEUE_DROP_NEWEST discards the message being sent.
+// SEND_QUEUE_DISCONNECT closes the connection.
+const (
+    SEND_QUEUE_BLOCK = iota
+    SEND_QUEUE_DROP_OLDEST
+    SEND_QUEUE_DROP_NEWEST
+    SEND_QUEUE_DISCONNECT
+)
+
+// Message priority classes. Each connection queues the classes separately,
+// and its writer interleaves between them by weight, so that bulk traffic
+// doesn't hold up latency sensitive messages. Messages within a class are
+// always written in order, but messages in different classes may be
+// reordered.
+const (
+    PRIORITY_HIGH = iota
+    PRIORITY_NORMAL
+    PRIORITY_LOW
+    PRIORITY_COUNT
+)
+
+// Number of messages written from each priority class per turn.
+var priorityWeights = [PRIORITY_COUNT]int { 8, 4, 1 }
+
+// Send queue defaults. A limit of zero is unlimited.
+const (
+    DEFAULT_SEND_QUEUE_BYTES = 0
+    DEFAULT_SEND_QUEUE_MSGS  = QUEUE_BUFFERS
+)
+
+// Results of queueing a message.
+const (
+    pushOk = iota
+    pushClosed
+    pushDropped
+    pushOverflow
+    pushTimeout
+)
+
+// Perf counters.
+const (
+    PERF_SENDQ_DISCONNECT = iota
+    PERF_SENDQ_DROP_NEWEST
+    PERF_SENDQ_DROP_OLDEST
+    PERF_SENDQ_HIGH_WATER_BYTES
+    PERF_SENDQ_HIGH_WATER_MSGS
+    PERF_SENDQ_SENT_HIGH
+    PERF_SENDQ_SENT_NORMAL
+    PERF_SENDQ_SENT_LOW
+    PERF_SENDQ_COUNT
+)
+
+// Perf counter friendly names.
+var sendqPerfNames = []string {
+    "Disconnect",
+    "DropNewest",
+    "DropOldest",
+    "HighWaterBytes",
+    "HighWaterMsgs",
+    "SentHigh",
+    "SentNormal",
+    "SentLow",
+}
+
+// Global send queue perf object, shared by all connections.
+var sendqPerfs = perf.NewCounterSet(
+    "Module.Net.SendQueue",
+    PERF_SENDQ_COUNT,
+    sendqPerfNames,
+)
+
+// Synchronizes updates to the high-water mark counters.
+var sendqHighMutex sync.Mutex
+
+
+// NewSendQueueLimits returns a new SendQueueLimits populated with default
+// values.
+func NewSendQueueLimits() *SendQueueLimits {
+    newLimits := SendQueueLimits {
+        MaxBytes : DEFAULT_SEND_QUEUE_BYTES,
+        MaxMsgs  : DEFAULT_SEND_QUEUE_MSGS,
+        Policy   : SEND_QUEUE_BLOCK,
+    }
+
+    return &newLimits
+}
+
+// prioritySender is implemented by connections which queue messages by
+// priority class.
+type prioritySender interface {
+    sendPriority(data []byte, timeoutSec, priority int)
+}
+
+// SendQueueLimits bounds the outbound queue of each connection, in bytes
+// and in messages, and selects the policy applied once either limit is
+// reached. A limit of zero is unlimited. A single message larger than
+// MaxBytes is still accepted by an empty queue.
+type SendQueueLimits struct {
+    MaxBytes int
+    MaxMsgs  int
+    Policy   int
+}
+
+
+// SetSendQueueLimits sets the outbound queue limits and overflow policy of
+// connections created after the call. Passing nil restores the defaults.
+func (this *Protocol) SetSendQueueLimits(limits *SendQueueLimits) {
+    if limits == nil {
+        limits = NewSendQueueLimits()
+    }
+
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.sendLimits = *limits
+}
+
+// getSendQueueLimits returns the limits for newly created connections.
+func (this *Protocol) getSendQueueLimits() SendQueueLimits {
+    this.objMutex.RLock()
+    defer this.objMutex.RUnlock()
+
+    return this.sendLimits
+}
+
+
+// newSendQueue returns a new, empty sendQueue bounded by the given limits.
+func newSendQueue(limits SendQueueLimits) *sendQueue {
+    newQueue := sendQueue {
+        credit : priorityWeights[PRIORITY_HIGH],
+        limits : limits,
+        ready  : make(chan struct{}, 1),
+        room   : make(chan struct{}, 1),
+    }
+
+    return &newQueue
+}
+
+// sendQueue is the bounded outbound queue between a connection's Send
+// method and its write goroutine. Messages are queued separately for each
+// priority class, and the limits apply to the total across all classes.
+type sendQueue struct {
+    bytes   int
+    class   int
+    credit  int
+    data    [PRIORITY_COUNT][]queuedFrame
+    limits  SendQueueLimits
+    msgs    int
+    mutex   sync.Mutex
+    ready   chan struct{}
+    room    chan struct{}
+    writing bool
+}
+
+// drain removes and returns all queued messages, highest priority first.
+// Pooled buffers are handed over with the messages, and are not returned to
+// their pools.
+func (this *sendQueue) drain() [][]byte {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    data := make([][]byte, 0, this.msgs)
+    for i := range this.data {
+        for j := range this.data[i] {
+            data = append(data, this.data[i][j].data)
+        }
+
+        this.data[i] = nil
+    }
+
+    this.bytes = 0
+    this.msgs  = 0
+
+    signal(this.room)
+
+    return data
+}
+
+// dropOldest discards the oldest message of the lowest priority class which
+// has any queued. The caller must hold this.mutex.
+func (this *sendQueue) dropOldest() {
+    for i := PRIORITY_COUNT - 1; i >= 0; i-- {
+        if len(this.data[i]) < 1 {
+            continue
+        }
+
+        this.bytes  -= len(this.data[i][0].data)
+        this.data[i][0].release()
+        this.data[i] = this.data[i][1:]
+        this.msgs--
+
+        sendqPerfs.Increment(PERF_SENDQ_DROP_OLDEST)
+
+        return
+    }
+}
+
+// flushed returns true if the queue is empty, and the writer has come back
+// for more after writing the last message it popped.
+func (this *sendQueue) flushed() bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    return this.msgs < 1 && !this.writing
+}
+
+// fits returns true if a message of the given length can be queued within
+// the queue's limits. The caller must hold this.mutex.
+func (this *sendQueue) fits(dataLen int) bool {
+    if this.msgs < 1 {
+        return true
+    }
+
+    if this.limits.MaxMsgs > 0 && this.msgs + 1 > this.limits.MaxMsgs {
+        return false
+    }
+
+    if this.limits.MaxBytes > 0 && this.bytes + dataLen > this.limits.MaxBytes {
+        return false
+    }
+
+    return true
+}
+
+// pop removes and returns the next message to be written, or nil if the
+// queue is empty. Any pooled buffer holding the message is not returned to
+// its pool.
+func (this *sendQueue) pop() []byte {
+    return this.popFrame().data
+}
+
+// popFrame removes and returns the next frame to be written, or an empty
+// frame if the queue is empty. The frame counts as being written until the
+// next call to popFrame. Classes are served in weighted round robin order,
+// taking up to priorityWeights[class] messages from each class in turn, so
+// that lower priority classes are slowed, but never starved.
+func (this *sendQueue) popFrame() queuedFrame {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.msgs < 1 {
+        this.writing = false
+        return queuedFrame{}
+    }
+
+    for this.credit < 1 || len(this.data[this.class]) < 1 {
+        this.class  = (this.class + 1) % PRIORITY_COUNT
+        this.credit = priorityWeights[this.class]
+    }
+
+    frame               := this.data[this.class][0]
+    this.data[this.class] = this.data[this.class][1:]
+    this.bytes          -= len(frame.data)
+    this.writing         = true
+    this.credit--
+    this.msgs--
+
+    sendqPerfs.Increment(PERF_SENDQ_SENT_HIGH + this.class)
+
+    signal(this.room)
+
+    return frame
+}
+
+// push queues a message in the given priority class, applying the queue's
+// overflow policy if it is full. Under SEND_QUEUE_BLOCK, push waits up to
+// timeoutSec seconds for room, or until the owning connection shuts down.
+func (this *sendQueue) push(
+    data       []byte,
+    priority   int,
+    timeoutSec int,
+    syncObj    *lifecycle.Lifecycle,
+) int {
+    return this.pushFrame(
+        queuedFrame { data : data },
+        priority,
+        timeoutSec,
+        syncObj,
+    )
+}
+
+// pushFrame queues a frame as push does. The frame's pooled buffer, if any,
+// belongs to the queue once pushFrame returns pushOk, and stays with the
+// caller otherwise.
+func (this *sendQueue) pushFrame(
+    frame      queuedFrame,
+    priority   int,
+    timeoutSec int,
+    syncObj    *lifecycle.Lifecycle,
+) int {
+    var deadline <-chan time.Time
+
+    data := frame.data
+
+    if priority < 0 || priority >= PRIORITY_COUNT {
+        priority = PRIORITY_NORMAL
+    }
+
+    for {
+        this.mutex.Lock()
+
+        if !this.fits(len(data)) {
+            switch this.limits.Policy {
+            case SEND_QUEUE_DROP_NEWEST:
+                this.mutex.Unlock()
+                sendqPerfs.Increment(PERF_SENDQ_DROP_NEWEST)
+                return pushDropped
+            case SEND_QUEUE_DISCONNECT:
+                this.mutex.Unlock()
+                sendqPerfs.Increment(PERF_SENDQ_DISCONNECT)
+                return pushOverflow
+            case SEND_QUEUE_DROP_OLDEST:
+                for !this.fits(len(data)) {
+                    this.dropOldest()
+                }
+            default:
+                this.mutex.Unlock()
+
+                if deadline == nil {
+                    deadline = time.After(time.Duration(timeoutSec) * time.Second)
+                }
+
+                select {
+                case <-this.room:
+                    continue
+                case <-deadline:
+                    return pushTimeout
+                case <-syncObj.QueryShutdown():
+                    return pushClosed
+                }
+            }
+        }
+
+        this.data[priority] = append(this.data[priority], frame)
+        this.bytes         += len(data)
+        this.msgs++
+
+        msgs, bytes := this.msgs, this.bytes
+        this.mutex.Unlock()
+
+        signal(this.ready)
+        updateHighWater(msgs, bytes)
+
+        return pushOk
+    }
+}
+
+// queuedFrame is a frame waiting in a sendQueue, along with the pooled
+// buffer holding it, if any.
+type queuedFrame struct {
+    data []byte
+    slab *slab
+}
+
+// release returns the frame's buffer to its pool, once it has been written
+// or discarded.
+func (this *queuedFrame) release() {
+    if this.slab != nil {
+        putSlab(this.slab)
+        this.slab = nil
+    }
+}
+
+
+// sendPriority sends data to the given connection in the given priority
+// class, if the connection supports priorities, or with a plain Send
+// otherwise.
+func sendPriority(con Connection, data []byte, timeoutSec, priority int) {
+    sender, ok := con.(prioritySender)
+    if ok {
+        sender.sendPriority(data, timeoutSec, priority)
+        return
+    }
+
+    con.Send(data, timeoutSec)
+}
+
+// signal wakes a goroutine waiting on the given channel, without blocking
+// if it has already been signaled.
+func signal(c chan struct{}) {
+    select {
+    case c<- struct{}{}:
+    default:
+    }
+}
+
+// updateHighWater raises the send queue high-water mark counters if the
+// given queue depth exceeds them.
+func updateHighWater(msgs, bytes int) {
+    sendqHighMutex.Lock()
+    defer sendqHighMutex.Unlock()
+
+    if int64(msgs) > sendqPerfs.Value(PERF_SENDQ_HIGH_WATER_MSGS) {
+        sendqPerfs.Set(PERF_SENDQ_HIGH_WATER_MSGS, int64(msgs))
+    }
+
+    if int64(bytes) > sendqPerfs.Value(PERF_SENDQ_HIGH_WATER_BYTES) {
+        sendqPerfs.Set(PERF_SENDQ_HIGH_WATER_BYTES, int64(bytes))
+    }
+}
@@ -21,6 +21,9 @@ import (
 
 // Stdlib imports.
 import (
+    "crypto/tls"
+    "errors"
+    "fmt"
     stdnet "net"
     "time"
 )
@@ -34,6 +37,10 @@ const (
     PERF_TCP_MSG_SEND
     PERF_TCP_MSG_SEND_BYTES
     PERF_TCP_MSG_TIMEOUT
+    PERF_TCP_RECONNECT_ATTEMPT
+    PERF_TCP_RECONNECT_FAIL
+    PERF_TCP_RECONNECT_OK
+    PERF_TCP_RECONNECT_QUEUE_DROP
     PERF_TCP_SERVERS
     PERF_TCP_COUNT
 )
@@ -47,6 +54,10 @@ var tcpPerfNames = []string {
     "MsgSent",
     "MsgSentBytes",
     "MsgTimeout",
+    "ReconnectAttempt",
+    "ReconnectFail",
+    "ReconnectSuccess",
+    "ReconnectQueueDrop",
     "Servers",
 }
 
@@ -62,9 +73,33 @@ const TCP_BUFFER_SIZE_B = 256
 
 
 // newtcpSrv is a helper function which initializes a new tcpSrv instance
-// and returns a pointer to it for use.
-func newtcpSrv(proto *Protocol) *tcpSrv {
+// and returns a pointer to it for use. If tlsConfig is non-nil, accepted
+// connections are secured with TLS.
+func newtcpSrv(proto *Protocol, tlsConfig *tls.Config) *tcpSrv {
     srv := tcpSrv{
+        listen    : func(addr string) (stdnet.Listener, error) {
+            return stdnet.Listen("tcp", addr)
+        },
+        network   : TRANSPORT_TCP,
+        protocol  : proto,
+        syncObj   : lifecycle.New(),
+        tlsConfig : tlsConfig,
+    }
+
+    return &srv
+}
+
+// newStreamSrv initializes a new tcpSrv instance which accepts connections
+// from listeners created by the supplied listen function, rather than from
+// a TCP socket. Any connection oriented transport can be served this way.
+func newStreamSrv(
+    proto   *Protocol,
+    network string,
+    listen  func(addr string) (stdnet.Listener, error),
+) *tcpSrv {
+    srv := tcpSrv{
+        listen   : listen,
+        network  : network,
         protocol : proto,
         syncObj  : lifecycle.New(),
     }
@@ -73,24 +108,38 @@ func newtcpSrv(proto *Protocol) *tcpSrv {
 }
 
 // tcpSrv represents a TCP server object. The server object handles basic
-// communications, client synchronization, and error handling.
+// communications, client synchronization, and error handling. Connections
+// accepted from other stream transports are handled identically, and are
+// included in the TCP perf counters.
 type tcpSrv struct {
-    listener stdnet.Listener
-    protocol *Protocol
-    syncObj  *lifecycle.Lifecycle
+    listen    func(addr string) (stdnet.Listener, error)
+    listener  stdnet.Listener
+    network   string
+    protocol  *Protocol
+    syncObj   *lifecycle.Lifecycle
+    tlsConfig *tls.Config
 }
 
 // Start initializes and starts the TCP server in a new goroutine,
 // on the given network address.
 func (this *tcpSrv) Start(addr string) (Connection, error) {
-    ln, err := stdnet.Listen("tcp", addr)
+    ln, err := this.listen(addr)
     if err != nil {
         log.Error("%v", err)
         return nil, err
     }
 
+    if this.tlsConfig != nil {
+        ln = tls.NewListener(ln, this.tlsConfig)
+    }
+
     this.listener = ln  
-    log.Info("TCP start complete %v", addr)
+    log.Info(
+        "%s start complete %v (tls: %v)",
+        this.network,
+        addr,
+        this.tlsConfig != nil,
+    )
 
     go this.acceptConnections()
 
@@ -112,7 +161,10 @@ func (this *tcpSrv) acceptConnections() {
     for {
         cliCon, err := this.listener.Accept()
         if err != nil {
-            if !this.syncObj.QueryRun() { 
+            // the shutdown flag may not be set yet when Stop closes the
+            // listener
+            closed := errors.Is(err, stdnet.ErrClosed) || err == errMemClosed
+            if closed || !this.syncObj.QueryRun() { 
                 break 
             }
 
@@ -120,38 +172,32 @@ func (this *tcpSrv) acceptConnections() {
             continue
         }
 
-        cli := tcpCon{
-            discoChan   : this.protocol.discoChan,
-            id          : NextNetID(),
-            rcvChan     : this.protocol.rcvChan,
-            socket      : cliCon.(*stdnet.TCPConn),
-            syncObj     : lifecycle.New(),
-            timeoutChan : this.protocol.timeoutChan,
-            writeChan   : make(chan []byte, QUEUE_BUFFERS),
-        }
-
-        this.protocol.connectChan <- &cli
-
-        cli.startHandlers()
-
-        tcpPerfs.Increment(PERF_TCP_CONNECTIONS)
+        this.protocol.acceptTcpCon(cliCon, this.listenerKey())
     }
 
     this.syncObj.ShutdownComplete()
 }
 
+// listenerKey returns the name the server's connections are counted under
+// when enforcing per-listener connection caps.
+func (this *tcpSrv) listenerKey() string {
+    return fmt.Sprintf("%s:%s", this.network, this.listener.Addr())
+}
+
 
 // tcpCon represents a TCP connection.
 type tcpCon struct {
-    discoChan   chan Connection
-    id          uint32
-    key         string
-    nextMsg     *Msg
-    rcvChan     chan *Msg
-    socket      *stdnet.TCPConn
-    syncObj     *lifecycle.Lifecycle
-    timeoutChan chan *TimeoutEvent
-    writeChan   chan []byte
+    discoChan    chan Connection
+    id           uint32
+    key          string
+    nextMsg      *Msg
+    parent       Connection
+    rcvChan      chan *Msg
+    sendQ        *sendQueue
+    shutdownChan <-chan bool
+    socket       stdnet.Conn
+    syncObj      *lifecycle.Lifecycle
+    timeoutChan  chan *TimeoutEvent
 }
 
 // close shuts down the client TCP connection.
@@ -179,22 +225,46 @@ func (this *tcpCon) RemoteAddr() stdnet.Addr {
     return this.socket.RemoteAddr()
 }
 
-// Send takes raw data and sends it to the connection's write go routine.
+// Send queues raw data for the connection's write go routine, in the
+// normal priority class.
 func (this *tcpCon) Send(data []byte, timeoutSec int) {
-    select {
-    case this.writeChan <- data:
-    case <-time.After(time.Duration(timeoutSec) * time.Second):
+    this.sendPriority(data, timeoutSec, PRIORITY_NORMAL)
+}
+
+// sendPriority queues raw data in the given priority class, applying the
+// connection's send queue overflow policy if the queue is full.
+func (this *tcpCon) sendPriority(data []byte, timeoutSec, priority int) {
+    this.sendFrame(queuedFrame { data : data }, timeoutSec, priority)
+}
+
+// sendSlab queues a frame built in a pooled buffer, which is returned to its
+// pool once the frame has been written.
+func (this *tcpCon) sendSlab(s *slab, timeoutSec, priority int) {
+    this.sendFrame(queuedFrame { data : s.buf, slab : s }, timeoutSec, priority)
+}
+
+// sendFrame queues a frame in the given priority class, applying the
+// connection's send queue overflow policy if the queue is full.
+func (this *tcpCon) sendFrame(frame queuedFrame, timeoutSec, priority int) {
+    switch this.sendQ.pushFrame(frame, priority, timeoutSec, this.syncObj) {
+    case pushTimeout:
         sig         := uint16(0)
-        header, err := GetMsgHeader(data)
+        header, err := GetMsgHeader(frame.data)
         if err == nil {
             sig = GetMsgSig(header)
         }
-        this.notifyTimeout(TIMEOUT_SEND, sig, this.id, data)
-    case <-this.syncObj.QueryShutdown():
-        return
+        this.notifyTimeout(TIMEOUT_SEND, sig, this.id, frame.data)
+    case pushOverflow:
+        log.Error("Send queue overflow, disconnecting client %v", this.id)
+        this.Close()
     }
 }
 
+// flushed returns true once all queued data has been written to the line.
+func (this *tcpCon) flushed() bool {
+    return this.sendQ.flushed()
+}
+
 // buildMsg is called when raw data is received off of the line. This function
 // handles the segmentation of messages across multiple receive buffers or
 // the packing of multiple messages into a single buffer in the stream. buildMsg
@@ -206,7 +276,11 @@ func (this *tcpCon) buildMsg(msgData []byte) []byte {
 
     if this.nextMsg == nil {
         this.nextMsg = NewMsg()
-        this.nextMsg.SetConnection(this)
+        if this.parent != nil {
+            this.nextMsg.SetConnection(this.parent)
+        } else {
+            this.nextMsg.SetConnection(this)
+        }
     }
 
     // read available data, up to msg length
@@ -237,12 +311,9 @@ func (this *tcpCon) handleReads() {
             return
         }
 
-        // received data
-        cpBuffer := make([]byte, count)
-        copy(cpBuffer, buffer[:count])
-
+        // received data is copied into each message's own buffer
         for 
-            pending := this.buildMsg(cpBuffer)
+            pending := this.buildMsg(buffer[:count])
             pending != nil
             pending = this.buildMsg(pending) {}
 
@@ -261,19 +332,25 @@ func (this *tcpCon) handleWrites() {
 
     for this.syncObj.QueryRun() {
         select {
-        case data := <-this.writeChan:
-            count, err = this.socket.Write(data)
-            tcpPerfs.Increment(PERF_TCP_MSG_SEND)
-            tcpPerfs.Add(PERF_TCP_MSG_SEND_BYTES, int64(len(data)))
-
-            // disco
-            if count < 1 {
-                this.notifyDisco()
-                return
-            }
-
-            if err != nil {
-                log.Error("%v", err)
+        case <-this.sendQ.ready:
+            for 
+                frame := this.sendQ.popFrame()
+                frame.data != nil
+                frame = this.sendQ.popFrame() {
+                count, err = this.socket.Write(frame.data)
+                tcpPerfs.Increment(PERF_TCP_MSG_SEND)
+                tcpPerfs.Add(PERF_TCP_MSG_SEND_BYTES, int64(len(frame.data)))
+                frame.release()
+
+                // disco
+                if count < 1 {
+                    this.notifyDisco()
+                    return
+                }
+
+                if err != nil {
+                    log.Error("%v", err)
+                }
             }
         case <-time.After(QUEUE_TIMEOUT_SEC * time.Second):
         case <-this.syncObj.QueryShutdown():
@@ -295,7 +372,7 @@ func (this *tcpCon) notifyDisco() {
     case this.discoChan<- this:
     case <-time.After(QUEUE_TIMEOUT_SEC * time.Second):
         log.Error("notifyDisco timeout")
-    case <-this.syncObj.QueryShutdown():
+    case <-this.shutdownChan:
         return
     }
 }
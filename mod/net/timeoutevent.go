@@ -19,6 +19,8 @@ const (
     TIMEOUT_GENERAL
     TIMEOUT_RCV
     TIMEOUT_SEND
+    TIMEOUT_REASSEMBLY
+    TIMEOUT_RETRANSMIT
 )
 
 // TimeoutEvent represents a network operation and associated data which has
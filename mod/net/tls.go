@@ -0,0 +1,124 @@
+//  ---------------------------------------------------------------------------
+//
+//  tls.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/config"
+)
+
+// Stdlib imports.
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+)
+
+// TLS config key names, relative to the section passed to LoadTLSConfig.
+const (
+    TLS_KEY_CA_FILE       = "TlsCAFile"
+    TLS_KEY_CERT_FILE     = "TlsCertFile"
+    TLS_KEY_KEY_FILE      = "TlsKeyFile"
+    TLS_KEY_SERVER_NAME   = "TlsServerName"
+    TLS_KEY_SKIP_VERIFY   = "TlsSkipVerify"
+    TLS_KEY_VERIFY_CLIENT = "TlsVerifyClient"
+)
+
+// Common error messages.
+var errNoTLSConfig = errors.New("TLS config required")
+
+
+// LoadTLSConfig builds a tls.Config object from the certificate, key and CA
+// file paths registered with the config service under the given section
+// (ex. Net.TlsCertFile, Net.TlsKeyFile, Net.TlsCAFile).
+func LoadTLSConfig(section string) (*tls.Config, error) {
+    certFile, _ := config.GetVal(configKey(section, TLS_KEY_CERT_FILE), 0, "")
+    keyFile, _  := config.GetVal(configKey(section, TLS_KEY_KEY_FILE), 0, "")
+    caFile, _   := config.GetVal(configKey(section, TLS_KEY_CA_FILE), 0, "")
+
+    tlsCfg, err := NewTLSConfig(certFile, keyFile, caFile)
+    if err != nil {
+        return nil, err
+    }
+
+    tlsCfg.ServerName, _ = config.GetVal(
+        configKey(section, TLS_KEY_SERVER_NAME),
+        0,
+        "",
+    )
+
+    tlsCfg.InsecureSkipVerify, _ = config.GetBoolVal(
+        configKey(section, TLS_KEY_SKIP_VERIFY),
+        0,
+        false,
+    )
+
+    verifyCli, _ := config.GetBoolVal(
+        configKey(section, TLS_KEY_VERIFY_CLIENT),
+        0,
+        false,
+    )
+    if verifyCli {
+        tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+
+    return tlsCfg, nil
+}
+
+// NewTLSConfig builds a tls.Config object from the supplied PEM encoded
+// certificate, key and CA files. Any of the paths may be left blank. If a CA
+// file is supplied, it is used to verify both servers and clients.
+func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+    tlsCfg := new(tls.Config)
+
+    if certFile != "" || keyFile != "" {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, err
+        }
+
+        tlsCfg.Certificates = []tls.Certificate { cert }
+    }
+
+    if caFile != "" {
+        caData, err := ioutil.ReadFile(caFile)
+        if err != nil {
+            return nil, err
+        }
+
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(caData) {
+            return nil, errors.New(fmt.Sprintf(
+                "No valid certificates found in %s",
+                caFile,
+            ))
+        }
+
+        tlsCfg.RootCAs   = pool
+        tlsCfg.ClientCAs = pool
+    }
+
+    return tlsCfg, nil
+}
+
+// configKey returns the fully qualified config key for the given section
+// and key name.
+func configKey(section, key string) string {
+    if section == "" {
+        return key
+    }
+
+    return fmt.Sprintf("%s.%s", section, key)
+}
@@ -0,0 +1,707 @@
+//  ---------------------------------------------------------------------------
+//
+//  topic.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/lib/buffer"
+    "github.com/xaevman/goat/lib/perf"
+)
+
+// Stdlib imports.
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "sort"
+)
+
+// Topic operations. Each SIG_TOPIC payload begins with an operation and the
+// name of the topic it applies to.
+//
+// [0]   operation
+// [1-4] topic name length
+// [5-]  topic name
+//
+// TOPIC_PUBLISH payloads go on to wrap a message of a registered signature.
+//
+// [0-3] wrapped message signature and flags
+// [4-]  wrapped message payload
+const (
+    TOPIC_SUBSCRIBE = iota
+    TOPIC_UNSUBSCRIBE
+    TOPIC_FEDERATE
+    TOPIC_PUBLISH
+)
+
+// Maximum length, in bytes, of a topic name.
+const MAX_TOPIC_NAME_LEN = 255
+
+// Topic defaults.
+const (
+    DEFAULT_FEDERATION_ACCESS = ACCESS_MAX
+    DEFAULT_MAX_TOPIC_SUBS    = 64
+    DEFAULT_PUBLISH_ACCESS    = ACCESS_MAX
+)
+
+// Per-topic perf counters.
+const (
+    PERF_TOPIC_DELIVER = iota
+    PERF_TOPIC_PEERS
+    PERF_TOPIC_PUBLISH
+    PERF_TOPIC_RCV_PEER
+    PERF_TOPIC_SUBSCRIBERS
+    PERF_TOPIC_COUNT
+)
+
+// Per-topic perf counter friendly names.
+var topicPerfNames = []string {
+    "Delivered",
+    "Peers",
+    "Published",
+    "ReceivedFromPeers",
+    "Subscribers",
+}
+
+// Common error messages.
+var (
+    errTopicMalformed = errors.New("Malformed topic msg")
+    errTopicName      = errors.New("Invalid topic name")
+)
+
+
+// TopicHandler may optionally be implemented by an EventHandler which wants
+// to tell published messages apart from those sent directly. OnPublish is
+// called in place of OnReceive for messages published to a topic.
+type TopicHandler interface {
+    OnPublish(topic string, msg interface{}, fromId uint32, access byte)
+}
+
+
+// topic tracks the local subscribers of a named topic, and the federated
+// servers which share it.
+type topic struct {
+    name  string
+    peers *BroadcastGroup
+    perfs *perf.CounterSet
+    subs  *BroadcastGroup
+}
+
+
+// AddSubscriber subscribes the connection with the given id to a topic, so
+// that it receives messages published to the topic on this server.
+func (this *Protocol) AddSubscriber(name string, id uint32) error {
+    con, err := this.getTopicCon(name, id)
+    if err != nil {
+        return err
+    }
+
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+
+    t := this.getTopic(name)
+    t.subs.AddConnection(con)
+    this.updateTopic(t)
+
+    return nil
+}
+
+// Federate links a topic on this server with the same topic on the remote
+// server at the other end of the given connection. Messages published on
+// either server are forwarded to the other, and delivered to its local
+// subscribers. Forwarded messages are never forwarded again, so servers
+// sharing a topic should be federated in a full mesh.
+func (this *Protocol) Federate(id uint32, name string) error {
+    con, err := this.getTopicCon(name, id)
+    if err != nil {
+        return err
+    }
+
+    this.topicMutex.Lock()
+    t := this.getTopic(name)
+    t.peers.AddConnection(con)
+    this.updateTopic(t)
+    this.setRemoteTopic(id, name, TOPIC_FEDERATE)
+    this.topicMutex.Unlock()
+
+    this.sendTopicCtrl(con, TOPIC_FEDERATE, name)
+
+    return nil
+}
+
+// FederateTcp dials the server at the given address, as DialTcpReconnect
+// does, and federates the given topics with it. Federation is restored each
+// time the connection is re-established. The new connection's id is
+// returned.
+func (this *Protocol) FederateTcp(
+    addr      string,
+    tlsConfig *tls.Config,
+    policy    *ReconnectPolicy,
+    names     ...string,
+) (uint32, error) {
+    rCon, err := this.dialTcpReconnect(addr, tlsConfig, policy)
+    if err != nil {
+        return 0, err
+    }
+
+    for i := range names {
+        err = this.Federate(rCon.Id(), names[i])
+        if err != nil {
+            return rCon.Id(), err
+        }
+    }
+
+    return rCon.Id(), nil
+}
+
+// Publish sends a message to all local subscribers of a topic, and to all
+// servers federated with it. The message is serialized by the MsgProcessor
+// registered for sig.
+func (this *Protocol) Publish(name string, sig uint16, msg interface{}) error {
+    return this.publish(name, uint32(sig), msg, true)
+}
+
+// PublishTo publishes a message to a topic on the remote server at the other
+// end of the given connection.
+func (this *Protocol) PublishTo(
+    id   uint32,
+    name string,
+    sig  uint16,
+    msg  interface{},
+) error {
+    if !validTopicName(name) {
+        return errTopicName
+    }
+
+    cli, err := this.getSendCon(id)
+    if err != nil {
+        return err
+    }
+
+    inner, err := this.buildMsg(cli, uint32(sig), msg)
+    if err != nil {
+        return err
+    }
+
+    err = this.checkPeer(cli, inner, 0)
+    if err != nil {
+        return err
+    }
+
+    return this.sendTopicMsg(cli, name, inner)
+}
+
+// RemoveSubscriber removes the connection with the given id from a topic's
+// local subscribers.
+func (this *Protocol) RemoveSubscriber(name string, id uint32) {
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+
+    t := this.topicMap[name]
+    if t == nil {
+        return
+    }
+
+    t.subs.RemoveConnection(id)
+    this.updateTopic(t)
+}
+
+// SetFederationAccess sets the minimum access level a remote peer needs in
+// order to federate with this server. The default is ACCESS_MAX. It should be
+// kept above the level granted to ordinary clients, as federated peers may
+// publish to any topic they share.
+func (this *Protocol) SetFederationAccess(access byte) {
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+
+    this.topicAccess = access
+}
+
+// SetPublishAccess sets the minimum access level a remote subscriber needs
+// in order to publish to a topic on this server. The default is ACCESS_MAX.
+// Messages published by federated peers, and by servers we subscribed to,
+// are still delivered locally, but only messages from local publishers, and
+// from subscribers with publish access, are forwarded to federated peers.
+func (this *Protocol) SetPublishAccess(access byte) {
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+
+    this.topicPublish = access
+}
+
+// SetTopicLimit sets the maximum number of topics each remote peer may
+// subscribe to on this server. Subscriptions beyond the limit are refused,
+// so that peers can't create topics without bound. The default is
+// DEFAULT_MAX_TOPIC_SUBS.
+func (this *Protocol) SetTopicLimit(maxSubs int) {
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+
+    this.topicMaxSubs = maxSubs
+}
+
+// Subscribe asks the remote server at the other end of the given connection
+// to deliver messages published to a topic. The subscription is restored
+// each time a connection dialed with DialTcpReconnect is re-established.
+// Published messages are passed to the EventHandler's OnPublish method if
+// it implements TopicHandler, otherwise to OnReceive.
+func (this *Protocol) Subscribe(id uint32, name string) error {
+    con, err := this.getTopicCon(name, id)
+    if err != nil {
+        return err
+    }
+
+    this.topicMutex.Lock()
+    this.setRemoteTopic(id, name, TOPIC_SUBSCRIBE)
+    this.topicMutex.Unlock()
+
+    this.sendTopicCtrl(con, TOPIC_SUBSCRIBE, name)
+
+    return nil
+}
+
+// TopicGroup returns the BroadcastGroup which holds a topic's local
+// subscribers, or nil if the topic has no subscribers or peers.
+func (this *Protocol) TopicGroup(name string) *BroadcastGroup {
+    this.topicMutex.RLock()
+    defer this.topicMutex.RUnlock()
+
+    t := this.topicMap[name]
+    if t == nil {
+        return nil
+    }
+
+    return t.subs
+}
+
+// TopicPeers returns the BroadcastGroup which holds the federated peers of a
+// topic, or nil if the topic has no subscribers or peers.
+func (this *Protocol) TopicPeers(name string) *BroadcastGroup {
+    this.topicMutex.RLock()
+    defer this.topicMutex.RUnlock()
+
+    t := this.topicMap[name]
+    if t == nil {
+        return nil
+    }
+
+    return t.peers
+}
+
+// Topics returns the sorted names of all topics which have local
+// subscribers or federated peers.
+func (this *Protocol) Topics() []string {
+    this.topicMutex.RLock()
+    defer this.topicMutex.RUnlock()
+
+    names := make([]string, 0, len(this.topicMap))
+    for k, _ := range this.topicMap {
+        names = append(names, k)
+    }
+
+    sort.Strings(names)
+
+    return names
+}
+
+// Unsubscribe cancels a subscription made with Subscribe.
+func (this *Protocol) Unsubscribe(id uint32, name string) error {
+    con, err := this.getTopicCon(name, id)
+    if err != nil {
+        return err
+    }
+
+    this.topicMutex.Lock()
+    this.setRemoteTopic(id, name, TOPIC_UNSUBSCRIBE)
+    this.topicMutex.Unlock()
+
+    this.sendTopicCtrl(con, TOPIC_UNSUBSCRIBE, name)
+
+    return nil
+}
+
+// dropTopics removes a departing connection from all topics, and forgets
+// any requests made of it.
+func (this *Protocol) dropTopics(conId uint32) {
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+
+    for _, t := range this.topicMap {
+        if t.subs.GetConnection(conId) == nil &&
+            t.peers.GetConnection(conId) == nil {
+            continue
+        }
+
+        t.subs.RemoveConnection(conId)
+        t.peers.RemoveConnection(conId)
+        this.updateTopic(t)
+    }
+
+    delete(this.topicRemote, conId)
+}
+
+// getTopic returns the named topic, creating it if it doesn't exist yet.
+// The caller must hold the topic mutex.
+func (this *Protocol) getTopic(name string) *topic {
+    t := this.topicMap[name]
+    if t != nil {
+        return t
+    }
+
+    t = &topic {
+        name  : name,
+        peers : NewBroadcastGroup(name),
+        perfs : this.topicPerfs.Get(name),
+        subs  : NewBroadcastGroup(name),
+    }
+
+    this.topicMap[name] = t
+
+    return t
+}
+
+// getTopicCon validates a topic name and returns the registered connection
+// with the given id.
+func (this *Protocol) getTopicCon(name string, id uint32) (Connection, error) {
+    if !validTopicName(name) {
+        return nil, errTopicName
+    }
+
+    return this.getSendCon(id)
+}
+
+// publish builds and sends a message to a topic's local subscribers, and
+// optionally its federated peers. Each group is sent a single copy of the
+// message.
+func (this *Protocol) publish(
+    name    string,
+    sig     uint32,
+    obj     interface{},
+    toPeers bool,
+) error {
+    if !validTopicName(name) {
+        return errTopicName
+    }
+
+    this.topicMutex.RLock()
+    t := this.topicMap[name]
+    this.topicMutex.RUnlock()
+
+    if t == nil {
+        return nil
+    }
+
+    t.perfs.Increment(PERF_TOPIC_PUBLISH)
+
+    groups := []*BroadcastGroup { t.subs }
+    if toPeers {
+        groups = append(groups, t.peers)
+    }
+
+    for _, group := range groups {
+        count := len(group.GetAllConnections())
+        if count < 1 {
+            continue
+        }
+
+        inner, err := this.buildMsg(group, sig, obj)
+        if err != nil {
+            return err
+        }
+
+        err = this.checkPeer(group, inner, 0)
+        if err != nil {
+            return err
+        }
+
+        err = this.sendTopicMsg(group, name, inner)
+        if err != nil {
+            return err
+        }
+
+        t.perfs.Add(PERF_TOPIC_DELIVER, int64(count))
+    }
+
+    return nil
+}
+
+// rcvTopic handles a received topic message. Published messages are passed
+// on to local subscribers, and to federated peers if they were published by
+// a subscriber with publish access, before being delivered to the
+// EventHandler. Messages are only accepted from subscribers with publish
+// access and federated peers of a topic, and from servers we subscribed to
+// it.
+func (this *Protocol) rcvTopic(msg *Msg, access byte) {
+    con    := msg.Connection()
+    cursor := 0
+    data   := msg.GetPayload()
+
+    op, err := buffer.ReadByte(data, &cursor)
+    if err != nil {
+        this.topicMalformed(msg)
+        return
+    }
+
+    name, err := buffer.ReadString(data, &cursor)
+    if err != nil || !validTopicName(name) {
+        this.topicMalformed(msg)
+        return
+    }
+
+    switch op {
+    case TOPIC_SUBSCRIBE:
+        this.topicMutex.Lock()
+        subs := this.topicSubs(con.Id())
+        if subs >= this.topicMaxSubs && !this.isSubscriber(name, con.Id()) {
+            this.topicMutex.Unlock()
+            this.perfs.Increment(PERF_PROTO_ERR_NO_ACCESS)
+            this.errChan<- errors.New(fmt.Sprintf(
+                "Subscription denied (topic %s, con %v, subs %v / %v)",
+                name,
+                con.Id(),
+                subs,
+                this.topicMaxSubs,
+            ))
+            return
+        }
+
+        t := this.getTopic(name)
+        t.subs.AddConnection(con)
+        this.updateTopic(t)
+        this.topicMutex.Unlock()
+    case TOPIC_UNSUBSCRIBE:
+        this.RemoveSubscriber(name, con.Id())
+    case TOPIC_FEDERATE:
+        this.topicMutex.Lock()
+        if access < this.topicAccess {
+            this.topicMutex.Unlock()
+            this.perfs.Increment(PERF_PROTO_ERR_NO_ACCESS)
+            this.errChan<- errors.New(fmt.Sprintf(
+                "Federation denied (topic %s, con %v, access %v / %v)",
+                name,
+                con.Id(),
+                access,
+                this.topicAccess,
+            ))
+            return
+        }
+
+        t := this.getTopic(name)
+        t.peers.AddConnection(con)
+        this.updateTopic(t)
+        this.topicMutex.Unlock()
+    case TOPIC_PUBLISH:
+        this.rcvPublish(msg, name, data[cursor:], access)
+    default:
+        this.topicMalformed(msg)
+    }
+}
+
+// rcvPublish unwraps and delivers a message published to a topic.
+func (this *Protocol) rcvPublish(
+    msg    *Msg,
+    name   string,
+    data   []byte,
+    access byte,
+) {
+    this.topicMutex.RLock()
+    t          := this.topicMap[name]
+    _, fromReq := this.topicRemote[msg.From()][name]
+    pubAccess  := this.topicPublish
+    this.topicMutex.RUnlock()
+
+    fromPeer := t != nil && t.peers.GetConnection(msg.From()) != nil
+    fromSub  := t != nil && t.subs.GetConnection(msg.From()) != nil
+    allowed  := fromSub && access >= pubAccess
+    if !fromPeer && !fromReq && !allowed {
+        this.perfs.Increment(PERF_PROTO_ERR_NO_ACCESS)
+        this.errChan<- errors.New(fmt.Sprintf(
+            "Publish denied (topic %s, con %v, access %v / %v). Dropping msg",
+            name,
+            msg.From(),
+            access,
+            pubAccess,
+        ))
+        return
+    }
+
+    cursor        := 0
+    sigFlags, err := buffer.ReadUint32(data, &cursor)
+    if err != nil {
+        this.topicMalformed(msg)
+        return
+    }
+
+    inner := NewMsg()
+    inner.SetConnection(msg.Connection())
+
+    err = inner.openEnvelope(sigFlags, data[cursor:])
+    if err != nil || isReservedSig(inner.ExtMsgType()) {
+        this.topicMalformed(msg)
+        return
+    }
+
+    obj, err := this.decodeMsg(inner, access)
+    if err != nil {
+        return
+    }
+
+    if fromPeer {
+        t.perfs.Increment(PERF_TOPIC_RCV_PEER)
+    }
+
+    this.publish(name, inner.ExtMsgType(), obj, !fromPeer && allowed)
+
+    fromId := msg.From()
+    this.dispatch(fromId, func() {
+        handler, ok := this.evtHandler.(TopicHandler)
+        if ok {
+            handler.OnPublish(name, obj, fromId, access)
+        } else {
+            this.evtHandler.OnReceive(obj, fromId, access)
+        }
+    })
+
+    this.perfs.Increment(PERF_PROTO_RCV_OK)
+    this.perfs.Add(PERF_PROTO_RCV_BYTES, int64(msg.Len()))
+}
+
+// resubscribe replays the subscribe and federate requests made of a
+// reconnecting connection over its newly established link.
+func (this *Protocol) resubscribe(id uint32, con Connection) {
+    this.topicMutex.RLock()
+    ops := make(map[string]byte, len(this.topicRemote[id]))
+    for k, v := range this.topicRemote[id] {
+        ops[k] = v
+    }
+    this.topicMutex.RUnlock()
+
+    for name, op := range ops {
+        this.sendTopicCtrl(con, op, name)
+    }
+}
+
+// sendTopicCtrl sends a topic operation which carries no message.
+func (this *Protocol) sendTopicCtrl(con Connection, op byte, name string) {
+    cursor  := 0
+    payload := make([]byte, 1 + buffer.LenString(name))
+
+    buffer.WriteByte(op, payload, &cursor)
+    buffer.WriteString(name, payload, &cursor)
+
+    this.sendCtrlMsg(con, SIG_TOPIC, payload)
+}
+
+// sendTopicMsg wraps a fully built message in a topic envelope and sends it
+// to the given connection.
+func (this *Protocol) sendTopicMsg(cli Connection, name string, msg *Msg) error {
+    sigFlags, data := msg.envelope()
+
+    cursor  := 0
+    payload := make(
+        []byte,
+        1 + buffer.LenString(name) + buffer.LenUint32() + len(data),
+    )
+
+    buffer.WriteByte(TOPIC_PUBLISH, payload, &cursor)
+    buffer.WriteString(name, payload, &cursor)
+    buffer.WriteUint32(sigFlags, payload, &cursor)
+    copy(payload[cursor:], data)
+
+    err := this.checkMsgLen(len(payload))
+    if err != nil {
+        return err
+    }
+
+    envelope := NewMsg()
+    envelope.SetMsgType(SIG_TOPIC)
+    envelope.SetPayload(payload)
+    envelope.SetPriority(msg.Priority())
+    envelope.SetTimeout(msg.TimeoutSec())
+
+    this.sendFrames(cli, envelope)
+
+    return nil
+}
+
+// setRemoteTopic records a request made of a remote peer, so that it can be
+// replayed on reconnect. Unsubscribing forgets the topic. The caller must
+// hold the topic mutex.
+func (this *Protocol) setRemoteTopic(id uint32, name string, op byte) {
+    ops := this.topicRemote[id]
+    if ops == nil {
+        ops = make(map[string]byte)
+        this.topicRemote[id] = ops
+    }
+
+    if op == TOPIC_UNSUBSCRIBE {
+        delete(ops, name)
+        return
+    }
+
+    ops[name] = op
+}
+
+// isSubscriber returns true if the connection with the given id subscribes
+// to the named topic. The caller must hold the topic mutex.
+func (this *Protocol) isSubscriber(name string, conId uint32) bool {
+    t := this.topicMap[name]
+
+    return t != nil && t.subs.GetConnection(conId) != nil
+}
+
+// topicSubs returns the number of topics the connection with the given id
+// subscribes to. The caller must hold the topic mutex.
+func (this *Protocol) topicSubs(conId uint32) int {
+    count := 0
+    for _, t := range this.topicMap {
+        if t.subs.GetConnection(conId) != nil {
+            count++
+        }
+    }
+
+    return count
+}
+
+// topicMalformed reports a malformed topic message.
+func (this *Protocol) topicMalformed(msg *Msg) {
+    this.perfs.Increment(PERF_PROTO_ERR_DESERIALIZE)
+    this.errChan<- errors.New(fmt.Sprintf(
+        "%v (proto: %s, con: %v). Dropping msg",
+        errTopicMalformed,
+        this.name,
+        msg.From(),
+    ))
+}
+
+// updateTopic refreshes a topic's perf counters, and removes it once it has
+// neither subscribers nor peers. The caller must hold the topic mutex.
+func (this *Protocol) updateTopic(t *topic) {
+    subs  := len(t.subs.GetAllConnections())
+    peers := len(t.peers.GetAllConnections())
+
+    t.perfs.Set(PERF_TOPIC_SUBSCRIBERS, int64(subs))
+    t.perfs.Set(PERF_TOPIC_PEERS, int64(peers))
+
+    if subs > 0 || peers > 0 {
+        return
+    }
+
+    delete(this.topicMap, t.name)
+    this.topicPerfs.Remove(t.name)
+}
+
+// validTopicName returns true if the given name may be used as a topic.
+func validTopicName(name string) bool {
+    return len(name) > 0 && len(name) <= MAX_TOPIC_NAME_LEN
+}
@@ -0,0 +1,294 @@
+//  ---------------------------------------------------------------------------
+//
+//  transport.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "errors"
+    "fmt"
+    stdnet "net"
+    "sync"
+)
+
+// Stock transport names.
+const (
+    TRANSPORT_MEM  = "mem"
+    TRANSPORT_TCP  = "tcp"
+    TRANSPORT_UDP  = "udp"
+    TRANSPORT_UNIX = "unix"
+)
+
+// Common error messages.
+var (
+    errMemAddrInUse  = errors.New("In-memory address already in use")
+    errMemClosed     = errors.New("In-memory listener closed")
+    errMemNoListener = errors.New("No in-memory listener at address")
+)
+
+// Transport registry and synchronization.
+var (
+    transportMutex sync.RWMutex
+    transports     = map[string]Transport {
+        TRANSPORT_MEM  : newMemTransport(),
+        TRANSPORT_TCP  : &streamTransport { network : "tcp" },
+        TRANSPORT_UDP  : new(udpTransport),
+        TRANSPORT_UNIX : &streamTransport { network : "unix" },
+        TRANSPORT_WS   : new(wsTransport),
+    }
+)
+
+
+// Transport represents a type of network which protocols can listen on and
+// dial out over. Transports are registered by name with RegisterTransport,
+// and used through Protocol.Listen and Protocol.Dial.
+type Transport interface {
+    Dial(proto *Protocol, addr string) error
+    NewListener(proto *Protocol) NetConnector
+}
+
+// RegisterTransport registers a Transport under the given name, replacing
+// any existing registration.
+func RegisterTransport(name string, transport Transport) {
+    if transport == nil {
+        return
+    }
+
+    transportMutex.Lock()
+    defer transportMutex.Unlock()
+
+    transports[name] = transport
+
+    log.Info("Transport %s registered", name)
+}
+
+// getTransport returns the Transport registered under the given name.
+func getTransport(name string) (Transport, error) {
+    transportMutex.RLock()
+    defer transportMutex.RUnlock()
+
+    transport := transports[name]
+    if transport == nil {
+        return nil, errors.New(fmt.Sprintf("Unknown transport %q", name))
+    }
+
+    return transport, nil
+}
+
+
+// Dial attempts to create a connection to the given address over the named
+// transport.
+func (this *Protocol) Dial(transport, addr string) error {
+    t, err := getTransport(transport)
+    if err != nil {
+        log.Error("%v", err)
+        return err
+    }
+
+    err = t.Dial(this, addr)
+    if err != nil {
+        log.Error("%v", err)
+        return err
+    }
+
+    return nil
+}
+
+// Listen attempts to set up a listener for the named transport on the
+// given address.
+func (this *Protocol) Listen(transport, addr string) error {
+    t, err := getTransport(transport)
+    if err != nil {
+        log.Error("%v", err)
+        return err
+    }
+
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    srv    := t.NewListener(this)
+    _, err  = srv.Start(addr)
+    if err != nil {
+        return err
+    }
+
+    this.netObjects = append(this.netObjects, srv)
+
+    return nil
+}
+
+
+// streamTransport is a Transport for connection oriented networks supported
+// by the standard library, such as tcp and unix domain sockets.
+type streamTransport struct {
+    network string
+}
+
+// Dial connects to the given address.
+func (this *streamTransport) Dial(proto *Protocol, addr string) error {
+    conn, err := stdnet.Dial(this.network, addr)
+    if err != nil {
+        return err
+    }
+
+    proto.startTcpCon(conn)
+
+    return nil
+}
+
+// NewListener returns a new server which listens on this transport's
+// network.
+func (this *streamTransport) NewListener(proto *Protocol) NetConnector {
+    return newStreamSrv(proto, this.network, func(addr string) (stdnet.Listener, error) {
+        return stdnet.Listen(this.network, addr)
+    })
+}
+
+
+// udpTransport is a Transport for UDP endpoints.
+type udpTransport struct {}
+
+// Dial creates a UDP endpoint for the given address.
+func (this *udpTransport) Dial(proto *Protocol, addr string) error {
+    return proto.DialUdp(addr, nil)
+}
+
+// NewListener returns a new UDP server.
+func (this *udpTransport) NewListener(proto *Protocol) NetConnector {
+    return newudpSrv(proto)
+}
+
+
+// newMemTransport returns a newly initialized memTransport.
+func newMemTransport() *memTransport {
+    newTransport := memTransport {
+        listeners : make(map[string]*memListener),
+    }
+
+    return &newTransport
+}
+
+// memTransport is a Transport which connects protocols within the same
+// process over in-memory pipes. Addresses are arbitrary names, which are
+// only visible inside the process.
+type memTransport struct {
+    listeners map[string]*memListener
+    mutex     sync.Mutex
+}
+
+// Dial connects to the in-memory listener at the given address.
+func (this *memTransport) Dial(proto *Protocol, addr string) error {
+    this.mutex.Lock()
+    ln := this.listeners[addr]
+    this.mutex.Unlock()
+
+    if ln == nil {
+        return errors.New(fmt.Sprintf("%v (%s)", errMemNoListener, addr))
+    }
+
+    cliEnd, srvEnd := stdnet.Pipe()
+
+    select {
+    case ln.connChan<- srvEnd:
+    case <-ln.closeChan:
+        cliEnd.Close()
+        srvEnd.Close()
+        return errors.New(fmt.Sprintf("%v (%s)", errMemClosed, addr))
+    }
+
+    proto.startTcpCon(cliEnd)
+
+    return nil
+}
+
+// NewListener returns a new server which accepts in-memory connections.
+func (this *memTransport) NewListener(proto *Protocol) NetConnector {
+    return newStreamSrv(proto, TRANSPORT_MEM, this.listen)
+}
+
+// listen registers a new in-memory listener at the given address.
+func (this *memTransport) listen(addr string) (stdnet.Listener, error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.listeners[addr] != nil {
+        return nil, errors.New(fmt.Sprintf("%v (%s)", errMemAddrInUse, addr))
+    }
+
+    ln := memListener {
+        addr      : memAddr(addr),
+        closeChan : make(chan struct{}),
+        connChan  : make(chan stdnet.Conn),
+        transport : this,
+    }
+
+    this.listeners[addr] = &ln
+
+    return &ln, nil
+}
+
+
+// memListener implements net.Listener for in-memory connections.
+type memListener struct {
+    addr      memAddr
+    closeChan chan struct{}
+    closeOnce sync.Once
+    connChan  chan stdnet.Conn
+    transport *memTransport
+}
+
+// Accept waits for and returns the next in-memory connection.
+func (this *memListener) Accept() (stdnet.Conn, error) {
+    select {
+    case conn := <-this.connChan:
+        return conn, nil
+    case <-this.closeChan:
+        return nil, errMemClosed
+    }
+}
+
+// Addr returns the listener's address.
+func (this *memListener) Addr() stdnet.Addr {
+    return this.addr
+}
+
+// Close unregisters the listener, freeing its address.
+func (this *memListener) Close() error {
+    this.closeOnce.Do(func() {
+        this.transport.mutex.Lock()
+        delete(this.transport.listeners, string(this.addr))
+        this.transport.mutex.Unlock()
+
+        close(this.closeChan)
+    })
+
+    return nil
+}
+
+
+// memAddr implements net.Addr for in-memory listeners.
+type memAddr string
+
+// Network returns TRANSPORT_MEM.
+func (this memAddr) Network() string {
+    return TRANSPORT_MEM
+}
+
+// String returns the address name.
+func (this memAddr) String() string {
+    return string(this)
+}
@@ -30,8 +30,13 @@ import (
 
 // Perf counters.
 const (
-    PERF_UDP_MSG_RECEIVE = iota
+    PERF_UDP_ACK_RECEIVE = iota
+    PERF_UDP_ACK_SEND
+    PERF_UDP_MSG_DUPLICATE
+    PERF_UDP_MSG_OUT_OF_WINDOW
+    PERF_UDP_MSG_RECEIVE
     PERF_UDP_MSG_RECEIVE_BYTES
+    PERF_UDP_MSG_RETRANSMIT
     PERF_UDP_MSG_SEND
     PERF_UDP_MSG_SEND_BYTES
     PERF_UDP_MSG_TIMEOUT
@@ -41,8 +46,13 @@ const (
 
 // Perf counter friendly names.
 var udpPerfNames = []string {
+    "AckReceived",
+    "AckSent",
+    "MsgDuplicate",
+    "MsgOutOfWindow",
     "MsgReceived",
     "MsgReceivedBytes",
+    "MsgRetransmit",
     "MsgSent",
     "MsgSentBytes",
     "MsgTimeout",
@@ -123,6 +133,7 @@ func (this *udpSrv) Stop() {
 // for handling.
 func (this *udpSrv) handleReads() {
     inbuffer := make([]byte, MAX_NET_MSG_LEN)
+    listener := fmt.Sprintf("udp:%s", this.socket.LocalAddr())
 
     for {
         count, addr, err := this.socket.ReadFrom(inbuffer)
@@ -151,24 +162,50 @@ func (this *udpSrv) handleReads() {
             )
         }
 
-        con, err := this.proto.getUDPEndpoint(addr, this.socket)
+        con, err := this.proto.getUDPEndpoint(addr, this.socket, listener)
+        if err == ErrConRefused || err == ErrIpBanned || err == ErrDraining {
+            continue
+        }
+
         if err != nil {
             log.Error(err.Error())
             continue
         }
 
-        cpBuffer := make([]byte, count)
-        copy(cpBuffer, inbuffer[:count])
-
+        // the datagram is copied into the message's own buffer
         msg := NewMsg()
         msg.SetConnection(con)
 
-        _, complete := msg.addData(cpBuffer)
+        _, complete := msg.addData(inbuffer[:count])
         if !complete {
             log.Error("Received incomplete datagram. Dropping...")
+            msg.Release()
+            continue
         }
 
-        this.notifyMsg(msg)
+        // reliable control sigs are only honored by reliable endpoints, and
+        // only once their checksum has been validated. Everything else is
+        // left to the protocol, which validates, rate limits, and authorizes
+        // it as usual.
+        if con.mode == UDP_UNRELIABLE || !msg.isValid() {
+            this.notifyMsg(msg)
+            continue
+        }
+
+        switch msg.MsgType() {
+        case SIG_ACK:
+            udpPerfs.Increment(PERF_UDP_ACK_RECEIVE)
+            con.ackReliable(msg)
+            msg.Release()
+        case SIG_RELIABLE:
+            ready := con.receiveReliable(msg)
+            msg.Release()
+            for i := range ready {
+                this.notifyMsg(ready[i])
+            }
+        default:
+            this.notifyMsg(msg)
+        }
     }
 }
 
@@ -201,16 +238,25 @@ func (this *udpSrv) startHandlers() {
 
 
 // udpEndpoint represents a UDP endpoint to which you will send
-// data.
+// data. Endpoints created while their Protocol is in one of the reliable
+// delivery modes sequence, acknowledge, and retransmit outgoing datagrams.
 type udpEndpoint struct {
     discoChan   chan Connection
     id          uint32
     key         string
+    maxRetries  int
+    mode        int
+    rcvNext     uint32
+    rcvWindow   map[uint32]*Msg
+    relMutex    sync.Mutex
     remoteAddr  stdnet.Addr
+    retryMs     int
+    sendQ       *sendQueue
+    sendSeq     uint32
     socket      *stdnet.UDPConn
     syncObj     *lifecycle.Lifecycle
     timeoutChan chan *TimeoutEvent
-    writeChan   chan []byte
+    unacked     map[uint32]*unackedDatagram
 }
 
 // close shuts down the client UDP endpoint.
@@ -242,50 +288,95 @@ func (this *udpEndpoint) RemoteAddr() stdnet.Addr {
     return this.remoteAddr
 }
 
-// Send takes raw data and sends it to the endpoint's write go routine.
+// Send queues raw data for the endpoint's write go routine, in the
+// normal priority class.
 func (this *udpEndpoint) Send(data []byte, timeoutSec int) {
-    select {
-    case this.writeChan <- data:
-    case <-time.After(time.Duration(timeoutSec) * time.Second):
+    this.sendPriority(data, timeoutSec, PRIORITY_NORMAL)
+}
+
+// flushed returns true once all queued data has been written to the socket.
+// Reliable datagrams awaiting acknowledgement are not waited for.
+func (this *udpEndpoint) flushed() bool {
+    return this.sendQ.flushed()
+}
+
+// sendPriority queues raw data in the given priority class, applying the
+// endpoint's send queue overflow policy if the queue is full.
+func (this *udpEndpoint) sendPriority(data []byte, timeoutSec, priority int) {
+    this.sendFrame(queuedFrame { data : data }, timeoutSec, priority)
+}
+
+// sendSlab queues a frame built in a pooled buffer, which is returned to its
+// pool once the frame has been written. Frames sent in the reliable modes
+// are kept for retransmission, and left to the garbage collector instead.
+func (this *udpEndpoint) sendSlab(s *slab, timeoutSec, priority int) {
+    this.sendFrame(queuedFrame { data : s.buf, slab : s }, timeoutSec, priority)
+}
+
+// sendFrame queues a frame in the given priority class, applying the
+// endpoint's send queue overflow policy if the queue is full.
+func (this *udpEndpoint) sendFrame(frame queuedFrame, timeoutSec, priority int) {
+    switch this.sendQ.pushFrame(frame, priority, timeoutSec, this.syncObj) {
+    case pushTimeout:
         sig         := uint16(0)
-        header, err := GetMsgHeader(data)
+        header, err := GetMsgHeader(frame.data)
         if err == nil {
             sig = GetMsgSig(header)
         }
-        this.notifyTimeout(TIMEOUT_SEND, sig, this.id, data)
-    case <-this.syncObj.QueryShutdown():
-        return
+        this.notifyTimeout(TIMEOUT_SEND, sig, this.id, frame.data)
+    case pushOverflow:
+        log.Error("Send queue overflow, dropping endpoint %v", this.id)
+        go this.notifyDisco()
     }
 }
 
 // handleWrites runs in its own goroutine, looping endlessly, putting
 // write events onto the line.
 func (this *udpEndpoint) handleWrites() {
-    var count int
-    var err   error
+    var count     int
+    var err       error
+    var retryChan <-chan time.Time
 
-    for this.syncObj.QueryRun() {
-        select {
-        case data := <-this.writeChan:
-            if this.remoteAddr == nil {
-                count, err = this.socket.Write(data)
-            } else {
-                count, err = this.socket.WriteTo(data, this.remoteAddr)
-            }
+    if this.mode != UDP_UNRELIABLE {
+        ticker := time.NewTicker(RETRANSMIT_INTERVAL_MS * time.Millisecond)
+        defer ticker.Stop()
 
-            if err != nil {
-                log.Error(err.Error())
-                continue
-            }
+        retryChan = ticker.C
+    }
 
-            if count < 1 {
-                this.notifyDisco()
-                return
+    for this.syncObj.QueryRun() {
+        select {
+        case <-this.sendQ.ready:
+            for 
+                frame := this.sendQ.popFrame()
+                frame.data != nil
+                frame = this.sendQ.popFrame() {
+                data := frame.data
+                if this.mode != UDP_UNRELIABLE {
+                    data = this.wrapReliable(data)
+                }
+
+                count, err = this.write(data)
+                if this.mode == UDP_UNRELIABLE {
+                    frame.release()
+                }
+
+                if err != nil {
+                    log.Error(err.Error())
+                    continue
+                }
+
+                if count < 1 {
+                    this.notifyDisco()
+                    return
+                }
+
+                udpPerfs.Increment(PERF_UDP_MSG_SEND)
+                udpPerfs.Add(PERF_UDP_MSG_SEND_BYTES, int64(count))
             }
 
-            udpPerfs.Increment(PERF_UDP_MSG_SEND)
-            udpPerfs.Add(PERF_UDP_MSG_SEND_BYTES, int64(count))
-
+        case <-retryChan:
+            this.retransmit()
         case <-time.After(QUEUE_TIMEOUT_SEC * time.Second):
         case <-this.syncObj.QueryShutdown():
         }
@@ -339,6 +430,16 @@ func (this *udpEndpoint) notifyTimeout(
     }
 }
 
+// write puts the supplied data onto the line, addressed to the remote
+// endpoint.
+func (this *udpEndpoint) write(data []byte) (int, error) {
+    if this.remoteAddr == nil {
+        return this.socket.Write(data)
+    }
+
+    return this.socket.WriteTo(data, this.remoteAddr)
+}
+
 // startHandlers starts the  goroutine responsible for handling IO and
 // for this endpoint.
 func (this *udpEndpoint) startHandlers() {
@@ -0,0 +1,609 @@
+//  ---------------------------------------------------------------------------
+//
+//  websocket.go
+//
+//  Copyright (c) 2014, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package net
+
+// External imports.
+import (
+    "github.com/xaevman/goat/mod/log"
+)
+
+// Stdlib imports.
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    stdnet "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+// WebSocket transport name. Listen addresses are the HTTP path to serve on
+// the server started by InitHttpSrv, and dial addresses are ws:// or wss://
+// URLs.
+const TRANSPORT_WS = "ws"
+
+// WebSocket frame opcodes.
+const (
+    WS_OP_CONTINUATION = 0x0
+    WS_OP_TEXT         = 0x1
+    WS_OP_BINARY       = 0x2
+    WS_OP_CLOSE        = 0x8
+    WS_OP_PING         = 0x9
+    WS_OP_PONG         = 0xA
+)
+
+// WebSocket close status codes.
+const (
+    WS_CLOSE_NORMAL      = 1000
+    WS_CLOSE_PROTOCOL    = 1002
+    WS_CLOSE_UNSUPPORTED = 1003
+)
+
+// Frame header constants.
+const (
+    wsFinBit        = 0x80
+    wsMaskBit       = 0x80
+    wsMaxControlLen = 125
+    wsOpcodeMask    = 0x0F
+)
+
+// Time allowed for sending the close frame when closing a connection.
+const WS_CLOSE_TIMEOUT_MS = 1000
+
+// Key suffix used to compute the handshake's Sec-WebSocket-Accept value.
+const wsAcceptGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Common error messages.
+var (
+    errWsBadHandshake = errors.New("WebSocket handshake failed")
+    errWsClosed       = errors.New("WebSocket closed by peer")
+    errWsOrigin       = errors.New("WebSocket origin not allowed")
+    errWsPathInUse    = errors.New("WebSocket path already in use")
+    errWsProtocol     = errors.New("WebSocket protocol violation")
+    errWsText         = errors.New("WebSocket text frames unsupported")
+)
+
+// WebSocket servers, by path, and synchronization. Paths are registered with
+// net/http once, and stay registered after their server stops, since
+// handlers can't be removed from http.DefaultServeMux.
+var (
+    wsMutex  sync.RWMutex
+    wsRoutes = make(map[string]bool)
+    wsSrvs   = make(map[string]*wsSrv)
+)
+
+// wsTransport is a Transport for WebSocket connections. Each binary frame
+// carries a standard goat message header and payload, so WebSocket clients,
+// including browsers, join protocols exactly as TCP clients do.
+type wsTransport struct {}
+
+// Dial connects to the given ws:// or wss:// URL.
+func (this *wsTransport) Dial(proto *Protocol, addr string) error {
+    conn, err := dialWebSocket(addr)
+    if err != nil {
+        return err
+    }
+
+    proto.startTcpCon(conn)
+
+    return nil
+}
+
+// NewListener returns a new server which upgrades HTTP requests to
+// WebSocket connections.
+func (this *wsTransport) NewListener(proto *Protocol) NetConnector {
+    newSrv := wsSrv {
+        protocol : proto,
+    }
+
+    return &newSrv
+}
+
+
+// wsSrv accepts WebSocket connections on a single path of the HTTP server
+// started by InitHttpSrv.
+type wsSrv struct {
+    path     string
+    protocol *Protocol
+}
+
+// Start begins upgrading requests on the given HTTP path.
+func (this *wsSrv) Start(path string) (Connection, error) {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+
+    if wsSrvs[path] != nil {
+        return nil, errors.New(fmt.Sprintf("%v (%s)", errWsPathInUse, path))
+    }
+
+    this.path    = path
+    wsSrvs[path] = this
+
+    if !wsRoutes[path] {
+        http.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+            serveWebSocket(path, w, req)
+        })
+        wsRoutes[path] = true
+    }
+
+    log.Info("WebSocket start complete %s", path)
+
+    tcpPerfs.Increment(PERF_TCP_SERVERS)
+
+    return nil, nil
+}
+
+// Stop stops upgrading requests. Established connections are unaffected.
+func (this *wsSrv) Stop() {
+    wsMutex.Lock()
+    defer wsMutex.Unlock()
+
+    if wsSrvs[this.path] == this {
+        delete(wsSrvs, this.path)
+    }
+
+    tcpPerfs.Add(PERF_TCP_SERVERS, -1)
+}
+
+
+// newWsConn wraps an upgraded socket in a new wsConn. Client connections
+// mask the frames they send, as required of WebSocket clients.
+func newWsConn(conn stdnet.Conn, reader *bufio.Reader, client bool) *wsConn {
+    newConn := wsConn {
+        Conn   : conn,
+        client : client,
+        reader : reader,
+    }
+
+    return &newConn
+}
+
+// wsConn implements net.Conn on top of a WebSocket connection, so that it
+// can be driven by a tcpCon. Each Write is sent as a single binary frame,
+// and Read returns the payloads of received binary frames as a continuous
+// stream. Pings are answered and other control frames consumed internally.
+// Continuation frames are only accepted after a binary frame without its FIN
+// bit set.
+type wsConn struct {
+    stdnet.Conn
+    client     bool
+    closeOnce  sync.Once
+    fragmented bool
+    mask       [4]byte
+    maskPos    int
+    masked     bool
+    reader     *bufio.Reader
+    remaining  uint64
+    writeMutex sync.Mutex
+}
+
+// Close sends a close frame to the remote peer and closes the socket.
+func (this *wsConn) Close() error {
+    this.Conn.SetWriteDeadline(
+        time.Now().Add(WS_CLOSE_TIMEOUT_MS * time.Millisecond),
+    )
+    this.sendClose(WS_CLOSE_NORMAL)
+    return this.Conn.Close()
+}
+
+// Read reads binary frame payload data from the connection.
+func (this *wsConn) Read(p []byte) (int, error) {
+    for this.remaining < 1 {
+        err := this.readFrameHeader()
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    if uint64(len(p)) > this.remaining {
+        p = p[:this.remaining]
+    }
+
+    count, err := this.reader.Read(p)
+    this.unmask(p[:count])
+    this.remaining -= uint64(count)
+
+    return count, err
+}
+
+// Write sends the supplied data as a single binary frame.
+func (this *wsConn) Write(p []byte) (int, error) {
+    err := this.writeFrame(WS_OP_BINARY, p)
+    if err != nil {
+        return 0, err
+    }
+
+    return len(p), nil
+}
+
+// readControl reads and handles the payload of a control frame.
+func (this *wsConn) readControl(opcode byte, length uint64) error {
+    if length > wsMaxControlLen {
+        this.sendClose(WS_CLOSE_PROTOCOL)
+        return errWsProtocol
+    }
+
+    payload := make([]byte, length)
+    _, err  := io.ReadFull(this.reader, payload)
+    if err != nil {
+        return err
+    }
+    this.unmask(payload)
+
+    switch opcode {
+    case WS_OP_CLOSE:
+        this.sendClose(WS_CLOSE_NORMAL)
+        return errWsClosed
+    case WS_OP_PING:
+        return this.writeFrame(WS_OP_PONG, payload)
+    case WS_OP_PONG:
+        return nil
+    }
+
+    this.sendClose(WS_CLOSE_PROTOCOL)
+    return errWsProtocol
+}
+
+// readFrameHeader reads the next frame header from the connection. Control
+// frames are handled immediately, while the payload length of data frames
+// is recorded for subsequent calls to Read.
+func (this *wsConn) readFrameHeader() error {
+    var hdr [2]byte
+
+    _, err := io.ReadFull(this.reader, hdr[:])
+    if err != nil {
+        return err
+    }
+
+    final  := hdr[0] & wsFinBit != 0
+    opcode := hdr[0] & wsOpcodeMask
+    masked := hdr[1] & wsMaskBit != 0
+    length := uint64(hdr[1] &^ wsMaskBit)
+
+    // clients must mask their frames, and servers must not
+    if masked == this.client {
+        this.sendClose(WS_CLOSE_PROTOCOL)
+        return errWsProtocol
+    }
+
+    switch length {
+    case 126:
+        var ext [2]byte
+        _, err = io.ReadFull(this.reader, ext[:])
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        _, err = io.ReadFull(this.reader, ext[:])
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+
+    if err != nil {
+        return err
+    }
+
+    this.masked  = masked
+    this.maskPos = 0
+    if masked {
+        _, err = io.ReadFull(this.reader, this.mask[:])
+        if err != nil {
+            return err
+        }
+    }
+
+    switch opcode {
+    case WS_OP_BINARY, WS_OP_CONTINUATION:
+        // continuations must follow an unfinished binary frame, and a new
+        // binary frame may not interrupt one
+        if this.fragmented != (opcode == WS_OP_CONTINUATION) {
+            this.sendClose(WS_CLOSE_PROTOCOL)
+            return errWsProtocol
+        }
+
+        this.fragmented = !final
+        this.remaining  = length
+        return nil
+    case WS_OP_TEXT:
+        this.sendClose(WS_CLOSE_UNSUPPORTED)
+        return errWsText
+    }
+
+    return this.readControl(opcode, length)
+}
+
+// sendClose sends a close frame with the given status code, once.
+func (this *wsConn) sendClose(status uint16) {
+    this.closeOnce.Do(func() {
+        payload := make([]byte, 2)
+        binary.BigEndian.PutUint16(payload, status)
+        this.writeFrame(WS_OP_CLOSE, payload)
+    })
+}
+
+// unmask applies the current frame's masking key to the supplied payload
+// data, in place.
+func (this *wsConn) unmask(data []byte) {
+    if !this.masked {
+        return
+    }
+
+    for i := range data {
+        data[i] ^= this.mask[this.maskPos & 3]
+        this.maskPos++
+    }
+}
+
+// writeFrame sends a single, final frame with the given opcode and payload.
+func (this *wsConn) writeFrame(opcode byte, payload []byte) error {
+    frame := make([]byte, 0, 14 + len(payload))
+    frame  = append(frame, wsFinBit | opcode)
+
+    var maskBit byte
+    if this.client {
+        maskBit = wsMaskBit
+    }
+
+    length := len(payload)
+    switch {
+    case length < 126:
+        frame = append(frame, maskBit | byte(length))
+    case length <= 0xFFFF:
+        frame = append(frame, maskBit | 126, 0, 0)
+        binary.BigEndian.PutUint16(frame[2:], uint16(length))
+    default:
+        frame = append(frame, maskBit | 127, 0, 0, 0, 0, 0, 0, 0, 0)
+        binary.BigEndian.PutUint64(frame[2:], uint64(length))
+    }
+
+    if this.client {
+        var mask [4]byte
+        _, err := rand.Read(mask[:])
+        if err != nil {
+            return err
+        }
+
+        frame = append(frame, mask[:]...)
+        for i := range payload {
+            frame = append(frame, payload[i] ^ mask[i & 3])
+        }
+    } else {
+        frame = append(frame, payload...)
+    }
+
+    this.writeMutex.Lock()
+    defer this.writeMutex.Unlock()
+
+    _, err := this.Conn.Write(frame)
+    return err
+}
+
+
+// dialWebSocket opens a new client WebSocket connection to the given URL.
+func dialWebSocket(addr string) (*wsConn, error) {
+    wsUrl, err := url.Parse(addr)
+    if err != nil {
+        return nil, err
+    }
+
+    host := wsUrl.Host
+    if wsUrl.Port() == "" {
+        port := "80"
+        if wsUrl.Scheme == "wss" {
+            port = "443"
+        }
+        host = stdnet.JoinHostPort(wsUrl.Hostname(), port)
+    }
+
+    var conn stdnet.Conn
+
+    switch wsUrl.Scheme {
+    case "ws":
+        conn, err = stdnet.Dial("tcp", host)
+    case "wss":
+        conn, err = tls.Dial("tcp", host, &tls.Config { ServerName : wsUrl.Hostname() })
+    default:
+        return nil, errors.New(fmt.Sprintf(
+            "Unsupported WebSocket URL scheme %q",
+            wsUrl.Scheme,
+        ))
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, 16)
+    _, err = rand.Read(nonce)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    key := base64.StdEncoding.EncodeToString(nonce)
+
+    req, err := http.NewRequest("GET", wsUrl.String(), nil)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Sec-WebSocket-Key", key)
+    req.Header.Set("Sec-WebSocket-Version", "13")
+
+    err = req.Write(conn)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    reader    := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    if resp.StatusCode != http.StatusSwitchingProtocols ||
+        resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+        conn.Close()
+        return nil, errors.New(fmt.Sprintf(
+            "%v (%s: %s)",
+            errWsBadHandshake,
+            addr,
+            resp.Status,
+        ))
+    }
+
+    return newWsConn(conn, reader, true), nil
+}
+
+// headerContains returns true if the comma separated list of tokens in the
+// given header contains the supplied token, ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+    for _, val := range header[http.CanonicalHeaderKey(name)] {
+        for _, part := range strings.Split(val, ",") {
+            if strings.EqualFold(strings.TrimSpace(part), token) {
+                return true
+            }
+        }
+    }
+
+    return false
+}
+
+// serveWebSocket upgrades an HTTP request on the given path to a WebSocket
+// connection and hands it to the protocol listening on that path.
+func serveWebSocket(path string, w http.ResponseWriter, req *http.Request) {
+    wsMutex.RLock()
+    srv := wsSrvs[path]
+    wsMutex.RUnlock()
+
+    if srv == nil {
+        http.NotFound(w, req)
+        return
+    }
+
+    key := req.Header.Get("Sec-WebSocket-Key")
+
+    if req.Method != "GET" ||
+        key == "" ||
+        !headerContains(req.Header, "Connection", "upgrade") ||
+        !headerContains(req.Header, "Upgrade", "websocket") {
+        http.Error(w, errWsBadHandshake.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if req.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, errWsBadHandshake.Error(), http.StatusUpgradeRequired)
+        return
+    }
+
+    srv.protocol.objMutex.RLock()
+    allowed := srv.protocol.wsOrigins
+    srv.protocol.objMutex.RUnlock()
+
+    if !wsOriginAllowed(req, allowed) {
+        log.Error(
+            "%v (%s, %s)",
+            errWsOrigin,
+            path,
+            req.Header.Get("Origin"),
+        )
+        http.Error(w, errWsOrigin.Error(), http.StatusForbidden)
+        return
+    }
+
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, errWsBadHandshake.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        log.Error("WebSocket hijack failed (%v)", err)
+        return
+    }
+
+    _, err = fmt.Fprintf(
+        rw,
+        "HTTP/1.1 101 Switching Protocols\r\n" +
+        "Upgrade: websocket\r\n" +
+        "Connection: Upgrade\r\n" +
+        "Sec-WebSocket-Accept: %s\r\n\r\n",
+        wsAcceptKey(key),
+    )
+    if err == nil {
+        err = rw.Flush()
+    }
+
+    if err != nil {
+        log.Error("WebSocket handshake failed (%v)", err)
+        conn.Close()
+        return
+    }
+
+    srv.protocol.acceptTcpCon(newWsConn(conn, rw.Reader, false), "ws:" + path)
+}
+
+// SetWebSocketOrigins sets the origins, such as "https://example.com", from
+// which WebSocket listeners accept upgrade requests. "*" allows any origin.
+// With no origins set, only requests from the same origin as the requested
+// host are accepted. Requests without an Origin header, as sent by
+// non-browser clients, are always accepted.
+func (this *Protocol) SetWebSocketOrigins(origins ...string) {
+    this.objMutex.Lock()
+    defer this.objMutex.Unlock()
+
+    this.wsOrigins = append([]string(nil), origins...)
+}
+
+// wsOriginAllowed returns true if the given request's Origin header is
+// permitted by the supplied list of allowed origins.
+func wsOriginAllowed(req *http.Request, allowed []string) bool {
+    origin := req.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+
+    if len(allowed) < 1 {
+        originUrl, err := url.Parse(origin)
+        return err == nil && strings.EqualFold(originUrl.Host, req.Host)
+    }
+
+    for _, val := range allowed {
+        if val == "*" || strings.EqualFold(val, origin) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value for the given
+// Sec-WebSocket-Key.
+func wsAcceptKey(key string) string {
+    hash := sha1.Sum([]byte(key + wsAcceptGuid))
+    return base64.StdEncoding.EncodeToString(hash[:])
+}
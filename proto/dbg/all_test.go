@@ -18,6 +18,7 @@ import "github.com/xaevman/goat/proto"
 // Stdlib imports.
 import (
     "log"
+    "strings"
     "testing"
 )
 
@@ -75,3 +76,21 @@ func TestMsgSerialize(t *testing.T) {
 
     log.Printf("TestMsgSerialize: passed")
 }
+
+// TestRpcReplyCmds validates that response and error commands sent to the
+// server as rpc requests are refused with an accurate error.
+func TestRpcReplyCmds(t *testing.T) {
+    srv := new(DbgSrv)
+
+    for _, cmd := range []byte { CMD_ERROR, CMD_RESPONSE } {
+        cmdMsg     := new(CmdMsg)
+        cmdMsg.Cmd  = cmd
+
+        _, err := srv.onRpc(cmdMsg, 1, 255)
+        if err == nil || !strings.Contains(err.Error(), "Unexpected") {
+            t.Fatalf("Reply cmd %d not refused (%v)", cmd, err)
+        }
+    }
+
+    log.Printf("TestRpcReplyCmds: passed")
+}
@@ -18,8 +18,14 @@ package dbg
 // External imports.
 import (
     "github.com/xaevman/goat/lib/perf"
+    "github.com/xaevman/goat/mod/net"
 )
 
+// Minimum access level required to issue or receive debugging commands. Pair
+// DbgSrv with an AccessProvider such as net.CredentialAccess to restrict
+// debugging commands to privileged clients.
+const DBG_MIN_ACCESS = 200
+
 
 // Perf counters.
 const (
@@ -56,3 +62,16 @@ const (
     CMD_STACK
     CMD_SYS
 )
+
+// MinAccess returns the minimum access level required for CmdMsg messages
+// to be processed (DBG_MIN_ACCESS).
+func (this *CmdMsgHandler) MinAccess() byte {
+    return DBG_MIN_ACCESS
+}
+
+// Priority returns the priority class CmdMsg messages are sent in. Diag
+// dumps can be large, so they're sent with low priority, to avoid delaying
+// other traffic sharing the same connections.
+func (this *CmdMsgHandler) Priority() int {
+    return net.PRIORITY_LOW
+}
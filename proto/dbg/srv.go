@@ -23,33 +23,43 @@ import (
 
 // Stdlib imports
 import (
+    "errors"
     "fmt"
 )
 
 
 // DbgSrv represents a basic debugging server. Attach this event handler
 // to an existing or new protocol to gain some simple debugging capabilities
-// over TCP connections from client implementations such as DbgCli.
+// over TCP connections from client implementations such as DbgCli. Commands
+// are served as rpc requests, and answered with a CMD_RESPONSE CmdMsg.
+// Commands sent as plain messages are answered with a plain message.
 type DbgSrv struct {
     msgHandler *CmdMsgHandler
     proto      *net.Protocol
 }
     
-// Close deletes the CmdMsgHandler signature registration from the parent
-// protocol.
+// Close deletes the CmdMsgHandler signature and rpc handler registrations
+// from the parent protocol.
 func (this *DbgSrv) Close() {
+    this.proto.HandleRpc(proto.DBG_MSG, nil)
     this.proto.DeleteSignature(this.msgHandler)
     this.msgHandler = nil
 }
 
 // Init saves a reference to the parent protocol and registers the CmdMsgHandler
-// signature on the protocol.
-func (this *DbgSrv) Init(proto *net.Protocol) {
+// signature and command rpc handler on the protocol.
+func (this *DbgSrv) Init(dbgProto *net.Protocol) {
     this.msgHandler = new(CmdMsgHandler)
-    this.proto      = proto
+    this.proto      = dbgProto
 
     this.proto.AddSignature(this.msgHandler)
+    this.proto.HandleRpc(proto.DBG_MSG, this.onRpc)
     this.proto.SetAccessProvider(new(net.NoSecurity))
+    this.proto.SetVersion(
+        proto.DBG_PROTO_NAME,
+        proto.DBG_PROTO_VER,
+        proto.DBG_PROTO_MIN_VER,
+    )
 }
 
 // OnConnect logs debugging information about the newly connected client.
@@ -69,17 +79,37 @@ func (this *DbgSrv) OnError(err error) {
 }
 
 // OnReceive makes sure that new incoming messages pass a type assertion
-// and then routes the message to the appropriate command handler.
+// and then routes the message to the appropriate command handler, sending
+// the response back to the requestor.
 func (this *DbgSrv) OnReceive(msg interface{}, fromId uint32, access byte) {
     cmdMsg, ok := msg.(*CmdMsg)
     if !ok {
-        log.Error("Cannot handle message type %T", cmdMsg)
+        log.Error("Cannot handle message type %T", msg)
         return
     }
 
     cmdMsg.FromId = fromId
     cmdMsg.Access = access
 
+    if this.handleCmd(cmdMsg) {
+        this.send(cmdMsg)
+    }
+}
+
+// OnShutdown performs no actions in DbgSrv.
+func (this *DbgSrv) OnShutdown() {}
+
+// OnTimeout passes timeout events along to the logging system as an error.
+// It does not make any attempts to retry failures.
+func (this *DbgSrv) OnTimeout(timeout *net.TimeoutEvent) {
+    log.Error("Timeout: %v", timeout)
+}
+
+
+// handleCmd routes the given command to the appropriate command handler,
+// which replaces its contents with the response. handleCmd returns false if
+// there is no response to send.
+func (this *DbgSrv) handleCmd(cmdMsg *CmdMsg) bool {
     switch cmdMsg.Cmd {
     default:
         log.Error(
@@ -87,13 +117,14 @@ func (this *DbgSrv) OnReceive(msg interface{}, fromId uint32, access byte) {
             cmdMsg.Cmd, 
             cmdMsg.Data,
         )
-        break
+        return false
     case CMD_BLOCKED:
         this.onBlockedCmd(cmdMsg)
     case CMD_ENV:
         this.onEnvCmd(cmdMsg)
     case CMD_ERROR:
         log.Error(cmdMsg.Data)
+        return false
     case CMD_STACK:
         this.onStackCmd(cmdMsg)
     case CMD_MEM:
@@ -101,80 +132,84 @@ func (this *DbgSrv) OnReceive(msg interface{}, fromId uint32, access byte) {
     case CMD_PERF:
         this.onPerfCmd(cmdMsg)
     case CMD_RESPONSE:
-        break
+        return false
     case CMD_SYS:
         this.onSysCmd(cmdMsg)
     }
-}
-
-// OnShutdown performs no actions in DbgSrv.
-func (this *DbgSrv) OnShutdown() {}
 
-// OnTimeout passes timeout events along to the logging system as an error.
-// It does not make any attempts to retry failures.
-func (this *DbgSrv) OnTimeout(timeout *net.TimeoutEvent) {
-    log.Error("Timeout: %v", timeout)
+    return true
 }
 
-
 // onBlockedCmd dumps stack trace information for currently blocked 
-// goroutines and transmits them back to the requestor.
+// goroutines into the response.
 func (this *DbgSrv) onBlockedCmd(cmdMsg *CmdMsg) {
     data       := diag.NewBlockedData()
     cmdMsg.Cmd  = CMD_RESPONSE
     cmdMsg.Data = data
-
-    this.send(cmdMsg)
 }
 
-// onEnvCmd dumps environment variable data and transmits it back to the
-// requestor.
+// onEnvCmd dumps environment variable data into the response.
 func (this *DbgSrv) onEnvCmd(cmdMsg *CmdMsg) {
     env        := diag.NewEnvData()
     cmdMsg.Cmd  = CMD_RESPONSE
     cmdMsg.Data = fmt.Sprintf("%v", env)
-
-    this.send(cmdMsg)
 }
 
-// onMemCmd dumps memory statistics data adn transmits it back to the
-// requestor.
+// onMemCmd dumps memory statistics data into the response.
 func (this *DbgSrv) onMemCmd(cmdMsg *CmdMsg) {
     mem        := diag.NewMemData()
     cmdMsg.Cmd  = CMD_RESPONSE
     cmdMsg.Data = diag.FmtMemStatsStr(mem)
-
-    this.send(cmdMsg)
 }
 
-// onPerfCmd dumps performance counter information and transmits it back
-// to the requestor.
+// onPerfCmd dumps performance counter information into the response.
 func (this *DbgSrv) onPerfCmd(cmdMsg *CmdMsg) {
     perfs      := perf.TakeSnapshot()
     cmdMsg.Cmd  = CMD_RESPONSE
     cmdMsg.Data = perfs.StringBrief()
-
-    this.send(cmdMsg)
 }
 
-// onStackCmd dumps a full stack trace of all goroutines and transmits it
-// back to the requestor.
+// onStackCmd dumps a full stack trace of all goroutines into the response.
 func (this *DbgSrv) onStackCmd(cmdMsg *CmdMsg) {
     stack      := diag.NewStackString()
     cmdMsg.Cmd  = CMD_RESPONSE
     cmdMsg.Data = stack
-
-    this.send(cmdMsg)
 }
 
-// onSysCmd gathers basic system information and transmits it back to
-// the requestor.
+// onSysCmd gathers basic system information into the response.
 func (this *DbgSrv) onSysCmd(cmdMsg *CmdMsg) {
     sys        := diag.NewSysData()
     cmdMsg.Cmd  = CMD_RESPONSE
     cmdMsg.Data = sys.String()
+}
+
+// onRpc serves commands sent as rpc requests, returning the response
+// CmdMsg.
+func (this *DbgSrv) onRpc(req interface{}, fromId uint32, access byte) (interface{}, error) {
+    cmdMsg, ok := req.(*CmdMsg)
+    if !ok {
+        return nil, errors.New(fmt.Sprintf("Cannot handle message type %T", req))
+    }
+
+    cmdMsg.FromId = fromId
+    cmdMsg.Access = access
+
+    // responses and errors are only ever sent by the server
+    switch cmdMsg.Cmd {
+    case CMD_ERROR:
+        return nil, errors.New(fmt.Sprintf(
+            "Unexpected error cmd sent to server: %s",
+            cmdMsg.Data,
+        ))
+    case CMD_RESPONSE:
+        return nil, errors.New("Unexpected response cmd sent to server")
+    }
+
+    if !this.handleCmd(cmdMsg) {
+        return nil, errors.New(fmt.Sprintf("Unknown cmd: %d", cmdMsg.Cmd))
+    }
 
-    this.send(cmdMsg)
+    return cmdMsg, nil
 }
 
 // send passes the give CmdMsg along to the protocol layer.
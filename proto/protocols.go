@@ -14,8 +14,23 @@
 // network protocols and message signatures.
 package proto
 
-// protocol message signatures
+// protocol message signatures. Signatures 1000-1023 are reserved by the net
+// module, and signatures above 1023 are sent with extended headers, which
+// only peers built after their introduction understand. Conflicting
+// registrations across protocols are reported by net.SignatureConflicts.
 const (
     CHAT_MSG = 0
     DBG_MSG  = 10
 )
+
+// protocol names and versions, exchanged in the connect-time handshake.
+// Bump the version when adding message types, and the minimum version when
+// dropping support for older builds.
+const (
+    CHAT_PROTO_NAME    = "chat"
+    CHAT_PROTO_VER     = 1
+    CHAT_PROTO_MIN_VER = 1
+    DBG_PROTO_NAME     = "dbg"
+    DBG_PROTO_VER      = 1
+    DBG_PROTO_MIN_VER  = 1
+)